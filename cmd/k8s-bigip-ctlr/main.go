@@ -17,6 +17,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -78,6 +79,7 @@ var (
 	osRouteFlags *pflag.FlagSet
 
 	pythonBaseDir    *string
+	configDir        *string
 	logLevel         *string
 	verifyInterval   *int
 	nodePollInterval *int
@@ -96,11 +98,15 @@ var (
 	defaultIngIP      *string
 	useSecrets        *bool
 	schemaLocal       *string
+	lbIPRanges        *[]string
+	ipamConfigMap     *string
+	certExpiryWarning *int
 
 	bigIPURL        *string
 	bigIPUsername   *string
 	bigIPPassword   *string
 	bigIPPartitions *[]string
+	driverFeatures  *[]string
 
 	vxlanMode        string
 	openshiftSDNName *string
@@ -110,6 +116,9 @@ var (
 	routeLabel       *string
 	routeHttpVs      *string
 	routeHttpsVs     *string
+	routerName       *string
+	routeSharedLabel *string
+	routeShardStrs   *[]string
 	clientSSL        *string
 	serverSSL        *string
 
@@ -117,6 +126,7 @@ var (
 	isNodePort         bool
 	watchAllNamespaces bool
 	vxlanName          string
+	routeShards        []appmanager.RouteShard
 )
 
 func _init() {
@@ -141,6 +151,10 @@ func _init() {
 	// Global flags
 	pythonBaseDir = globalFlags.String("python-basedir", "",
 		"DEPRECATED: Optional, directory location of python utilities")
+	configDir = globalFlags.String("config-dir", "",
+		"Optional, directory in which to write the configuration for the "+
+			"config driver, such as a tmpfs mount; defaults to the system "+
+			"temporary directory")
 	logLevel = globalFlags.String("log-level", "INFO",
 		"Optional, logging level")
 	verifyInterval = globalFlags.Int("verify-interval", 30,
@@ -164,7 +178,15 @@ func _init() {
 	bigIPPassword = bigIPFlags.String("bigip-password", "",
 		"Required, password for the Big-IP user account.")
 	bigIPPartitions = bigIPFlags.StringArray("bigip-partition", []string{},
-		"Required, partition(s) for the Big-IP kubernetes objects.")
+		"Required, partition(s) for the Big-IP kubernetes objects. The first is "+
+			"the default; the virtual-server.f5.com/partition annotation of a "+
+			"namespace or Ingress, or the partition of a ConfigMap, selects "+
+			"another.")
+	driverFeatures = bigIPFlags.StringArray("driver-feature", []string{},
+		"Optional, a feature of the BIG-IP config driver the controller may use, "+
+			"for a driver that supports it: "+
+			strings.Join(appmanager.DriverFeatures, ", ")+". May be specified more "+
+			"than once.")
 
 	bigIPFlags.Usage = func() {
 		fmt.Fprintf(os.Stderr, "  BigIP:\n%s\n", bigIPFlags.FlagUsagesWrapped(width))
@@ -203,6 +225,15 @@ func _init() {
 		"Optional, enable/disable use of Secrets for Ingress or ConfigMap SSL Profiles.")
 	schemaLocal = kubeFlags.String("schema-db-base-dir", "file:///app/vendor/src/f5/schemas/",
 		"Optional, where the schema db's locally reside")
+	lbIPRanges = kubeFlags.StringArray("loadbalancer-ip-range", []string{},
+		"Optional, IP range(s) (CIDR or start-end) from which addresses are allocated "+
+			"to Services of type LoadBalancer.")
+	ipamConfigMap = kubeFlags.String("ipam-configmap", "",
+		"Optional, namespace/name of a ConfigMap holding labelled IP ranges used to "+
+			"allocate addresses to resources with the 'virtual-server.f5.com/ipam-label' annotation.")
+	certExpiryWarning = kubeFlags.Int("cert-warning-days", 30,
+		"Optional, number of days before a certificate expires that the controller "+
+			"starts recording warning events for it.")
 
 	// If the flag is specified with no argument, default to LOOKUP
 	kubeFlags.Lookup("resolve-ingress-names").NoOptDefVal = "LOOKUP"
@@ -238,6 +269,16 @@ func _init() {
 		"Optional, the name to be used for the OpenShift Route http vserver")
 	routeHttpsVs = osRouteFlags.String("route-https-vserver", "https-ose-vserver",
 		"Optional, the name to be used for the OpenShift Route https vserver")
+	routerName = osRouteFlags.String("route-router-name", appmanager.DEFAULT_ROUTER_NAME,
+		"Optional, the router name this controller reports in the status of OpenShift Routes")
+	routeSharedLabel = osRouteFlags.String("route-shared-label", "",
+		"Optional, label selector for namespaces whose Routes may use the same host "+
+			"names with different paths")
+	routeShardStrs = osRouteFlags.StringArray("route-shard", []string{},
+		"Optional, JSON definition of a Route shard with its own virtual servers, e.g. "+
+			"'{\"name\":\"a\",\"routeLabel\":\"tenant=a\",\"vserverAddr\":\"10.1.1.1\","+
+			"\"httpVserver\":\"a-http\",\"httpsVserver\":\"a-https\"}'. "+
+			"May be specified more than once.")
 	clientSSL = osRouteFlags.String("default-client-ssl", "",
 		"Optional, specify a user-created client ssl profile to be used as"+
 			" default for SNI for Route virtual servers")
@@ -305,6 +346,54 @@ func verifyArgs() error {
 		watchAllNamespaces = false
 	}
 
+	if len(*ipamConfigMap) != 0 && len(strings.Split(*ipamConfigMap, "/")) > 2 {
+		return fmt.Errorf("ipam-configmap must be in the form 'namespace/name' or 'name'")
+	}
+
+	if len(*routeSharedLabel) != 0 {
+		if _, err := labels.Parse(*routeSharedLabel); nil != err {
+			return fmt.Errorf("Invalid route-shared-label: %v", err)
+		}
+	}
+
+	for _, feature := range *driverFeatures {
+		if !appmanager.IsDriverFeature(feature) {
+			return fmt.Errorf("Unknown driver-feature '%s'; valid features are: %s",
+				feature, strings.Join(appmanager.DriverFeatures, ", "))
+		}
+	}
+
+	// Shards share nothing with each other or the default Route virtual
+	// servers, since their data groups and iRules are named after them
+	routeShards = nil
+	shardNames := make(map[string]bool)
+	vsUsers := map[string]string{
+		*routeHttpVs:  "route-http-vserver",
+		*routeHttpsVs: "route-https-vserver",
+	}
+	for _, shardStr := range *routeShardStrs {
+		var shard appmanager.RouteShard
+		if err := json.Unmarshal([]byte(shardStr), &shard); nil != err {
+			return fmt.Errorf("Invalid route-shard '%s': %v", shardStr, err)
+		}
+		if err := shard.Validate(); nil != err {
+			return err
+		}
+		if shardNames[shard.Name] {
+			return fmt.Errorf("Route shard name '%s' is used more than once",
+				shard.Name)
+		}
+		shardNames[shard.Name] = true
+		for _, vs := range []string{shard.HttpVs, shard.HttpsVs} {
+			if user, used := vsUsers[vs]; used {
+				return fmt.Errorf("Route shard '%s' virtual server '%s' is "+
+					"already used by %s", shard.Name, vs, user)
+			}
+			vsUsers[vs] = fmt.Sprintf("route shard '%s'", shard.Name)
+		}
+		routeShards = append(routeShards, shard)
+	}
+
 	u, err := url.Parse(*bigIPURL)
 	if nil != err {
 		return fmt.Errorf("Error parsing url: %s", err)
@@ -488,7 +577,7 @@ func main() {
 		log.Infof("SCALE_PERF: Started controller at: %d", now.Unix())
 	}
 
-	configWriter, err := writer.NewConfigWriter()
+	configWriter, err := writer.NewConfigWriterInDir(*configDir)
 	if nil != err {
 		log.Fatalf("Failed creating ConfigWriter tool: %v", err)
 	}
@@ -498,24 +587,32 @@ func main() {
 		*routeLabel = fmt.Sprintf("f5type in (%s)", *routeLabel)
 	}
 	var routeConfig = appmanager.RouteConfig{
-		RouteVSAddr: *routeVserverAddr,
-		RouteLabel:  *routeLabel,
-		HttpVs:      *routeHttpVs,
-		HttpsVs:     *routeHttpsVs,
-		ClientSSL:   *clientSSL,
-		ServerSSL:   *serverSSL,
+		RouteVSAddr:      *routeVserverAddr,
+		RouteLabel:       *routeLabel,
+		HttpVs:           *routeHttpVs,
+		HttpsVs:          *routeHttpsVs,
+		RouterName:       *routerName,
+		HostSharingLabel: *routeSharedLabel,
+		Shards:           routeShards,
+		ClientSSL:        *clientSSL,
+		ServerSSL:        *serverSSL,
 	}
 
 	var appMgrParms = appmanager.Params{
-		ConfigWriter:      configWriter,
-		UseNodeInternal:   *useNodeInternal,
-		IsNodePort:        isNodePort,
-		RouteConfig:       routeConfig,
-		NodeLabelSelector: *nodeLabelSelector,
-		ResolveIngress:    *resolveIngNames,
-		DefaultIngIP:      *defaultIngIP,
-		UseSecrets:        *useSecrets,
-		SchemaLocal:       *schemaLocal,
+		ConfigWriter:          configWriter,
+		UseNodeInternal:       *useNodeInternal,
+		IsNodePort:            isNodePort,
+		RouteConfig:           routeConfig,
+		NodeLabelSelector:     *nodeLabelSelector,
+		ResolveIngress:        *resolveIngNames,
+		DefaultIngIP:          *defaultIngIP,
+		UseSecrets:            *useSecrets,
+		SchemaLocal:           *schemaLocal,
+		LoadBalancerIPRanges:  *lbIPRanges,
+		IPAMConfigMap:         *ipamConfigMap,
+		CertExpiryWarningDays: *certExpiryWarning,
+		Partitions:            *bigIPPartitions,
+		DriverFeatures:        *driverFeatures,
 	}
 
 	// If running with Flannel, create an event channel that the appManager
@@ -322,6 +322,122 @@ var _ = Describe("Main Tests", func() {
 			Expect(err).ToNot(BeNil())
 		})
 
+		It("verifies driver feature args", func() {
+			defer _init()
+			os.Args = []string{
+				"./bin/k8s-bigip-ctlr",
+				"--namespace=testing",
+				"--bigip-partition=velcro1",
+				"--bigip-password=admin",
+				"--bigip-url=bigip.example.com",
+				"--bigip-username=admin",
+				"--pool-member-type=cluster",
+				"--driver-feature=tuned-profiles",
+			}
+
+			flags.Parse(os.Args)
+			err := verifyArgs()
+			Expect(err).To(BeNil())
+			Expect(*driverFeatures).To(Equal([]string{"tuned-profiles"}))
+
+			*driverFeatures = []string{"time-travel"}
+			err = verifyArgs()
+			Expect(err).ToNot(BeNil())
+		})
+
+		It("verifies route shard args", func() {
+			defer _init()
+			os.Args = []string{
+				"./bin/k8s-bigip-ctlr",
+				"--namespace=testing",
+				"--bigip-partition=velcro1",
+				"--bigip-password=admin",
+				"--bigip-url=bigip.example.com",
+				"--bigip-username=admin",
+				"--pool-member-type=cluster",
+				`--route-shard={"name":"a","routeLabel":"tenant=a",` +
+					`"vserverAddr":"10.1.1.1","httpVserver":"a-http","httpsVserver":"a-https"}`,
+			}
+
+			flags.Parse(os.Args)
+			err := verifyArgs()
+			Expect(err).To(BeNil())
+			Expect(routeShards).To(Equal([]appmanager.RouteShard{{
+				Name:        "a",
+				RouteLabel:  "tenant=a",
+				RouteVSAddr: "10.1.1.1",
+				HttpVs:      "a-http",
+				HttpsVs:     "a-https",
+			}}))
+
+			*routeShardStrs = []string{`{"name":"b"}`}
+			err = verifyArgs()
+			Expect(err).ToNot(BeNil())
+
+			*routeShardStrs = []string{`{"name":"b","httpVserver":"b-http",` +
+				`"httpsVserver":"b-https"}`}
+			err = verifyArgs()
+			Expect(err).ToNot(BeNil())
+
+			*routeShardStrs = []string{`{"name":"b","httpVserver":"b-http",` +
+				`"httpsVserver":"b-https","vserverAddr":"10.1.1.2",` +
+				`"namespaceLabel":"team in (b"}`}
+			err = verifyArgs()
+			Expect(err).ToNot(BeNil())
+
+			*routeShardStrs = []string{`not json`}
+			err = verifyArgs()
+			Expect(err).ToNot(BeNil())
+
+			shard := func(name, httpVs, httpsVs string) string {
+				return fmt.Sprintf(`{"name":"%s","vserverAddr":"10.1.1.1",`+
+					`"httpVserver":"%s","httpsVserver":"%s"}`, name, httpVs, httpsVs)
+			}
+			*routeShardStrs = []string{
+				shard("a", "a-http", "a-https"),
+				shard("b.1", "b-http", "b-https"),
+			}
+			err = verifyArgs()
+			Expect(err).To(BeNil())
+			Expect(routeShards).To(HaveLen(2))
+
+			// Shard names are unique and usable in BIG-IP object names
+			*routeShardStrs = []string{
+				shard("a", "a-http", "a-https"),
+				shard("a", "b-http", "b-https"),
+			}
+			err = verifyArgs()
+			Expect(err).ToNot(BeNil())
+
+			*routeShardStrs = []string{shard("a/b", "a-http", "a-https")}
+			err = verifyArgs()
+			Expect(err).ToNot(BeNil())
+
+			*routeShardStrs = []string{shard("a b", "a-http", "a-https")}
+			err = verifyArgs()
+			Expect(err).ToNot(BeNil())
+
+			// Virtual servers belong to one shard, or to the default Routes
+			*routeShardStrs = []string{shard("a", "ose-vserver", "a-https")}
+			err = verifyArgs()
+			Expect(err).ToNot(BeNil())
+
+			*routeShardStrs = []string{shard("a", "a-http", "https-ose-vserver")}
+			err = verifyArgs()
+			Expect(err).ToNot(BeNil())
+
+			*routeShardStrs = []string{
+				shard("a", "a-http", "a-https"),
+				shard("b", "b-http", "a-https"),
+			}
+			err = verifyArgs()
+			Expect(err).ToNot(BeNil())
+
+			*routeShardStrs = []string{shard("a", "a-vs", "a-vs")}
+			err = verifyArgs()
+			Expect(err).ToNot(BeNil())
+		})
+
 		It("sets up the node poller", func() {
 			defer _init()
 			os.Args = []string{
@@ -87,18 +87,22 @@ func runBigIPDriver(pid chan<- int, cmd *exec.Cmd) {
 	cmdOut, err := cmd.StderrPipe()
 	scanOut := bufio.NewScanner(cmdOut)
 	go func() {
+		// The driver may log parts of the config, keys included, and PEM
+		// keys may span lines
+		var redactor writer.KeyRedactor
 		for true {
 			if scanOut.Scan() {
-				if strings.Contains(scanOut.Text(), "DEBUG]") {
-					log.Debug(scanOut.Text())
-				} else if strings.Contains(scanOut.Text(), "WARNING]") {
-					log.Warning(scanOut.Text())
-				} else if strings.Contains(scanOut.Text(), "ERROR]") {
-					log.Error(scanOut.Text())
-				} else if strings.Contains(scanOut.Text(), "CRITICAL]") {
-					log.Critical(scanOut.Text())
+				text := redactor.RedactKeys(scanOut.Text())
+				if strings.Contains(text, "DEBUG]") {
+					log.Debug(text)
+				} else if strings.Contains(text, "WARNING]") {
+					log.Warning(text)
+				} else if strings.Contains(text, "ERROR]") {
+					log.Error(text)
+				} else if strings.Contains(text, "CRITICAL]") {
+					log.Critical(text)
 				} else {
-					log.Info(scanOut.Text())
+					log.Info(text)
 				}
 			} else {
 				break
@@ -0,0 +1,168 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	log "github.com/F5Networks/k8s-bigip-ctlr/pkg/vlogger"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// Return the access policies of the annotations of an object, or nil if it
+// has none
+func annotationAccessPolicies(annotations map[string]string) *accessPolicies {
+	var acc accessPolicies
+	found := false
+	for annotation, field := range map[string]*string{
+		f5VsAccessProfileAnnotation:       &acc.AccessProfile,
+		f5VsConnectivityProfileAnnotation: &acc.ConnectivityProfile,
+		f5VsPerRequestPolicyAnnotation:    &acc.PerRequestPolicy,
+	} {
+		if val, ok := annotations[annotation]; ok {
+			*field = strings.TrimSpace(val)
+			found = true
+		}
+	}
+	if !found {
+		return nil
+	}
+	return &acc
+}
+
+// Return the access policies of an F5 resource ConfigMap
+func configMapAccessPolicies(cm *v1.ConfigMap) *accessPolicies {
+	var cfgMap ConfigMap
+	if err := json.Unmarshal([]byte(cm.Data["data"]), &cfgMap); nil != err {
+		return nil
+	}
+	return cfgMap.VirtualServer.Frontend.Access
+}
+
+// Check the access policies for a virtual server, returning them with their
+// paths in /partition/name form. The BIG-IP only takes an access profile on
+// a virtual server with an HTTP profile, and a connectivity profile or a
+// per-request policy on one with an access profile.
+func checkAccessPolicies(
+	rsCfg *ResourceConfig,
+	acc accessPolicies,
+) (accessPolicies, error) {
+	var err error
+	for _, field := range []struct {
+		kind string
+		path *string
+	}{
+		{"access profile", &acc.AccessProfile},
+		{"connectivity profile", &acc.ConnectivityProfile},
+		{"per-request policy", &acc.PerRequestPolicy},
+	} {
+		if "" == *field.path {
+			continue
+		}
+		if *field.path, err = formatSecurityPath(field.kind, *field.path); nil != err {
+			return accessPolicies{}, err
+		}
+		if "" == acc.AccessProfile {
+			return accessPolicies{}, fmt.Errorf("%s '%s' needs an access profile",
+				field.kind, *field.path)
+		}
+	}
+	if "" != acc.AccessProfile && !isHttpVirtual(rsCfg) {
+		return accessPolicies{}, fmt.Errorf("access profiles need a virtual " +
+			"server in http mode")
+	}
+	return acc, nil
+}
+
+// Attach access policies to a virtual server. Nil detaches them.
+func setVirtualAccessPolicies(v *Virtual, acc *accessPolicies) {
+	if nil == acc {
+		acc = &accessPolicies{}
+	}
+	v.AccessProfile = acc.AccessProfile
+	v.ConnectivityProfile = acc.ConnectivityProfile
+	v.PerRequestPolicy = acc.PerRequestPolicy
+}
+
+var accessPolicySetting = ownedSetting{
+	action:         "attaching",
+	name:           "access policies",
+	conflictReason: "AccessPolicyConflict",
+	owner: func(rsCfg *ResourceConfig) *string {
+		return &rsCfg.MetaData.AccessOwner
+	},
+	reset: func(rsCfg *ResourceConfig) {
+		setVirtualAccessPolicies(&rsCfg.Virtual, nil)
+	},
+}
+
+func virtualAccessPolicies(v *Virtual) accessPolicies {
+	return accessPolicies{
+		AccessProfile:       v.AccessProfile,
+		ConnectivityProfile: v.ConnectivityProfile,
+		PerRequestPolicy:    v.PerRequestPolicy,
+	}
+}
+
+// Attach the access policies an object asks for to its virtual server, with
+// the same ownership of shared virtuals as security policies
+func (appMgr *Manager) handleAccessPolicies(
+	rsCfg *ResourceConfig,
+	obj runtime.Object,
+	meta metav1.ObjectMeta,
+	acc *accessPolicies,
+) {
+	if rsCfg.MetaData.ResourceType == "iapp" ||
+		nil == rsCfg.Virtual.VirtualAddress ||
+		rsCfg.Virtual.VirtualAddress.BindAddr == "" {
+		// Nothing to attach for iApps and pool-only mode
+		return
+	}
+	owner := meta.Namespace + "/" + meta.Name
+	detach := func() { accessPolicySetting.detach(rsCfg, owner) }
+	if nil == acc {
+		detach()
+		return
+	}
+	checked, err := checkAccessPolicies(rsCfg, *acc)
+	if nil != err {
+		msg := fmt.Sprintf("Not attaching access policies for %s: %v",
+			meta.Name, err)
+		log.Warning(msg)
+		appMgr.recordEvent(obj, meta.Namespace, v1.EventTypeWarning,
+			"InvalidAccessPolicy", msg)
+		detach()
+		return
+	}
+	if !appMgr.checkDriverFeature(obj, meta, driverFeatureAccessPolicies,
+		"access policies") {
+		detach()
+		return
+	}
+	if !appMgr.mayOwnSetting(accessPolicySetting, rsCfg, obj, meta,
+		reflect.DeepEqual(virtualAccessPolicies(&rsCfg.Virtual), checked)) {
+		return
+	}
+	setVirtualAccessPolicies(&rsCfg.Virtual, &checked)
+	rsCfg.MetaData.AccessOwner = owner
+}
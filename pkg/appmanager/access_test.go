@@ -0,0 +1,64 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Access Policy Tests", func() {
+	It("parses and checks access policies", func() {
+		Expect(annotationAccessPolicies(nil)).To(BeNil())
+		acc := annotationAccessPolicies(map[string]string{
+			f5VsAccessProfileAnnotation:       " Common/sso ",
+			f5VsConnectivityProfileAnnotation: "/Common/connectivity",
+		})
+		Expect(acc).To(Equal(&accessPolicies{
+			AccessProfile:       "Common/sso",
+			ConnectivityProfile: "/Common/connectivity",
+		}))
+
+		var rsCfg ResourceConfig
+		setProfilesForMode("http", &rsCfg)
+		checked, err := checkAccessPolicies(&rsCfg, *acc)
+		Expect(err).To(BeNil())
+		Expect(checked).To(Equal(accessPolicies{
+			AccessProfile:       "/Common/sso",
+			ConnectivityProfile: "/Common/connectivity",
+		}))
+
+		for _, bad := range []accessPolicies{
+			{AccessProfile: "sso"},
+			{AccessProfile: "/Common/sso", PerRequestPolicy: "/Common/prp/extra"},
+			// Connectivity profiles and per-request policies need an access
+			// profile
+			{ConnectivityProfile: "/Common/connectivity"},
+			{PerRequestPolicy: "/Common/prp"},
+		} {
+			_, err = checkAccessPolicies(&rsCfg, bad)
+			Expect(err).ToNot(BeNil(), "%v", bad)
+		}
+
+		// Access profiles need HTTP
+		rsCfg = ResourceConfig{}
+		setProfilesForMode("tcp", &rsCfg)
+		_, err = checkAccessPolicies(&rsCfg, accessPolicies{
+			AccessProfile: "/Common/sso"})
+		Expect(err).ToNot(BeNil())
+	})
+})
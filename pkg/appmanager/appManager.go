@@ -37,6 +37,7 @@ import (
 	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/labels"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
@@ -64,6 +65,54 @@ const f5VsSourceAddrTranslationAnnotation = "virtual-server.f5.com/source-addr-t
 const f5ClientSslProfileAnnotation = "virtual-server.f5.com/clientssl"
 const f5ServerSslProfileAnnotation = "virtual-server.f5.com/serverssl"
 const f5ServerSslSecureAnnotation = "virtual-server.f5.com/secure-serverssl"
+const ipamLabelAnnotation = "virtual-server.f5.com/ipam-label"
+const f5VsRuleConditionsAnnotation = "virtual-server.f5.com/rule-conditions"
+const f5VsPathTypeAnnotation = "virtual-server.f5.com/path-type"
+const f5VsRuleActionsAnnotation = "virtual-server.f5.com/rule-actions"
+const f5VsAllowSourceRangeAnnotation = "virtual-server.f5.com/allow-source-range"
+const f5VsDenySourceRangeAnnotation = "virtual-server.f5.com/deny-source-range"
+const f5VsPersistenceAnnotation = "virtual-server.f5.com/persistence"
+const f5VsPersistenceHeaderAnnotation = "virtual-server.f5.com/persistence-header"
+const f5VsBackendWeightsAnnotation = "virtual-server.f5.com/backend-weights"
+const f5RouteABModeAnnotation = "virtual-server.f5.com/ab-mode"
+const f5VsCanaryAnnotation = "virtual-server.f5.com/canary"
+const f5VsCanaryByHeaderAnnotation = "virtual-server.f5.com/canary-by-header"
+const f5VsCanaryByHeaderValueAnnotation = "virtual-server.f5.com/canary-by-header-value"
+const f5VsCanaryByCookieAnnotation = "virtual-server.f5.com/canary-by-cookie"
+const f5VsCanaryWeightAnnotation = "virtual-server.f5.com/canary-weight"
+const f5VsFallbackServiceAnnotation = "virtual-server.f5.com/fallback-service"
+const f5VsPoolFallbackServicesAnnotation = "virtual-server.f5.com/pool-fallback-services"
+const f5VsMaintenancePageAnnotation = "virtual-server.f5.com/maintenance-page"
+const f5VsMaintenanceStatusAnnotation = "virtual-server.f5.com/maintenance-status"
+const f5VsRateLimitAnnotation = "virtual-server.f5.com/rate-limit"
+const f5VsRateLimitKeyAnnotation = "virtual-server.f5.com/rate-limit-key"
+const f5VsRateLimitActionAnnotation = "virtual-server.f5.com/rate-limit-action"
+const f5VsHttpProfileAnnotation = "virtual-server.f5.com/http-profile"
+const f5VsOneConnectProfileAnnotation = "virtual-server.f5.com/oneconnect-profile"
+const f5VsHttpCompressionProfileAnnotation = "virtual-server.f5.com/http-compression-profile"
+const f5VsHttp2ProfileAnnotation = "virtual-server.f5.com/http2-profile"
+const f5VsWebSocketProfileAnnotation = "virtual-server.f5.com/websocket-profile"
+const f5VsTcpProfileAnnotation = "virtual-server.f5.com/tcp-profile"
+const f5VsFastL4ProfileAnnotation = "virtual-server.f5.com/fastl4-profile"
+const f5VsTlsPolicyAnnotation = "virtual-server.f5.com/tls-policy"
+const f5VsHstsMaxAgeAnnotation = "virtual-server.f5.com/hsts-max-age"
+const f5VsHstsIncludeSubdomainsAnnotation = "virtual-server.f5.com/hsts-include-subdomains"
+const f5VsHstsPreloadAnnotation = "virtual-server.f5.com/hsts-preload"
+const f5VsClientCASecretAnnotation = "virtual-server.f5.com/client-ca-secret"
+const f5VsClientCertModeAnnotation = "virtual-server.f5.com/client-cert-mode"
+const f5VsClientCertHeaderAnnotation = "virtual-server.f5.com/client-cert-header"
+const f5VsBackendTlsAnnotation = "virtual-server.f5.com/backend-tls"
+const f5VsBackendCASecretAnnotation = "virtual-server.f5.com/backend-ca-secret"
+const f5VsBackendServerNameAnnotation = "virtual-server.f5.com/backend-server-name"
+const f5VsSniDefaultAnnotation = "virtual-server.f5.com/sni-default"
+const f5VsWafPolicyAnnotation = "virtual-server.f5.com/waf-policy"
+const f5VsDosProfileAnnotation = "virtual-server.f5.com/dos-profile"
+const f5VsBotDefenseProfileAnnotation = "virtual-server.f5.com/bot-defense-profile"
+const f5VsSecurityLogProfilesAnnotation = "virtual-server.f5.com/security-log-profiles"
+const f5VsAccessProfileAnnotation = "virtual-server.f5.com/access-profile"
+const f5VsConnectivityProfileAnnotation = "virtual-server.f5.com/connectivity-profile"
+const f5VsPerRequestPolicyAnnotation = "virtual-server.f5.com/per-request-policy"
+const f5VsFirewallRulesAnnotation = "virtual-server.f5.com/firewall-rules"
 const defaultSslServerCAName = "openshift_route_cluster_default-ca"
 
 type ResourceMap map[int32][]*ResourceConfig
@@ -101,6 +150,10 @@ type Manager struct {
 	// Namespace informer support (namespace labels)
 	nsQueue    workqueue.RateLimitingInterface
 	nsInformer cache.SharedIndexInformer
+	// Namespaces read from the API during a sync, when there is no
+	// namespace informer to read them from
+	nsCacheMutex sync.Mutex
+	nsCache      map[string]*v1.Namespace
 	// Event notifier
 	eventNotifier *EventNotifier
 	// Route configurations
@@ -117,6 +170,21 @@ type Manager struct {
 	eventChan chan interface{}
 	// Where the schemas reside locally
 	schemaLocal string
+	// Addresses for Services of type LoadBalancer and the IPAM label annotation
+	ipam *ipAllocator
+	// ConfigMap with the named IPAM ranges
+	ipamNamespace string
+	ipamName      string
+	ipamInformer  cache.SharedIndexInformer
+	// How long before certificates expire to start warning about them
+	certExpiryWarning time.Duration
+	// Last expiry warning recorded for each profile of an object
+	certWarnings      map[string]certWarning
+	certWarningsMutex sync.Mutex
+	// BIG-IP partitions the controller manages
+	partitions []string
+	// Driver features the config may use
+	driverFeatures map[string]bool
 }
 
 // Struct to allow NewManager to receive all or only specific parameters.
@@ -132,6 +200,17 @@ type Params struct {
 	NodeLabelSelector string
 	UseSecrets        bool
 	EventChan         chan interface{}
+	// IP ranges (CIDR or start-end) for Services of type LoadBalancer
+	LoadBalancerIPRanges []string
+	// ConfigMap ("namespace/name") with named ranges for IPAM
+	IPAMConfigMap string
+	// Days before certificates expire to start warning about them
+	CertExpiryWarningDays int
+	// BIG-IP partitions the controller manages. DEFAULT_PARTITION is always
+	// managed.
+	Partitions []string
+	// Features of the config driver to use, from DriverFeatures
+	DriverFeatures []string
 	// Package local for unit testing only
 	restClient      rest.Interface
 	initialState    bool
@@ -141,12 +220,17 @@ type Params struct {
 
 // Configuration options for Routes in OpenShift
 type RouteConfig struct {
-	RouteVSAddr string
-	RouteLabel  string
-	HttpVs      string
-	HttpsVs     string
-	ClientSSL   string
-	ServerSSL   string
+	RouteVSAddr      string
+	RouteLabel       string
+	HttpVs           string
+	HttpsVs          string
+	ClientSSL        string
+	ServerSSL        string
+	RouterName       string
+	HostSharingLabel string
+	Shards           []RouteShard
+	// Name of the shard whose virtual servers are configured, if any
+	Shard string
 }
 
 // Create and return a new app manager that meets the Manager interface
@@ -179,6 +263,11 @@ func NewManager(params *Params) *Manager {
 		appInformers:      make(map[string]*appInformer),
 		eventNotifier:     NewEventNotifier(params.broadcasterFunc),
 		schemaLocal:       params.SchemaLocal,
+		ipam:              newIPAllocator(params.LoadBalancerIPRanges),
+		certExpiryWarning: certExpiryWarning(params.CertExpiryWarningDays),
+		certWarnings:      make(map[string]certWarning),
+		partitions:        params.Partitions,
+		driverFeatures:    newDriverFeatures(params.DriverFeatures),
 	}
 	if nil != manager.kubeClient && nil == manager.restClientv1 {
 		// This is the normal production case, but need the checks for unit tests.
@@ -188,6 +277,17 @@ func NewManager(params *Params) *Manager {
 		// This is the normal production case, but need the checks for unit tests.
 		manager.restClientv1beta1 = manager.kubeClient.Extensions().RESTClient()
 	}
+	if params.IPAMConfigMap != "" {
+		parts := strings.SplitN(params.IPAMConfigMap, "/", 2)
+		if len(parts) == 2 {
+			manager.ipamNamespace, manager.ipamName = parts[0], parts[1]
+		} else {
+			manager.ipamNamespace, manager.ipamName = "default", parts[0]
+		}
+		if nil != manager.restClientv1 {
+			manager.newIPAMInformer(30 * time.Second)
+		}
+	}
 
 	return &manager
 }
@@ -397,7 +497,11 @@ type appInformer struct {
 	endptInformer  cache.SharedIndexInformer
 	ingInformer    cache.SharedIndexInformer
 	routeInformer  cache.SharedIndexInformer
-	stopCh         chan struct{}
+	// All the ConfigMaps, for the maintenance pages of fallbacks
+	pageInformer cache.SharedIndexInformer
+	// The watched namespaces, for their partition annotation
+	nsInformer cache.SharedIndexInformer
+	stopCh     chan struct{}
 }
 
 func (appMgr *Manager) newAppInformer(
@@ -405,6 +509,10 @@ func (appMgr *Manager) newAppInformer(
 	cfgMapSelector labels.Selector,
 	resyncPeriod time.Duration,
 ) *appInformer {
+	nsSelector := fields.Everything()
+	if namespace != "" {
+		nsSelector = fields.OneTermEqualSelector("metadata.name", namespace)
+	}
 	appInf := appInformer{
 		namespace: namespace,
 		stopCh:    make(chan struct{}),
@@ -452,6 +560,28 @@ func (appMgr *Manager) newAppInformer(
 			resyncPeriod,
 			cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
 		),
+		pageInformer: cache.NewSharedIndexInformer(
+			newListWatchWithLabelSelector(
+				appMgr.restClientv1,
+				"configmaps",
+				namespace,
+				maintenancePageSelector,
+			),
+			&v1.ConfigMap{},
+			resyncPeriod,
+			cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
+		),
+		nsInformer: cache.NewSharedIndexInformer(
+			cache.NewListWatchFromClient(
+				appMgr.restClientv1,
+				"namespaces",
+				"",
+				nsSelector,
+			),
+			&v1.Namespace{},
+			resyncPeriod,
+			cache.Indexers{},
+		),
 	}
 	if nil != appMgr.routeClientV1 {
 		// Ensure the default server cert is loaded
@@ -459,7 +589,9 @@ func (appMgr *Manager) newAppInformer(
 
 		var label labels.Selector
 		var err error
-		if len(appMgr.routeConfig.RouteLabel) == 0 {
+		if len(appMgr.routeConfig.RouteLabel) == 0 ||
+			len(appMgr.routeConfig.Shards) > 0 {
+			// Shards select their own Routes, so watch all of them
 			label = labels.Everything()
 		} else {
 			label, err = labels.Parse(appMgr.routeConfig.RouteLabel)
@@ -516,11 +648,29 @@ func (appMgr *Manager) newAppInformer(
 		resyncPeriod,
 	)
 
+	appInf.pageInformer.AddEventHandlerWithResyncPeriod(
+		&cache.ResourceEventHandlerFuncs{
+			AddFunc:    func(obj interface{}) { appMgr.enqueueMaintenancePage(obj) },
+			UpdateFunc: func(old, cur interface{}) { appMgr.enqueueMaintenancePage(cur) },
+			DeleteFunc: func(obj interface{}) { appMgr.enqueueMaintenancePage(obj) },
+		},
+		resyncPeriod,
+	)
+
+	appInf.nsInformer.AddEventHandlerWithResyncPeriod(
+		&cache.ResourceEventHandlerFuncs{
+			UpdateFunc: func(old, cur interface{}) {
+				appMgr.enqueueNamespacePartition(old, cur)
+			},
+		},
+		resyncPeriod,
+	)
+
 	if nil != appMgr.routeClientV1 {
 		appInf.routeInformer.AddEventHandlerWithResyncPeriod(
 			&cache.ResourceEventHandlerFuncs{
 				AddFunc:    func(obj interface{}) { appMgr.enqueueRoute(obj) },
-				UpdateFunc: func(old, cur interface{}) { appMgr.enqueueRoute(cur) },
+				UpdateFunc: func(old, cur interface{}) { appMgr.enqueueRouteUpdate(old, cur) },
 				DeleteFunc: func(obj interface{}) { appMgr.enqueueRoute(obj) },
 			},
 			resyncPeriod,
@@ -590,6 +740,13 @@ func (appMgr *Manager) enqueueIngress(obj interface{}) {
 }
 
 func (appMgr *Manager) enqueueRoute(obj interface{}) {
+	if tomb, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		// A deleted Route whose final state was missed still frees its host
+		obj = tomb.Obj
+	}
+	if _, ok := obj.(*routeapi.Route); !ok {
+		return
+	}
 	if ok, keys := appMgr.checkValidRoute(obj); ok {
 		for _, key := range keys {
 			appMgr.vsQueue.Add(*key)
@@ -597,6 +754,14 @@ func (appMgr *Manager) enqueueRoute(obj interface{}) {
 	}
 }
 
+func (appMgr *Manager) enqueueRouteUpdate(old, cur interface{}) {
+	if ok, keys := appMgr.checkValidRouteUpdate(old, cur); ok {
+		for _, key := range keys {
+			appMgr.vsQueue.Add(*key)
+		}
+	}
+}
+
 func (appMgr *Manager) getNamespaceInformer(
 	ns string,
 ) (*appInformer, bool) {
@@ -622,6 +787,8 @@ func (appInf *appInformer) start() {
 	go appInf.svcInformer.Run(appInf.stopCh)
 	go appInf.endptInformer.Run(appInf.stopCh)
 	go appInf.ingInformer.Run(appInf.stopCh)
+	go appInf.pageInformer.Run(appInf.stopCh)
+	go appInf.nsInformer.Run(appInf.stopCh)
 	if nil != appInf.routeInformer {
 		go appInf.routeInformer.Run(appInf.stopCh)
 	}
@@ -635,6 +802,8 @@ func (appInf *appInformer) waitForCacheSync() {
 			appInf.svcInformer.HasSynced,
 			appInf.endptInformer.HasSynced,
 			appInf.ingInformer.HasSynced,
+			appInf.pageInformer.HasSynced,
+			appInf.nsInformer.HasSynced,
 			appInf.routeInformer.HasSynced,
 		)
 	} else {
@@ -644,6 +813,8 @@ func (appInf *appInformer) waitForCacheSync() {
 			appInf.svcInformer.HasSynced,
 			appInf.endptInformer.HasSynced,
 			appInf.ingInformer.HasSynced,
+			appInf.pageInformer.HasSynced,
+			appInf.nsInformer.HasSynced,
 		)
 	}
 }
@@ -679,6 +850,12 @@ func (appMgr *Manager) runImpl(stopCh <-chan struct{}) {
 		go wait.Until(appMgr.namespaceWorker, time.Second, stopCh)
 	}
 
+	if nil != appMgr.ipamInformer {
+		// Named ranges and persisted allocations must be known before any
+		// addresses are handed out.
+		appMgr.startAndSyncIPAMInformer(stopCh)
+	}
+
 	appMgr.startAndSyncAppInformers()
 
 	// Using only one virtual server worker currently.
@@ -760,6 +937,8 @@ type vsSyncStats struct {
 	cpUpdated    int
 	dgUpdated    int
 	poolsUpdated int
+	// Object statuses that could not be written
+	statusErrors int
 }
 
 func (appMgr *Manager) syncVirtualServer(sKey serviceQueueKey) error {
@@ -769,6 +948,7 @@ func (appMgr *Manager) syncVirtualServer(sKey serviceQueueKey) error {
 		log.Debugf("Finished syncing virtual servers %+v (%v)",
 			sKey, endTime.Sub(startTime))
 	}()
+	appMgr.resetNamespaceCache()
 	// Get the informers for the namespace. This will tell us if we care about
 	// this item.
 	appInf, haveNamespace := appMgr.getNamespaceInformer(sKey.Namespace)
@@ -806,7 +986,12 @@ func (appMgr *Manager) syncVirtualServer(sKey serviceQueueKey) error {
 	dgMap := make(InternalDataGroupMap)
 
 	var stats vsSyncStats
-	err = appMgr.syncConfigMaps(&stats, sKey, rsMap, svcPortMap, svc, appInf)
+	// Release the policies of deleted objects first, so others sharing their
+	// virtuals can attach their own
+	for _, setting := range ownedSettings {
+		appMgr.syncOwnedSetting(setting, appInf, sKey.Namespace, &stats)
+	}
+	err = appMgr.syncConfigMaps(&stats, sKey, rsMap, svcPortMap, svc, appInf, dgMap)
 	if nil != err {
 		return err
 	}
@@ -821,6 +1006,10 @@ func (appMgr *Manager) syncVirtualServer(sKey serviceQueueKey) error {
 			return err
 		}
 	}
+	appMgr.syncLoadBalancer(&stats, sKey, rsMap, svcPortMap, svc, appInf)
+	// Release addresses of deleted resources and persist any changes
+	appMgr.releaseIPAMAddresses(appInf, sKey.Namespace)
+	ipamErr := appMgr.saveIPAMAllocations()
 	// Update internal data groups if changed
 	appMgr.syncDataGroups(&stats, dgMap, sKey.Namespace)
 	// Delete IRules if necessary
@@ -840,6 +1029,15 @@ func (appMgr *Manager) syncVirtualServer(sKey serviceQueueKey) error {
 
 	// delete any custom profiles that are no longer referenced
 	appMgr.deleteUnusedProfiles(appInf, sKey.Namespace, &stats)
+	// Sync the iRules that depend on which virtuals are left
+	appMgr.syncIngressPathRegexIRules()
+	appMgr.syncSourceRangeIRules()
+	appMgr.syncPersistenceIRules()
+	appMgr.syncFallback()
+	appMgr.syncRateLimitIRules()
+	appMgr.syncHstsIRules()
+	appMgr.syncClientCertIRules()
+	appMgr.syncBackendTlsIRules()
 
 	if stats.vsUpdated > 0 || stats.vsDeleted > 0 || stats.cpUpdated > 0 ||
 		stats.dgUpdated > 0 || stats.poolsUpdated > 0 {
@@ -852,6 +1050,16 @@ func (appMgr *Manager) syncVirtualServer(sKey serviceQueueKey) error {
 		}
 	}
 
+	if stats.statusErrors > 0 {
+		// Returning non-nil err will re-queue this item with rate-limiting,
+		// so the statuses are written again.
+		return fmt.Errorf("failed to write %d object statuses",
+			stats.statusErrors)
+	}
+	if nil != ipamErr {
+		// Re-queue so the IPAM allocations are saved again
+		return ipamErr
+	}
 	return nil
 }
 
@@ -862,6 +1070,7 @@ func (appMgr *Manager) syncConfigMaps(
 	svcPortMap map[int32]bool,
 	svc *v1.Service,
 	appInf *appInformer,
+	dgMap InternalDataGroupMap,
 ) error {
 	cfgMapsByIndex, err := appInf.cfgMapInformer.GetIndexer().ByIndex(
 		"namespace", sKey.Namespace)
@@ -887,9 +1096,24 @@ func (appMgr *Manager) syncConfigMaps(
 				cm.ObjectMeta.Namespace, cm.ObjectMeta.Name)
 			continue
 		}
+		if !appMgr.checkPartition(cm, cm.ObjectMeta, rsCfg.GetPartition()) {
+			continue
+		}
+
+		// Request an address from IPAM if the virtual has none
+		if _, ok := cm.ObjectMeta.Annotations[ipamLabelAnnotation]; ok &&
+			rsCfg.MetaData.ResourceType != "iapp" &&
+			rsCfg.Virtual.VirtualAddress != nil &&
+			rsCfg.Virtual.VirtualAddress.BindAddr == "" {
+			if ip := appMgr.allocateConfigMapAddress(cm); ip != "" {
+				rsCfg.Virtual.SetVirtualAddress(ip, rsCfg.Virtual.VirtualAddress.Port)
+			}
+		}
 
 		// Check if SSLProfile(s) are contained in Secrets
 		if appMgr.useSecrets {
+			policy := appMgr.tlsPolicyFor(cm, cm.ObjectMeta)
+			auth := appMgr.clientAuthFor(cm, cm.ObjectMeta, rsCfg.Virtual.Partition)
 			for _, profile := range rsCfg.Virtual.Profiles {
 				if profile.Context != customProfileClient {
 					continue
@@ -903,7 +1127,8 @@ func (appMgr *Manager) syncConfigMaps(
 						"parsing secretName as path instead.", profile.Name, sKey.Namespace)
 					continue
 				}
-				err, updated := appMgr.createSecretSslProfile(rsCfg, secret)
+				err, updated := appMgr.createSecretSslProfile(
+					rsCfg, cm, cm.ObjectMeta, secret, "", policy, auth)
 				if err != nil {
 					log.Warningf("%v", err)
 					continue
@@ -914,6 +1139,21 @@ func (appMgr *Manager) syncConfigMaps(
 			}
 		}
 
+		appMgr.handleConfigMapSourceRanges(rsCfg, cm, dgMap)
+		appMgr.handleConfigMapClientCertHeader(rsCfg, cm, dgMap)
+		if rsCfg.MetaData.ResourceType == "configmap" {
+			appMgr.handlePersistence(rsCfg, cm, cm.ObjectMeta,
+				configMapPersistence(cm), svc)
+			appMgr.handleTunedProfiles(rsCfg, cm, cm.ObjectMeta,
+				configMapTunedProfiles(cm))
+			appMgr.handleSecurityPolicies(rsCfg, cm, cm.ObjectMeta,
+				configMapSecurityPolicies(cm))
+			appMgr.handleAccessPolicies(rsCfg, cm, cm.ObjectMeta,
+				configMapAccessPolicies(cm))
+			appMgr.handleFirewallRules(rsCfg, cm, cm.ObjectMeta,
+				configMapFirewallRules(cm))
+		}
+
 		rsName := rsCfg.GetName()
 		ok, found, updated := appMgr.handleConfigForType(
 			rsCfg, sKey, rsMap, rsName, svcPortMap,
@@ -954,19 +1194,41 @@ func (appMgr *Manager) syncIngresses(
 			sKey.Namespace, err)
 		return err
 	}
-	svcFwdRulesMap := NewServiceFwdRuleMap()
+	// Canary Ingresses change the rules of their primary, so they come last
+	var ingresses, canaries []*v1beta1.Ingress
 	for _, obj := range ingByIndex {
-		// We need to look at all ingresses in the store, parse the data blob,
-		// and see if it belongs to the service that has changed.
 		ing := obj.(*v1beta1.Ingress)
 		if ing.ObjectMeta.Namespace != sKey.Namespace {
 			continue
 		}
-
-		// Resolve first Ingress Host name (if required)
-		_, exists := ing.ObjectMeta.Annotations[f5VsBindAddrAnnotation]
-		if !exists && appMgr.resolveIng != "" {
-			appMgr.resolveIngressHost(ing, sKey.Namespace)
+		if isCanaryIngress(ing) {
+			canaries = append(canaries, ing)
+		} else {
+			ingresses = append(ingresses, ing)
+		}
+	}
+	svcFwdRulesMap := make(PartitionFwdRuleMap)
+	plainPools := make(PlainBackendPools)
+	for _, ing := range append(ingresses, canaries...) {
+		// We need to look at all ingresses in the store, parse the data blob,
+		// and see if it belongs to the service that has changed.
+		// The status is set on the stored Ingress.
+		storedIng := ing
+		if isCanaryIngress(ing) {
+			// A canary takes its virtual servers from its primary
+			ing = appMgr.prepareCanaryIngress(ing, ingresses)
+			if nil == ing {
+				continue
+			}
+		} else {
+			// Request an address from IPAM, or resolve first Ingress Host name
+			// (if required)
+			_, exists := ing.ObjectMeta.Annotations[f5VsBindAddrAnnotation]
+			if _, ipam := ing.ObjectMeta.Annotations[ipamLabelAnnotation]; !exists && ipam {
+				appMgr.allocateIngressAddress(ing)
+			} else if !exists && appMgr.resolveIng != "" {
+				appMgr.resolveIngressHost(ing, sKey.Namespace)
+			}
 		}
 
 		// Get a list of dependencies removed so their pools can be removed.
@@ -1002,11 +1264,34 @@ func (appMgr *Manager) syncIngresses(
 				continue
 			}
 
+			appMgr.handlePersistence(rsCfg, ing, ing.ObjectMeta,
+				annotationPersistence(ing.ObjectMeta.Annotations),
+				ingressAffinityService(ing, appInf.svcInformer.GetIndexer()))
+			appMgr.handleTunedProfiles(rsCfg, ing, ing.ObjectMeta,
+				annotationTunedProfiles(ing.ObjectMeta.Annotations))
+			appMgr.handleSecurityPolicies(rsCfg, ing, ing.ObjectMeta,
+				annotationSecurityPolicies(ing.ObjectMeta.Annotations))
+			appMgr.handleAccessPolicies(rsCfg, ing, ing.ObjectMeta,
+				annotationAccessPolicies(ing.ObjectMeta.Annotations))
+			appMgr.handleFirewallRules(rsCfg, ing, ing.ObjectMeta,
+				annotationFirewallRules(ing.ObjectMeta.Annotations))
+
 			// Handle TLS configuration
-			updated := appMgr.handleIngressTls(rsCfg, ing, svcFwdRulesMap)
+			updated := appMgr.handleIngressTls(rsCfg, ing,
+				svcFwdRulesMap.ForPartition(rsCfg.Virtual.Partition, ""))
 			if updated {
 				stats.cpUpdated += 1
 			}
+			if appMgr.handleIngressBackendTls(rsCfg, ing, dgMap, plainPools) {
+				stats.cpUpdated += 1
+			}
+			appMgr.handleIngressPathRegex(rsCfg, ing, dgMap)
+			appMgr.handleIngressSourceRanges(rsCfg, ing, dgMap)
+			appMgr.handleIngressRateLimit(rsCfg, ing, dgMap)
+			appMgr.handleIngressHsts(rsCfg, ing, dgMap)
+			appMgr.handleIngressClientCertHeader(rsCfg, ing, dgMap)
+			appMgr.handleFallback(rsCfg, ing, ing.ObjectMeta,
+				ingressServiceNames(ing), formatIngressPoolName, dgMap)
 
 			// Handle Ingress health monitors
 			rsName := rsCfg.GetName()
@@ -1046,6 +1331,7 @@ func (appMgr *Manager) syncIngresses(
 			} else { // single-service
 				svcs = append(svcs, ing.Spec.Backend.ServiceName)
 			}
+			svcs = append(svcs, fallbackServiceNames(ing.ObjectMeta.Annotations)...)
 
 			// Remove any left over pools from services no longer used by this Ingress
 			for _, dep := range depsRemoved {
@@ -1081,19 +1367,11 @@ func (appMgr *Manager) syncIngresses(
 				}
 			}
 			// Set the Ingress Status IP address
-			appMgr.setIngressStatus(ing, rsCfg)
-		}
-	}
-	if len(svcFwdRulesMap) > 0 {
-		httpsRedirectDg := nameRef{
-			Name:      httpsRedirectDgName,
-			Partition: DEFAULT_PARTITION,
-		}
-		if _, found := dgMap[httpsRedirectDg]; !found {
-			dgMap[httpsRedirectDg] = make(DataGroupNamespaceMap)
+			appMgr.setIngressStatus(storedIng, rsCfg)
 		}
-		svcFwdRulesMap.AddToDataGroup(dgMap[httpsRedirectDg])
 	}
+	svcFwdRulesMap.AddToDataGroups(dgMap)
+	plainPools.AddToDataGroups(dgMap)
 	return nil
 }
 
@@ -1114,11 +1392,22 @@ func (appMgr *Manager) syncRoutes(
 	}
 
 	// Rebuild all internal data groups for routes as we process each
-	svcFwdRulesMap := NewServiceFwdRuleMap()
+	svcFwdRulesMap := make(PartitionFwdRuleMap)
+	activeRules := make(map[string]map[string]bool)
 	for _, route := range routeByIndex {
 		if route.ObjectMeta.Namespace != sKey.Namespace {
 			continue
 		}
+		routeConfig, ok := appMgr.routeConfigForRoute(route)
+		if !ok {
+			continue
+		}
+		partition := appMgr.namespacePartition(route.ObjectMeta.Namespace)
+		if !appMgr.checkPartition(route, route.ObjectMeta, partition) {
+			continue
+		}
+		routeConfig.HttpVs = formatPartitionVSName(routeConfig.HttpVs, partition)
+		routeConfig.HttpsVs = formatPartitionVSName(routeConfig.HttpsVs, partition)
 
 		//FIXME(kenr): why do we process services that aren't associated
 		//             with a route?
@@ -1129,6 +1418,8 @@ func (appMgr *Manager) syncRoutes(
 
 		// Collect all service names for this Route.
 		svcNames := getRouteServiceNames(route)
+		svcNames = append(svcNames,
+			fallbackServiceNames(route.ObjectMeta.Annotations)...)
 
 		// Get a list of dependencies removed so their pools can be removed.
 		objKey, objDeps := NewObjectDependencies(route)
@@ -1148,19 +1439,63 @@ func (appMgr *Manager) syncRoutes(
 		_, depsRemoved := appMgr.resources.UpdateDependencies(
 			objKey, objDeps, svcDepKey, routeLookupFunc)
 
+		admission := routeAdmission{admitted: true}
+		if claimed, msg := appMgr.checkRouteHostClaim(route); claimed {
+			// Leave the host to the Route that claimed it first
+			admission.reject(routeReasonHostClaimed, msg)
+			written, err := appMgr.setRouteStatus(route, admission)
+			if nil != err {
+				stats.statusErrors++
+			}
+			if written {
+				log.Warning(msg)
+				appMgr.recordEvent(route, route.ObjectMeta.Namespace,
+					v1.EventTypeWarning, routeReasonHostClaimed, msg)
+			}
+			continue
+		}
+		for _, rsName := range []string{routeConfig.HttpVs, routeConfig.HttpsVs} {
+			if _, found := activeRules[rsName]; !found {
+				activeRules[rsName] = make(map[string]bool)
+			}
+			activeRules[rsName][formatRouteRuleName(route)] = true
+		}
+		if missing := missingRouteServices(route, appInf); len(missing) > 0 {
+			admission.reject(routeReasonServiceNotFound, fmt.Sprintf(
+				"Service(s) %s not found.", strings.Join(missing, ", ")))
+		}
+
+		// Without pool member ratios the A/B iRule splits the traffic
+		ratioAB := isRouteRatioABDeployment(route) &&
+			appMgr.checkDriverFeature(route, route.ObjectMeta,
+				driverFeaturePoolMemberRatio, "ratio A/B mode")
+
 		pStructs := []portStruct{{protocol: "http", port: DEFAULT_HTTP_PORT},
 			{protocol: "https", port: DEFAULT_HTTPS_PORT}}
 		for _, ps := range pStructs {
 			rsCfg, err, pool := appMgr.createRSConfigFromRoute(
-				route, svcName, appMgr.resources, appMgr.routeConfig, ps,
-				appInf.svcInformer.GetIndexer(), svcFwdRulesMap)
+				route, svcName, appMgr.resources, routeConfig, ps,
+				appInf.svcInformer.GetIndexer(),
+				svcFwdRulesMap.ForPartition(partition, routeConfig.Shard))
 			if err != nil {
 				// We return err if there was an error creating a rule
 				log.Warningf("%v", err)
+				admission.reject(routeReasonRuleFailed, err.Error())
 				continue
 			}
 
 			rsName := rsCfg.GetName()
+			appMgr.handleRouteSourceRanges(rsCfg, route, dgMap)
+			appMgr.handleRouteRateLimit(rsCfg, route, dgMap)
+			appMgr.handleRouteHsts(rsCfg, route, ps.protocol, dgMap)
+			appMgr.handleSecurityPolicies(rsCfg, route, route.ObjectMeta,
+				annotationSecurityPolicies(route.ObjectMeta.Annotations))
+			appMgr.handleAccessPolicies(rsCfg, route, route.ObjectMeta,
+				annotationAccessPolicies(route.ObjectMeta.Annotations))
+			appMgr.handleFirewallRules(rsCfg, route, route.ObjectMeta,
+				annotationFirewallRules(route.ObjectMeta.Annotations))
+			appMgr.handleFallback(rsCfg, route, route.ObjectMeta,
+				getRouteServiceNames(route), formatRoutePoolName, dgMap)
 
 			// Handle Route health monitors
 			hmStr, exists := route.ObjectMeta.Annotations[healthMonitorAnnotation]
@@ -1181,13 +1516,15 @@ func (appMgr *Manager) syncRoutes(
 				rsCfg.Virtual.VirtualAddress.Port == DEFAULT_HTTPS_PORT {
 				switch route.Spec.TLS.Termination {
 				case routeapi.TLSTerminationEdge:
-					appMgr.setClientSslProfile(stats, sKey, rsCfg, route)
+					appMgr.setClientSslProfile(stats, sKey, rsCfg, route, routeConfig)
 				case routeapi.TLSTerminationReencrypt:
-					appMgr.setClientSslProfile(stats, sKey, rsCfg, route)
-					serverSsl := appMgr.setServerSslProfile(stats, sKey, rsCfg, route)
+					appMgr.setClientSslProfile(stats, sKey, rsCfg, route, routeConfig)
+					serverSsl := appMgr.setServerSslProfile(
+						stats, sKey, rsCfg, route, routeConfig)
 					if "" != serverSsl {
-						updateDataGroup(dgMap, reencryptServerSslDgName,
-							DEFAULT_PARTITION, sKey.Namespace, route.Spec.Host, serverSsl)
+						updateDataGroup(dgMap,
+							formatShardName(reencryptServerSslDgName, routeConfig.Shard),
+							partition, sKey.Namespace, route.Spec.Host, serverSsl)
 					}
 				}
 			}
@@ -1218,26 +1555,25 @@ func (appMgr *Manager) syncRoutes(
 			// info to the A/B data group).
 			switch route.Spec.TLS.Termination {
 			case routeapi.TLSTerminationPassthrough:
-				updateDataGroupForPassthroughRoute(route, DEFAULT_PARTITION,
-					sKey.Namespace, dgMap)
+				updateDataGroupForPassthroughRoute(route, partition,
+					routeConfig.Shard, sKey.Namespace, dgMap)
 			case routeapi.TLSTerminationReencrypt:
-				updateDataGroupForReencryptRoute(route, DEFAULT_PARTITION,
-					sKey.Namespace, dgMap)
+				updateDataGroupForReencryptRoute(route, partition,
+					routeConfig.Shard, sKey.Namespace, dgMap)
 			}
 		}
-		updateDataGroupForABRoute(route, svcName, DEFAULT_PARTITION, sKey.Namespace, dgMap)
-	}
-
-	if len(svcFwdRulesMap) > 0 {
-		httpsRedirectDg := nameRef{
-			Name:      httpsRedirectDgName,
-			Partition: DEFAULT_PARTITION,
-		}
-		if _, found := dgMap[httpsRedirectDg]; !found {
-			dgMap[httpsRedirectDg] = make(DataGroupNamespaceMap)
+		updateDataGroupForABRoute(route, svcName, partition, routeConfig.Shard,
+			sKey.Namespace, ratioAB, dgMap)
+		if _, err := appMgr.setRouteStatus(route, admission); nil != err {
+			stats.statusErrors++
 		}
-		svcFwdRulesMap.AddToDataGroup(dgMap[httpsRedirectDg])
 	}
+	// Drop the rules of deleted and rejected Routes
+	if appMgr.pruneRouteRules(sKey.Namespace, activeRules) {
+		stats.vsUpdated++
+	}
+
+	svcFwdRulesMap.AddToDataGroups(dgMap)
 	return nil
 }
 
@@ -1450,6 +1786,7 @@ func (appMgr *Manager) handleConfigForType(
 		correctBackend, reason, msg =
 			appMgr.updatePoolMembersForCluster(svc, svcKey, rsCfg, appInf, plIdx)
 	}
+	rsCfg.updateWeightedPools()
 
 	// This will only update the config if the vs actually changed.
 	if appMgr.saveVirtualServer(svcKey, rsName, rsCfg) {
@@ -1490,7 +1827,8 @@ func (appMgr *Manager) updatePoolMembersForNodePort(
 	rsCfg *ResourceConfig,
 	index int,
 ) (bool, string, string) {
-	if svc.Spec.Type == v1.ServiceTypeNodePort {
+	if svc.Spec.Type == v1.ServiceTypeNodePort ||
+		svc.Spec.Type == v1.ServiceTypeLoadBalancer {
 		for _, portSpec := range svc.Spec.Ports {
 			if portSpec.Port == svcKey.ServicePort {
 				log.Debugf("Service backend matched %+v: using node port %v",
@@ -1547,6 +1885,7 @@ func (appMgr *Manager) deactivateVirtualServer(
 	if rs, ok := appMgr.resources.Get(sKey, rsName); ok {
 		rsCfg.MetaData.Active = false
 		rsCfg.Pools[index].Members = nil
+		rsCfg.updateWeightedPools()
 		if !reflect.DeepEqual(rs, rsCfg) {
 			log.Debugf("Service delete matching backend %v %v deactivating config",
 				sKey, rsName)
@@ -1650,8 +1989,9 @@ func (appMgr *Manager) deleteUnusedResources(
 			continue
 		}
 		for _, pool := range cfg.Pools {
-			// Make sure we aren't processing empty pool
-			if pool.Name != "" {
+			// Make sure we aren't processing empty pool. Weighted pools go
+			// along with their backends.
+			if pool.Name != "" && len(pool.Backends) == 0 {
 				key := serviceKey{
 					ServiceName: pool.ServiceName,
 					ServicePort: pool.ServicePort,
@@ -20,6 +20,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -28,12 +29,15 @@ import (
 	. "github.com/onsi/gomega"
 
 	routeapi "github.com/openshift/origin/pkg/route/api"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/kubernetes/fake"
 	"k8s.io/client-go/pkg/api/v1"
 	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
+	"k8s.io/client-go/tools/cache"
 )
 
 func init() {
@@ -299,6 +303,117 @@ var configmapIApp2 string = string(`{
   }
 }`)
 
+var configmapPersist string = string(`{
+  "virtualServer": {
+    "backend": {
+      "serviceName": "foo",
+      "servicePort": 80
+    },
+    "frontend": {
+      "balance": "round-robin",
+      "mode": "http",
+      "partition": "velcro",
+      "virtualAddress": {
+        "bindAddr": "10.128.10.240",
+        "port": 5051
+      },
+      "persistence": {
+        "method": "universal",
+        "header": "X-Session-Id"
+      }
+    }
+  }
+}`)
+
+var configmapFastL4 string = string(`{
+  "virtualServer": {
+    "backend": {
+      "serviceName": "foo",
+      "servicePort": 80
+    },
+    "frontend": {
+      "balance": "round-robin",
+      "mode": "tcp",
+      "partition": "velcro",
+      "virtualAddress": {
+        "bindAddr": "10.128.10.240",
+        "port": 5051
+      },
+      "tunedProfiles": {
+        "fastl4": { "idleTimeout": 600, "looseInitialization": true }
+      }
+    }
+  }
+}`)
+
+var configmapSecurity string = string(`{
+  "virtualServer": {
+    "backend": {
+      "serviceName": "foo",
+      "servicePort": 80
+    },
+    "frontend": {
+      "balance": "round-robin",
+      "mode": "http",
+      "partition": "velcro",
+      "virtualAddress": {
+        "bindAddr": "10.128.10.240",
+        "port": 5051
+      },
+      "security": {
+        "wafPolicy": "/Common/waf",
+        "dosProfile": "Common/dos",
+        "logProfiles": [ "/Common/Log all requests" ]
+      }
+    }
+  }
+}`)
+
+var configmapAccess string = string(`{
+  "virtualServer": {
+    "backend": {
+      "serviceName": "foo",
+      "servicePort": 80
+    },
+    "frontend": {
+      "balance": "round-robin",
+      "mode": "http",
+      "partition": "velcro",
+      "virtualAddress": {
+        "bindAddr": "10.128.10.240",
+        "port": 5051
+      },
+      "access": {
+        "accessProfile": "Common/sso",
+        "perRequestPolicy": "/Common/prp"
+      }
+    }
+  }
+}`)
+
+var configmapFirewall string = string(`{
+  "virtualServer": {
+    "backend": {
+      "serviceName": "foo",
+      "servicePort": 80
+    },
+    "frontend": {
+      "balance": "round-robin",
+      "mode": "tcp",
+      "partition": "velcro",
+      "virtualAddress": {
+        "bindAddr": "10.128.10.240",
+        "port": 5051
+      },
+      "firewallRules": [
+        { "action": "accept", "sources": [ "10.0.0.0/8" ], "protocol": "tcp",
+          "ports": [ 5051, "6000-6010" ] },
+        { "action": "drop" }
+      ]
+    }
+  }
+}`)
+
 var emptyConfig string = string(`{"resources":{}}`)
 
 var twoSvcsFourPortsThreeNodesConfig string = string(`{"resources":{"velcro":{"virtualServers":[{"name":"default_barmap","pool":"/velcro/cfgmap_default_barmap_bar","ipProtocol":"tcp","enabled":true,"sourceAddressTranslation":{"type":"automap"},"destination":"/velcro/10.128.10.240:6051","profiles":[{"partition":"Common","name":"http","context":"all"},{"partition":"Common","name":"tcp","context":"all"}]},{"name":"default_foomap","pool":"/velcro/cfgmap_default_foomap_foo","ipProtocol":"tcp","enabled":true,"sourceAddressTranslation":{"type":"automap"},"destination":"/velcro/10.128.10.240:5051","profiles":[{"partition":"Common","name":"http","context":"all"},{"partition":"Common","name":"tcp","context":"all"},{"partition":"velcro","name":"testcert","context":"clientside"}]},{"name":"default_foomap8080","pool":"/velcro/cfgmap_default_foomap8080_foo","ipProtocol":"tcp","enabled":true,"sourceAddressTranslation":{"type":"none"},"destination":"/velcro/10.128.10.240:5051","profiles":[{"partition":"Common","name":"http","context":"all"},{"partition":"Common","name":"tcp","context":"all"}]},{"name":"default_foomap9090","pool":"/velcro/cfgmap_default_foomap9090_foo","ipProtocol":"tcp","enabled":true,"sourceAddressTranslation":{"type":"snat","pool":"snat-pool"},"destination":"/velcro/10.128.10.200:4041","profiles":[{"partition":"Common","name":"tcp","context":"all"}]}],"pools":[{"name":"cfgmap_default_barmap_bar","loadBalancingMode":"round-robin","members":[{"address":"127.0.0.1","port":37001,"session":"user-enabled"},{"address":"127.0.0.2","port":37001,"session":"user-enabled"},{"address":"127.0.0.3","port":37001,"session":"user-enabled"}],"monitors":null},{"name":"cfgmap_default_foomap_foo","loadBalancingMode":"round-robin","members":[{"address":"127.0.0.1","port":30001,"session":"user-enabled"},{"address":"127.0.0.2","port":30001,"session":"user-enabled"},{"address":"127.0.0.3","port":30001,"session":"user-enabled"}],"monitors":["/velcro/cfgmap_default_foomap_foo_0_tcp"]},{"name":"cfgmap_default_foomap8080_foo","loadBalancingMode":"round-robin","members":[{"address":"127.0.0.1","port":38001,"session":"user-enabled"},{"address":"127.0.0.2","port":38001,"session":"user-enabled"},{"address":"127.0.0.3","port":38001,"session":"user-enabled"}],"monitors":null},{"name":"cfgmap_default_foomap9090_foo","loadBalancingMode":"round-robin","members":[{"address":"127.0.0.1","port":39001,"session":"user-enabled"},{"address":"127.0.0.2","port":39001,"session":"user-enabled"},{"address":"127.0.0.3","port":39001,"session":"user-enabled"}],"monitors":null}],"monitors":[{"name":"cfgmap_default_foomap_foo_0_tcp","interval":30,"type":"tcp","send":"GET /","recv":"Hello from","timeout":20}]}}}`)
@@ -324,6 +439,8 @@ type mockAppManager struct {
 	mutex   sync.Mutex
 	vsMutex map[serviceQueueKey]*sync.Mutex
 	nsLabel string
+	// Route statuses written since recordRouteStatus
+	sentRoutes *test.SentObjects
 }
 
 func newMockAppManager(params *Params) *mockAppManager {
@@ -606,7 +723,12 @@ func (m *mockAppManager) addRoute(route *routeapi.Route) bool {
 }
 
 func (m *mockAppManager) updateRoute(route *routeapi.Route) bool {
-	ok, keys := m.appMgr.checkValidRoute(route)
+	var old interface{}
+	if appInf, found := m.appMgr.getNamespaceInformer(
+		route.ObjectMeta.Namespace); found {
+		old, _, _ = appInf.routeInformer.GetStore().Get(route)
+	}
+	ok, keys := m.appMgr.checkValidRouteUpdate(old, route)
 	if ok {
 		appInf, _ := m.appMgr.getNamespaceInformer(route.ObjectMeta.Namespace)
 		appInf.routeInformer.GetStore().Update(route)
@@ -635,6 +757,28 @@ func (m *mockAppManager) deleteRoute(route *routeapi.Route) bool {
 	return ok
 }
 
+// Write Route statuses through a client that keeps them for routeStatus
+func (m *mockAppManager) recordRouteStatus() *test.SentObjects {
+	m.sentRoutes = &test.SentObjects{}
+	m.appMgr.routeClientV1 = test.CreateRecordingHTTPClient(m.sentRoutes)
+	return m.sentRoutes
+}
+
+// Return the Route as last written with its status, or nil if no status
+// was written for it
+func (m *mockAppManager) routeStatus(route *routeapi.Route) *routeapi.Route {
+	m.sentRoutes.Lock()
+	defer m.sentRoutes.Unlock()
+	for i := len(m.sentRoutes.Objects) - 1; i >= 0; i-- {
+		sent, ok := m.sentRoutes.Objects[i].(*routeapi.Route)
+		if ok && sent.ObjectMeta.Namespace == route.ObjectMeta.Namespace &&
+			sent.ObjectMeta.Name == route.ObjectMeta.Name {
+			return sent
+		}
+	}
+	return nil
+}
+
 func (m *mockAppManager) addNamespace(ns *v1.Namespace) bool {
 	if "" == m.nsLabel {
 		return false
@@ -656,6 +800,77 @@ func (m *mockAppManager) getFakeEvents(ns string) []FakeEvent {
 	return []FakeEvent{}
 }
 
+// Add a ClusterIP Service with an http port 80, and its endpoints
+func (m *mockAppManager) addClusterIPService(name, ns string, ips []string) {
+	ports := []v1.ServicePort{newServicePort("http", 80)}
+	endpts := test.NewEndpoints(name, "1", ns, ips, []string{},
+		convertSvcPortsToEndpointPorts(ports))
+	Expect(m.addEndpoints(endpts)).To(BeTrue())
+	svc := test.NewService(name, "1", ns, "ClusterIP", ports)
+	Expect(m.addService(svc)).To(BeTrue())
+}
+
+func (m *mockAppManager) getFakeEventReasons(ns string) []string {
+	var reasons []string
+	for _, ev := range m.getFakeEvents(ns) {
+		reasons = append(reasons, ev.Reason)
+	}
+	return reasons
+}
+
+// Return the records of an internal data group from all namespaces, or nil
+// if there is no such data group
+func (m *mockAppManager) getDataGroupRecords(
+	name string,
+	partition string,
+) []InternalDataGroupRecord {
+	nsMap, found := m.appMgr.intDgMap[nameRef{
+		Name:      name,
+		Partition: partition,
+	}]
+	if !found || len(nsMap) == 0 {
+		return nil
+	}
+	return nsMap.FlattenNamespaces().Records
+}
+
+// Return the iRules of a virtual server, which must exist
+func (m *mockAppManager) getVirtualIRules(
+	key serviceKey,
+	vsName string,
+) []string {
+	rs, ok := m.resources().Get(key, vsName)
+	Expect(ok).To(BeTrue())
+	return rs.Virtual.IRules
+}
+
+func (m *mockAppManager) hasIRule(name, partition string) bool {
+	_, found := m.appMgr.irulesMap[nameRef{
+		Name:      name,
+		Partition: partition,
+	}]
+	return found
+}
+
+// Return the pool of a resource config, or nil if it has no such pool
+func findPool(rs *ResourceConfig, name string) *Pool {
+	for i, pool := range rs.Pools {
+		if pool.Name == name {
+			return &rs.Pools[i]
+		}
+	}
+	return nil
+}
+
+func generateExpectedRatioMember(addr string, ratio int) Member {
+	return Member{
+		Address: addr,
+		Port:    80,
+		Session: "user-enabled",
+		Ratio:   ratio,
+	}
+}
+
 func generateExpectedAddrs(port int32, ips []string) []Member {
 	var ret []Member
 	for _, ip := range ips {
@@ -825,6 +1040,15 @@ var _ = Describe("AppManager Tests", func() {
 			Expect(func() { appMgr.outputConfig() }).ToNot(Panic())
 			Expect(mw.WrittenTimes).To(Equal(1))
 		})
+
+		It("keeps custom profiles out of the debug copy", func() {
+			resources := PartitionMap{"velcro": &BigIPConfig{
+				CustomProfiles: []CustomProfile{
+					{Name: "secret", Cert: "cert", Key: "key"},
+				},
+			}}
+			Expect(copyResourceData(resources)["velcro"].CustomProfiles).To(BeEmpty())
+		})
 	})
 
 	Describe("Using Real Manager", func() {
@@ -2236,7 +2460,10 @@ var _ = Describe("AppManager Tests", func() {
 					"schema": schemaUrl,
 					"data":   configmapFoo})
 				_, err := parseConfigMap(wrongPartition, mockMgr.appMgr.schemaLocal)
-				Expect(err).ToNot(BeNil(), "Config map with wrong partition should throw an error.")
+				Expect(err).To(BeNil(), "The partition is checked after parsing.")
+				r := mockMgr.addConfigMap(wrongPartition)
+				Expect(r).To(BeFalse(), "Config map with wrong partition should be rejected.")
+				Expect(mockMgr.resources().VirtualCount()).To(Equal(0))
 				DEFAULT_PARTITION = "velcro"
 			})
 
@@ -2496,6 +2723,162 @@ var _ = Describe("AppManager Tests", func() {
 				validateServiceIps(svcName, namespace, svcPorts[1:2], svcPodIps, resources)
 			})
 
+			It("restricts ConfigMap clients", func() {
+				svcFoo := test.NewService("foo", "1", namespace, "NodePort",
+					[]v1.ServicePort{{Port: 80, NodePort: 37001}})
+				Expect(mockMgr.addService(svcFoo)).To(BeTrue())
+				cfgFoo := test.NewConfigMap("foomap", "1", namespace, map[string]string{
+					"schema": schemaUrl,
+					"data":   configmapFoo})
+				cfgFoo.ObjectMeta.Annotations = map[string]string{
+					f5VsAllowSourceRangeAnnotation: "172.16.0.0/12",
+				}
+				Expect(mockMgr.addConfigMap(cfgFoo)).To(BeTrue())
+
+				vsName := formatConfigMapVSName(cfgFoo)
+				dgName := formatSourceRangeDgName(vsName)
+				Expect(mockMgr.getDataGroupRecords(dgName, "velcro")).To(Equal(
+					[]InternalDataGroupRecord{{
+						Name: "*",
+						Data: "allow 172.16.0.0/12",
+					}}))
+				fooKey := serviceKey{"foo", 80, namespace}
+				Expect(mockMgr.getVirtualIRules(fooKey, vsName)).To(Equal(
+					[]string{joinBigipPath(DEFAULT_PARTITION, sourceRangeIRuleName)}))
+
+				cfgFoo.ObjectMeta.Annotations = nil
+				Expect(mockMgr.updateConfigMap(cfgFoo)).To(BeTrue())
+				Expect(mockMgr.getDataGroupRecords(dgName, "velcro")).To(BeNil())
+				Expect(mockMgr.getVirtualIRules(fooKey, vsName)).To(BeEmpty())
+				Expect(mockMgr.hasIRule(sourceRangeIRuleName,
+					DEFAULT_PARTITION)).To(BeFalse())
+			})
+
+			It("sets ConfigMap persistence", func() {
+				svc := test.NewService("foo", "1", namespace, "NodePort",
+					[]v1.ServicePort{{Port: 80, NodePort: 37001}})
+				Expect(mockMgr.addService(svc)).To(BeTrue())
+				cfgFoo := test.NewConfigMap("foomap", "1", namespace, map[string]string{
+					"schema": strings.Replace(schemaUrl, "v0.1.8", "v0.1.9", 1),
+					"data":   configmapPersist})
+				Expect(mockMgr.addConfigMap(cfgFoo)).To(BeTrue())
+
+				rs, ok := mockMgr.resources().Get(serviceKey{"foo", 80, namespace},
+					formatConfigMapVSName(cfgFoo))
+				Expect(ok).To(BeTrue())
+				Expect(rs.Virtual.Persist[0].Name).To(Equal("universal"))
+				iRuleName := formatUniversalPersistIRuleName("X-Session-Id")
+				Expect(rs.Virtual.IRules).To(ContainElement(joinBigipPath(
+					DEFAULT_PARTITION, iRuleName)))
+				Expect(mockMgr.hasIRule(iRuleName, DEFAULT_PARTITION)).To(BeTrue())
+
+				Expect(mockMgr.deleteConfigMap(cfgFoo)).To(BeTrue())
+				Expect(mockMgr.hasIRule(iRuleName, DEFAULT_PARTITION)).To(BeFalse())
+			})
+
+			It("replaces the tcp profile of a ConfigMap with fastL4", func() {
+				mockMgr.appMgr.driverFeatures = newDriverFeatures(
+					[]string{driverFeatureTunedProfiles})
+				svcFoo := test.NewService("foo", "1", namespace, "NodePort",
+					[]v1.ServicePort{{Port: 80, NodePort: 37001}})
+				Expect(mockMgr.addService(svcFoo)).To(BeTrue())
+
+				cfgFoo := test.NewConfigMap("foomap", "1", namespace, map[string]string{
+					"schema": strings.Replace(schemaUrl, "v0.1.8", "v0.1.9", 1),
+					"data":   configmapFastL4})
+				Expect(mockMgr.addConfigMap(cfgFoo)).To(BeTrue())
+
+				vsName := formatConfigMapVSName(cfgFoo)
+				rs, ok := mockMgr.resources().Get(serviceKey{"foo", 80, namespace}, vsName)
+				Expect(ok).To(BeTrue())
+				Expect(rs.Virtual.Profiles).To(Equal(ProfileRefs{{
+					Name:      formatTunedProfileName(vsName, tunedProfileFastL4),
+					Partition: DEFAULT_PARTITION,
+					Context:   customProfileAll,
+				}}))
+				Expect(rs.TunedProfiles).To(Equal([]TunedProfile{{
+					Name:         formatTunedProfileName(vsName, tunedProfileFastL4),
+					Partition:    DEFAULT_PARTITION,
+					Type:         "fastl4",
+					DefaultsFrom: "/Common/fastL4",
+					Settings: map[string]interface{}{
+						"idleTimeout":         600,
+						"looseInitialization": true,
+					},
+				}}))
+			})
+
+			It("attaches security policies for a ConfigMap", func() {
+				mockMgr.appMgr.driverFeatures = newDriverFeatures(
+					[]string{driverFeatureSecurityPolicies})
+				svcFoo := test.NewService("foo", "1", namespace, "NodePort",
+					[]v1.ServicePort{{Port: 80, NodePort: 37001}})
+				Expect(mockMgr.addService(svcFoo)).To(BeTrue())
+
+				cfgFoo := test.NewConfigMap("foomap", "1", namespace, map[string]string{
+					"schema": strings.Replace(schemaUrl, "v0.1.8", "v0.1.9", 1),
+					"data":   configmapSecurity})
+				Expect(mockMgr.addConfigMap(cfgFoo)).To(BeTrue())
+
+				rs, ok := mockMgr.resources().Get(serviceKey{"foo", 80, namespace},
+					formatConfigMapVSName(cfgFoo))
+				Expect(ok).To(BeTrue())
+				Expect(virtualSecurityPolicies(&rs.Virtual)).To(Equal(securityPolicies{
+					WafPolicy:   "/Common/waf",
+					DosProfile:  "/Common/dos",
+					LogProfiles: []string{"/Common/Log all requests"},
+				}))
+			})
+
+			It("attaches access policies for a ConfigMap", func() {
+				mockMgr.appMgr.driverFeatures = newDriverFeatures(
+					[]string{driverFeatureAccessPolicies})
+				svcFoo := test.NewService("foo", "1", namespace, "NodePort",
+					[]v1.ServicePort{{Port: 80, NodePort: 37001}})
+				Expect(mockMgr.addService(svcFoo)).To(BeTrue())
+
+				cfgFoo := test.NewConfigMap("foomap", "1", namespace, map[string]string{
+					"schema": strings.Replace(schemaUrl, "v0.1.8", "v0.1.9", 1),
+					"data":   configmapAccess})
+				Expect(mockMgr.addConfigMap(cfgFoo)).To(BeTrue())
+
+				rs, ok := mockMgr.resources().Get(serviceKey{"foo", 80, namespace},
+					formatConfigMapVSName(cfgFoo))
+				Expect(ok).To(BeTrue())
+				Expect(virtualAccessPolicies(&rs.Virtual)).To(Equal(accessPolicies{
+					AccessProfile:    "/Common/sso",
+					PerRequestPolicy: "/Common/prp",
+				}))
+			})
+
+			It("enforces firewall rules for a ConfigMap", func() {
+				mockMgr.appMgr.driverFeatures = newDriverFeatures(
+					[]string{driverFeatureFirewallPolicies})
+				svcFoo := test.NewService("foo", "1", namespace, "NodePort",
+					[]v1.ServicePort{{Port: 80, NodePort: 37001}})
+				Expect(mockMgr.addService(svcFoo)).To(BeTrue())
+
+				cfgFoo := test.NewConfigMap("foomap", "1", namespace, map[string]string{
+					"schema": strings.Replace(schemaUrl, "v0.1.8", "v0.1.9", 1),
+					"data":   configmapFirewall})
+				Expect(mockMgr.addConfigMap(cfgFoo)).To(BeTrue())
+
+				rs, ok := mockMgr.resources().Get(serviceKey{"foo", 80, namespace},
+					formatConfigMapVSName(cfgFoo))
+				Expect(ok).To(BeTrue())
+				Expect(rs.FirewallPolicy).ToNot(BeNil())
+				Expect(rs.FirewallPolicy.Rules).To(Equal([]FirewallPolicyRule{
+					{
+						Name:             "rule-1",
+						Action:           firewallAccept,
+						IpProtocol:       "tcp",
+						SourceAddresses:  []string{"10.0.0.0/8"},
+						DestinationPorts: []string{"5051", "6000-6010"},
+					},
+					{Name: "rule-2", Action: firewallDrop},
+				}))
+			})
+
 			It("handles non-NodePort service mode - NodePort", func() {
 				cfgFoo := test.NewConfigMap(
 					"foomap",
@@ -2638,7 +3021,8 @@ var _ = Describe("AppManager Tests", func() {
 				Expect(rs.Virtual.VirtualAddress.Port).To(Equal(int32(80)))
 				Expect(rs.Virtual.SourceAddrTranslation.Type).To(Equal("automap"))
 				Expect(rs.Virtual.SourceAddrTranslation.Pool).To(Equal(""))
-				// Update the Ingress resource
+				// Update the Ingress resource, moving it to another managed partition
+				mockMgr.appMgr.partitions = []string{"velcro", "velcro2"}
 				ingress2 := test.NewIngress("ingress", "1", namespace, ingressConfig,
 					map[string]string{
 						f5VsBindAddrAnnotation:              "5.6.7.8",
@@ -2762,12 +3146,13 @@ var _ = Describe("AppManager Tests", func() {
 				Expect(resources.PoolCount()).To(Equal(3))
 				rs, ok = resources.Get(
 					serviceKey{"foo", 80, "default"}, formatIngressVSName("1.2.3.4", 80))
-				Expect(len(rs.Policies[0].Rules)).To(Equal(4))
+				// Each path also has a rule for the paths below it
+				Expect(len(rs.Policies[0].Rules)).To(Equal(8))
 				mockMgr.deleteService(fooSvc)
 				Expect(resources.PoolCount()).To(Equal(2))
 				rs, ok = resources.Get(
 					serviceKey{"bar", 80, "default"}, formatIngressVSName("1.2.3.4", 80))
-				Expect(len(rs.Policies[0].Rules)).To(Equal(2))
+				Expect(len(rs.Policies[0].Rules)).To(Equal(4))
 
 				mockMgr.deleteIngress(ingress3)
 				mockMgr.addService(fooSvc)
@@ -2820,7 +3205,7 @@ var _ = Describe("AppManager Tests", func() {
 				Expect(resources.PoolCount()).To(Equal(3))
 				rs, ok = resources.Get(
 					serviceKey{"foo", 80, "default"}, formatIngressVSName("1.2.3.4", 80))
-				Expect(len(rs.Policies[0].Rules)).To(Equal(2))
+				Expect(len(rs.Policies[0].Rules)).To(Equal(4))
 				events = mockMgr.getFakeEvents(namespace)
 				Expect(len(events)).To(Equal(7))
 
@@ -3044,51 +3429,1893 @@ var _ = Describe("AppManager Tests", func() {
 				Expect(flatDg).To(BeNil(), "should not have data")
 			})
 
-			Context("Routes", func() {
-				BeforeEach(func() {
-					mockMgr.appMgr.routeConfig = RouteConfig{
-						HttpVs:  "ose-vserver",
-						HttpsVs: "https-ose-vserver",
-					}
-				})
-
-				It("configures virtual servers via Routes", func() {
-					spec := routeapi.RouteSpec{
-						Host: "foobar.com",
-						Path: "/foo",
-						To: routeapi.RouteTargetReference{
-							Kind: "Service",
-							Name: "foo",
-						},
-						Port: &routeapi.RoutePort{
-							TargetPort: intstr.FromString("foo-80"),
+			It("restricts Ingress clients", func() {
+				svcFoo := test.NewService("foo", "1", namespace, "NodePort",
+					[]v1.ServicePort{{Port: 80, NodePort: 37001}})
+				Expect(mockMgr.addService(svcFoo)).To(BeTrue())
+				spec := v1beta1.IngressSpec{
+					Rules: []v1beta1.IngressRule{
+						{Host: "Foo.com",
+							IngressRuleValue: v1beta1.IngressRuleValue{
+								HTTP: &v1beta1.HTTPIngressRuleValue{
+									Paths: []v1beta1.HTTPIngressPath{
+										{Path: "/admin",
+											Backend: v1beta1.IngressBackend{
+												ServiceName: "foo",
+												ServicePort: intstr.IntOrString{IntVal: 80},
+											},
+										},
+									},
+								},
+							},
 						},
-						TLS: &routeapi.TLSConfig{
-							Termination: "edge",
-							Certificate: "cert",
-							Key:         "key",
+					},
+				}
+				ing := test.NewIngress("ingress", "1", namespace, spec,
+					map[string]string{
+						f5VsBindAddrAnnotation:         "1.2.3.4",
+						f5VsAllowSourceRangeAnnotation: "10.0.0.0/8",
+					})
+				Expect(mockMgr.addIngress(ing)).To(BeTrue())
+
+				vsName := formatIngressVSName("1.2.3.4", 80)
+				dgName := formatSourceRangeDgName(vsName)
+				fooKey := serviceKey{"foo", 80, namespace}
+				httpIRule := joinBigipPath(DEFAULT_PARTITION, sourceRangeHttpIRuleName)
+				Expect(mockMgr.getDataGroupRecords(dgName, DEFAULT_PARTITION)).To(Equal(
+					[]InternalDataGroupRecord{{
+						Name: "foo.com /admin",
+						Data: "allow 10.0.0.0/8",
+					}}))
+				Expect(mockMgr.getVirtualIRules(fooKey, vsName)).To(Equal([]string{httpIRule}))
+				Expect(mockMgr.hasIRule(sourceRangeHttpIRuleName,
+					DEFAULT_PARTITION)).To(BeTrue())
+
+				// Malformed ranges are reported
+				ing.ObjectMeta.Annotations[f5VsDenySourceRangeAnnotation] = "10.1.0.0/16,10.2"
+				Expect(mockMgr.updateIngress(ing)).To(BeTrue())
+				Expect(mockMgr.getDataGroupRecords(dgName, DEFAULT_PARTITION)[0].Data).To(Equal(
+					"allow 10.0.0.0/8;deny 10.1.0.0/16"))
+				Expect(mockMgr.getFakeEventReasons(namespace)).To(
+					ContainElement("InvalidSourceRange"))
+
+				// Keys follow the path type of the Ingress
+				ing.ObjectMeta.Annotations[f5VsPathTypeAnnotation] = pathTypeExact
+				Expect(mockMgr.updateIngress(ing)).To(BeTrue())
+				Expect(mockMgr.getDataGroupRecords(dgName, DEFAULT_PARTITION)[0].Name).To(Equal(
+					"foo.com =/admin"))
+
+				// Without the annotations the data group and iRule go away
+				delete(ing.ObjectMeta.Annotations, f5VsAllowSourceRangeAnnotation)
+				delete(ing.ObjectMeta.Annotations, f5VsDenySourceRangeAnnotation)
+				Expect(mockMgr.updateIngress(ing)).To(BeTrue())
+				Expect(mockMgr.getDataGroupRecords(dgName, DEFAULT_PARTITION)).To(BeNil())
+				Expect(mockMgr.getVirtualIRules(fooKey, vsName)).To(BeEmpty())
+				Expect(mockMgr.hasIRule(sourceRangeHttpIRuleName,
+					DEFAULT_PARTITION)).To(BeFalse())
+			})
+
+			It("limits Ingress clients per host and path", func() {
+				svcFoo := test.NewService("foo", "1", namespace, "NodePort",
+					[]v1.ServicePort{{Port: 80, NodePort: 37001}})
+				Expect(mockMgr.addService(svcFoo)).To(BeTrue())
+
+				spec := v1beta1.IngressSpec{
+					Rules: []v1beta1.IngressRule{
+						{Host: "foo.com",
+							IngressRuleValue: v1beta1.IngressRuleValue{
+								HTTP: &v1beta1.HTTPIngressRuleValue{
+									Paths: []v1beta1.HTTPIngressPath{
+										{Path: "/api",
+											Backend: v1beta1.IngressBackend{
+												ServiceName: "foo",
+												ServicePort: intstr.IntOrString{IntVal: 80},
+											},
+										},
+									},
+								},
+							},
 						},
-					}
-					route := test.NewRoute("route", "1", namespace, spec,
-						map[string]string{
-							f5VsSourceAddrTranslationAnnotation: string(`{"type":"snat","pool":"snat-pool"}`),
-						})
-					r := mockMgr.addRoute(route)
-					Expect(r).To(BeTrue(), "Route resource should be processed.")
+					},
+				}
+				ing := test.NewIngress("ingress", "1", namespace, spec,
+					map[string]string{
+						f5VsBindAddrAnnotation:         "1.2.3.4",
+						f5VsAllowSourceRangeAnnotation: "10.0.0.0/8",
+						f5VsRateLimitAnnotation:        "20",
+					})
+				Expect(mockMgr.addIngress(ing)).To(BeTrue())
+
+				vsName := formatIngressVSName("1.2.3.4", 80)
+				dgName := formatRateLimitDgName(vsName)
+				fooKey := serviceKey{"foo", 80, namespace}
+				rateLimitIRule := joinBigipPath(DEFAULT_PARTITION, rateLimitIRuleName)
+				Expect(mockMgr.getDataGroupRecords(dgName, DEFAULT_PARTITION)).To(
+					Equal([]InternalDataGroupRecord{{
+						Name: "foo.com /api",
+						Data: "20 429 client-ip",
+					}}))
+				// Clients turned away by source range are not counted
+				Expect(mockMgr.getVirtualIRules(fooKey, vsName)).To(Equal([]string{
+					joinBigipPath(DEFAULT_PARTITION, sourceRangeHttpIRuleName),
+					rateLimitIRule,
+				}))
 
-					resources := mockMgr.resources()
-					// Associate a service
-					fooSvc := test.NewService("foo", "1", namespace, "NodePort",
-						[]v1.ServicePort{{Name: "foo-80", Port: 80, NodePort: 37001}})
-					r = mockMgr.addService(fooSvc)
-					Expect(r).To(BeTrue(), "Service should be processed.")
-					Expect(resources.PoolCount()).To(Equal(1))
+				// Invalid settings are reported
+				ing.ObjectMeta.Annotations[f5VsRateLimitActionAnnotation] = "drop"
+				mockMgr.updateIngress(ing)
+				Expect(mockMgr.getFakeEventReasons(namespace)).To(
+					ContainElement("InvalidRateLimit"))
+
+				// Without the annotations the data group and iRule go away
+				delete(ing.ObjectMeta.Annotations, f5VsRateLimitAnnotation)
+				delete(ing.ObjectMeta.Annotations, f5VsRateLimitActionAnnotation)
+				mockMgr.updateIngress(ing)
+				Expect(mockMgr.getDataGroupRecords(dgName, DEFAULT_PARTITION)).To(
+					BeNil())
+				Expect(mockMgr.getVirtualIRules(fooKey, vsName)).ToNot(
+					ContainElement(rateLimitIRule))
+				Expect(mockMgr.hasIRule(rateLimitIRuleName,
+					DEFAULT_PARTITION)).To(BeFalse())
+			})
 
-					rs, ok := resources.Get(
-						serviceKey{"foo", 80, "default"}, "https-ose-vserver")
-					Expect(ok).To(BeTrue(), "Route should be accessible.")
-					Expect(rs).ToNot(BeNil(), "Route should be object.")
-					Expect(rs.Virtual.SourceAddrTranslation.Type).To(Equal("snat"))
+			It("sets Ingress persistence", func() {
+				svc := test.NewService("foo", "1", namespace, "NodePort",
+					[]v1.ServicePort{{Port: 80, NodePort: 37001}})
+				Expect(mockMgr.addService(svc)).To(BeTrue())
+				spec := v1beta1.IngressSpec{
+					Backend: &v1beta1.IngressBackend{
+						ServiceName: "foo",
+						ServicePort: intstr.IntOrString{IntVal: 80},
+					},
+				}
+				ing := test.NewIngress("ingress", "1", namespace, spec,
+					map[string]string{
+						f5VsBindAddrAnnotation:    "1.2.3.4",
+						f5VsPersistenceAnnotation: persistCookie,
+					})
+				Expect(mockMgr.addIngress(ing)).To(BeTrue())
+				iRuleName := formatUniversalPersistIRuleName("X-Session-Id")
+				vsName := formatIngressVSName("1.2.3.4", 80)
+				virtual := func() Virtual {
+					rs, ok := mockMgr.resources().Get(
+						serviceKey{"foo", 80, namespace}, vsName)
+					Expect(ok).To(BeTrue())
+					return rs.Virtual
+				}
+				Expect(virtual().Persist).To(Equal([]persistenceRef{{
+					Name:      "cookie",
+					Partition: "Common",
+					TmDefault: "yes",
+				}}))
+
+				// Universal persistence brings its iRule along
+				ing.ObjectMeta.Annotations[f5VsPersistenceAnnotation] = persistUniversal
+				ing.ObjectMeta.Annotations[f5VsPersistenceHeaderAnnotation] = "X-Session-Id"
+				Expect(mockMgr.updateIngress(ing)).To(BeTrue())
+				Expect(virtual().Persist[0].Name).To(Equal("universal"))
+				Expect(virtual().IRules).To(Equal([]string{joinBigipPath(
+					DEFAULT_PARTITION, iRuleName)}))
+				Expect(mockMgr.hasIRule(iRuleName, DEFAULT_PARTITION)).To(BeTrue())
+				Expect(mockMgr.appMgr.irulesMap[nameRef{
+					Name:      iRuleName,
+					Partition: DEFAULT_PARTITION,
+				}].Code).To(ContainSubstring(`[HTTP::header "x-session-id"]`))
+
+				// An invalid setting is reported and leaves no persistence
+				ing.ObjectMeta.Annotations[f5VsPersistenceAnnotation] = "sticky"
+				Expect(mockMgr.updateIngress(ing)).To(BeTrue())
+				Expect(virtual().Persist).To(BeEmpty())
+				Expect(virtual().IRules).To(BeEmpty())
+				Expect(mockMgr.hasIRule(iRuleName, DEFAULT_PARTITION)).To(BeFalse())
+				Expect(mockMgr.getFakeEventReasons(namespace)).To(
+					ContainElement("InvalidPersistence"))
+
+				delete(ing.ObjectMeta.Annotations, f5VsPersistenceAnnotation)
+				Expect(mockMgr.updateIngress(ing)).To(BeTrue())
+				Expect(virtual().Persist).To(BeEmpty())
+			})
+
+			It("keeps Ingress persistence with its owner on a shared virtual", func() {
+				svc := test.NewService("foo", "1", namespace, "NodePort",
+					[]v1.ServicePort{{Port: 80, NodePort: 37001}})
+				svc.Spec.SessionAffinity = v1.ServiceAffinityClientIP
+				Expect(mockMgr.addService(svc)).To(BeTrue())
+				spec := v1beta1.IngressSpec{
+					Backend: &v1beta1.IngressBackend{
+						ServiceName: "foo",
+						ServicePort: intstr.IntOrString{IntVal: 80},
+					},
+				}
+				ing := test.NewIngress("ingress", "1", namespace, spec,
+					map[string]string{f5VsBindAddrAnnotation: "1.2.3.4"})
+				Expect(mockMgr.addIngress(ing)).To(BeTrue())
+				vsName := formatIngressVSName("1.2.3.4", 80)
+				virtual := func() Virtual {
+					rs, ok := mockMgr.resources().Get(
+						serviceKey{"foo", 80, namespace}, vsName)
+					Expect(ok).To(BeTrue())
+					return rs.Virtual
+				}
+				// The backend's ClientIP session affinity applies to the Ingress
+				sourceAddr := []persistenceRef{{
+					Name:      "source_addr",
+					Partition: "Common",
+					TmDefault: "yes",
+				}}
+				Expect(virtual().Persist).To(Equal(sourceAddr))
+
+				// Another Ingress on the same address cannot replace it
+				other := test.NewIngress("other", "1", namespace, spec,
+					map[string]string{
+						f5VsBindAddrAnnotation:    "1.2.3.4",
+						f5VsPersistenceAnnotation: persistCookie,
+					})
+				Expect(mockMgr.addIngress(other)).To(BeTrue())
+				Expect(virtual().Persist).To(Equal(sourceAddr))
+				Expect(mockMgr.getFakeEventReasons(namespace)).To(
+					ContainElement("PersistenceConflict"))
+
+				// Once the owner is gone, the other Ingress sets its own
+				Expect(mockMgr.deleteIngress(ing)).To(BeTrue())
+				Expect(mockMgr.updateIngress(other)).To(BeTrue())
+				Expect(virtual().Persist[0].Name).To(Equal("cookie"))
+			})
+
+			It("weights the Services of an Ingress path", func() {
+				mockMgr.appMgr.isNodePort = false
+				mockMgr.appMgr.driverFeatures = newDriverFeatures(
+					[]string{driverFeaturePoolMemberRatio})
+				mockMgr.addClusterIPService("foo", namespace,
+					[]string{"10.2.96.1", "10.2.96.2"})
+				mockMgr.addClusterIPService("bar", namespace, []string{"10.2.96.3"})
+
+				backend := func(svc string) v1beta1.IngressBackend {
+					return v1beta1.IngressBackend{
+						ServiceName: svc,
+						ServicePort: intstr.IntOrString{IntVal: 80},
+					}
+				}
+				spec := v1beta1.IngressSpec{
+					Rules: []v1beta1.IngressRule{
+						{Host: "foo.com",
+							IngressRuleValue: v1beta1.IngressRuleValue{
+								HTTP: &v1beta1.HTTPIngressRuleValue{
+									Paths: []v1beta1.HTTPIngressPath{
+										{Path: "/app", Backend: backend("foo")},
+										{Path: "/app", Backend: backend("bar")},
+										{Path: "/foo", Backend: backend("foo")},
+									},
+								},
+							},
+						},
+					},
+				}
+				ing := test.NewIngress("ingress", "1", namespace, spec,
+					map[string]string{
+						f5VsBindAddrAnnotation:       "1.2.3.4",
+						f5VsBackendWeightsAnnotation: `{"foo": 90, "bar": 10}`,
+					})
+				Expect(mockMgr.addIngress(ing)).To(BeTrue())
+
+				vsName := formatIngressVSName("1.2.3.4", 80)
+				poolName := formatIngressWeightedPoolName(namespace, "ingress",
+					[]string{"bar", "foo"})
+				rs, ok := mockMgr.resources().Get(serviceKey{"foo", 80, namespace}, vsName)
+				Expect(ok).To(BeTrue())
+				Expect(findPool(rs, poolName).Members).To(ConsistOf(
+					generateExpectedRatioMember("10.2.96.1", 9),
+					generateExpectedRatioMember("10.2.96.2", 9),
+					generateExpectedRatioMember("10.2.96.3", 2)))
+				var pools []string
+				for _, rl := range rs.Policies[0].Rules {
+					pools = append(pools, rl.Actions[0].Pool)
+				}
+				// Each path has a rule for itself and one for the paths below it
+				Expect(pools).To(ConsistOf(
+					joinBigipPath(DEFAULT_PARTITION, poolName),
+					joinBigipPath(DEFAULT_PARTITION, poolName),
+					joinBigipPath(DEFAULT_PARTITION,
+						formatIngressPoolName(namespace, "foo")),
+					joinBigipPath(DEFAULT_PARTITION,
+						formatIngressPoolName(namespace, "foo"))))
+
+				// A Service sharing the path without a weight is reported
+				ing.ObjectMeta.Annotations[f5VsBackendWeightsAnnotation] = `{"foo": 90}`
+				Expect(mockMgr.updateIngress(ing)).To(BeTrue())
+				rs, _ = mockMgr.resources().Get(serviceKey{"foo", 80, namespace}, vsName)
+				Expect(findPool(rs, poolName)).To(BeNil())
+				Expect(mockMgr.getFakeEventReasons(namespace)).To(
+					ContainElement("InvalidBackendWeights"))
+
+				// So is an invalid annotation, and the weighted pool stays dropped
+				ing.ObjectMeta.Annotations[f5VsBackendWeightsAnnotation] = `{"foo": -1}`
+				Expect(mockMgr.updateIngress(ing)).To(BeTrue())
+				rs, _ = mockMgr.resources().Get(serviceKey{"foo", 80, namespace}, vsName)
+				Expect(findPool(rs, poolName)).To(BeNil())
+
+				// Weights need the driver feature
+				ing.ObjectMeta.Annotations[f5VsBackendWeightsAnnotation] =
+					`{"foo": 90, "bar": 10}`
+				mockMgr.appMgr.driverFeatures = newDriverFeatures(nil)
+				Expect(mockMgr.updateIngress(ing)).To(BeTrue())
+				rs, _ = mockMgr.resources().Get(serviceKey{"foo", 80, namespace}, vsName)
+				Expect(findPool(rs, poolName)).To(BeNil())
+				events := mockMgr.getFakeEvents(namespace)
+				Expect(events[len(events)-1].Reason).To(Equal("UnsupportedDriverFeature"))
+			})
+
+			It("configures a fallback pool and maintenance page for an Ingress", func() {
+				mockMgr.appMgr.isNodePort = false
+				mockMgr.addClusterIPService("foo", namespace, []string{"10.2.96.1"})
+				mockMgr.addClusterIPService("sorry", namespace, []string{"10.2.96.9"})
+
+				cm := test.NewConfigMap("maintenance", "1", namespace, map[string]string{
+					maintenancePageBodyKey: "<h1>Back soon</h1>",
+				})
+				cm.ObjectMeta.Labels = map[string]string{"f5type": "maintenance-page"}
+				appInf, _ := mockMgr.appMgr.getNamespaceInformer(namespace)
+				appInf.pageInformer.GetStore().Add(cm)
+
+				spec := v1beta1.IngressSpec{
+					Backend: &v1beta1.IngressBackend{
+						ServiceName: "foo",
+						ServicePort: intstr.IntOrString{IntVal: 80},
+					},
+				}
+				ing := test.NewIngress("ingress", "1", namespace, spec,
+					map[string]string{
+						f5VsBindAddrAnnotation:        "1.2.3.4",
+						f5VsFallbackServiceAnnotation: "sorry",
+						f5VsMaintenancePageAnnotation: "maintenance",
+					})
+				Expect(mockMgr.addIngress(ing)).To(BeTrue())
+
+				vsName := formatIngressVSName("1.2.3.4", 80)
+				dgName := formatFallbackDgName(vsName)
+				fallbackIRule := joinBigipPath(DEFAULT_PARTITION, fallbackIRuleName)
+				fooPool := joinBigipPath(DEFAULT_PARTITION,
+					formatIngressPoolName(namespace, "foo"))
+				sorryPool := formatIngressPoolName(namespace, "sorry")
+				rs, ok := mockMgr.resources().Get(serviceKey{"sorry", 80, namespace}, vsName)
+				Expect(ok).To(BeTrue())
+				Expect(rs.Virtual.PoolName).To(Equal(fooPool))
+				Expect(rs.Virtual.IRules).To(ContainElement(fallbackIRule))
+				Expect(rs.Pools).To(HaveLen(2))
+				Expect(rs.Pools[1].Name).To(Equal(sorryPool))
+				Expect(rs.Pools[1].Fallback).To(BeTrue())
+				Expect(rs.Pools[1].Members).To(Equal([]Member{
+					{Address: "10.2.96.9", Port: 80, Session: "user-enabled"}}))
+				Expect(mockMgr.getDataGroupRecords(dgName, DEFAULT_PARTITION)).To(
+					ConsistOf(
+						InternalDataGroupRecord{
+							Name: fooPool,
+							Data: joinBigipPath(DEFAULT_PARTITION, sorryPool),
+						},
+						InternalDataGroupRecord{
+							Name: fooPool + " status",
+							Data: "503",
+						},
+						InternalDataGroupRecord{
+							Name: fooPool + " type",
+							Data: defaultMaintenancePageType,
+						},
+						InternalDataGroupRecord{
+							Name: fooPool + " page",
+							Data: "<h1>Back soon</h1>",
+						}))
+				Expect(mockMgr.hasIRule(fallbackIRuleName,
+					DEFAULT_PARTITION)).To(BeTrue())
+
+				// A change to the page queues the Ingress again
+				cm.Data[maintenancePageBodyKey] = "<h1>Back later</h1>"
+				appInf.pageInformer.GetStore().Update(cm)
+				mockMgr.appMgr.enqueueMaintenancePage(cm)
+				queueLen := mockMgr.appMgr.vsQueue.Len()
+				Expect(queueLen).To(BeNumerically(">", 0))
+				for i := 0; i < queueLen; i++ {
+					mockMgr.appMgr.processNextVirtualServer()
+				}
+				Expect(mockMgr.getDataGroupRecords(dgName, DEFAULT_PARTITION)).To(
+					ContainElement(InternalDataGroupRecord{
+						Name: fooPool + " page",
+						Data: "<h1>Back later</h1>",
+					}))
+
+				// ConfigMaps without the label are not maintenance pages
+				unlabelled := test.NewConfigMap("maintenance", "2", namespace,
+					map[string]string{maintenancePageBodyKey: "<h1>Gone</h1>"})
+				mockMgr.appMgr.enqueueMaintenancePage(unlabelled)
+				Expect(mockMgr.appMgr.vsQueue.Len()).To(BeZero())
+				appInf.pageInformer.GetStore().Update(unlabelled)
+				Expect(mockMgr.updateIngress(ing)).To(BeTrue())
+				Expect(mockMgr.getFakeEventReasons(namespace)).To(
+					ContainElement("MaintenancePageNotFound"))
+				appInf.pageInformer.GetStore().Update(cm)
+
+				// Without the annotations the fallback goes away
+				delete(ing.ObjectMeta.Annotations, f5VsFallbackServiceAnnotation)
+				delete(ing.ObjectMeta.Annotations, f5VsMaintenancePageAnnotation)
+				Expect(mockMgr.updateIngress(ing)).To(BeTrue())
+				rs, ok = mockMgr.resources().Get(serviceKey{"foo", 80, namespace}, vsName)
+				Expect(ok).To(BeTrue())
+				Expect(rs.Pools).To(HaveLen(1))
+				Expect(rs.Virtual.IRules).ToNot(ContainElement(fallbackIRule))
+				// The fallback Service no longer references the virtual
+				_, ok = mockMgr.resources().Get(serviceKey{"sorry", 80, namespace}, vsName)
+				Expect(ok).To(BeFalse())
+				Expect(mockMgr.getDataGroupRecords(dgName, DEFAULT_PARTITION)).To(
+					BeNil())
+				Expect(mockMgr.hasIRule(fallbackIRuleName,
+					DEFAULT_PARTITION)).To(BeFalse())
+
+				// Invalid settings are reported
+				ing.ObjectMeta.Annotations[f5VsMaintenanceStatusAnnotation] = "99"
+				mockMgr.updateIngress(ing)
+				Expect(mockMgr.getFakeEventReasons(namespace)).To(
+					ContainElement("InvalidFallback"))
+			})
+
+			It("attaches and creates profiles for an Ingress", func() {
+				mockMgr.appMgr.driverFeatures = newDriverFeatures(
+					[]string{driverFeatureTunedProfiles})
+				svcFoo := test.NewService("foo", "1", namespace, "NodePort",
+					[]v1.ServicePort{{Port: 80, NodePort: 37001}})
+				Expect(mockMgr.addService(svcFoo)).To(BeTrue())
+
+				spec := v1beta1.IngressSpec{
+					Backend: &v1beta1.IngressBackend{
+						ServiceName: "foo",
+						ServicePort: intstr.IntOrString{IntVal: 80},
+					},
+				}
+				ing := test.NewIngress("ingress", "1", namespace, spec,
+					map[string]string{
+						f5VsBindAddrAnnotation:          "1.2.3.4",
+						f5VsHttpProfileAnnotation:       `{"insertXForwardedFor": true}`,
+						f5VsOneConnectProfileAnnotation: "/Common/oneconnect",
+						f5VsPersistenceAnnotation:       persistCookie,
+					})
+				Expect(mockMgr.addIngress(ing)).To(BeTrue())
+
+				vsName := formatIngressVSName("1.2.3.4", 80)
+				httpRef := ProfileRef{
+					Name:      formatTunedProfileName(vsName, tunedProfileHttp),
+					Partition: DEFAULT_PARTITION,
+					Context:   customProfileAll,
+				}
+				oneConnectRef := ProfileRef{
+					Name:      "oneconnect",
+					Partition: "Common",
+					Context:   customProfileAll,
+				}
+				defaultHttpRef := ProfileRef{
+					Name:      "http",
+					Partition: "Common",
+					Context:   customProfileAll,
+				}
+				rs, ok := mockMgr.resources().Get(serviceKey{"foo", 80, namespace}, vsName)
+				Expect(ok).To(BeTrue())
+				Expect(rs.Virtual.Profiles).To(ContainElement(httpRef))
+				Expect(rs.Virtual.Profiles).To(ContainElement(oneConnectRef))
+				Expect(rs.Virtual.Profiles).ToNot(ContainElement(defaultHttpRef))
+				Expect(rs.TunedProfiles).To(HaveLen(1))
+				Expect(rs.TunedProfiles[0].Settings).To(Equal(
+					map[string]interface{}{"insertXForwardedFor": true}))
+
+				// Cookie persistence still sees an HTTP virtual server
+				Expect(mockMgr.updateIngress(ing)).To(BeTrue())
+				rs, _ = mockMgr.resources().Get(serviceKey{"foo", 80, namespace}, vsName)
+				Expect(rs.Virtual.Persist).To(HaveLen(1))
+
+				// Invalid settings are reported, and the defaults come back
+				ing.ObjectMeta.Annotations[f5VsTcpProfileAnnotation] = `{"nagle": "off"}`
+				mockMgr.updateIngress(ing)
+				Expect(mockMgr.getFakeEventReasons(namespace)).To(
+					ContainElement("InvalidProfile"))
+				rs, _ = mockMgr.resources().Get(serviceKey{"foo", 80, namespace}, vsName)
+				Expect(rs.Virtual.Profiles).To(ContainElement(defaultHttpRef))
+				Expect(rs.Virtual.Profiles).ToNot(ContainElement(httpRef))
+				Expect(rs.Virtual.Profiles).ToNot(ContainElement(oneConnectRef))
+				Expect(rs.TunedProfiles).To(BeEmpty())
+			})
+
+			It("keeps the profiles of the Ingress that attached them", func() {
+				mockMgr.appMgr.driverFeatures = newDriverFeatures(
+					[]string{driverFeatureTunedProfiles})
+				svcFoo := test.NewService("foo", "1", namespace, "NodePort",
+					[]v1.ServicePort{{Port: 80, NodePort: 37001}})
+				Expect(mockMgr.addService(svcFoo)).To(BeTrue())
+
+				spec := v1beta1.IngressSpec{
+					Backend: &v1beta1.IngressBackend{
+						ServiceName: "foo",
+						ServicePort: intstr.IntOrString{IntVal: 80},
+					},
+				}
+				ing := test.NewIngress("ingress", "1", namespace, spec,
+					map[string]string{
+						f5VsBindAddrAnnotation:    "1.2.3.4",
+						f5VsHttpProfileAnnotation: `{"insertXForwardedFor": true}`,
+					})
+				Expect(mockMgr.addIngress(ing)).To(BeTrue())
+				vsName := formatIngressVSName("1.2.3.4", 80)
+				tuned := func() []TunedProfile {
+					rs, ok := mockMgr.resources().Get(
+						serviceKey{"foo", 80, namespace}, vsName)
+					Expect(ok).To(BeTrue())
+					return rs.TunedProfiles
+				}
+				Expect(tuned()).To(HaveLen(1))
+
+				// Another Ingress on the same address neither removes nor
+				// replaces them
+				plain := test.NewIngress("plain", "1", namespace, spec,
+					map[string]string{f5VsBindAddrAnnotation: "1.2.3.4"})
+				Expect(mockMgr.addIngress(plain)).To(BeTrue())
+				Expect(tuned()).To(HaveLen(1))
+				other := test.NewIngress("other", "1", namespace, spec,
+					map[string]string{
+						f5VsBindAddrAnnotation:    "1.2.3.4",
+						f5VsHttpProfileAnnotation: `{"insertXForwardedFor": false}`,
+					})
+				Expect(mockMgr.addIngress(other)).To(BeTrue())
+				Expect(tuned()[0].Settings).To(Equal(
+					map[string]interface{}{"insertXForwardedFor": true}))
+				Expect(mockMgr.getFakeEventReasons(namespace)).To(ContainElement("ProfileConflict"))
+
+				// Once the owner is gone, the other Ingress attaches its own
+				Expect(mockMgr.deleteIngress(ing)).To(BeTrue())
+				Expect(mockMgr.updateIngress(other)).To(BeTrue())
+				Expect(tuned()[0].Settings).To(Equal(
+					map[string]interface{}{"insertXForwardedFor": false}))
+
+				// Settings need the driver feature
+				mockMgr.appMgr.driverFeatures = newDriverFeatures(nil)
+				Expect(mockMgr.updateIngress(other)).To(BeTrue())
+				Expect(tuned()).To(BeEmpty())
+				Expect(mockMgr.getFakeEventReasons(namespace)).To(ContainElement("UnsupportedDriverFeature"))
+			})
+
+			It("applies the TLS policy and HSTS of an Ingress", func() {
+				mockMgr.appMgr.driverFeatures = newDriverFeatures(
+					[]string{driverFeatureSslProfileSettings})
+				mockMgr.appMgr.useSecrets = true
+				svcFoo := test.NewService("foo", "1", namespace, "NodePort",
+					[]v1.ServicePort{{Port: 80, NodePort: 37001}})
+				Expect(mockMgr.addService(svcFoo)).To(BeTrue())
+
+				secret := &v1.Secret{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "secret1",
+						Namespace: namespace,
+					},
+					Data: map[string][]byte{
+						"tls.crt": []byte("testcert"),
+						"tls.key": []byte("testkey"),
+					},
+				}
+				_, err := mockMgr.appMgr.kubeClient.Core().Secrets(namespace).Create(secret)
+				Expect(err).To(BeNil())
+
+				spec := v1beta1.IngressSpec{
+					TLS: []v1beta1.IngressTLS{{SecretName: "secret1"}},
+					Backend: &v1beta1.IngressBackend{
+						ServiceName: "foo",
+						ServicePort: intstr.IntOrString{IntVal: 80},
+					},
+				}
+				ing := test.NewIngress("ingress", "1", namespace, spec,
+					map[string]string{
+						f5VsBindAddrAnnotation:   "1.2.3.4",
+						f5VsTlsPolicyAnnotation:  `{"minVersion": "1.2"}`,
+						f5VsHstsMaxAgeAnnotation: "600",
+					})
+				Expect(mockMgr.addIngress(ing)).To(BeTrue())
+
+				httpsVs := formatIngressVSName("1.2.3.4", 443)
+				hstsIRule := joinBigipPath(DEFAULT_PARTITION, hstsIRuleName)
+				cp, ok := mockMgr.customProfiles()[secretKey{
+					Name:         "secret1",
+					ResourceName: httpsVs,
+				}]
+				Expect(ok).To(BeTrue())
+				Expect(cp.TmOptions).To(Equal(
+					[]string{"no-sslv3", "no-tlsv1", "no-tlsv1.1"}))
+				Expect(mockMgr.getDataGroupRecords(formatHstsDgName(httpsVs),
+					DEFAULT_PARTITION)).To(Equal([]InternalDataGroupRecord{{
+					Name: "* /",
+					Data: "max-age=600",
+				}}))
+				rs, ok := mockMgr.resources().Get(serviceKey{"foo", 80, namespace}, httpsVs)
+				Expect(ok).To(BeTrue())
+				Expect(rs.Virtual.IRules).To(ContainElement(hstsIRule))
+				// Only the HTTPS virtual sends the header
+				Expect(mockMgr.getDataGroupRecords(formatHstsDgName(
+					formatIngressVSName("1.2.3.4", 80)), DEFAULT_PARTITION)).To(BeNil())
+
+				// Without the annotations the header and policy go away
+				delete(ing.ObjectMeta.Annotations, f5VsTlsPolicyAnnotation)
+				delete(ing.ObjectMeta.Annotations, f5VsHstsMaxAgeAnnotation)
+				Expect(mockMgr.updateIngress(ing)).To(BeTrue())
+				cp = mockMgr.customProfiles()[secretKey{
+					Name:         "secret1",
+					ResourceName: httpsVs,
+				}]
+				Expect(cp.TmOptions).To(BeEmpty())
+				Expect(mockMgr.getDataGroupRecords(formatHstsDgName(httpsVs),
+					DEFAULT_PARTITION)).To(BeNil())
+				rs, _ = mockMgr.resources().Get(serviceKey{"foo", 80, namespace}, httpsVs)
+				Expect(rs.Virtual.IRules).ToNot(ContainElement(hstsIRule))
+
+				// The policy needs the driver feature
+				mockMgr.appMgr.driverFeatures = newDriverFeatures(nil)
+				ing.ObjectMeta.Annotations[f5VsTlsPolicyAnnotation] = `{"minVersion": "1.2"}`
+				Expect(mockMgr.updateIngress(ing)).To(BeTrue())
+				cp = mockMgr.customProfiles()[secretKey{
+					Name:         "secret1",
+					ResourceName: httpsVs,
+				}]
+				Expect(cp.TmOptions).To(BeEmpty())
+				Expect(mockMgr.getFakeEventReasons(namespace)).To(
+					ContainElement("UnsupportedDriverFeature"))
+			})
+
+			It("attaches and detaches security policies for an Ingress", func() {
+				mockMgr.appMgr.driverFeatures = newDriverFeatures(
+					[]string{driverFeatureSecurityPolicies})
+				svcFoo := test.NewService("foo", "1", namespace, "NodePort",
+					[]v1.ServicePort{{Port: 80, NodePort: 37001}})
+				Expect(mockMgr.addService(svcFoo)).To(BeTrue())
+
+				spec := v1beta1.IngressSpec{
+					Backend: &v1beta1.IngressBackend{
+						ServiceName: "foo",
+						ServicePort: intstr.IntOrString{IntVal: 80},
+					},
+				}
+				ing := test.NewIngress("ingress", "1", namespace, spec,
+					map[string]string{
+						f5VsBindAddrAnnotation:            "1.2.3.4",
+						f5VsWafPolicyAnnotation:           "Common/waf",
+						f5VsBotDefenseProfileAnnotation:   "/Common/bot",
+						f5VsSecurityLogProfilesAnnotation: "/Common/log",
+					})
+				Expect(mockMgr.addIngress(ing)).To(BeTrue())
+
+				vsName := formatIngressVSName("1.2.3.4", 80)
+				rs, ok := mockMgr.resources().Get(serviceKey{"foo", 80, namespace}, vsName)
+				Expect(ok).To(BeTrue())
+				Expect(rs.Virtual.WafPolicy).To(Equal("/Common/waf"))
+				Expect(rs.Virtual.BotDefenseProfile).To(Equal("/Common/bot"))
+				Expect(rs.Virtual.SecurityLogProfiles).To(Equal([]string{"/Common/log"}))
+
+				// Another Ingress on the same address cannot replace them
+				other := test.NewIngress("other", "1", namespace, spec,
+					map[string]string{
+						f5VsBindAddrAnnotation:  "1.2.3.4",
+						f5VsWafPolicyAnnotation: "/Common/other",
+					})
+				mockMgr.addIngress(other)
+				Expect(mockMgr.getFakeEventReasons(namespace)).To(ContainElement("SecurityPolicyConflict"))
+				rs, _ = mockMgr.resources().Get(serviceKey{"foo", 80, namespace}, vsName)
+				Expect(rs.Virtual.WafPolicy).To(Equal("/Common/waf"))
+				mockMgr.deleteIngress(other)
+
+				// Invalid paths are reported and attach nothing
+				ing.ObjectMeta.Annotations[f5VsDosProfileAnnotation] = "dos"
+				mockMgr.updateIngress(ing)
+				Expect(mockMgr.getFakeEventReasons(namespace)).To(ContainElement("InvalidSecurityPolicy"))
+				rs, _ = mockMgr.resources().Get(serviceKey{"foo", 80, namespace}, vsName)
+				Expect(rs.Virtual.WafPolicy).To(BeEmpty())
+				Expect(rs.Virtual.SecurityLogProfiles).To(BeEmpty())
+
+				ing.ObjectMeta.Annotations[f5VsDosProfileAnnotation] = "/Common/dos"
+				Expect(mockMgr.updateIngress(ing)).To(BeTrue())
+				rs, _ = mockMgr.resources().Get(serviceKey{"foo", 80, namespace}, vsName)
+				Expect(rs.Virtual.DosProfile).To(Equal("/Common/dos"))
+
+				// Security policies need the driver feature
+				mockMgr.appMgr.driverFeatures = newDriverFeatures(nil)
+				Expect(mockMgr.updateIngress(ing)).To(BeTrue())
+				Expect(mockMgr.getFakeEventReasons(namespace)).To(ContainElement("UnsupportedDriverFeature"))
+				rs, _ = mockMgr.resources().Get(serviceKey{"foo", 80, namespace}, vsName)
+				Expect(virtualSecurityPolicies(&rs.Virtual)).To(Equal(securityPolicies{}))
+				mockMgr.appMgr.driverFeatures = newDriverFeatures(
+					[]string{driverFeatureSecurityPolicies})
+				Expect(mockMgr.updateIngress(ing)).To(BeTrue())
+
+				// Without the annotations they are detached
+				ing.ObjectMeta.Annotations = map[string]string{
+					f5VsBindAddrAnnotation: "1.2.3.4",
+				}
+				Expect(mockMgr.updateIngress(ing)).To(BeTrue())
+				rs, _ = mockMgr.resources().Get(serviceKey{"foo", 80, namespace}, vsName)
+				Expect(virtualSecurityPolicies(&rs.Virtual)).To(Equal(securityPolicies{}))
+				Expect(rs.MetaData.SecurityOwner).To(BeEmpty())
+			})
+
+			It("attaches and detaches access policies for an Ingress", func() {
+				mockMgr.appMgr.driverFeatures = newDriverFeatures(
+					[]string{driverFeatureAccessPolicies})
+				svcFoo := test.NewService("foo", "1", namespace, "NodePort",
+					[]v1.ServicePort{{Port: 80, NodePort: 37001}})
+				Expect(mockMgr.addService(svcFoo)).To(BeTrue())
+
+				spec := v1beta1.IngressSpec{
+					Backend: &v1beta1.IngressBackend{
+						ServiceName: "foo",
+						ServicePort: intstr.IntOrString{IntVal: 80},
+					},
+				}
+				ing := test.NewIngress("ingress", "1", namespace, spec,
+					map[string]string{
+						f5VsBindAddrAnnotation:         "1.2.3.4",
+						f5VsAccessProfileAnnotation:    "/Common/sso",
+						f5VsPerRequestPolicyAnnotation: "/Common/prp",
+					})
+				Expect(mockMgr.addIngress(ing)).To(BeTrue())
+
+				vsName := formatIngressVSName("1.2.3.4", 80)
+				rs, ok := mockMgr.resources().Get(serviceKey{"foo", 80, namespace}, vsName)
+				Expect(ok).To(BeTrue())
+				Expect(virtualAccessPolicies(&rs.Virtual)).To(Equal(accessPolicies{
+					AccessProfile:    "/Common/sso",
+					PerRequestPolicy: "/Common/prp",
+				}))
+
+				// Another Ingress on the same address cannot replace them
+				other := test.NewIngress("other", "1", namespace, spec,
+					map[string]string{
+						f5VsBindAddrAnnotation:      "1.2.3.4",
+						f5VsAccessProfileAnnotation: "/Common/other",
+					})
+				mockMgr.addIngress(other)
+				Expect(mockMgr.getFakeEventReasons(namespace)).To(ContainElement("AccessPolicyConflict"))
+				rs, _ = mockMgr.resources().Get(serviceKey{"foo", 80, namespace}, vsName)
+				Expect(rs.Virtual.AccessProfile).To(Equal("/Common/sso"))
+				mockMgr.deleteIngress(other)
+
+				// A per-request policy without an access profile is refused
+				delete(ing.ObjectMeta.Annotations, f5VsAccessProfileAnnotation)
+				mockMgr.updateIngress(ing)
+				Expect(mockMgr.getFakeEventReasons(namespace)).To(ContainElement("InvalidAccessPolicy"))
+				rs, _ = mockMgr.resources().Get(serviceKey{"foo", 80, namespace}, vsName)
+				Expect(virtualAccessPolicies(&rs.Virtual)).To(Equal(accessPolicies{}))
+
+				ing.ObjectMeta.Annotations[f5VsAccessProfileAnnotation] = "/Common/sso"
+				Expect(mockMgr.updateIngress(ing)).To(BeTrue())
+				rs, _ = mockMgr.resources().Get(serviceKey{"foo", 80, namespace}, vsName)
+				Expect(rs.Virtual.AccessProfile).To(Equal("/Common/sso"))
+
+				// Access policies need the driver feature
+				mockMgr.appMgr.driverFeatures = newDriverFeatures(nil)
+				Expect(mockMgr.updateIngress(ing)).To(BeTrue())
+				Expect(mockMgr.getFakeEventReasons(namespace)).To(ContainElement("UnsupportedDriverFeature"))
+				rs, _ = mockMgr.resources().Get(serviceKey{"foo", 80, namespace}, vsName)
+				Expect(virtualAccessPolicies(&rs.Virtual)).To(Equal(accessPolicies{}))
+				mockMgr.appMgr.driverFeatures = newDriverFeatures(
+					[]string{driverFeatureAccessPolicies})
+				Expect(mockMgr.updateIngress(ing)).To(BeTrue())
+
+				// Deleting the Ingress detaches them from the virtual it shares
+				Expect(mockMgr.addIngress(other)).To(BeTrue())
+				mockMgr.deleteIngress(ing)
+				rs, ok = mockMgr.resources().Get(serviceKey{"foo", 80, namespace}, vsName)
+				Expect(ok).To(BeTrue())
+				Expect(rs.Virtual.AccessProfile).To(Equal("/Common/other"))
+				Expect(rs.MetaData.AccessOwner).To(Equal(namespace + "/other"))
+			})
+
+			It("enforces firewall rules for an Ingress", func() {
+				mockMgr.appMgr.driverFeatures = newDriverFeatures(
+					[]string{driverFeatureFirewallPolicies})
+				svcFoo := test.NewService("foo", "1", namespace, "NodePort",
+					[]v1.ServicePort{{Port: 80, NodePort: 37001}})
+				Expect(mockMgr.addService(svcFoo)).To(BeTrue())
+
+				spec := v1beta1.IngressSpec{
+					Backend: &v1beta1.IngressBackend{
+						ServiceName: "foo",
+						ServicePort: intstr.IntOrString{IntVal: 80},
+					},
+				}
+				ing := test.NewIngress("ingress", "1", namespace, spec,
+					map[string]string{
+						f5VsBindAddrAnnotation: "1.2.3.4",
+						f5VsFirewallRulesAnnotation: `[
+							{"action": "accept", "sources": ["10.0.0.0/8"]},
+							{"action": "drop"}]`,
+					})
+				Expect(mockMgr.addIngress(ing)).To(BeTrue())
+
+				vsName := formatIngressVSName("1.2.3.4", 80)
+				rs, ok := mockMgr.resources().Get(serviceKey{"foo", 80, namespace}, vsName)
+				Expect(ok).To(BeTrue())
+				Expect(rs.Virtual.FirewallPolicy).To(Equal(
+					"/velcro/" + formatFirewallPolicyName(vsName)))
+				Expect(rs.FirewallPolicy).ToNot(BeNil())
+				Expect(rs.FirewallPolicy.Rules).To(HaveLen(2))
+
+				// The policy is written with the other resources
+				mockMgr.appMgr.outputConfig()
+				resources := mw.Sections["resources"].(PartitionMap)
+				Expect(resources["velcro"].FirewallPolicies).To(HaveLen(1))
+				Expect(resources["velcro"].FirewallPolicies[0].Name).To(Equal(
+					formatFirewallPolicyName(vsName)))
+
+				// Another Ingress on the same address cannot replace them
+				other := test.NewIngress("other", "1", namespace, spec,
+					map[string]string{
+						f5VsBindAddrAnnotation:      "1.2.3.4",
+						f5VsFirewallRulesAnnotation: `[{"action": "reject"}]`,
+					})
+				mockMgr.addIngress(other)
+				Expect(mockMgr.getFakeEventReasons(namespace)).To(ContainElement("FirewallRuleConflict"))
+				rs, _ = mockMgr.resources().Get(serviceKey{"foo", 80, namespace}, vsName)
+				Expect(rs.FirewallPolicy.Rules).To(HaveLen(2))
+				mockMgr.deleteIngress(other)
+
+				// Invalid rules are reported and enforce nothing
+				ing.ObjectMeta.Annotations[f5VsFirewallRulesAnnotation] =
+					`[{"action": "allow"}]`
+				mockMgr.updateIngress(ing)
+				Expect(mockMgr.getFakeEventReasons(namespace)).To(ContainElement("InvalidFirewallRule"))
+				rs, _ = mockMgr.resources().Get(serviceKey{"foo", 80, namespace}, vsName)
+				Expect(rs.FirewallPolicy).To(BeNil())
+				Expect(rs.Virtual.FirewallPolicy).To(BeEmpty())
+
+				// Firewall policies need the driver feature
+				ing.ObjectMeta.Annotations[f5VsFirewallRulesAnnotation] =
+					`[{"action": "drop"}]`
+				mockMgr.appMgr.driverFeatures = newDriverFeatures(nil)
+				Expect(mockMgr.updateIngress(ing)).To(BeTrue())
+				Expect(mockMgr.getFakeEventReasons(namespace)).To(ContainElement("UnsupportedDriverFeature"))
+				rs, _ = mockMgr.resources().Get(serviceKey{"foo", 80, namespace}, vsName)
+				Expect(rs.FirewallPolicy).To(BeNil())
+				Expect(rs.Virtual.FirewallPolicy).To(BeEmpty())
+			})
+
+			Context("canary Ingresses", func() {
+				BeforeEach(func() {
+					mockMgr.appMgr.isNodePort = false
+					mockMgr.appMgr.driverFeatures = newDriverFeatures(
+						[]string{driverFeaturePoolMemberRatio})
+					mockMgr.addClusterIPService("foo", namespace,
+						[]string{"10.2.96.1", "10.2.96.2"})
+					mockMgr.addClusterIPService("bar", namespace, []string{"10.2.96.3"})
+				})
+
+				ingressSpec := func(host, svc string) v1beta1.IngressSpec {
+					return v1beta1.IngressSpec{
+						Rules: []v1beta1.IngressRule{
+							{Host: host,
+								IngressRuleValue: v1beta1.IngressRuleValue{
+									HTTP: &v1beta1.HTTPIngressRuleValue{
+										Paths: []v1beta1.HTTPIngressPath{
+											{Path: "/app",
+												Backend: v1beta1.IngressBackend{
+													ServiceName: svc,
+													ServicePort: intstr.IntOrString{IntVal: 80},
+												}},
+										},
+									},
+								},
+							},
+						},
+					}
+				}
+
+				It("merges a canary Ingress into the rules of its primary", func() {
+					primary := test.NewIngress("ingress", "1", namespace,
+						ingressSpec("foo.com", "foo"),
+						map[string]string{f5VsBindAddrAnnotation: "1.2.3.4"})
+					Expect(mockMgr.addIngress(primary)).To(BeTrue())
+					// The canary takes the virtual server of its primary
+					cnry := test.NewIngress("canary", "1", namespace,
+						ingressSpec("foo.com", "bar"),
+						map[string]string{
+							f5VsCanaryAnnotation:         "true",
+							f5VsCanaryByHeaderAnnotation: "X-Canary",
+							f5VsCanaryByCookieAnnotation: "canary",
+							f5VsCanaryWeightAnnotation:   "20",
+						})
+					Expect(mockMgr.addIngress(cnry)).To(BeTrue())
+
+					vsName := formatIngressVSName("1.2.3.4", 80)
+					fooPool := formatIngressPoolName(namespace, "foo")
+					barPool := formatIngressPoolName(namespace, "bar")
+					weightedPool := formatCanaryPoolName(fooPool, "canary")
+					canaryRuleName := formatIngressRuleName("foo.com", "/app", barPool)
+					primaryRuleName := formatIngressRuleName("foo.com", "/app", fooPool)
+					getRules := func() Rules {
+						rs, ok := mockMgr.resources().Get(
+							serviceKey{"foo", 80, namespace}, vsName)
+						Expect(ok).To(BeTrue())
+						Expect(rs.Policies).To(HaveLen(1))
+						return rs.Policies[0].Rules
+					}
+
+					ruleNames := func(rules Rules) []string {
+						var names []string
+						for _, rl := range rules {
+							names = append(names, rl.Name)
+						}
+						return names
+					}
+
+					// The rules for the paths below /app come first
+					rules := getRules()
+					Expect(ruleNames(rules)).To(Equal([]string{
+						canaryRuleName + subPathRuleSuffix + canaryCookieRuleSuffix,
+						canaryRuleName + subPathRuleSuffix + canaryHeaderRuleSuffix,
+						primaryRuleName + subPathRuleSuffix,
+						canaryRuleName + canaryCookieRuleSuffix,
+						canaryRuleName + canaryHeaderRuleSuffix,
+						primaryRuleName,
+					}))
+					header := rules[4].Conditions[len(rules[4].Conditions)-1]
+					Expect(header.HTTPHeader).To(BeTrue())
+					Expect(header.TmName).To(Equal("X-Canary"))
+					Expect(header.Values).To(Equal([]string{canaryAlways}))
+					Expect(rules[4].Actions[0].Pool).To(Equal(
+						joinBigipPath(DEFAULT_PARTITION, barPool)))
+					cookie := rules[3].Conditions[len(rules[3].Conditions)-1]
+					Expect(cookie.HTTPCookie).To(BeTrue())
+					Expect(cookie.TmName).To(Equal("canary"))
+					for _, i := range []int{2, 5} {
+						Expect(rules[i].Actions[0].Pool).To(Equal(
+							joinBigipPath(DEFAULT_PARTITION, weightedPool)))
+					}
+
+					rs, _ := mockMgr.resources().Get(serviceKey{"foo", 80, namespace}, vsName)
+					Expect(findPool(rs, weightedPool).Members).To(ConsistOf(
+						generateExpectedRatioMember("10.2.96.1", 2),
+						generateExpectedRatioMember("10.2.96.2", 2),
+						generateExpectedRatioMember("10.2.96.3", 1)))
+
+					// Without a weight or header the primary gets its pool back
+					delete(cnry.ObjectMeta.Annotations, f5VsCanaryWeightAnnotation)
+					delete(cnry.ObjectMeta.Annotations, f5VsCanaryByHeaderAnnotation)
+					Expect(mockMgr.updateIngress(cnry)).To(BeTrue())
+					rules = getRules()
+					Expect(ruleNames(rules)).To(Equal([]string{
+						canaryRuleName + subPathRuleSuffix + canaryCookieRuleSuffix,
+						primaryRuleName + subPathRuleSuffix,
+						canaryRuleName + canaryCookieRuleSuffix,
+						primaryRuleName,
+					}))
+					Expect(rules[3].Actions[0].Pool).To(Equal(
+						joinBigipPath(DEFAULT_PARTITION, fooPool)))
+					rs, _ = mockMgr.resources().Get(serviceKey{"foo", 80, namespace}, vsName)
+					Expect(findPool(rs, weightedPool)).To(BeNil())
+
+					// Deleting the canary leaves the primary alone
+					Expect(mockMgr.deleteIngress(cnry)).To(BeTrue())
+					Expect(ruleNames(getRules())).To(Equal([]string{
+						primaryRuleName + subPathRuleSuffix,
+						primaryRuleName,
+					}))
+				})
+
+				It("reports canaries it cannot configure", func() {
+					cnry := test.NewIngress("canary", "1", namespace,
+						ingressSpec("foo.com", "bar"),
+						map[string]string{
+							f5VsCanaryAnnotation:         "true",
+							f5VsCanaryByHeaderAnnotation: "X-Canary",
+						})
+					Expect(mockMgr.addIngress(cnry)).To(BeTrue())
+					Expect(mockMgr.getFakeEventReasons(namespace)).To(ContainElement("CanaryPrimaryNotFound"))
+					Expect(mockMgr.resources().PoolCount()).To(Equal(0))
+
+					primary := test.NewIngress("ingress", "1", namespace,
+						ingressSpec("foo.com", "foo"),
+						map[string]string{f5VsBindAddrAnnotation: "1.2.3.4"})
+					Expect(mockMgr.addIngress(primary)).To(BeTrue())
+					cnry.ObjectMeta.Annotations[f5VsCanaryWeightAnnotation] = "ten"
+					mockMgr.updateIngress(cnry)
+					Expect(mockMgr.getFakeEventReasons(namespace)).To(ContainElement("InvalidCanary"))
+
+					// A weight needs pool member ratios; the header still applies
+					cnry.ObjectMeta.Annotations[f5VsCanaryWeightAnnotation] = "10"
+					mockMgr.appMgr.driverFeatures = newDriverFeatures(nil)
+					Expect(mockMgr.updateIngress(cnry)).To(BeTrue())
+					Expect(mockMgr.getFakeEventReasons(namespace)).To(ContainElement("UnsupportedDriverFeature"))
+					rs, ok := mockMgr.resources().Get(serviceKey{"foo", 80, namespace},
+						formatIngressVSName("1.2.3.4", 80))
+					Expect(ok).To(BeTrue())
+					for _, rl := range rs.Policies[0].Rules {
+						Expect(rl.Actions[0].Pool).ToNot(Equal(joinBigipPath(DEFAULT_PARTITION,
+							formatCanaryPoolName(formatIngressPoolName(namespace, "foo"),
+								"canary"))))
+					}
+					Expect(len(rs.Policies[0].Rules)).To(Equal(4))
+				})
+			})
+
+			Context("client certificates", func() {
+				var caKey secretKey
+				BeforeEach(func() {
+					caKey = secretKey{Name: formatClientCAName(namespace, "client-ca")}
+					mockMgr.appMgr.driverFeatures = newDriverFeatures(
+						[]string{driverFeatureClientCrl})
+					mockMgr.appMgr.useSecrets = true
+					svcFoo := test.NewService("foo", "1", namespace, "NodePort",
+						[]v1.ServicePort{{Port: 80, NodePort: 37001}})
+					Expect(mockMgr.addService(svcFoo)).To(BeTrue())
+					for name, data := range map[string]map[string][]byte{
+						"testcert":  {"tls.crt": []byte("testcert"), "tls.key": []byte("testkey")},
+						"client-ca": {clientCAKey: []byte("ca bundle"), clientCrlKey: []byte("crl")},
+						"empty-ca":  {"tls.crt": []byte("testcert")},
+					} {
+						secret := &v1.Secret{
+							ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+							Data:       data,
+						}
+						_, err := mockMgr.appMgr.kubeClient.Core().Secrets(namespace).Create(secret)
+						Expect(err).To(BeNil())
+					}
+				})
+
+				It("requires client certificates for an Ingress", func() {
+					spec := v1beta1.IngressSpec{
+						TLS: []v1beta1.IngressTLS{{SecretName: "testcert"}},
+						Backend: &v1beta1.IngressBackend{
+							ServiceName: "foo",
+							ServicePort: intstr.IntOrString{IntVal: 80},
+						},
+					}
+					ing := test.NewIngress("ingress", "1", namespace, spec,
+						map[string]string{
+							f5VsBindAddrAnnotation:         "1.2.3.4",
+							f5VsClientCASecretAnnotation:   "client-ca",
+							f5VsClientCertHeaderAnnotation: "X-Client-Subject",
+						})
+					Expect(mockMgr.addIngress(ing)).To(BeTrue())
+
+					httpsVs := formatIngressVSName("1.2.3.4", 443)
+					certIRule := joinBigipPath(DEFAULT_PARTITION, clientCertIRuleName)
+					profKey := secretKey{Name: "testcert", ResourceName: httpsVs}
+					cp := mockMgr.customProfiles()[profKey]
+					Expect(cp.PeerCertMode).To(Equal(peerCertRequired))
+					Expect(cp.CAFile).To(Equal(makeCertificateFileName(caKey.Name)))
+					Expect(cp.CrlFile).To(Equal(makeCrlFileName(caKey.Name)))
+					ca, ok := mockMgr.customProfiles()[caKey]
+					Expect(ok).To(BeTrue())
+					Expect(ca.Cert).To(Equal("ca bundle"))
+					Expect(ca.Crl).To(Equal("crl"))
+					Expect(ca.CAFile).To(Equal("self"))
+
+					Expect(mockMgr.getDataGroupRecords(formatClientCertDgName(httpsVs),
+						DEFAULT_PARTITION)).To(Equal([]InternalDataGroupRecord{{
+						Name: "* /",
+						Data: "X-Client-Subject",
+					}}))
+					rs, ok := mockMgr.resources().Get(serviceKey{"foo", 80, namespace}, httpsVs)
+					Expect(ok).To(BeTrue())
+					Expect(rs.Virtual.IRules).To(ContainElement(certIRule))
+					// The HTTP virtual removes the header clients send
+					httpVs := formatIngressVSName("1.2.3.4", 80)
+					Expect(mockMgr.getDataGroupRecords(formatClientCertDgName(httpVs),
+						DEFAULT_PARTITION)).To(Equal(mockMgr.getDataGroupRecords(
+						formatClientCertDgName(httpsVs), DEFAULT_PARTITION)))
+					rs, ok = mockMgr.resources().Get(serviceKey{"foo", 80, namespace}, httpVs)
+					Expect(ok).To(BeTrue())
+					Expect(rs.Virtual.IRules).To(ContainElement(certIRule))
+					Expect(clientCertIRule()).To(ContainSubstring(
+						"[PROFILE::exists clientssl] && [SSL::cert count] > 0"))
+
+					// The revocation list needs the driver feature
+					mockMgr.appMgr.driverFeatures = newDriverFeatures(nil)
+					Expect(mockMgr.updateIngress(ing)).To(BeTrue())
+					cp = mockMgr.customProfiles()[profKey]
+					Expect(cp.CAFile).To(Equal(makeCertificateFileName(caKey.Name)))
+					Expect(cp.CrlFile).To(BeEmpty())
+					Expect(mockMgr.customProfiles()[caKey].Crl).To(BeEmpty())
+					Expect(mockMgr.getFakeEventReasons(namespace)).To(
+						ContainElement("UnsupportedDriverFeature"))
+
+					// Request mode keeps the CA
+					ing.ObjectMeta.Annotations[f5VsClientCertModeAnnotation] = peerCertRequested
+					Expect(mockMgr.updateIngress(ing)).To(BeTrue())
+					cp = mockMgr.customProfiles()[profKey]
+					Expect(cp.PeerCertMode).To(Equal(peerCertRequested))
+					Expect(cp.CAFile).To(Equal(makeCertificateFileName(caKey.Name)))
+
+					// Without the annotations the profile stops asking for certificates,
+					// and the CA and header go away
+					ing.ObjectMeta.Annotations = map[string]string{
+						f5VsBindAddrAnnotation: "1.2.3.4",
+					}
+					Expect(mockMgr.updateIngress(ing)).To(BeTrue())
+					cp = mockMgr.customProfiles()[profKey]
+					Expect(cp.PeerCertMode).To(BeEmpty())
+					Expect(cp.CAFile).To(BeEmpty())
+					_, ok = mockMgr.customProfiles()[caKey]
+					Expect(ok).To(BeFalse())
+					Expect(mockMgr.getDataGroupRecords(formatClientCertDgName(httpsVs),
+						DEFAULT_PARTITION)).To(BeNil())
+					rs, _ = mockMgr.resources().Get(serviceKey{"foo", 80, namespace}, httpsVs)
+					Expect(rs.Virtual.IRules).ToNot(ContainElement(certIRule))
+				})
+
+				It("reports invalid client certificate settings", func() {
+					spec := v1beta1.IngressSpec{
+						TLS: []v1beta1.IngressTLS{{SecretName: "testcert"}},
+						Backend: &v1beta1.IngressBackend{
+							ServiceName: "foo",
+							ServicePort: intstr.IntOrString{IntVal: 80},
+						},
+					}
+					for _, annotations := range []map[string]string{
+						{f5VsClientCertModeAnnotation: peerCertRequired},
+						{f5VsClientCASecretAnnotation: "client-ca",
+							f5VsClientCertModeAnnotation: "always"},
+						{f5VsClientCASecretAnnotation: "missing"},
+						{f5VsClientCASecretAnnotation: "empty-ca"},
+						{f5VsClientCertHeaderAnnotation: "X Client"},
+					} {
+						annotations[f5VsBindAddrAnnotation] = "1.2.3.4"
+						ing := test.NewIngress("ingress", "1", namespace, spec, annotations)
+						mockMgr.addIngress(ing)
+						Expect(mockMgr.getFakeEventReasons(namespace)).To(
+							ContainElement("InvalidClientAuth"), "%v", annotations)
+						cp := mockMgr.customProfiles()[secretKey{
+							Name:         "testcert",
+							ResourceName: formatIngressVSName("1.2.3.4", 443),
+						}]
+						Expect(cp.PeerCertMode).To(BeEmpty(), "%v", annotations)
+						mockMgr.deleteIngress(ing)
+					}
+				})
+
+				It("requires client certificates for a ConfigMap", func() {
+					cfgFoo := test.NewConfigMap("foomap", "1", namespace, map[string]string{
+						"schema": schemaUrl,
+						"data":   configmapFoo})
+					cfgFoo.ObjectMeta.Annotations[f5VsClientCASecretAnnotation] = "client-ca"
+					cfgFoo.ObjectMeta.Annotations[f5VsClientCertHeaderAnnotation] = "X-Client"
+					Expect(mockMgr.addConfigMap(cfgFoo)).To(BeTrue())
+
+					vsName := formatConfigMapVSName(cfgFoo)
+					cp, ok := mockMgr.customProfiles()[secretKey{
+						Name:         "testcert",
+						ResourceName: vsName,
+					}]
+					Expect(ok).To(BeTrue())
+					Expect(cp.PeerCertMode).To(Equal(peerCertRequired))
+					Expect(cp.CAFile).To(Equal(makeCertificateFileName(caKey.Name)))
+					Expect(mockMgr.getDataGroupRecords(formatClientCertDgName(vsName),
+						DEFAULT_PARTITION)).To(Equal([]InternalDataGroupRecord{{
+						Name: "* /",
+						Data: "X-Client",
+					}}))
+					rs, ok := mockMgr.resources().Get(serviceKey{"foo", 80, namespace}, vsName)
+					Expect(ok).To(BeTrue())
+					Expect(rs.Virtual.IRules).To(ContainElement(joinBigipPath(
+						DEFAULT_PARTITION, clientCertIRuleName)))
+				})
+			})
+
+			Context("backend TLS", func() {
+				BeforeEach(func() {
+					for _, name := range []string{"foo", "bar"} {
+						svc := test.NewService(name, "1", namespace, "NodePort",
+							[]v1.ServicePort{{Port: 443, NodePort: 37001}})
+						Expect(mockMgr.addService(svc)).To(BeTrue())
+					}
+					secret := &v1.Secret{
+						ObjectMeta: metav1.ObjectMeta{Name: "backend-ca", Namespace: namespace},
+						Data:       map[string][]byte{clientCAKey: []byte("ca bundle")},
+					}
+					_, err := mockMgr.appMgr.kubeClient.Core().Secrets(namespace).Create(secret)
+					Expect(err).To(BeNil())
+				})
+
+				backendPath := func(path, svc string) v1beta1.HTTPIngressPath {
+					return v1beta1.HTTPIngressPath{
+						Path: path,
+						Backend: v1beta1.IngressBackend{
+							ServiceName: svc,
+							ServicePort: intstr.IntOrString{IntVal: 443},
+						},
+					}
+				}
+				spec := v1beta1.IngressSpec{
+					Rules: []v1beta1.IngressRule{
+						{Host: "foo.com",
+							IngressRuleValue: v1beta1.IngressRuleValue{
+								HTTP: &v1beta1.HTTPIngressRuleValue{
+									Paths: []v1beta1.HTTPIngressPath{
+										backendPath("/foo", "foo"),
+										backendPath("/bar", "bar"),
+									},
+								},
+							},
+						},
+					},
+				}
+				vsName := formatIngressVSName("1.2.3.4", 80)
+				dgName := formatBackendTlsDgName(vsName)
+
+				It("creates and attaches server SSL profiles for an Ingress", func() {
+					ing := test.NewIngress("ingress", "1", namespace, spec,
+						map[string]string{
+							f5VsBindAddrAnnotation:          "1.2.3.4",
+							f5VsBackendTlsAnnotation:        "true",
+							f5VsBackendCASecretAnnotation:   "backend-ca",
+							f5VsBackendServerNameAnnotation: "backend.foo.com",
+						})
+					Expect(mockMgr.addIngress(ing)).To(BeTrue())
+
+					profRef := makeIngressServerSSLProfileRef(
+						DEFAULT_PARTITION, namespace, "ingress")
+					sniRef := ProfileRef{
+						Name:      formatServerSslDefaultName(vsName),
+						Partition: DEFAULT_PARTITION,
+						Context:   customProfileServer,
+					}
+					rs, ok := mockMgr.resources().Get(serviceKey{"foo", 443, namespace}, vsName)
+					Expect(ok).To(BeTrue())
+					Expect(rs.Virtual.Profiles).To(ContainElement(profRef))
+					Expect(rs.Virtual.Profiles).To(ContainElement(sniRef))
+					Expect(rs.Virtual.IRules).To(ContainElement(joinBigipPath(
+						DEFAULT_PARTITION, backendTlsIRuleName)))
+
+					cp, ok := mockMgr.customProfiles()[secretKey{
+						Name:         profRef.Name,
+						ResourceName: vsName,
+					}]
+					Expect(ok).To(BeTrue())
+					Expect(cp.Context).To(Equal(customProfileServer))
+					Expect(cp.ServerName).To(Equal("backend.foo.com"))
+					Expect(cp.PeerCertMode).To(Equal(peerCertRequired))
+					Expect(cp.CAFile).To(Equal(makeCertificateFileName(profRef.Name + "-ca")))
+					ca, ok := mockMgr.customProfiles()[secretKey{Name: profRef.Name + "-ca"}]
+					Expect(ok).To(BeTrue())
+					Expect(ca.Cert).To(Equal("ca bundle"))
+
+					profile := joinBigipPath(DEFAULT_PARTITION, profRef.Name)
+					Expect(mockMgr.getDataGroupRecords(dgName, DEFAULT_PARTITION)).To(ConsistOf(
+						InternalDataGroupRecord{
+							Name: "/velcro/" + formatIngressPoolName(namespace, "bar"),
+							Data: profile,
+						},
+						InternalDataGroupRecord{
+							Name: "/velcro/" + formatIngressPoolName(namespace, "foo"),
+							Data: profile,
+						},
+					))
+
+					// Without the annotation the profiles, CA and iRule go away
+					ing.ObjectMeta.Annotations = map[string]string{
+						f5VsBindAddrAnnotation: "1.2.3.4",
+					}
+					Expect(mockMgr.updateIngress(ing)).To(BeTrue())
+					rs, _ = mockMgr.resources().Get(serviceKey{"foo", 443, namespace}, vsName)
+					Expect(rs.Virtual.Profiles).ToNot(ContainElement(profRef))
+					Expect(rs.Virtual.Profiles).ToNot(ContainElement(sniRef))
+					Expect(rs.Virtual.IRules).ToNot(ContainElement(joinBigipPath(
+						DEFAULT_PARTITION, backendTlsIRuleName)))
+					Expect(mockMgr.getDataGroupRecords(dgName, DEFAULT_PARTITION)).To(BeNil())
+					Expect(mockMgr.customProfiles()).To(BeEmpty())
+				})
+
+				It("disables server SSL only for plain pools it knows", func() {
+					ing := test.NewIngress("ingress", "1", namespace, spec,
+						map[string]string{
+							f5VsBindAddrAnnotation:   "1.2.3.4",
+							f5VsBackendTlsAnnotation: "true",
+						})
+					Expect(mockMgr.addIngress(ing)).To(BeTrue())
+					for _, name := range []string{"plain", "serverssl"} {
+						svc := test.NewService(name, "1", namespace, "NodePort",
+							[]v1.ServicePort{{Port: 443, NodePort: 37002}})
+						Expect(mockMgr.addService(svc)).To(BeTrue())
+					}
+					single := func(svc string) v1beta1.IngressSpec {
+						return v1beta1.IngressSpec{
+							Rules: []v1beta1.IngressRule{
+								{Host: svc + ".com",
+									IngressRuleValue: v1beta1.IngressRuleValue{
+										HTTP: &v1beta1.HTTPIngressRuleValue{
+											Paths: []v1beta1.HTTPIngressPath{
+												backendPath("/", svc),
+											},
+										},
+									},
+								},
+							},
+						}
+					}
+					plain := test.NewIngress("plain", "1", namespace, single("plain"),
+						map[string]string{f5VsBindAddrAnnotation: "1.2.3.4"})
+					Expect(mockMgr.addIngress(plain)).To(BeTrue())
+					serverssl := test.NewIngress("serverssl", "1", namespace,
+						single("serverssl"), map[string]string{
+							f5VsBindAddrAnnotation:       "1.2.3.4",
+							f5ServerSslProfileAnnotation: "Common/serverssl",
+						})
+					Expect(mockMgr.addIngress(serverssl)).To(BeTrue())
+
+					profile := joinBigipPath(DEFAULT_PARTITION, makeIngressServerSSLProfileRef(
+						DEFAULT_PARTITION, namespace, "ingress").Name)
+					Expect(mockMgr.getDataGroupRecords(dgName, DEFAULT_PARTITION)).To(ConsistOf(
+						InternalDataGroupRecord{
+							Name: "/velcro/" + formatIngressPoolName(namespace, "bar"),
+							Data: profile,
+						},
+						InternalDataGroupRecord{
+							Name: "/velcro/" + formatIngressPoolName(namespace, "foo"),
+							Data: profile,
+						},
+						InternalDataGroupRecord{
+							Name: "/velcro/" + formatIngressPoolName(namespace, "plain"),
+							Data: backendTlsNone,
+						},
+					))
+
+					// Without an Ingress using backend TLS nothing is marked
+					Expect(mockMgr.deleteIngress(ing)).To(BeTrue())
+					Expect(mockMgr.getDataGroupRecords(dgName, DEFAULT_PARTITION)).To(BeNil())
+				})
+
+				It("reports invalid backend TLS settings", func() {
+					ing := test.NewIngress("ingress", "1", namespace, spec,
+						map[string]string{
+							f5VsBindAddrAnnotation:        "1.2.3.4",
+							f5VsBackendTlsAnnotation:      "true",
+							f5VsBackendCASecretAnnotation: "missing",
+						})
+					mockMgr.addIngress(ing)
+					Expect(mockMgr.getFakeEventReasons(namespace)).To(
+						ContainElement("InvalidBackendTls"))
+					Expect(mockMgr.customProfiles()).To(BeEmpty())
+					Expect(mockMgr.getDataGroupRecords(dgName, DEFAULT_PARTITION)).To(BeNil())
+
+					// A server SSL profile named by annotation is used as is
+					delete(ing.ObjectMeta.Annotations, f5VsBackendCASecretAnnotation)
+					ing.ObjectMeta.Annotations[f5ServerSslProfileAnnotation] = "Common/serverssl"
+					mockMgr.updateIngress(ing)
+					Expect(mockMgr.customProfiles()).To(BeEmpty())
+					Expect(mockMgr.getDataGroupRecords(dgName, DEFAULT_PARTITION)).To(BeNil())
+				})
+			})
+
+			Context("certificates", func() {
+				BeforeEach(func() {
+					mockMgr.appMgr.useSecrets = true
+					mockMgr.appMgr.routeConfig = RouteConfig{
+						HttpVs:  "ose-vserver",
+						HttpsVs: "https-ose-vserver",
+					}
+					svcFoo := test.NewService("foo", "1", namespace, "NodePort",
+						[]v1.ServicePort{{Port: 80, NodePort: 37001}})
+					Expect(mockMgr.addService(svcFoo)).To(BeTrue())
+				})
+
+				addSecret := func(name, cert, key string) {
+					secret := &v1.Secret{
+						ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+						Data: map[string][]byte{
+							"tls.crt": []byte(cert),
+							"tls.key": []byte(key),
+						},
+					}
+					_, err := mockMgr.appMgr.kubeClient.Core().Secrets(namespace).Create(secret)
+					Expect(err).To(BeNil())
+				}
+				ingressSpec := func(secret string) v1beta1.IngressSpec {
+					return v1beta1.IngressSpec{
+						TLS: []v1beta1.IngressTLS{{SecretName: secret}},
+						Backend: &v1beta1.IngressBackend{
+							ServiceName: "foo",
+							ServicePort: intstr.IntOrString{IntVal: 80},
+						},
+					}
+				}
+
+				It("warns about expiring Ingress certificates", func() {
+					cert, key := newTestCertificate(time.Now().Add(10 * 24 * time.Hour))
+					addSecret("expiring", cert, key)
+					ing := test.NewIngress("ingress", "1", namespace, ingressSpec("expiring"),
+						map[string]string{f5VsBindAddrAnnotation: "1.2.3.4"})
+					Expect(mockMgr.addIngress(ing)).To(BeTrue())
+					Expect(mockMgr.getFakeEventReasons(namespace)).To(ContainElement("CertificateExpiring"))
+					expiring := func() int {
+						count := 0
+						for _, reason := range mockMgr.getFakeEventReasons(namespace) {
+							if reason == "CertificateExpiring" {
+								count++
+							}
+						}
+						return count
+					}
+					warned := expiring()
+
+					// Another sync with the same certificate does not warn again
+					mockMgr.updateIngress(ing)
+					Expect(expiring()).To(Equal(warned))
+
+					skey := secretKey{
+						Name:         "expiring",
+						ResourceName: formatIngressVSName("1.2.3.4", 443),
+					}
+					Expect(mockMgr.customProfiles()).To(HaveKey(skey))
+					mockMgr.appMgr.customProfiles.Lock()
+					Expect(mockMgr.appMgr.customProfiles.certs[skey]).To(Equal(
+						[]string{namespace, "ingress", "expiring"}))
+					mockMgr.appMgr.customProfiles.Unlock()
+
+					// The metric goes away with the profile
+					mockMgr.deleteIngress(ing)
+					mockMgr.appMgr.customProfiles.Lock()
+					Expect(mockMgr.appMgr.customProfiles.certs).To(BeEmpty())
+					mockMgr.appMgr.customProfiles.Unlock()
+					Expect(mockMgr.appMgr.certWarnings).To(BeEmpty())
+				})
+
+				It("refuses expired Ingress certificates", func() {
+					cert, key := newTestCertificate(time.Now().Add(-time.Hour))
+					addSecret("expired", cert, key)
+					ing := test.NewIngress("ingress", "1", namespace, ingressSpec("expired"),
+						map[string]string{f5VsBindAddrAnnotation: "1.2.3.4"})
+					mockMgr.addIngress(ing)
+					Expect(mockMgr.getFakeEventReasons(namespace)).To(ContainElement("InvalidCertificate"))
+					Expect(mockMgr.customProfiles()).ToNot(HaveKey(secretKey{
+						Name:         "expired",
+						ResourceName: formatIngressVSName("1.2.3.4", 443),
+					}))
+				})
+
+				It("refuses Route certificates that do not match their key", func() {
+					notAfter := time.Now().Add(90 * 24 * time.Hour)
+					cert, _ := newTestCertificate(notAfter)
+					_, otherKey := newTestCertificate(notAfter)
+					spec := routeapi.RouteSpec{
+						Host: "foo.com",
+						To: routeapi.RouteTargetReference{
+							Kind: "Service",
+							Name: "foo",
+						},
+						TLS: &routeapi.TLSConfig{
+							Termination: routeapi.TLSTerminationEdge,
+							Certificate: cert,
+							Key:         otherKey,
+						},
+					}
+					route := test.NewRoute("route", "1", namespace, spec, nil)
+					mockMgr.addRoute(route)
+					Expect(mockMgr.getFakeEventReasons(namespace)).To(ContainElement("InvalidCertificate"))
+					profRef := makeRouteClientSSLProfileRef(
+						DEFAULT_PARTITION, namespace, "route")
+					Expect(mockMgr.customProfiles()).ToNot(HaveKey(secretKey{
+						Name:         profRef.Name,
+						ResourceName: "https-ose-vserver",
+					}))
+				})
+			})
+
+			Context("SNI default", func() {
+				BeforeEach(func() {
+					mockMgr.appMgr.useSecrets = true
+					svcFoo := test.NewService("foo", "1", namespace, "NodePort",
+						[]v1.ServicePort{{Port: 80, NodePort: 37001}})
+					Expect(mockMgr.addService(svcFoo)).To(BeTrue())
+					for _, name := range []string{"foo-cert", "bar-cert"} {
+						secret := &v1.Secret{
+							ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+							Data: map[string][]byte{
+								"tls.crt": []byte(name),
+								"tls.key": []byte(name + "-key"),
+							},
+						}
+						_, err := mockMgr.appMgr.kubeClient.Core().Secrets(namespace).Create(secret)
+						Expect(err).To(BeNil())
+					}
+				})
+
+				vsName := formatIngressVSName("1.2.3.4", 443)
+				profile := func(name string) (CustomProfile, bool) {
+					cp, ok := mockMgr.customProfiles()[secretKey{
+						Name:         name,
+						ResourceName: vsName,
+					}]
+					return cp, ok
+				}
+				ingressSpec := func(tls ...v1beta1.IngressTLS) v1beta1.IngressSpec {
+					return v1beta1.IngressSpec{
+						TLS: tls,
+						Backend: &v1beta1.IngressBackend{
+							ServiceName: "foo",
+							ServicePort: intstr.IntOrString{IntVal: 80},
+						},
+					}
+				}
+				fooTls := v1beta1.IngressTLS{
+					SecretName: "foo-cert",
+					Hosts:      []string{"foo.com", "*.foo.com"},
+				}
+				barTls := v1beta1.IngressTLS{
+					SecretName: "bar-cert",
+					Hosts:      []string{"bar.com"},
+				}
+
+				It("creates a profile for each host and picks the SNI default", func() {
+					ing := test.NewIngress("ingress", "1", namespace,
+						ingressSpec(fooTls, barTls),
+						map[string]string{f5VsBindAddrAnnotation: "1.2.3.4"})
+					Expect(mockMgr.addIngress(ing)).To(BeTrue())
+
+					for name, serverName := range map[string]string{
+						"foo-cert-foo.com":          "foo.com",
+						"foo-cert-wildcard.foo.com": "*.foo.com",
+						"bar-cert-bar.com":          "bar.com",
+					} {
+						cp, ok := profile(name)
+						Expect(ok).To(BeTrue(), name)
+						Expect(cp.ServerName).To(Equal(serverName))
+						Expect(cp.SNIDefault).To(BeFalse())
+					}
+					rs, ok := mockMgr.resources().Get(serviceKey{"foo", 80, namespace}, vsName)
+					Expect(ok).To(BeTrue())
+					Expect(rs.Virtual.Profiles).To(ContainElement(ProfileRef{
+						Name:      "foo-cert-wildcard.foo.com",
+						Partition: DEFAULT_PARTITION,
+						Context:   customProfileClient,
+						Namespace: namespace,
+					}))
+					Expect(rs.Virtual.Profiles).ToNot(ContainElement(ProfileRef{
+						Name:      "foo-cert",
+						Partition: DEFAULT_PARTITION,
+						Context:   customProfileClient,
+						Namespace: namespace,
+					}))
+
+					// Without an annotation the first profile by name is the default
+					sni, ok := profile(formatDefaultClientSslName(vsName))
+					Expect(ok).To(BeTrue())
+					Expect(sni.SNIDefault).To(BeTrue())
+					Expect(sni.ServerName).To(BeEmpty())
+					Expect(sni.Cert).To(Equal("bar-cert"))
+
+					ing.ObjectMeta.Annotations[f5VsSniDefaultAnnotation] = "foo-cert"
+					Expect(mockMgr.updateIngress(ing)).To(BeTrue())
+					sni, _ = profile(formatDefaultClientSslName(vsName))
+					Expect(sni.Cert).To(Equal("foo-cert"))
+					Expect(sni.Key).To(Equal("foo-cert-key"))
+
+					// Dropping a host drops its profile
+					ing.Spec.TLS[0].Hosts = []string{"foo.com"}
+					Expect(mockMgr.updateIngress(ing)).To(BeTrue())
+					_, ok = profile("foo-cert-wildcard.foo.com")
+					Expect(ok).To(BeFalse())
+					_, ok = profile("foo-cert-foo.com")
+					Expect(ok).To(BeTrue())
+				})
+
+				It("shares profiles of a Secret between Ingresses", func() {
+					ing1 := test.NewIngress("ingress1", "1", namespace, ingressSpec(fooTls),
+						map[string]string{f5VsBindAddrAnnotation: "1.2.3.4"})
+					ing2 := test.NewIngress("ingress2", "1", namespace,
+						ingressSpec(v1beta1.IngressTLS{
+							SecretName: "foo-cert",
+							Hosts:      []string{"foo.com"},
+						}, barTls),
+						map[string]string{
+							f5VsBindAddrAnnotation:   "1.2.3.4",
+							f5VsSniDefaultAnnotation: "foo-cert",
+						})
+					Expect(mockMgr.addIngress(ing1)).To(BeTrue())
+					Expect(mockMgr.addIngress(ing2)).To(BeTrue())
+					sni, _ := profile(formatDefaultClientSslName(vsName))
+					Expect(sni.Cert).To(Equal("foo-cert"))
+
+					// The shared profile stays with the Ingress still using it
+					mockMgr.deleteIngress(ing1)
+					_, ok := profile("foo-cert-foo.com")
+					Expect(ok).To(BeTrue())
+					_, ok = profile("foo-cert-wildcard.foo.com")
+					Expect(ok).To(BeFalse())
+					_, ok = profile("bar-cert-bar.com")
+					Expect(ok).To(BeTrue())
+					sni, _ = profile(formatDefaultClientSslName(vsName))
+					Expect(sni.Cert).To(Equal("foo-cert"))
+				})
+
+				It("reports an SNI default that is not a TLS Secret", func() {
+					ing := test.NewIngress("ingress", "1", namespace, ingressSpec(fooTls),
+						map[string]string{
+							f5VsBindAddrAnnotation:   "1.2.3.4",
+							f5VsSniDefaultAnnotation: "bar-cert",
+						})
+					Expect(mockMgr.addIngress(ing)).To(BeTrue())
+					Expect(mockMgr.getFakeEventReasons(namespace)).To(
+						ContainElement("InvalidSniDefault"))
+					sni, _ := profile(formatDefaultClientSslName(vsName))
+					Expect(sni.Cert).To(Equal("foo-cert"))
+				})
+
+				It("looks up the Secret only for profiles named after it", func() {
+					client := mockMgr.appMgr.kubeClient.(*fake.Clientset)
+					check := func(name string) (bool, []ProfileRef, int) {
+						client.ClearActions()
+						var referenced bool
+						var toRemove []ProfileRef
+						mockMgr.appMgr.checkIngressTlsProfile(
+							ProfileRef{Name: name, Partition: DEFAULT_PARTITION},
+							&toRemove, namespace, fooTls, &referenced)
+						return referenced, toRemove, len(client.Actions())
+					}
+					referenced, toRemove, gets := check("other-profile")
+					Expect(referenced).To(BeFalse())
+					Expect(toRemove).To(BeEmpty())
+					Expect(gets).To(Equal(0))
+
+					referenced, toRemove, gets = check(
+						formatSecretProfileName("foo-cert", "*.foo.com"))
+					Expect(referenced).To(BeTrue())
+					Expect(toRemove).To(BeEmpty())
+					Expect(gets).To(Equal(1))
+
+					// The profiles of the hosts replace the one named after the Secret
+					referenced, _, gets = check("foo-cert")
+					Expect(referenced).To(BeFalse())
+					Expect(gets).To(Equal(1))
+				})
+			})
+
+			Context("Routes", func() {
+				BeforeEach(func() {
+					mockMgr.appMgr.routeConfig = RouteConfig{
+						HttpVs:  "ose-vserver",
+						HttpsVs: "https-ose-vserver",
+					}
+				})
+
+				It("writes the admission status to Routes", func() {
+					sent := mockMgr.recordRouteStatus()
+					spec := routeapi.RouteSpec{
+						Host: "foobar.com",
+						Path: "/foo",
+						To: routeapi.RouteTargetReference{
+							Kind: "Service",
+							Name: "foo",
+						},
+					}
+					route := test.NewRoute("route", "1", namespace, spec, nil)
+					r := mockMgr.addRoute(route)
+					Expect(r).To(BeTrue(), "Route resource should be processed.")
+					// The cached Route is left alone; the status is written
+					Expect(route.Status.Ingress).To(BeEmpty())
+					written := mockMgr.routeStatus(route)
+					Expect(written).ToNot(BeNil())
+					Expect(len(written.Status.Ingress)).To(Equal(1))
+					ingress := written.Status.Ingress[0]
+					Expect(ingress.Host).To(Equal("foobar.com"))
+					Expect(ingress.RouterName).To(Equal(DEFAULT_ROUTER_NAME))
+					Expect(ingress.Conditions[0].Type).To(Equal(routeapi.RouteAdmitted))
+					Expect(string(ingress.Conditions[0].Status)).To(Equal("False"))
+					Expect(ingress.Conditions[0].Reason).To(Equal(routeReasonServiceNotFound))
+					// The watch brings the written status back
+					route = written
+					Expect(mockMgr.updateRoute(route)).To(BeTrue())
+
+					fooSvc := test.NewService("foo", "1", namespace, "NodePort",
+						[]v1.ServicePort{{Port: 80, NodePort: 37001}})
+					r = mockMgr.addService(fooSvc)
+					Expect(r).To(BeTrue(), "Service should be processed.")
+					written = mockMgr.routeStatus(route)
+					Expect(len(written.Status.Ingress)).To(Equal(1))
+					ingress = written.Status.Ingress[0]
+					Expect(string(ingress.Conditions[0].Status)).To(Equal("True"))
+					Expect(ingress.Conditions[0].Reason).To(Equal(""))
+					transitioned := ingress.Conditions[0].LastTransitionTime
+					route = written
+
+					// An unchanged status is not rewritten
+					writes := len(sent.Objects)
+					r = mockMgr.updateRoute(route)
+					Expect(r).To(BeTrue(), "Route resource should be processed.")
+					Expect(len(sent.Objects)).To(Equal(writes))
+
+					// A new host is written, but the Route stays admitted since then
+					route.Spec.Host = "foobaz.com"
+					r = mockMgr.updateRoute(route)
+					Expect(r).To(BeTrue(), "Route resource should be processed.")
+					written = mockMgr.routeStatus(route)
+					Expect(written.Status.Ingress[0].Host).To(Equal("foobaz.com"))
+					Expect(written.Status.Ingress[0].Conditions[0].LastTransitionTime).To(
+						BeIdenticalTo(transitioned))
+					route = written
+					Expect(mockMgr.updateRoute(route)).To(BeTrue())
+
+					// Entries from other routers are preserved
+					mockMgr.appMgr.routeConfig.RouterName = "bigip2"
+					route.Spec.Host = "foo%zz.com"
+					r = mockMgr.updateRoute(route)
+					Expect(r).To(BeTrue(), "Route resource should be processed.")
+					written = mockMgr.routeStatus(route)
+					Expect(len(written.Status.Ingress)).To(Equal(2))
+					ingress = written.Status.Ingress[1]
+					Expect(ingress.RouterName).To(Equal("bigip2"))
+					Expect(string(ingress.Conditions[0].Status)).To(Equal("False"))
+					Expect(ingress.Conditions[0].Reason).To(Equal(routeReasonRuleFailed))
+					route = written
+					Expect(mockMgr.updateRoute(route)).To(BeTrue())
+
+					// A status that fails to be written fails the sync, so it
+					// is retried, and the cached Route keeps the old status
+					mockMgr.appMgr.routeConfig.RouterName = "bigip3"
+					sent.Err = apierrors.NewConflict(schema.GroupResource{Resource: "routes"},
+						route.ObjectMeta.Name, fmt.Errorf("the object has been modified"))
+					writes = len(sent.Objects)
+					sKey := serviceQueueKey{ServiceName: "foo", Namespace: namespace}
+					Expect(mockMgr.appMgr.syncVirtualServer(sKey)).ToNot(BeNil())
+					Expect(len(sent.Objects)).To(Equal(writes))
+					Expect(len(route.Status.Ingress)).To(Equal(2))
+					// A conflict is only a newer Route, not worth a warning
+					Expect(mockMgr.getFakeEventReasons(namespace)).ToNot(
+						ContainElement("StatusError"))
+					sent.Err = fmt.Errorf("the server is down")
+					Expect(mockMgr.appMgr.syncVirtualServer(sKey)).ToNot(BeNil())
+					Expect(mockMgr.getFakeEventReasons(namespace)).To(
+						ContainElement("StatusError"))
+					sent.Err = nil
+					Expect(mockMgr.appMgr.syncVirtualServer(sKey)).To(BeNil())
+					written = mockMgr.routeStatus(route)
+					Expect(len(written.Status.Ingress)).To(Equal(3))
+					Expect(written.Status.Ingress[2].RouterName).To(Equal("bigip3"))
+				})
+
+				It("configures a virtual server pair per Route shard", func() {
+					mockMgr.appMgr.routeConfig.Shards = []RouteShard{
+						{
+							Name:        "a",
+							RouteLabel:  "tenant=a",
+							RouteVSAddr: "10.1.1.1",
+							HttpVs:      "a-http",
+							HttpsVs:     "a-https",
+						},
+						{
+							Name:           "b",
+							NamespaceLabel: "team=b",
+							RouteVSAddr:    "10.1.1.2",
+							HttpVs:         "b-http",
+							HttpsVs:        "b-https",
+						},
+					}
+					fooSvc := test.NewService("foo", "1", namespace, "NodePort",
+						[]v1.ServicePort{{Port: 80, NodePort: 37001}})
+					Expect(mockMgr.addService(fooSvc)).To(BeTrue())
+
+					newRoute := func(name, path string) *routeapi.Route {
+						spec := routeapi.RouteSpec{
+							Host: "foobar.com",
+							Path: path,
+							To: routeapi.RouteTargetReference{
+								Kind: "Service",
+								Name: "foo",
+							},
+						}
+						return test.NewRoute(name, "1", namespace, spec, nil)
+					}
+					rules := func(rsName string) []string {
+						rs, ok := mockMgr.resources().Get(
+							serviceKey{"foo", 80, namespace}, rsName)
+						if !ok || len(rs.Policies) == 0 {
+							return nil
+						}
+						var names []string
+						for _, rule := range rs.Policies[0].Rules {
+							names = append(names, rule.Name)
+						}
+						return names
+					}
+
+					shardRoute := newRoute("route-a", "/a")
+					shardRoute.ObjectMeta.Labels = map[string]string{"tenant": "a"}
+					Expect(mockMgr.addRoute(shardRoute)).To(BeTrue())
+					defaultRoute := newRoute("route-default", "/")
+					Expect(mockMgr.addRoute(defaultRoute)).To(BeTrue())
+
+					rs, ok := mockMgr.resources().Get(
+						serviceKey{"foo", 80, namespace}, "a-http")
+					Expect(ok).To(BeTrue())
+					Expect(rs.Virtual.Destination).To(Equal("/velcro/10.1.1.1:80"))
+					Expect(rules("a-http")).To(Equal(
+						[]string{"openshift_route_default_route-a"}))
+					Expect(rules("ose-vserver")).To(Equal(
+						[]string{"openshift_route_default_route-default"}))
+
+					// Namespace labels select the second shard
+					nsObj := test.NewNamespace(namespace, "1",
+						map[string]string{"team": "b"})
+					_, err := mockMgr.appMgr.kubeClient.CoreV1().Namespaces().Create(nsObj)
+					Expect(err).To(BeNil())
+					Expect(mockMgr.updateRoute(defaultRoute)).To(BeTrue())
+					rs, ok = mockMgr.resources().Get(
+						serviceKey{"foo", 80, namespace}, "b-http")
+					Expect(ok).To(BeTrue())
+					Expect(rs.Virtual.Destination).To(Equal("/velcro/10.1.1.2:80"))
+					Expect(rules("b-http")).To(Equal(
+						[]string{"openshift_route_default_route-default"}))
+					Expect(rules("a-http")).To(Equal(
+						[]string{"openshift_route_default_route-a"}))
+					Expect(rules("ose-vserver")).To(BeEmpty())
+
+					// A Route that loses its label moves to the next shard
+					shardRoute.ObjectMeta.Labels = nil
+					Expect(mockMgr.updateRoute(shardRoute)).To(BeTrue())
+					Expect(rules("a-http")).To(BeEmpty())
+					Expect(rules("b-http")).To(ConsistOf(
+						"openshift_route_default_route-a",
+						"openshift_route_default_route-default"))
+
+					// Passthrough Routes of a shard use its own iRule and data group
+					ptRoute := newRoute("route-pt", "")
+					ptRoute.Spec.Host = "pt.foobar.com"
+					ptRoute.Spec.TLS = &routeapi.TLSConfig{Termination: "passthrough"}
+					Expect(mockMgr.addRoute(ptRoute)).To(BeTrue())
+					rs, ok = mockMgr.resources().Get(
+						serviceKey{"foo", 80, namespace}, "b-https")
+					Expect(ok).To(BeTrue())
+					Expect(rs.Virtual.IRules).To(ContainElement(
+						"/velcro/openshift_passthrough_irule_shard_b"))
+					_, found := mockMgr.appMgr.irulesMap[nameRef{
+						"openshift_passthrough_irule_shard_b", "velcro"}]
+					Expect(found).To(BeTrue())
+					nsMap, found := mockMgr.appMgr.intDgMap[nameRef{
+						"ssl_passthrough_servername_dg_shard_b", "velcro"}]
+					Expect(found).To(BeTrue())
+					Expect(nsMap[namespace].Records).To(Equal(InternalDataGroupRecords{
+						{Name: "pt.foobar.com", Data: "openshift_default_foo"}}))
+					_, found = mockMgr.appMgr.intDgMap[nameRef{
+						passthroughHostsDgName, "velcro"}]
+					Expect(found).To(BeFalse())
+
+					Expect(RouteShard{Name: "c", HttpVs: "c-http",
+						HttpsVs: "c-https"}.Validate()).ToNot(BeNil())
+				})
+
+				It("configures virtual servers via Routes", func() {
+					spec := routeapi.RouteSpec{
+						Host: "foobar.com",
+						Path: "/foo",
+						To: routeapi.RouteTargetReference{
+							Kind: "Service",
+							Name: "foo",
+						},
+						Port: &routeapi.RoutePort{
+							TargetPort: intstr.FromString("foo-80"),
+						},
+						TLS: &routeapi.TLSConfig{
+							Termination: "edge",
+							Certificate: "cert",
+							Key:         "key",
+						},
+					}
+					route := test.NewRoute("route", "1", namespace, spec,
+						map[string]string{
+							f5VsSourceAddrTranslationAnnotation: string(`{"type":"snat","pool":"snat-pool"}`),
+						})
+					r := mockMgr.addRoute(route)
+					Expect(r).To(BeTrue(), "Route resource should be processed.")
+
+					resources := mockMgr.resources()
+					// Associate a service
+					fooSvc := test.NewService("foo", "1", namespace, "NodePort",
+						[]v1.ServicePort{{Name: "foo-80", Port: 80, NodePort: 37001}})
+					r = mockMgr.addService(fooSvc)
+					Expect(r).To(BeTrue(), "Service should be processed.")
+					Expect(resources.PoolCount()).To(Equal(1))
+
+					rs, ok := resources.Get(
+						serviceKey{"foo", 80, "default"}, "https-ose-vserver")
+					Expect(ok).To(BeTrue(), "Route should be accessible.")
+					Expect(rs).ToNot(BeNil(), "Route should be object.")
+					Expect(rs.Virtual.SourceAddrTranslation.Type).To(Equal("snat"))
 					Expect(rs.Virtual.SourceAddrTranslation.Pool).To(Equal("snat-pool"))
 					Expect(rs.MetaData.Active).To(BeTrue())
 					Expect(len(rs.Policies[0].Rules)).To(Equal(1))
@@ -3685,6 +5912,356 @@ var _ = Describe("AppManager Tests", func() {
 					flatDg = nsMap.FlattenNamespaces()
 					Expect(flatDg.Records[0].Data).To(Equal(""))
 				})
+
+				It("restricts Route clients", func() {
+					svcFoo := test.NewService("foo", "1", namespace, "NodePort",
+						[]v1.ServicePort{{Port: 80, NodePort: 37001}})
+					Expect(mockMgr.addService(svcFoo)).To(BeTrue())
+					fooKey := serviceKey{"foo", 80, namespace}
+					httpIRule := joinBigipPath(DEFAULT_PARTITION, sourceRangeHttpIRuleName)
+					dgName := formatSourceRangeDgName("ose-vserver")
+					spec := routeapi.RouteSpec{
+						Host: "foo.com",
+						To: routeapi.RouteTargetReference{
+							Kind: "Service",
+							Name: "foo",
+						},
+					}
+					route := test.NewRoute("route", "1", namespace, spec,
+						map[string]string{
+							f5VsDenySourceRangeAnnotation: "192.168.0.0/16",
+						})
+					Expect(mockMgr.addRoute(route)).To(BeTrue())
+					Expect(mockMgr.getDataGroupRecords(dgName, DEFAULT_PARTITION)).To(Equal(
+						[]InternalDataGroupRecord{{
+							Name: "foo.com /",
+							Data: "deny 192.168.0.0/16",
+						}}))
+					iRules := mockMgr.getVirtualIRules(fooKey, "ose-vserver")
+					Expect(iRules).To(ContainElement(httpIRule))
+					Expect(iRules[0]).To(Equal(httpIRule))
+
+					route.ObjectMeta.Annotations = nil
+					Expect(mockMgr.updateRoute(route)).To(BeTrue())
+					Expect(mockMgr.getDataGroupRecords(dgName, DEFAULT_PARTITION)).To(BeNil())
+					Expect(mockMgr.getVirtualIRules(fooKey, "ose-vserver")).ToNot(
+						ContainElement(httpIRule))
+
+					// Passthrough Routes cannot be restricted, which is reported
+					route.ObjectMeta.Annotations = map[string]string{
+						f5VsAllowSourceRangeAnnotation: "10.0.0.0/8",
+					}
+					route.Spec.TLS = &routeapi.TLSConfig{Termination: "passthrough"}
+					Expect(mockMgr.updateRoute(route)).To(BeTrue())
+					Expect(mockMgr.getDataGroupRecords(
+						formatSourceRangeDgName("https-ose-vserver"), DEFAULT_PARTITION)).To(BeNil())
+					events := mockMgr.getFakeEvents(namespace)
+					Expect(events[len(events)-1].Reason).To(Equal("InvalidSourceRange"))
+				})
+
+				It("limits Route clients by header", func() {
+					svcFoo := test.NewService("foo", "1", namespace, "NodePort",
+						[]v1.ServicePort{{Port: 80, NodePort: 37001}})
+					Expect(mockMgr.addService(svcFoo)).To(BeTrue())
+					fooKey := serviceKey{"foo", 80, namespace}
+					dgName := formatRateLimitDgName("ose-vserver")
+					rateLimitIRule := joinBigipPath(DEFAULT_PARTITION, rateLimitIRuleName)
+
+					spec := routeapi.RouteSpec{
+						Host: "foo.com",
+						Path: "/api",
+						To: routeapi.RouteTargetReference{
+							Kind: "Service",
+							Name: "foo",
+						},
+					}
+					route := test.NewRoute("route", "1", namespace, spec,
+						map[string]string{
+							f5VsRateLimitAnnotation:       "100",
+							f5VsRateLimitKeyAnnotation:    "header:X-Api-Key",
+							f5VsRateLimitActionAnnotation: "reset",
+						})
+					Expect(mockMgr.addRoute(route)).To(BeTrue())
+					Expect(mockMgr.getDataGroupRecords(dgName, DEFAULT_PARTITION)).To(
+						Equal([]InternalDataGroupRecord{{
+							Name: "foo.com /api",
+							Data: "100 reset X-Api-Key",
+						}}))
+					Expect(mockMgr.getVirtualIRules(fooKey, "ose-vserver")).To(
+						ContainElement(rateLimitIRule))
+
+					route.ObjectMeta.Annotations = nil
+					Expect(mockMgr.updateRoute(route)).To(BeTrue())
+					Expect(mockMgr.getDataGroupRecords(dgName, DEFAULT_PARTITION)).To(
+						BeNil())
+					Expect(mockMgr.getVirtualIRules(fooKey, "ose-vserver")).ToNot(
+						ContainElement(rateLimitIRule))
+				})
+
+				It("applies the TLS policy and HSTS of a Route", func() {
+					mockMgr.appMgr.driverFeatures = newDriverFeatures(
+						[]string{driverFeatureSslProfileSettings})
+					svcFoo := test.NewService("foo", "1", namespace, "NodePort",
+						[]v1.ServicePort{{Port: 80, NodePort: 37001}})
+					Expect(mockMgr.addService(svcFoo)).To(BeTrue())
+
+					spec := routeapi.RouteSpec{
+						Host: "foo.com",
+						To: routeapi.RouteTargetReference{
+							Kind: "Service",
+							Name: "foo",
+						},
+						TLS: &routeapi.TLSConfig{
+							Termination: routeapi.TLSTerminationEdge,
+							Certificate: "cert",
+							Key:         "key",
+						},
+					}
+					route := test.NewRoute("route", "1", namespace, spec,
+						map[string]string{
+							f5VsTlsPolicyAnnotation: `{"sessionTickets": false,
+								"ocspStapling": true, "ocspResponder": "/Common/ocsp"}`,
+							f5VsHstsMaxAgeAnnotation:            "600",
+							f5VsHstsIncludeSubdomainsAnnotation: "true",
+						})
+					Expect(mockMgr.addRoute(route)).To(BeTrue())
+
+					profRef := makeRouteClientSSLProfileRef(
+						DEFAULT_PARTITION, namespace, "route")
+					cp, ok := mockMgr.customProfiles()[secretKey{
+						Name:         profRef.Name,
+						ResourceName: "https-ose-vserver",
+					}]
+					Expect(ok).To(BeTrue())
+					Expect(cp.SessionTicket).To(Equal("disabled"))
+					Expect(cp.OcspStapling).To(Equal("enabled"))
+					Expect(cp.Ocsp).To(Equal("/Common/ocsp"))
+					Expect(mockMgr.getDataGroupRecords(
+						formatHstsDgName("https-ose-vserver"), DEFAULT_PARTITION)).To(Equal(
+						[]InternalDataGroupRecord{{
+							Name: "foo.com /",
+							Data: "max-age=600; includeSubDomains",
+						}}))
+					Expect(mockMgr.getDataGroupRecords(
+						formatHstsDgName("ose-vserver"), DEFAULT_PARTITION)).To(BeNil())
+
+					// Invalid settings are reported
+					route.ObjectMeta.Annotations[f5VsTlsPolicyAnnotation] = `{"maxVersion": "2"}`
+					Expect(mockMgr.updateRoute(route)).To(BeTrue())
+					Expect(mockMgr.getFakeEventReasons(namespace)).To(
+						ContainElement("InvalidTlsPolicy"))
+				})
+
+				It("splits A/B Route traffic with a weighted pool", func() {
+					mockMgr.appMgr.isNodePort = false
+					mockMgr.appMgr.driverFeatures = newDriverFeatures(
+						[]string{driverFeaturePoolMemberRatio})
+					mockMgr.addClusterIPService("foo", namespace,
+						[]string{"10.2.96.1", "10.2.96.2"})
+					mockMgr.addClusterIPService("bar", namespace, []string{"10.2.96.3"})
+
+					w80 := int32(80)
+					w20 := int32(20)
+					spec := routeapi.RouteSpec{
+						Host: "foo.com",
+						To: routeapi.RouteTargetReference{
+							Kind:   "Service",
+							Name:   "foo",
+							Weight: &w80,
+						},
+						AlternateBackends: []routeapi.RouteTargetReference{
+							{Kind: "Service", Name: "bar", Weight: &w20},
+						},
+					}
+					route := test.NewRoute("route", "1", namespace, spec,
+						map[string]string{f5RouteABModeAnnotation: abModeRatio})
+					Expect(mockMgr.addRoute(route)).To(BeTrue())
+
+					poolName := formatRouteWeightedPoolName(namespace, "route")
+					rs, ok := mockMgr.resources().Get(
+						serviceKey{"foo", 80, namespace}, "ose-vserver")
+					Expect(ok).To(BeTrue())
+					pool := findPool(rs, poolName)
+					Expect(pool).ToNot(BeNil())
+					Expect(pool.Balance).To(Equal(weightedPoolBalance))
+					Expect(pool.Members).To(ConsistOf(
+						generateExpectedRatioMember("10.2.96.1", 2),
+						generateExpectedRatioMember("10.2.96.2", 2),
+						generateExpectedRatioMember("10.2.96.3", 1)))
+					Expect(rs.Policies[0].Rules[0].Actions[0].Pool).To(Equal(
+						joinBigipPath(DEFAULT_PARTITION, poolName)))
+					Expect(rs.Virtual.IRules).ToNot(ContainElement(
+						joinBigipPath(DEFAULT_PARTITION, abDeploymentPathIRuleName)))
+					_, found := mockMgr.appMgr.intDgMap[nameRef{
+						Name:      abDeploymentDgName,
+						Partition: DEFAULT_PARTITION,
+					}]
+					Expect(found).To(BeFalse())
+
+					// New weights only change the ratios
+					w50 := int32(50)
+					route.Spec.To.Weight = &w50
+					route.Spec.AlternateBackends[0].Weight = &w50
+					Expect(mockMgr.updateRoute(route)).To(BeTrue())
+					rs, _ = mockMgr.resources().Get(
+						serviceKey{"foo", 80, namespace}, "ose-vserver")
+					Expect(findPool(rs, poolName).Members).To(ConsistOf(
+						generateExpectedRatioMember("10.2.96.1", 1),
+						generateExpectedRatioMember("10.2.96.2", 1),
+						generateExpectedRatioMember("10.2.96.3", 2)))
+
+					// Back to the iRule, the weighted pool goes away
+					route.ObjectMeta.Annotations[f5RouteABModeAnnotation] = abModeIRule
+					Expect(mockMgr.updateRoute(route)).To(BeTrue())
+					rs, _ = mockMgr.resources().Get(
+						serviceKey{"foo", 80, namespace}, "ose-vserver")
+					Expect(findPool(rs, poolName)).To(BeNil())
+					Expect(rs.Virtual.IRules).To(ContainElement(
+						joinBigipPath(DEFAULT_PARTITION, abDeploymentPathIRuleName)))
+
+					// Ratio mode needs the driver feature, and falls back to the iRule
+					route.ObjectMeta.Annotations[f5RouteABModeAnnotation] = abModeRatio
+					mockMgr.appMgr.driverFeatures = newDriverFeatures(nil)
+					Expect(mockMgr.updateRoute(route)).To(BeTrue())
+					rs, _ = mockMgr.resources().Get(
+						serviceKey{"foo", 80, namespace}, "ose-vserver")
+					Expect(findPool(rs, poolName)).To(BeNil())
+					Expect(rs.Virtual.IRules).To(ContainElement(
+						joinBigipPath(DEFAULT_PARTITION, abDeploymentPathIRuleName)))
+					_, found = mockMgr.appMgr.intDgMap[nameRef{
+						Name:      abDeploymentDgName,
+						Partition: DEFAULT_PARTITION,
+					}]
+					Expect(found).To(BeTrue())
+					events := mockMgr.getFakeEvents(namespace)
+					Expect(events[len(events)-1].Reason).To(Equal("UnsupportedDriverFeature"))
+				})
+
+				It("configures per-pool fallbacks for a Route", func() {
+					mockMgr.appMgr.isNodePort = false
+					mockMgr.addClusterIPService("foo", namespace, []string{"10.2.96.1"})
+					mockMgr.addClusterIPService("sorry", namespace, []string{"10.2.96.9"})
+
+					spec := routeapi.RouteSpec{
+						Host: "foo.com",
+						To: routeapi.RouteTargetReference{
+							Kind: "Service",
+							Name: "foo",
+						},
+					}
+					route := test.NewRoute("route", "1", namespace, spec,
+						map[string]string{
+							f5VsPoolFallbackServicesAnnotation: `{"foo": "sorry"}`,
+							f5VsMaintenanceStatusAnnotation:    "502",
+						})
+					Expect(mockMgr.addRoute(route)).To(BeTrue())
+
+					fooPool := joinBigipPath(DEFAULT_PARTITION,
+						formatRoutePoolName(namespace, "foo"))
+					sorryPool := formatRoutePoolName(namespace, "sorry")
+					rs, ok := mockMgr.resources().Get(
+						serviceKey{"sorry", 80, namespace}, "ose-vserver")
+					Expect(ok).To(BeTrue())
+					Expect(rs.Virtual.IRules).To(ContainElement(
+						joinBigipPath(DEFAULT_PARTITION, fallbackIRuleName)))
+					Expect(findPool(rs, sorryPool)).ToNot(BeNil())
+					Expect(mockMgr.getDataGroupRecords(
+						formatFallbackDgName("ose-vserver"), DEFAULT_PARTITION)).To(
+						ConsistOf(
+							InternalDataGroupRecord{
+								Name: fooPool,
+								Data: joinBigipPath(DEFAULT_PARTITION, sorryPool),
+							},
+							InternalDataGroupRecord{
+								Name: fooPool + " status",
+								Data: "502",
+							},
+							InternalDataGroupRecord{
+								Name: fooPool + " type",
+								Data: defaultMaintenancePageType,
+							},
+							InternalDataGroupRecord{
+								Name: fooPool + " page",
+								Data: "",
+							}))
+				})
+
+				It("attaches security policies for a Route until it is deleted", func() {
+					mockMgr.appMgr.driverFeatures = newDriverFeatures(
+						[]string{driverFeatureSecurityPolicies})
+					mockMgr.appMgr.routeConfig.RouteVSAddr = "10.1.1.1"
+					svcFoo := test.NewService("foo", "1", namespace, "NodePort",
+						[]v1.ServicePort{{Port: 80, NodePort: 37001}})
+					Expect(mockMgr.addService(svcFoo)).To(BeTrue())
+
+					spec := routeapi.RouteSpec{
+						Host: "foo.com",
+						To: routeapi.RouteTargetReference{
+							Kind: "Service",
+							Name: "foo",
+						},
+					}
+					route := test.NewRoute("route", "1", namespace, spec,
+						map[string]string{
+							f5VsWafPolicyAnnotation:  "/Common/waf",
+							f5VsDosProfileAnnotation: "/Common/dos",
+						})
+					Expect(mockMgr.addRoute(route)).To(BeTrue())
+					rs, ok := mockMgr.resources().Get(
+						serviceKey{"foo", 80, namespace}, "ose-vserver")
+					Expect(ok).To(BeTrue())
+					Expect(rs.Virtual.WafPolicy).To(Equal("/Common/waf"))
+					Expect(rs.Virtual.DosProfile).To(Equal("/Common/dos"))
+
+					spec.Host = "bar.com"
+					plain := test.NewRoute("plain", "1", namespace, spec, nil)
+					Expect(mockMgr.addRoute(plain)).To(BeTrue())
+					rs, _ = mockMgr.resources().Get(
+						serviceKey{"foo", 80, namespace}, "ose-vserver")
+					Expect(rs.Virtual.WafPolicy).To(Equal("/Common/waf"))
+
+					mockMgr.deleteRoute(route)
+					rs, _ = mockMgr.resources().Get(
+						serviceKey{"foo", 80, namespace}, "ose-vserver")
+					Expect(rs.Virtual.WafPolicy).To(BeEmpty())
+					Expect(rs.Virtual.DosProfile).To(BeEmpty())
+				})
+
+				It("enforces firewall rules for a Route until it is deleted", func() {
+					mockMgr.appMgr.driverFeatures = newDriverFeatures(
+						[]string{driverFeatureFirewallPolicies})
+					mockMgr.appMgr.routeConfig.RouteVSAddr = "10.1.1.1"
+					svcFoo := test.NewService("foo", "1", namespace, "NodePort",
+						[]v1.ServicePort{{Port: 80, NodePort: 37001}})
+					Expect(mockMgr.addService(svcFoo)).To(BeTrue())
+
+					spec := routeapi.RouteSpec{
+						Host: "foo.com",
+						To: routeapi.RouteTargetReference{
+							Kind: "Service",
+							Name: "foo",
+						},
+					}
+					route := test.NewRoute("route", "1", namespace, spec,
+						map[string]string{
+							f5VsFirewallRulesAnnotation: `[{"action": "drop",
+								"sources": ["192.168.0.0/16"]}]`,
+						})
+					Expect(mockMgr.addRoute(route)).To(BeTrue())
+					rs, ok := mockMgr.resources().Get(
+						serviceKey{"foo", 80, namespace}, "ose-vserver")
+					Expect(ok).To(BeTrue())
+					Expect(rs.Virtual.FirewallPolicy).ToNot(BeEmpty())
+
+					spec.Host = "bar.com"
+					plain := test.NewRoute("plain", "1", namespace, spec, nil)
+					Expect(mockMgr.addRoute(plain)).To(BeTrue())
+					mockMgr.deleteRoute(route)
+					rs, _ = mockMgr.resources().Get(
+						serviceKey{"foo", 80, namespace}, "ose-vserver")
+					Expect(rs.FirewallPolicy).To(BeNil())
+					Expect(rs.Virtual.FirewallPolicy).To(BeEmpty())
+				})
 			})
 
 			// Check that the provided host resolves into the expected addr.
@@ -4145,7 +6722,7 @@ var _ = Describe("AppManager Tests", func() {
 					},
 				}
 				spec2 := routeapi.RouteSpec{
-					Host: "foobar.com",
+					Host: "barfoo.com",
 					Path: "/bar",
 					Port: &routeapi.RoutePort{
 						TargetPort: intstr.IntOrString{IntVal: 80},
@@ -4204,6 +6781,176 @@ var _ = Describe("AppManager Tests", func() {
 				addr = []string{"127.0.0.0"}
 				Expect(rs.Pools[0].Members).To(Equal(generateExpectedAddrs(37001, addr)))
 			})
+
+			It("rejects routes for hosts claimed by older routes", func() {
+				mockMgr.appMgr.routeConfig = RouteConfig{
+					HttpVs:  "ose-vserver",
+					HttpsVs: "https-ose-vserver",
+				}
+				mockMgr.recordRouteStatus()
+				ns1 := "default"
+				ns2 := "kube-system"
+
+				cfgMapSelector, err := labels.Parse(DefaultConfigMapLabel)
+				Expect(err).To(BeNil())
+				err = mockMgr.appMgr.AddNamespace("", cfgMapSelector, 0)
+				Expect(err).To(BeNil())
+
+				for _, ns := range []string{ns1, ns2} {
+					svc := test.NewService("foo", "1", ns, "NodePort",
+						[]v1.ServicePort{{Port: 80, NodePort: 37001}})
+					mockMgr.addService(svc)
+				}
+
+				newRoute := func(name, ns, path string, age int) *routeapi.Route {
+					spec := routeapi.RouteSpec{
+						Host: "foobar.com",
+						Path: path,
+						To: routeapi.RouteTargetReference{
+							Kind: "Service",
+							Name: "foo",
+						},
+					}
+					route := test.NewRoute(name, "1", ns, spec, nil)
+					route.ObjectMeta.CreationTimestamp = metav1.NewTime(
+						time.Now().Add(-time.Duration(age) * time.Minute))
+					return route
+				}
+				admitted := func(route *routeapi.Route) (string, string) {
+					written := mockMgr.routeStatus(route)
+					Expect(written).ToNot(BeNil())
+					Expect(len(written.Status.Ingress)).To(Equal(1))
+					cond := written.Status.Ingress[0].Conditions[0]
+					return string(cond.Status), cond.Reason
+				}
+				ruleCount := func() int {
+					rs, ok := mockMgr.resources().Get(
+						serviceKey{"foo", 80, ns1}, "ose-vserver")
+					Expect(ok).To(BeTrue())
+					return len(rs.Policies[0].Rules)
+				}
+
+				oldest := newRoute("oldest", ns1, "/foo", 10)
+				Expect(mockMgr.addRoute(oldest)).To(BeTrue())
+				// Same host and path in the same namespace
+				samePath := newRoute("samepath", ns1, "/foo", 5)
+				Expect(mockMgr.addRoute(samePath)).To(BeTrue())
+				// Other paths in the same namespace are allowed
+				otherPath := newRoute("otherpath", ns1, "/bar", 5)
+				Expect(mockMgr.addRoute(otherPath)).To(BeTrue())
+				// The host belongs to the first namespace
+				otherNs := newRoute("otherns", ns2, "/baz", 5)
+				Expect(mockMgr.addRoute(otherNs)).To(BeTrue())
+
+				status, _ := admitted(oldest)
+				Expect(status).To(Equal("True"))
+				status, reason := admitted(samePath)
+				Expect(status).To(Equal("False"))
+				Expect(reason).To(Equal(routeReasonHostClaimed))
+				status, _ = admitted(otherPath)
+				Expect(status).To(Equal("True"))
+				status, reason = admitted(otherNs)
+				Expect(status).To(Equal("False"))
+				Expect(reason).To(Equal(routeReasonHostClaimed))
+				Expect(ruleCount()).To(Equal(2))
+
+				events := mockMgr.getFakeEvents(ns2)
+				Expect(len(events)).To(Equal(1))
+				Expect(events[0].Name).To(Equal("otherns"))
+				Expect(events[0].Reason).To(Equal(routeReasonHostClaimed))
+
+				// Namespaces matching the sharing label may share the host
+				mockMgr.appMgr.routeConfig.HostSharingLabel = "routes=shared"
+				for _, ns := range []string{ns1, ns2} {
+					nsObj := test.NewNamespace(ns, "1",
+						map[string]string{"routes": "shared"})
+					_, err = mockMgr.appMgr.kubeClient.CoreV1().Namespaces().Create(nsObj)
+					Expect(err).To(BeNil())
+				}
+				Expect(mockMgr.updateRoute(otherNs)).To(BeTrue())
+				status, _ = admitted(otherNs)
+				Expect(status).To(Equal("True"))
+				Expect(ruleCount()).To(Equal(3))
+
+				// Deleting the owner admits the next oldest route
+				Expect(mockMgr.deleteRoute(oldest)).To(BeTrue())
+				status, _ = admitted(samePath)
+				Expect(status).To(Equal("True"))
+				Expect(ruleCount()).To(Equal(3))
+			})
+
+			It("admits routes when the owner of their host moves or is deleted", func() {
+				mockMgr.appMgr.routeConfig = RouteConfig{
+					HttpVs:  "ose-vserver",
+					HttpsVs: "https-ose-vserver",
+				}
+				mockMgr.recordRouteStatus()
+				// The waiting Routes are in another namespace, so syncing the
+				// owner does not sync them
+				ns := "default"
+				otherNs := "other"
+				cfgMapSelector, err := labels.Parse(DefaultConfigMapLabel)
+				Expect(err).To(BeNil())
+				err = mockMgr.appMgr.AddNamespace("", cfgMapSelector, 0)
+				Expect(err).To(BeNil())
+				mockMgr.addService(test.NewService("foo", "1", ns, "NodePort",
+					[]v1.ServicePort{{Port: 80, NodePort: 37001}}))
+				mockMgr.addService(test.NewService("bar", "1", otherNs, "NodePort",
+					[]v1.ServicePort{{Port: 80, NodePort: 37002}}))
+
+				newRoute := func(
+					name, ns, host, svc string,
+					age int,
+				) *routeapi.Route {
+					spec := routeapi.RouteSpec{
+						Host: host,
+						Path: "/foo",
+						To: routeapi.RouteTargetReference{
+							Kind: "Service",
+							Name: svc,
+						},
+					}
+					route := test.NewRoute(name, "1", ns, spec, nil)
+					route.ObjectMeta.CreationTimestamp = metav1.NewTime(
+						time.Now().Add(-time.Duration(age) * time.Minute))
+					return route
+				}
+				admitted := func(route *routeapi.Route) string {
+					written := mockMgr.routeStatus(route)
+					Expect(written).ToNot(BeNil())
+					return string(written.Status.Ingress[0].Conditions[0].Status)
+				}
+
+				owner := newRoute("owner", ns, "foobar.com", "foo", 10)
+				Expect(mockMgr.addRoute(owner)).To(BeTrue())
+				waiting := newRoute("waiting", otherNs, "foobar.com", "bar", 5)
+				Expect(mockMgr.addRoute(waiting)).To(BeTrue())
+				Expect(admitted(waiting)).To(Equal("False"))
+
+				// The Routes of the previous host are synced on a host change
+				moved := newRoute("owner", ns, "other.com", "foo", 10)
+				moved.ObjectMeta.ResourceVersion = "2"
+				Expect(mockMgr.updateRoute(moved)).To(BeTrue())
+				Expect(admitted(moved)).To(Equal("True"))
+				Expect(admitted(waiting)).To(Equal("True"))
+
+				// And those of the host of a Route deleted while not watched
+				late := newRoute("late", otherNs, "other.com", "bar", 1)
+				Expect(mockMgr.addRoute(late)).To(BeTrue())
+				Expect(admitted(late)).To(Equal("False"))
+				appInf, _ := mockMgr.appMgr.getNamespaceInformer(ns)
+				appInf.routeInformer.GetStore().Delete(moved)
+				mockMgr.appMgr.enqueueRoute(cache.DeletedFinalStateUnknown{
+					Key: ns + "/owner",
+					Obj: moved,
+				})
+				queueLen := mockMgr.appMgr.vsQueue.Len()
+				Expect(queueLen).To(BeNumerically(">", 0))
+				for i := 0; i < queueLen; i++ {
+					mockMgr.appMgr.processNextVirtualServer()
+				}
+				Expect(admitted(late)).To(Equal("True"))
+			})
 		})
 	})
 })
@@ -0,0 +1,278 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	"fmt"
+	"reflect"
+
+	log "github.com/F5Networks/k8s-bigip-ctlr/pkg/vlogger"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
+)
+
+// Picks the server SSL profile of the pool a request goes to
+const backendTlsIRuleName = "backend_tls_irule"
+
+// Suffix of the internal data group that maps the pools of a virtual to
+// their server SSL profiles
+const backendTlsDgSuffix = "_backend_tls_dg"
+
+func formatBackendTlsDgName(vsName string) string {
+	return vsName + backendTlsDgSuffix
+}
+
+// Data group value of pools that keep plain connections
+const backendTlsNone = "none"
+
+// format the server ssl profile name for an Ingress
+func makeIngressServerSSLProfileRef(partition, namespace, name string) ProfileRef {
+	return ProfileRef{
+		Partition: partition,
+		Name:      fmt.Sprintf("ingress_%s_%s-server-ssl", namespace, name),
+		Context:   customProfileServer,
+		Namespace: namespace,
+	}
+}
+
+// Name of the Default for SNI server profile of a virtual whose pools
+// speak TLS
+func formatServerSslDefaultName(vsName string) string {
+	return fmt.Sprintf("default-serverssl-%s", vsName)
+}
+
+func hasBackendTls(ing *v1beta1.Ingress) bool {
+	return getBooleanAnnotation(ing.ObjectMeta.Annotations,
+		f5VsBackendTlsAnnotation, false)
+}
+
+// Use the server SSL profile of the selected pool, or plain connections if
+// the pool is marked as such. Pools missing from the data group are left to
+// the profiles of the virtual.
+func backendTlsIRule() string {
+	iRuleCode := fmt.Sprintf(`
+		when SERVER_CONNECTED {
+			set tls_class "[virtual name]%s"
+			if { not [class exists $tls_class] } {
+				return
+			}
+			set profile [class match -value [LB::server pool] equals $tls_class]
+			if { $profile eq "%s" } {
+				SSL::disable serverside
+			} elseif { $profile ne "" } {
+				SSL::profile $profile
+			}
+		}`, backendTlsDgSuffix, backendTlsNone)
+
+	return iRuleCode
+}
+
+// Build the server SSL profile of an Ingress, and the profile holding the
+// CA of its backends if it verifies them
+func (appMgr *Manager) ingressServerSslProfiles(
+	rsCfg *ResourceConfig,
+	ing *v1beta1.Ingress,
+) (CustomProfile, *CustomProfile, error) {
+	profRef := makeIngressServerSSLProfileRef(
+		rsCfg.Virtual.Partition, ing.ObjectMeta.Namespace, ing.ObjectMeta.Name)
+	serverName := ing.ObjectMeta.Annotations[f5VsBackendServerNameAnnotation]
+	secretName, ok := ing.ObjectMeta.Annotations[f5VsBackendCASecretAnnotation]
+	if !ok {
+		cp := NewCustomProfile(profRef, "", "", serverName, false,
+			peerCertIgnored, "")
+		return cp, nil, nil
+	}
+	secret, err := appMgr.kubeClient.Core().Secrets(ing.ObjectMeta.Namespace).
+		Get(secretName, metav1.GetOptions{})
+	if nil != err {
+		return CustomProfile{}, nil,
+			fmt.Errorf("unable to get CA Secret '%s': %v", secretName, err)
+	}
+	caCert, ok := secret.Data[clientCAKey]
+	if !ok || 0 == len(caCert) {
+		return CustomProfile{}, nil, fmt.Errorf("CA Secret '%s' has no '%s' field",
+			secretName, clientCAKey)
+	}
+	caRef := profRef
+	caRef.Name += "-ca"
+	ca := NewCustomProfile(
+		caRef,
+		string(caCert),
+		"", // no key
+		serverName,
+		false,
+		peerCertRequired,
+		"self",
+	)
+	cp := NewCustomProfile(
+		profRef,
+		string(caCert),
+		"", // no key
+		serverName,
+		false,
+		peerCertRequired,
+		makeCertificateFileName(caRef.Name),
+	)
+	return cp, &ca, nil
+}
+
+// Pools of Ingresses that use neither backend TLS nor a server SSL profile,
+// keyed by the backend TLS data group of their virtual
+type PlainBackendPools map[nameRef]map[string]string
+
+// Remember the pools of an Ingress that keep plain connections
+func (pbp PlainBackendPools) Add(rsCfg *ResourceConfig, ing *v1beta1.Ingress) {
+	dgRef := nameRef{
+		Name:      formatBackendTlsDgName(rsCfg.Virtual.Name),
+		Partition: rsCfg.Virtual.Partition,
+	}
+	pools, found := pbp[dgRef]
+	if !found {
+		pools = make(map[string]string)
+		pbp[dgRef] = pools
+	}
+	for _, svc := range ingressServiceNames(ing) {
+		pool := joinBigipPath(rsCfg.Virtual.Partition,
+			formatIngressPoolName(ing.ObjectMeta.Namespace, svc))
+		pools[pool] = ing.ObjectMeta.Namespace
+	}
+}
+
+// Mark the plain pools of virtuals that have a backend TLS data group, so
+// the iRule disables server SSL for them. Pools already mapped to a profile
+// keep it.
+func (pbp PlainBackendPools) AddToDataGroups(dgMap InternalDataGroupMap) {
+	for dgRef, pools := range pbp {
+		nsDg, found := dgMap[dgRef]
+		if !found {
+			continue
+		}
+		for pool, namespace := range pools {
+			if dg, found := nsDg[namespace]; found {
+				if dg.HasRecord(pool) {
+					continue
+				}
+			}
+			updateDataGroup(dgMap, dgRef.Name, dgRef.Partition, namespace,
+				pool, backendTlsNone)
+		}
+	}
+}
+
+// Create and attach the server SSL profile of an Ingress whose backends
+// speak TLS, and map its pools to the profile. The pools of an Ingress
+// without a server SSL profile are remembered in plainPools. Returns whether
+// the custom profiles changed.
+func (appMgr *Manager) handleIngressBackendTls(
+	rsCfg *ResourceConfig,
+	ing *v1beta1.Ingress,
+	dgMap InternalDataGroupMap,
+	plainPools PlainBackendPools,
+) bool {
+	if nil == rsCfg.Virtual.VirtualAddress ||
+		rsCfg.Virtual.VirtualAddress.BindAddr == "" {
+		return false
+	}
+	if _, ok := ing.ObjectMeta.Annotations[f5ServerSslProfileAnnotation]; ok {
+		if hasBackendTls(ing) {
+			log.Debugf("Both serverssl and backend TLS annotations provided "+
+				"for Ingress: %s, using serverssl.", ing.ObjectMeta.Name)
+		}
+		return false
+	}
+	if !hasBackendTls(ing) {
+		plainPools.Add(rsCfg, ing)
+		return false
+	}
+	cp, ca, err := appMgr.ingressServerSslProfiles(rsCfg, ing)
+	if nil != err {
+		msg := fmt.Sprintf("Not using TLS to the backends of %s: %v",
+			ing.ObjectMeta.Name, err)
+		log.Warning(msg)
+		appMgr.recordEvent(ing, ing.ObjectMeta.Namespace, v1.EventTypeWarning,
+			"InvalidBackendTls", msg)
+		return false
+	}
+	if policy := appMgr.tlsPolicyFor(ing, ing.ObjectMeta); nil != policy {
+		policy.apply(&cp)
+	}
+
+	updated := false
+	setProfile := func(skey secretKey, prof CustomProfile) {
+		if existing, ok := appMgr.customProfiles.profs[skey]; !ok ||
+			!reflect.DeepEqual(existing, prof) {
+			appMgr.customProfiles.profs[skey] = prof
+			updated = true
+		}
+	}
+	sni := ProfileRef{
+		Name:      formatServerSslDefaultName(rsCfg.GetName()),
+		Partition: rsCfg.Virtual.Partition,
+		Context:   customProfileServer,
+	}
+	appMgr.customProfiles.Lock()
+	// This is just a basic profile, so we don't need all the fields
+	setProfile(secretKey{Name: sni.Name, ResourceName: rsCfg.GetName()},
+		NewCustomProfile(sni, "", "", "", true, peerCertIgnored, ""))
+	if nil != ca {
+		setProfile(secretKey{Name: ca.Name}, *ca)
+	}
+	setProfile(secretKey{Name: cp.Name, ResourceName: rsCfg.GetName()}, cp)
+	appMgr.customProfiles.Unlock()
+
+	profRef := makeIngressServerSSLProfileRef(
+		rsCfg.Virtual.Partition, ing.ObjectMeta.Namespace, ing.ObjectMeta.Name)
+	rsCfg.Virtual.AddOrUpdateProfile(sni)
+	rsCfg.Virtual.AddOrUpdateProfile(profRef)
+
+	profile := joinBigipPath(profRef.Partition, profRef.Name)
+	for _, svc := range ingressServiceNames(ing) {
+		pool := joinBigipPath(rsCfg.Virtual.Partition,
+			formatIngressPoolName(ing.ObjectMeta.Namespace, svc))
+		updateDataGroup(dgMap, formatBackendTlsDgName(rsCfg.Virtual.Name),
+			rsCfg.Virtual.Partition, ing.ObjectMeta.Namespace, pool, profile)
+	}
+	appMgr.addIRule(backendTlsIRuleName, rsCfg.Virtual.Partition,
+		backendTlsIRule())
+	rsCfg.Virtual.AddIRule(
+		joinBigipPath(rsCfg.Virtual.Partition, backendTlsIRuleName))
+	return updated
+}
+
+// Remove the Default for SNI server profile from an Ingress virtual once
+// none of its pools speak TLS. Returns whether it was removed.
+func removeUnusedServerSslDefault(cfg *ResourceConfig) bool {
+	sni := ProfileRef{
+		Name:      formatServerSslDefaultName(cfg.GetName()),
+		Partition: cfg.Virtual.Partition,
+		Context:   customProfileServer,
+	}
+	for _, prof := range cfg.Virtual.Profiles {
+		if prof.Context == customProfileServer && prof != sni {
+			return false
+		}
+	}
+	return cfg.Virtual.RemoveProfile(sni)
+}
+
+// Remove the backend TLS iRule from virtuals whose pools no longer speak
+// TLS, and delete it if no virtual uses it
+func (appMgr *Manager) syncBackendTlsIRules() {
+	appMgr.syncHostPathIRule(backendTlsIRuleName, formatBackendTlsDgName)
+}
@@ -0,0 +1,34 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Backend TLS Tests", func() {
+	It("uses the profile of the selected pool", func() {
+		iRule := backendTlsIRule()
+		Expect(iRule).To(ContainSubstring(
+			`set tls_class "[virtual name]_backend_tls_dg"`))
+		Expect(iRule).To(ContainSubstring(`} elseif { $profile ne "" } {
+				SSL::profile $profile`))
+		Expect(iRule).To(ContainSubstring(`if { $profile eq "none" } {
+				SSL::disable serverside`))
+	})
+})
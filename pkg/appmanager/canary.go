@@ -0,0 +1,364 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/F5Networks/k8s-bigip-ctlr/pkg/vlogger"
+
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
+)
+
+// Default value of the canary header that sends a request to the canary;
+// the canary cookie always uses it
+const canaryAlways = "always"
+
+// Suffixes of the rules that send requests with the canary header or cookie
+// to the Services of a canary Ingress
+const (
+	canaryHeaderRuleSuffix = "_canary_header"
+	canaryCookieRuleSuffix = "_canary_cookie"
+)
+
+var canaryNameRegexp = regexp.MustCompile("^[A-Za-z0-9_-]+$")
+
+// Annotations a canary Ingress keeps when it takes those of its primary
+var canaryAnnotations = []string{
+	f5VsCanaryAnnotation,
+	f5VsCanaryByHeaderAnnotation,
+	f5VsCanaryByHeaderValueAnnotation,
+	f5VsCanaryByCookieAnnotation,
+	f5VsCanaryWeightAnnotation,
+}
+
+// Settings of a canary Ingress, which takes part of the traffic for the
+// hosts and paths it shares with a primary Ingress
+type canary struct {
+	Header      string
+	HeaderValue string
+	Cookie      string
+	Weight      int
+}
+
+func isCanaryIngress(ing *v1beta1.Ingress) bool {
+	return ing.ObjectMeta.Annotations[f5VsCanaryAnnotation] == "true"
+}
+
+// Name the weighted pool that shares the traffic of a primary pool with
+// a canary Ingress
+func formatCanaryPoolName(primaryPool, ing string) string {
+	return fmt.Sprintf("%s_canary_%s", primaryPool, ing)
+}
+
+// Parse the canary annotations of an Ingress. Returns nil if the Ingress
+// is not a canary.
+func parseCanary(annotations map[string]string) (*canary, error) {
+	if annotations[f5VsCanaryAnnotation] != "true" {
+		return nil, nil
+	}
+	c := canary{
+		Header:      annotations[f5VsCanaryByHeaderAnnotation],
+		HeaderValue: annotations[f5VsCanaryByHeaderValueAnnotation],
+		Cookie:      annotations[f5VsCanaryByCookieAnnotation],
+	}
+	if c.HeaderValue == "" {
+		c.HeaderValue = canaryAlways
+	}
+	if c.Header != "" && !canaryNameRegexp.MatchString(c.Header) {
+		return nil, fmt.Errorf("invalid canary header '%s'", c.Header)
+	}
+	if c.Cookie != "" && !canaryNameRegexp.MatchString(c.Cookie) {
+		return nil, fmt.Errorf("invalid canary cookie '%s'", c.Cookie)
+	}
+	if val, ok := annotations[f5VsCanaryWeightAnnotation]; ok {
+		weight, err := strconv.Atoi(val)
+		if nil != err || weight < 0 || weight > 100 {
+			return nil, fmt.Errorf("canary weight must be from 0 to 100, not '%s'",
+				val)
+		}
+		c.Weight = weight
+	}
+	if c.Header == "" && c.Cookie == "" && c.Weight == 0 {
+		return nil, fmt.Errorf("canary needs a header, a cookie or a weight")
+	}
+	return &c, nil
+}
+
+// Return the hosts and paths of an Ingress
+func ingressHostPaths(ing *v1beta1.Ingress) map[string]bool {
+	hostPaths := make(map[string]bool)
+	for _, rule := range ing.Spec.Rules {
+		if nil == rule.IngressRuleValue.HTTP {
+			continue
+		}
+		for _, path := range rule.IngressRuleValue.HTTP.Paths {
+			hostPaths[rule.Host+path.Path] = true
+		}
+	}
+	return hostPaths
+}
+
+// Return the names of the Services of an Ingress
+func ingressServiceNames(ing *v1beta1.Ingress) []string {
+	var names []string
+	if nil != ing.Spec.Backend {
+		names = append(names, ing.Spec.Backend.ServiceName)
+	}
+	for _, rule := range ing.Spec.Rules {
+		if nil == rule.IngressRuleValue.HTTP {
+			continue
+		}
+		for _, path := range rule.IngressRuleValue.HTTP.Paths {
+			if !contains(names, path.Backend.ServiceName) {
+				names = append(names, path.Backend.ServiceName)
+			}
+		}
+	}
+	return names
+}
+
+// Find the primary of a canary Ingress: the first Ingress by name of the
+// same class that is not a canary and shares a host and path with it
+func findCanaryPrimary(
+	ing *v1beta1.Ingress,
+	ingresses []*v1beta1.Ingress,
+) *v1beta1.Ingress {
+	hostPaths := ingressHostPaths(ing)
+	class := ing.ObjectMeta.Annotations[k8sIngressClass]
+	var candidates []string
+	byName := make(map[string]*v1beta1.Ingress)
+	for _, other := range ingresses {
+		if other.ObjectMeta.Namespace != ing.ObjectMeta.Namespace ||
+			isCanaryIngress(other) ||
+			other.ObjectMeta.Annotations[k8sIngressClass] != class {
+			continue
+		}
+		for hostPath := range ingressHostPaths(other) {
+			if hostPaths[hostPath] {
+				candidates = append(candidates, other.ObjectMeta.Name)
+				byName[other.ObjectMeta.Name] = other
+				break
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	sort.Strings(candidates)
+	return byName[candidates[0]]
+}
+
+// Return a copy of a canary Ingress with the annotations and TLS of its
+// primary, so it lands on the virtual servers of the primary and its rules
+// match like those of the primary. Only the paths shared with the primary
+// are kept. The weights of the primary's backends are left out, as the
+// canary weight takes their place.
+func canaryIngress(ing, primary *v1beta1.Ingress) *v1beta1.Ingress {
+	annotations := make(map[string]string)
+	for key, val := range primary.ObjectMeta.Annotations {
+		if key != f5VsBackendWeightsAnnotation {
+			annotations[key] = val
+		}
+	}
+	for _, key := range canaryAnnotations {
+		if val, ok := ing.ObjectMeta.Annotations[key]; ok {
+			annotations[key] = val
+		} else {
+			delete(annotations, key)
+		}
+	}
+
+	derived := *ing
+	derived.ObjectMeta.Annotations = annotations
+	derived.Spec.TLS = primary.Spec.TLS
+	derived.Spec.Backend = nil
+	derived.Spec.Rules = nil
+	shared := ingressHostPaths(primary)
+	for _, rule := range ing.Spec.Rules {
+		if nil == rule.IngressRuleValue.HTTP {
+			continue
+		}
+		var paths []v1beta1.HTTPIngressPath
+		for _, path := range rule.IngressRuleValue.HTTP.Paths {
+			if shared[rule.Host+path.Path] {
+				paths = append(paths, path)
+			}
+		}
+		if len(paths) > 0 {
+			derived.Spec.Rules = append(derived.Spec.Rules, v1beta1.IngressRule{
+				Host: rule.Host,
+				IngressRuleValue: v1beta1.IngressRuleValue{
+					HTTP: &v1beta1.HTTPIngressRuleValue{Paths: paths},
+				},
+			})
+		}
+	}
+	return &derived
+}
+
+// Return a canary Ingress ready to be configured with its primary, or nil
+// if its settings are invalid or it has no primary
+func (appMgr *Manager) prepareCanaryIngress(
+	ing *v1beta1.Ingress,
+	ingresses []*v1beta1.Ingress,
+) *v1beta1.Ingress {
+	if _, err := parseCanary(ing.ObjectMeta.Annotations); nil != err {
+		msg := fmt.Sprintf("Not configuring canary Ingress %s: %v",
+			ing.ObjectMeta.Name, err)
+		log.Warning(msg)
+		appMgr.recordEvent(ing, ing.ObjectMeta.Namespace, v1.EventTypeWarning,
+			"InvalidCanary", msg)
+		return nil
+	}
+	primary := findCanaryPrimary(ing, ingresses)
+	if nil == primary {
+		msg := fmt.Sprintf("Not configuring canary Ingress %s: no Ingress in "+
+			"namespace %s shares its hosts and paths", ing.ObjectMeta.Name,
+			ing.ObjectMeta.Namespace)
+		log.Warning(msg)
+		appMgr.recordEvent(ing, ing.ObjectMeta.Namespace, v1.EventTypeWarning,
+			"CanaryPrimaryNotFound", msg)
+		return nil
+	}
+	return canaryIngress(ing, primary)
+}
+
+func isCanaryRule(name string) bool {
+	return strings.HasSuffix(name, canaryHeaderRuleSuffix) ||
+		strings.HasSuffix(name, canaryCookieRuleSuffix)
+}
+
+// Copy a rule, renamed and with a condition added
+func canaryRule(rl *Rule, suffix string, cond RuleCondition) *Rule {
+	crl := *rl
+	crl.Name = rl.Name + suffix
+	crl.Conditions = append([]*condition{}, rl.Conditions...)
+	addRuleConditions(&crl, []RuleCondition{cond})
+	return &crl
+}
+
+// Return the rules that send requests with the canary header or cookie to
+// the Services of a canary Ingress, from its plain forwarding rules
+func canaryHeaderRules(rls Rules, c *canary) Rules {
+	var canaryRls Rules
+	for _, rl := range rls {
+		if strings.HasSuffix(rl.Name, appRootRuleSuffix) {
+			// The primary redirects the application root already
+			continue
+		}
+		if c.Header != "" {
+			canaryRls = append(canaryRls, canaryRule(rl, canaryHeaderRuleSuffix,
+				RuleCondition{
+					Type:   conditionHeader,
+					Name:   c.Header,
+					Values: []string{c.HeaderValue},
+				}))
+		}
+		if c.Cookie != "" {
+			canaryRls = append(canaryRls, canaryRule(rl, canaryCookieRuleSuffix,
+				RuleCondition{
+					Type:   conditionCookie,
+					Name:   c.Cookie,
+					Values: []string{canaryAlways},
+				}))
+		}
+	}
+	orderIngressRules(canaryRls)
+	return canaryRls
+}
+
+// Return the rules of the primary that match like the plain forwarding
+// rules of a canary Ingress, changed to forward to weighted pools giving
+// the canary Services their weight, along with those pools
+func canaryWeightedRules(
+	rls Rules,
+	primary *Policy,
+	pools Pools,
+	weight int,
+	ing string,
+) (Rules, Pools) {
+	var weightedRls Rules
+	var weighted Pools
+	canarySuffix := formatCanaryPoolName("", ing)
+	for _, rl := range rls {
+		if strings.HasSuffix(rl.Name, appRootRuleSuffix) || len(rl.Actions) == 0 {
+			continue
+		}
+		_, canaryPool := splitBigipPath(rl.Actions[0].Pool, false)
+		for _, prl := range primary.Rules {
+			if prl.FullURI != rl.FullURI || prl.Name == rl.Name ||
+				isCanaryRule(prl.Name) || len(prl.Actions) == 0 ||
+				!prl.Actions[0].Forward ||
+				!reflect.DeepEqual(prl.Conditions, rl.Conditions) {
+				continue
+			}
+			partition, primaryPool := splitBigipPath(prl.Actions[0].Pool, false)
+			// Once weighted, the rule forwards to the pool of this canary
+			primaryPool = strings.TrimSuffix(primaryPool, canarySuffix)
+			if primaryPool == canaryPool {
+				continue
+			}
+
+			pool := Pool{
+				Name:      formatCanaryPoolName(primaryPool, ing),
+				Partition: partition,
+				Balance:   weightedPoolBalance,
+			}
+			// A weighted primary keeps its shares within what is left
+			total := 0
+			for _, pl := range pools {
+				if pl.Name != primaryPool {
+					continue
+				}
+				for _, backend := range pl.Backends {
+					total += backend.Weight
+					pool.Backends = append(pool.Backends, PoolBackend{
+						Pool:   backend.Pool,
+						Weight: backend.Weight * (100 - weight),
+					})
+				}
+			}
+			if total == 0 {
+				total = 1
+				pool.Backends = []PoolBackend{{
+					Pool:   primaryPool,
+					Weight: 100 - weight,
+				}}
+			}
+			pool.Backends = append(pool.Backends, PoolBackend{
+				Pool:   canaryPool,
+				Weight: weight * total,
+			})
+
+			wrl := *prl
+			wrl.Actions = append([]*action{}, prl.Actions...)
+			fwd := *prl.Actions[0]
+			fwd.Pool = joinBigipPath(partition, pool.Name)
+			wrl.Actions[0] = &fwd
+			weightedRls = append(weightedRls, &wrl)
+			weighted = append(weighted, pool)
+		}
+	}
+	return weightedRls, weighted
+}
@@ -0,0 +1,55 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Canary Tests", func() {
+	It("parses canary settings", func() {
+		c, err := parseCanary(map[string]string{})
+		Expect(err).To(BeNil())
+		Expect(c).To(BeNil())
+
+		c, err = parseCanary(map[string]string{
+			f5VsCanaryAnnotation:         "true",
+			f5VsCanaryByHeaderAnnotation: "X-Canary",
+			f5VsCanaryByCookieAnnotation: "canary",
+			f5VsCanaryWeightAnnotation:   "10",
+		})
+		Expect(err).To(BeNil())
+		Expect(*c).To(Equal(canary{
+			Header:      "X-Canary",
+			HeaderValue: canaryAlways,
+			Cookie:      "canary",
+			Weight:      10,
+		}))
+
+		for _, annotations := range []map[string]string{
+			{f5VsCanaryAnnotation: "true"},
+			{f5VsCanaryAnnotation: "true", f5VsCanaryByHeaderAnnotation: "X Canary"},
+			{f5VsCanaryAnnotation: "true", f5VsCanaryByCookieAnnotation: "can;ary"},
+			{f5VsCanaryAnnotation: "true", f5VsCanaryWeightAnnotation: "101"},
+			{f5VsCanaryAnnotation: "true", f5VsCanaryWeightAnnotation: "ten"},
+		} {
+			_, err = parseCanary(annotations)
+			Expect(err).ToNot(BeNil(), "%v", annotations)
+		}
+	})
+})
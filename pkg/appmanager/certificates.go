@@ -0,0 +1,178 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	bigIPPrometheus "github.com/F5Networks/k8s-bigip-ctlr/pkg/prometheus"
+	log "github.com/F5Networks/k8s-bigip-ctlr/pkg/vlogger"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const defaultCertExpiryWarningDays = 30
+
+func certExpiryWarning(days int) time.Duration {
+	if days <= 0 {
+		days = defaultCertExpiryWarningDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// Certificate and days left before it expires, as last warned about
+type certWarning struct {
+	fingerprint [sha256.Size]byte
+	daysLeft    int
+}
+
+// Return whether an expiry warning for the certificate of a profile is
+// new, remembering it. Warnings repeat only once the certificate changes or
+// another day has passed.
+func (appMgr *Manager) newCertWarning(
+	meta metav1.ObjectMeta,
+	profile string,
+	crt *x509.Certificate,
+	now time.Time,
+) bool {
+	key := strings.Join([]string{meta.Namespace, meta.Name, profile}, "/")
+	appMgr.certWarningsMutex.Lock()
+	defer appMgr.certWarningsMutex.Unlock()
+	if nil == crt {
+		delete(appMgr.certWarnings, key)
+		return false
+	}
+	warning := certWarning{
+		fingerprint: sha256.Sum256(crt.Raw),
+		daysLeft:    int(crt.NotAfter.Sub(now) / (24 * time.Hour)),
+	}
+	if old, ok := appMgr.certWarnings[key]; ok && old == warning {
+		return false
+	}
+	appMgr.certWarnings[key] = warning
+	return true
+}
+
+// Parse the first certificate of a PEM bundle, and check that it has not
+// expired and matches its key. Returns nil if there is no certificate to
+// parse, leaving it to the BIG-IP to validate.
+func parseCertificate(cert, key string, now time.Time) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(cert))
+	if nil == block || block.Type != "CERTIFICATE" {
+		return nil, nil
+	}
+	crt, err := x509.ParseCertificate(block.Bytes)
+	if nil != err {
+		return nil, fmt.Errorf("unable to parse certificate: %v", err)
+	}
+	if now.After(crt.NotAfter) {
+		return nil, fmt.Errorf("certificate expired on %s",
+			crt.NotAfter.UTC().Format(time.RFC3339))
+	}
+	if keyBlock, _ := pem.Decode([]byte(key)); nil != keyBlock {
+		if _, err := tls.X509KeyPair([]byte(cert), []byte(key)); nil != err {
+			return nil, fmt.Errorf("certificate does not match its key: %v", err)
+		}
+	}
+	return crt, nil
+}
+
+// Check the certificate of a profile created for an object, recording an
+// event if it is refused or is about to expire. Expiry events are recorded
+// once per certificate and day left.
+func (appMgr *Manager) checkCertificate(
+	obj runtime.Object,
+	meta metav1.ObjectMeta,
+	profile string,
+	cert string,
+	key string,
+) (*x509.Certificate, error) {
+	now := time.Now()
+	crt, err := parseCertificate(cert, key, now)
+	if nil != err {
+		msg := fmt.Sprintf("Not using the certificate of profile %s for %s: %v",
+			profile, meta.Name, err)
+		log.Warning(msg)
+		appMgr.recordEvent(obj, meta.Namespace, v1.EventTypeWarning,
+			"InvalidCertificate", msg)
+		appMgr.newCertWarning(meta, profile, nil, now)
+		return nil, err
+	}
+	expiring := crt
+	if nil != crt && crt.NotAfter.Sub(now) >= appMgr.certExpiryWarning {
+		expiring = nil
+	}
+	if appMgr.newCertWarning(meta, profile, expiring, now) {
+		msg := fmt.Sprintf("The certificate of profile %s for %s expires on %s",
+			profile, meta.Name, crt.NotAfter.UTC().Format(time.RFC3339))
+		log.Warning(msg)
+		appMgr.recordEvent(obj, meta.Namespace, v1.EventTypeWarning,
+			"CertificateExpiring", msg)
+	}
+	return crt, nil
+}
+
+// Export the expiry of the certificate of a custom profile. Must be called
+// with the customProfiles lock held.
+func (appMgr *Manager) setCertificateExpiry(
+	skey secretKey,
+	crt *x509.Certificate,
+	meta metav1.ObjectMeta,
+	profile string,
+) {
+	if nil == crt {
+		appMgr.deleteCertificateExpiry(skey)
+		return
+	}
+	labels := []string{meta.Namespace, meta.Name, profile}
+	if old, ok := appMgr.customProfiles.certs[skey]; ok &&
+		!reflect.DeepEqual(old, labels) {
+		appMgr.deleteCertificateExpiry(skey)
+	}
+	appMgr.customProfiles.certs[skey] = labels
+	bigIPPrometheus.CertificateExpiry.WithLabelValues(labels...).Set(
+		float64(crt.NotAfter.Unix()))
+}
+
+// Stop exporting the expiry of the certificate of a custom profile, unless
+// another profile exports the same one. Must be called with the
+// customProfiles lock held.
+func (appMgr *Manager) deleteCertificateExpiry(skey secretKey) {
+	labels, ok := appMgr.customProfiles.certs[skey]
+	if !ok {
+		return
+	}
+	delete(appMgr.customProfiles.certs, skey)
+	appMgr.certWarningsMutex.Lock()
+	delete(appMgr.certWarnings, strings.Join(labels, "/"))
+	appMgr.certWarningsMutex.Unlock()
+	for _, other := range appMgr.customProfiles.certs {
+		if reflect.DeepEqual(other, labels) {
+			return
+		}
+	}
+	bigIPPrometheus.CertificateExpiry.DeleteLabelValues(labels...)
+}
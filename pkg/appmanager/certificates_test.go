@@ -0,0 +1,104 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Create a self-signed certificate valid until notAfter, and its key
+func newTestCertificate(notAfter time.Time) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).To(BeNil())
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "foo.com"},
+		NotBefore:    notAfter.Add(-365 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(
+		rand.Reader, &template, &template, &key.PublicKey, key)
+	Expect(err).To(BeNil())
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	Expect(err).To(BeNil())
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	return string(cert), string(keyPem)
+}
+
+var _ = Describe("Certificate Tests", func() {
+	It("checks certificates and keys", func() {
+		now := time.Now()
+		// Certificates that cannot be parsed are left to the BIG-IP
+		crt, err := parseCertificate("testcert", "testkey", now)
+		Expect(err).To(BeNil())
+		Expect(crt).To(BeNil())
+
+		notAfter := now.Add(90 * 24 * time.Hour).Truncate(time.Second)
+		cert, key := newTestCertificate(notAfter)
+		crt, err = parseCertificate(cert, key, now)
+		Expect(err).To(BeNil())
+		Expect(crt.NotAfter.Equal(notAfter)).To(BeTrue())
+
+		_, otherKey := newTestCertificate(notAfter)
+		_, err = parseCertificate(cert, otherKey, now)
+		Expect(err).ToNot(BeNil())
+
+		_, err = parseCertificate(cert, key, notAfter.Add(time.Hour))
+		Expect(err).ToNot(BeNil())
+
+		Expect(certExpiryWarning(0)).To(Equal(30 * 24 * time.Hour))
+		Expect(certExpiryWarning(7)).To(Equal(7 * 24 * time.Hour))
+	})
+
+	It("warns once per certificate and day left", func() {
+		appMgr := &Manager{certWarnings: make(map[string]certWarning)}
+		meta := metav1.ObjectMeta{Namespace: "default", Name: "ingress"}
+		now := time.Now()
+		cert, key := newTestCertificate(now.Add(10 * 24 * time.Hour))
+		crt, err := parseCertificate(cert, key, now)
+		Expect(err).To(BeNil())
+		Expect(appMgr.newCertWarning(meta, "profile", crt, now)).To(BeTrue())
+		Expect(appMgr.newCertWarning(meta, "profile", crt, now)).To(BeFalse())
+		Expect(appMgr.newCertWarning(meta, "other", crt, now)).To(BeTrue())
+
+		// A day later, or with a new certificate, it warns again
+		later := now.Add(24 * time.Hour)
+		Expect(appMgr.newCertWarning(meta, "profile", crt, later)).To(BeTrue())
+		cert, key = newTestCertificate(now.Add(10 * 24 * time.Hour))
+		crt, err = parseCertificate(cert, key, now)
+		Expect(err).To(BeNil())
+		Expect(appMgr.newCertWarning(meta, "profile", crt, later)).To(BeTrue())
+
+		// Once it is replaced by a certificate that is not expiring, the
+		// warning is forgotten
+		Expect(appMgr.newCertWarning(meta, "profile", nil, later)).To(BeFalse())
+		Expect(appMgr.certWarnings).ToNot(HaveKey("default/ingress/profile"))
+	})
+})
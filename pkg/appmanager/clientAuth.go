@@ -0,0 +1,240 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	"fmt"
+
+	log "github.com/F5Networks/k8s-bigip-ctlr/pkg/vlogger"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
+)
+
+// Forwards the subject of verified client certificates to the backends
+const clientCertIRuleName = "client_cert_header_irule"
+
+// Suffix of the internal data group that holds the client certificate
+// header of each host and path of a virtual
+const clientCertDgSuffix = "_client_cert_dg"
+
+// Keys of the CA bundle and revocation list in a client CA Secret
+const clientCAKey = "ca.crt"
+const clientCrlKey = "ca.crl"
+
+// Client certificate authentication for the SSL profiles created from the
+// Secrets of an object
+type clientAuth struct {
+	mode string
+	// CA file profile holding the CA bundle and CRL
+	ca CustomProfile
+}
+
+func formatClientCAName(namespace, secret string) string {
+	return fmt.Sprintf("%s-%s-client-ca", namespace, secret)
+}
+
+// Make a client SSL profile ask for client certificates
+func (a *clientAuth) apply(cp *CustomProfile) {
+	cp.PeerCertMode = a.mode
+	cp.CAFile = makeCertificateFileName(a.ca.Name)
+	cp.CrlFile = ""
+	if a.ca.Crl != "" {
+		cp.CrlFile = makeCrlFileName(a.ca.Name)
+	}
+}
+
+// Read the client certificate annotations of an object and the Secret
+// holding its CA bundle. Returns nil if the object does not ask for client
+// certificates.
+func (appMgr *Manager) parseClientAuth(
+	meta metav1.ObjectMeta,
+	partition string,
+) (*clientAuth, error) {
+	secretName, ok := meta.Annotations[f5VsClientCASecretAnnotation]
+	mode, modeOk := meta.Annotations[f5VsClientCertModeAnnotation]
+	if !ok {
+		if modeOk {
+			return nil, fmt.Errorf("'%s' needs a CA Secret in '%s'",
+				f5VsClientCertModeAnnotation, f5VsClientCASecretAnnotation)
+		}
+		return nil, nil
+	}
+	if !modeOk {
+		mode = peerCertRequired
+	}
+	if mode != peerCertRequired && mode != peerCertRequested {
+		return nil, fmt.Errorf("client certificate mode must be '%s' or '%s', "+
+			"not '%s'", peerCertRequired, peerCertRequested, mode)
+	}
+	secret, err := appMgr.kubeClient.Core().Secrets(meta.Namespace).
+		Get(secretName, metav1.GetOptions{})
+	if nil != err {
+		return nil, fmt.Errorf("unable to get CA Secret '%s': %v", secretName, err)
+	}
+	caCert, ok := secret.Data[clientCAKey]
+	if !ok || 0 == len(caCert) {
+		return nil, fmt.Errorf("CA Secret '%s' has no '%s' field",
+			secretName, clientCAKey)
+	}
+	caRef := ProfileRef{
+		Name:      formatClientCAName(meta.Namespace, secretName),
+		Partition: partition,
+		Context:   customProfileClient,
+	}
+	ca := NewCustomProfile(
+		caRef,
+		string(caCert),
+		"",    // no key
+		"",    // no serverName
+		false, // sni
+		peerCertRequired,
+		"self", // 'self' indicates this file is the CA file
+	)
+	ca.Crl = string(secret.Data[clientCrlKey])
+	return &clientAuth{mode: mode, ca: ca}, nil
+}
+
+// Return the client certificate authentication of an object, recording an
+// event if it is invalid or its revocation list cannot be applied
+func (appMgr *Manager) clientAuthFor(
+	obj runtime.Object,
+	meta metav1.ObjectMeta,
+	partition string,
+) *clientAuth {
+	auth, err := appMgr.parseClientAuth(meta, partition)
+	if nil != err {
+		msg := fmt.Sprintf("Not requesting client certificates for %s: %v",
+			meta.Name, err)
+		log.Warning(msg)
+		appMgr.recordEvent(obj, meta.Namespace, v1.EventTypeWarning,
+			"InvalidClientAuth", msg)
+		return nil
+	}
+	if nil != auth && auth.ca.Crl != "" && !appMgr.checkDriverFeature(obj,
+		meta, driverFeatureClientCrl, "the client certificate revocation list") {
+		auth.ca.Crl = ""
+	}
+	return auth
+}
+
+func formatClientCertDgName(vsName string) string {
+	return vsName + clientCertDgSuffix
+}
+
+// Replace the client certificate header with the subject of the verified
+// client certificate, so clients cannot send the header themselves. On a
+// virtual without a client SSL profile the header is only removed.
+func clientCertIRule() string {
+	iRuleCode := fmt.Sprintf(`
+		when HTTP_REQUEST {
+			set class "[virtual name]%s"
+			if { not [class exists $class] } {
+				return
+			}
+			%s
+			set header $record
+			if { $header eq "" } {
+				return
+			}
+			HTTP::header remove $header
+			if { [PROFILE::exists clientssl] && [SSL::cert count] > 0 &&
+				[SSL::verify_result] == 0 } {
+				HTTP::header insert $header [X509::subject [SSL::cert 0]]
+			}
+		}`, clientCertDgSuffix, hostPathMatch)
+
+	return iRuleCode
+}
+
+// Record the client certificate header of an object for the given keys of
+// its HTTPS virtual, and add the header iRule to the virtual
+func (appMgr *Manager) setClientCertHeader(
+	rsCfg *ResourceConfig,
+	obj runtime.Object,
+	meta metav1.ObjectMeta,
+	keys []string,
+	dgMap InternalDataGroupMap,
+) {
+	header, ok := meta.Annotations[f5VsClientCertHeaderAnnotation]
+	if !ok {
+		return
+	}
+	var err error
+	if !persistHeaderRegexp.MatchString(header) {
+		err = fmt.Errorf("invalid header name '%s'", header)
+	} else if !isHttpVirtual(rsCfg) {
+		err = fmt.Errorf("virtual server %s has no HTTP profile",
+			rsCfg.Virtual.Name)
+	}
+	if nil != err {
+		msg := fmt.Sprintf("Not forwarding client certificates for %s: %v",
+			meta.Name, err)
+		log.Warning(msg)
+		appMgr.recordEvent(obj, meta.Namespace, v1.EventTypeWarning,
+			"InvalidClientAuth", msg)
+		return
+	}
+	for _, key := range keys {
+		updateDataGroup(dgMap, formatClientCertDgName(rsCfg.Virtual.Name),
+			rsCfg.Virtual.Partition, meta.Namespace, key, header)
+	}
+	appMgr.addIRule(clientCertIRuleName, rsCfg.Virtual.Partition,
+		clientCertIRule())
+	rsCfg.Virtual.AddIRule(
+		joinBigipPath(rsCfg.Virtual.Partition, clientCertIRuleName))
+}
+
+// Forward the client certificates of an Ingress for each of its hosts and
+// paths on its HTTPS virtual. Its HTTP virtual removes the header, so
+// clients sending plain HTTP cannot set it.
+func (appMgr *Manager) handleIngressClientCertHeader(
+	rsCfg *ResourceConfig,
+	ing *v1beta1.Ingress,
+	dgMap InternalDataGroupMap,
+) {
+	if 0 == len(ing.Spec.TLS) ||
+		nil == rsCfg.Virtual.VirtualAddress ||
+		rsCfg.Virtual.VirtualAddress.BindAddr == "" {
+		return
+	}
+	appMgr.setClientCertHeader(rsCfg, ing, ing.ObjectMeta,
+		ingressHostPathKeys(ing), dgMap)
+}
+
+// Forward the client certificates of a ConfigMap virtual with an SSL profile
+func (appMgr *Manager) handleConfigMapClientCertHeader(
+	rsCfg *ResourceConfig,
+	cm *v1.ConfigMap,
+	dgMap InternalDataGroupMap,
+) {
+	if nil == rsCfg.Virtual.VirtualAddress ||
+		rsCfg.Virtual.VirtualAddress.BindAddr == "" ||
+		0 == rsCfg.Virtual.GetProfileCountByContext(customProfileClient) {
+		return
+	}
+	appMgr.setClientCertHeader(rsCfg, cm, cm.ObjectMeta,
+		[]string{sourceRangeKey("", "")}, dgMap)
+}
+
+// Remove the client certificate iRule from virtuals that no longer forward
+// the header, and delete it if no virtual uses it
+func (appMgr *Manager) syncClientCertIRules() {
+	appMgr.syncHostPathIRule(clientCertIRuleName, formatClientCertDgName)
+}
@@ -0,0 +1,95 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	"fmt"
+
+	log "github.com/F5Networks/k8s-bigip-ctlr/pkg/vlogger"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// Settings the controller can write that the config driver it ships with
+// does not apply yet. Each stays out of the config until it is enabled
+// with the driver-feature option, for a driver that supports it.
+const (
+	// Profiles created from settings (tunedProfiles)
+	driverFeatureTunedProfiles = "tuned-profiles"
+	// TLS settings of the SSL profiles created from Secrets (ciphers,
+	// tmOptions, renegotiation, sessionTicket, ocspStapling, ocsp)
+	driverFeatureSslProfileSettings = "ssl-profile-settings"
+	// Revocation lists of client CAs (crlFile, crl)
+	driverFeatureClientCrl = "client-crl"
+	// Security policies and profiles of virtuals (wafPolicy, dosProfile,
+	// botDefenseProfile, securityLogProfiles)
+	driverFeatureSecurityPolicies = "security-policies"
+	// Access profiles and policies of virtuals (accessProfile,
+	// connectivityProfile, perRequestPolicy)
+	driverFeatureAccessPolicies = "access-policies"
+	// Firewall policies made from rules, and their enforcement on virtuals
+	// (firewallPolicies, firewallEnforcedPolicy)
+	driverFeatureFirewallPolicies = "firewall-policies"
+	// Ratios of the members of weighted pools (ratio), which split the
+	// traffic of A/B Routes and of Ingress paths with several Services
+	driverFeaturePoolMemberRatio = "pool-member-ratio"
+)
+
+// Names of the driver features that can be enabled
+var DriverFeatures = []string{
+	driverFeatureTunedProfiles,
+	driverFeatureSslProfileSettings,
+	driverFeatureClientCrl,
+	driverFeatureSecurityPolicies,
+	driverFeatureAccessPolicies,
+	driverFeatureFirewallPolicies,
+	driverFeaturePoolMemberRatio,
+}
+
+// Return whether a driver feature is one the controller knows
+func IsDriverFeature(name string) bool {
+	return contains(DriverFeatures, name)
+}
+
+func newDriverFeatures(names []string) map[string]bool {
+	features := make(map[string]bool)
+	for _, name := range names {
+		features[name] = true
+	}
+	return features
+}
+
+// Return whether the driver supports a feature. If it does not, an event
+// tells the object what it asked for is left out.
+func (appMgr *Manager) checkDriverFeature(
+	obj runtime.Object,
+	meta metav1.ObjectMeta,
+	feature string,
+	what string,
+) bool {
+	if appMgr.driverFeatures[feature] {
+		return true
+	}
+	msg := fmt.Sprintf("Not configuring %s for %s: the BIG-IP driver "+
+		"feature '%s' is not enabled", what, meta.Name, feature)
+	log.Warning(msg)
+	appMgr.recordEvent(obj, meta.Namespace, v1.EventTypeWarning,
+		"UnsupportedDriverFeature", msg)
+	return false
+}
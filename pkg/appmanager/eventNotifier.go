@@ -124,3 +124,25 @@ func (appMgr *Manager) recordIngressEvent(
 		namespace, appMgr.kubeClient.Core())
 	evNotifier.recordEvent(ing, v1.EventTypeNormal, reason, message)
 }
+
+func (appMgr *Manager) recordServiceEvent(
+	svc *v1.Service,
+	eventType,
+	reason,
+	message string,
+) {
+	appMgr.recordEvent(svc, svc.ObjectMeta.Namespace, eventType, reason, message)
+}
+
+// Record an event of any type against any object in a namespace
+func (appMgr *Manager) recordEvent(
+	obj runtime.Object,
+	namespace,
+	eventType,
+	reason,
+	message string,
+) {
+	evNotifier := appMgr.eventNotifier.createNotifierForNamespace(
+		namespace, appMgr.kubeClient.Core())
+	evNotifier.recordEvent(obj, eventType, reason, message)
+}
@@ -23,6 +23,7 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
+	routeapi "github.com/openshift/origin/pkg/route/api"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/watch"
@@ -54,6 +55,22 @@ func NewFakeEvent(
 		ing := obj.(*v1beta1.Ingress)
 		namespace = ing.ObjectMeta.Namespace
 		name = ing.ObjectMeta.Name
+	case *v1.Service:
+		svc := obj.(*v1.Service)
+		namespace = svc.ObjectMeta.Namespace
+		name = svc.ObjectMeta.Name
+	case *v1.ConfigMap:
+		cm := obj.(*v1.ConfigMap)
+		namespace = cm.ObjectMeta.Namespace
+		name = cm.ObjectMeta.Name
+	case *routeapi.Route:
+		route := obj.(*routeapi.Route)
+		namespace = route.ObjectMeta.Namespace
+		name = route.ObjectMeta.Name
+	case *v1.ObjectReference:
+		ref := obj.(*v1.ObjectReference)
+		namespace = ref.Namespace
+		name = ref.Name
 	default:
 		// Set namespace and name to the error message
 		namespace = fmt.Sprintf("NewFakeEvent: Unhandled object type: %T\n", obj)
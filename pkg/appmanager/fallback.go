@@ -0,0 +1,465 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/F5Networks/k8s-bigip-ctlr/pkg/vlogger"
+
+	routeapi "github.com/openshift/origin/pkg/route/api"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Sends requests for pools without active members to their fallback pool,
+// or answers them with the maintenance page
+const fallbackIRuleName = "fallback_irule"
+
+// Suffix of the internal data group that holds the fallbacks of a virtual.
+// The key of a pool's fallback pool is the pool's path; the status, content
+// type and body of its maintenance page are keyed by the path, a space and
+// "status", "type" or "page".
+const fallbackDgSuffix = "_fallback_dg"
+
+// Status of the maintenance page if the annotation does not set one
+const defaultMaintenanceStatus = 503
+
+// Keys of the maintenance page ConfigMap
+const (
+	maintenancePageBodyKey = "body"
+	maintenancePageTypeKey = "content-type"
+)
+
+const defaultMaintenancePageType = "text/html; charset=utf-8"
+
+// Label of the ConfigMaps that hold maintenance pages. Only those are
+// watched, rather than every ConfigMap of the watched namespaces.
+var maintenancePageSelector = labels.SelectorFromSet(
+	labels.Set{"f5type": "maintenance-page"})
+
+// A Service that takes the requests of a pool whose members are all down
+type fallbackService struct {
+	Name string
+	Port int32
+}
+
+// Fallback settings of an Ingress or Route
+type fallbackConfig struct {
+	// Fallback for all the pools of the Ingress or Route
+	Service *fallbackService
+	// Fallbacks for the pools of some Services, overriding Service
+	Services map[string]fallbackService
+	// Name of the ConfigMap with the maintenance page
+	Page   string
+	Status int
+}
+
+func formatFallbackDgName(vsName string) string {
+	return vsName + fallbackDgSuffix
+}
+
+// Parse a fallback Service given as name:port, or name for port 80
+func parseFallbackService(val string) (fallbackService, error) {
+	fs := fallbackService{Name: val, Port: DEFAULT_HTTP_PORT}
+	if sep := strings.LastIndex(val, ":"); sep >= 0 {
+		port, err := strconv.Atoi(val[sep+1:])
+		if nil != err || port < 1 || port > 65535 {
+			return fs, fmt.Errorf("invalid port in fallback service '%s'", val)
+		}
+		fs.Name = val[:sep]
+		fs.Port = int32(port)
+	}
+	if fs.Name == "" {
+		return fs, fmt.Errorf("fallback service '%s' has no name", val)
+	}
+	return fs, nil
+}
+
+// Parse the fallback annotations of an Ingress or Route. Returns nil if
+// there are none.
+func parseFallback(annotations map[string]string) (*fallbackConfig, error) {
+	var fc fallbackConfig
+	var found bool
+	if val, ok := annotations[f5VsFallbackServiceAnnotation]; ok {
+		found = true
+		fs, err := parseFallbackService(val)
+		if nil != err {
+			return nil, err
+		}
+		fc.Service = &fs
+	}
+	if val, ok := annotations[f5VsPoolFallbackServicesAnnotation]; ok {
+		found = true
+		var services map[string]string
+		if err := json.Unmarshal([]byte(val), &services); nil != err {
+			return nil, fmt.Errorf("invalid %s annotation: %v",
+				f5VsPoolFallbackServicesAnnotation, err)
+		}
+		fc.Services = make(map[string]fallbackService)
+		for svc, fallback := range services {
+			fs, err := parseFallbackService(fallback)
+			if nil != err {
+				return nil, err
+			}
+			fc.Services[svc] = fs
+		}
+	}
+	if val, ok := annotations[f5VsMaintenancePageAnnotation]; ok {
+		found = true
+		fc.Page = val
+	}
+	if val, ok := annotations[f5VsMaintenanceStatusAnnotation]; ok {
+		found = true
+		status, err := strconv.Atoi(val)
+		if nil != err || status < 200 || status > 599 {
+			return nil, fmt.Errorf("maintenance status must be from 200 to 599, "+
+				"not '%s'", val)
+		}
+		fc.Status = status
+	} else if fc.Page != "" {
+		fc.Status = defaultMaintenanceStatus
+	}
+	if !found {
+		return nil, nil
+	}
+	return &fc, nil
+}
+
+// Return the fallback for the pool of a Service, or nil if it has none
+func (fc *fallbackConfig) serviceFor(svc string) *fallbackService {
+	if fs, ok := fc.Services[svc]; ok {
+		return &fs
+	}
+	return fc.Service
+}
+
+// Return the fallback Services, sorted by name
+func (fc *fallbackConfig) services() []fallbackService {
+	var services []fallbackService
+	if nil != fc.Service {
+		services = append(services, *fc.Service)
+	}
+	var names []string
+	for svc := range fc.Services {
+		names = append(names, svc)
+	}
+	sort.Strings(names)
+	for _, svc := range names {
+		fs := fc.Services[svc]
+		found := false
+		for _, other := range services {
+			if other == fs {
+				found = true
+				break
+			}
+		}
+		if !found {
+			services = append(services, fs)
+		}
+	}
+	return services
+}
+
+// Return the names of the fallback Services in the annotations of an
+// Ingress or Route, so they are synced along with it
+func fallbackServiceNames(annotations map[string]string) []string {
+	fc, err := parseFallback(annotations)
+	if nil != err || nil == fc {
+		return nil
+	}
+	var names []string
+	for _, fs := range fc.services() {
+		if !contains(names, fs.Name) {
+			names = append(names, fs.Name)
+		}
+	}
+	return names
+}
+
+// Return the fallback pools of an Ingress or Route, with their pool names
+// formatted by poolName
+func fallbackPools(
+	annotations map[string]string,
+	namespace string,
+	partition string,
+	balance string,
+	poolName func(namespace, svc string) string,
+) Pools {
+	fc, err := parseFallback(annotations)
+	if nil != err || nil == fc {
+		return nil
+	}
+	var pools Pools
+	for _, fs := range fc.services() {
+		pools = append(pools, Pool{
+			Name:        poolName(namespace, fs.Name),
+			Partition:   partition,
+			Balance:     balance,
+			ServiceName: fs.Name,
+			ServicePort: fs.Port,
+			Fallback:    true,
+			Namespace:   namespace,
+		})
+	}
+	return pools
+}
+
+// Add the fallback pools of an object to a config, unless it has pools of
+// those names already
+func (rc *ResourceConfig) addFallbackPools(pools Pools) {
+	for _, pool := range pools {
+		found := false
+		for _, pl := range rc.Pools {
+			if pl.Name == pool.Name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			rc.Pools = append(rc.Pools, pool)
+		}
+	}
+}
+
+// Return the number of pools that take requests directly
+func (rc *ResourceConfig) servingPoolCount() int {
+	var count int
+	for _, pool := range rc.Pools {
+		if !pool.Fallback {
+			count++
+		}
+	}
+	return count
+}
+
+// Use the fallback pool of a pool, or answer with the maintenance page, when
+// the pool selected for a request has no active members
+func fallbackIRule() string {
+	iRuleCode := fmt.Sprintf(`
+		when HTTP_REQUEST {
+			set fallback_class "[virtual name]%s"
+			if { not [class exists $fallback_class] } {
+				return
+			}
+			set selected_pool [LB::server pool]
+			if { $selected_pool eq "" || [active_members $selected_pool] > 0 } {
+				return
+			}
+			set fallback_pool [class match -value $selected_pool equals $fallback_class]
+			if { $fallback_pool ne "" && [active_members $fallback_pool] > 0 } {
+				pool $fallback_pool
+				return
+			}
+			set status [class match -value "$selected_pool status" equals $fallback_class]
+			if { $status ne "" } {
+				HTTP::respond $status content \
+					[class match -value "$selected_pool page" equals $fallback_class] \
+					"Content-Type" [class match -value "$selected_pool type" equals $fallback_class] \
+					"Connection" "Close"
+				event disable all
+			}
+		}`, fallbackDgSuffix)
+
+	return iRuleCode
+}
+
+// Return a maintenance page ConfigMap from the informer of its namespace
+func (appMgr *Manager) getMaintenancePage(
+	namespace string,
+	name string,
+) (*v1.ConfigMap, error) {
+	var cm *v1.ConfigMap
+	appInf, found := appMgr.getNamespaceInformer(namespace)
+	if !found {
+		var err error
+		cm, err = appMgr.kubeClient.CoreV1().ConfigMaps(namespace).Get(
+			name, metav1.GetOptions{})
+		if nil != err {
+			return nil, err
+		}
+	} else {
+		obj, found, err := appInf.pageInformer.GetIndexer().GetByKey(
+			namespace + "/" + name)
+		if nil != err {
+			return nil, err
+		}
+		if found {
+			cm = obj.(*v1.ConfigMap)
+		}
+	}
+	if nil == cm ||
+		!maintenancePageSelector.Matches(labels.Set(cm.ObjectMeta.Labels)) {
+		return nil, fmt.Errorf("configmaps \"%s\" with label %s not found",
+			name, maintenancePageSelector)
+	}
+	return cm, nil
+}
+
+// Queue the Ingresses and Routes whose maintenance page is in a ConfigMap
+func (appMgr *Manager) enqueueMaintenancePage(obj interface{}) {
+	if tomb, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tomb.Obj
+	}
+	cm, ok := obj.(*v1.ConfigMap)
+	if !ok ||
+		!maintenancePageSelector.Matches(labels.Set(cm.ObjectMeta.Labels)) {
+		return
+	}
+	appInf, found := appMgr.getNamespaceInformer(cm.ObjectMeta.Namespace)
+	if !found {
+		return
+	}
+	usesPage := func(meta metav1.ObjectMeta) bool {
+		fc, err := parseFallback(meta.Annotations)
+		return nil == err && nil != fc && fc.Page == cm.ObjectMeta.Name
+	}
+	ings, _ := appInf.ingInformer.GetIndexer().ByIndex(
+		"namespace", cm.ObjectMeta.Namespace)
+	for _, obj := range ings {
+		if ing := obj.(*v1beta1.Ingress); usesPage(ing.ObjectMeta) {
+			appMgr.enqueueIngress(ing)
+		}
+	}
+	if nil == appInf.routeInformer {
+		return
+	}
+	routes, _ := appInf.routeInformer.GetIndexer().ByIndex(
+		"namespace", cm.ObjectMeta.Namespace)
+	for _, obj := range routes {
+		if route := obj.(*routeapi.Route); usesPage(route.ObjectMeta) {
+			appMgr.enqueueRoute(route)
+		}
+	}
+}
+
+// Record the fallbacks of the pools of an object's Services in the data
+// group of its virtual, and add the fallback iRule to the virtual
+func (appMgr *Manager) handleFallback(
+	rsCfg *ResourceConfig,
+	obj runtime.Object,
+	meta metav1.ObjectMeta,
+	svcs []string,
+	poolName func(namespace, svc string) string,
+	dgMap InternalDataGroupMap,
+) {
+	fc, err := parseFallback(meta.Annotations)
+	if nil != err {
+		msg := fmt.Sprintf("Not configuring fallbacks for %s: %v", meta.Name, err)
+		log.Warning(msg)
+		appMgr.recordEvent(obj, meta.Namespace, v1.EventTypeWarning,
+			"InvalidFallback", msg)
+		return
+	}
+	if nil == fc || len(svcs) == 0 {
+		return
+	}
+
+	var page string
+	pageType := defaultMaintenancePageType
+	if fc.Page != "" {
+		cm, err := appMgr.getMaintenancePage(meta.Namespace, fc.Page)
+		if nil != err {
+			msg := fmt.Sprintf("Unable to get maintenance page ConfigMap %s "+
+				"for %s: %v", fc.Page, meta.Name, err)
+			log.Warning(msg)
+			appMgr.recordEvent(obj, meta.Namespace, v1.EventTypeWarning,
+				"MaintenancePageNotFound", msg)
+		} else {
+			page = cm.Data[maintenancePageBodyKey]
+			if val, ok := cm.Data[maintenancePageTypeKey]; ok {
+				pageType = val
+			}
+		}
+	}
+
+	partition := rsCfg.Virtual.Partition
+	dgName := formatFallbackDgName(rsCfg.Virtual.Name)
+	for _, svc := range svcs {
+		poolPath := joinBigipPath(partition, poolName(meta.Namespace, svc))
+		if fs := fc.serviceFor(svc); nil != fs && fs.Name != svc {
+			updateDataGroup(dgMap, dgName, partition, meta.Namespace, poolPath,
+				joinBigipPath(partition, poolName(meta.Namespace, fs.Name)))
+		}
+		if fc.Status != 0 {
+			updateDataGroup(dgMap, dgName, partition, meta.Namespace,
+				poolPath+" status", strconv.Itoa(fc.Status))
+			updateDataGroup(dgMap, dgName, partition, meta.Namespace,
+				poolPath+" type", pageType)
+			updateDataGroup(dgMap, dgName, partition, meta.Namespace,
+				poolPath+" page", page)
+		}
+	}
+	appMgr.addIRule(fallbackIRuleName, partition, fallbackIRule())
+	rsCfg.Virtual.AddIRule(joinBigipPath(partition, fallbackIRuleName))
+}
+
+// Remove the fallback iRule and pools that Ingress and Route virtuals no
+// longer use, and delete the iRule if no virtual uses it
+func (appMgr *Manager) syncFallback() {
+	appMgr.intDgMutex.Lock()
+	for _, cfg := range appMgr.resources.GetAllResources() {
+		if cfg.MetaData.ResourceType != "ingress" &&
+			cfg.MetaData.ResourceType != "route" {
+			continue
+		}
+		grpRef := nameRef{
+			Name:      formatFallbackDgName(cfg.Virtual.Name),
+			Partition: cfg.Virtual.Partition,
+		}
+		inUse := make(map[string]bool)
+		if nsGroups, found := appMgr.intDgMap[grpRef]; found {
+			for _, grp := range nsGroups {
+				for _, rec := range grp.Records {
+					inUse[rec.Data] = true
+				}
+			}
+		} else {
+			cfg.Virtual.RemoveIRule(
+				joinBigipPath(cfg.Virtual.Partition, fallbackIRuleName))
+		}
+		for i := len(cfg.Pools) - 1; i >= 0; i-- {
+			pool := cfg.Pools[i]
+			if !pool.Fallback || inUse[joinBigipPath(pool.Partition, pool.Name)] {
+				continue
+			}
+			key := serviceKey{
+				ServiceName: pool.ServiceName,
+				ServicePort: pool.ServicePort,
+				Namespace:   pool.Namespace,
+			}
+			if cfg.RemovePoolAt(i) {
+				appMgr.resources.DeleteKeyRef(key, cfg.GetName())
+			}
+		}
+	}
+	appMgr.intDgMutex.Unlock()
+
+	inUse := appMgr.iRulesInUse()
+
+	appMgr.irulesMutex.Lock()
+	defer appMgr.irulesMutex.Unlock()
+	appMgr.deleteUnusedIRule(fallbackIRuleName, inUse)
+}
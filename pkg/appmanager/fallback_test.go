@@ -0,0 +1,71 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Fallback Tests", func() {
+	It("parses fallback settings", func() {
+		fc, err := parseFallback(map[string]string{})
+		Expect(err).To(BeNil())
+		Expect(fc).To(BeNil())
+
+		fc, err = parseFallback(map[string]string{
+			f5VsFallbackServiceAnnotation:      "sorry",
+			f5VsPoolFallbackServicesAnnotation: `{"bar": "bar-sorry:8080"}`,
+			f5VsMaintenancePageAnnotation:      "maintenance",
+		})
+		Expect(err).To(BeNil())
+		Expect(*fc).To(Equal(fallbackConfig{
+			Service: &fallbackService{Name: "sorry", Port: 80},
+			Services: map[string]fallbackService{
+				"bar": {Name: "bar-sorry", Port: 8080},
+			},
+			Page:   "maintenance",
+			Status: defaultMaintenanceStatus,
+		}))
+		Expect(*fc.serviceFor("foo")).To(Equal(fallbackService{"sorry", 80}))
+		Expect(*fc.serviceFor("bar")).To(Equal(fallbackService{"bar-sorry", 8080}))
+		Expect(fallbackServiceNames(map[string]string{
+			f5VsFallbackServiceAnnotation:      "sorry",
+			f5VsPoolFallbackServicesAnnotation: `{"bar": "sorry:8080"}`,
+		})).To(Equal([]string{"sorry"}))
+
+		for _, annotations := range []map[string]string{
+			{f5VsFallbackServiceAnnotation: "sorry:http"},
+			{f5VsFallbackServiceAnnotation: ":80"},
+			{f5VsPoolFallbackServicesAnnotation: `["sorry"]`},
+			{f5VsMaintenanceStatusAnnotation: "99"},
+			{f5VsMaintenanceStatusAnnotation: "unavailable"},
+		} {
+			_, err = parseFallback(annotations)
+			Expect(err).ToNot(BeNil(), "%v", annotations)
+		}
+	})
+
+	It("responds with the maintenance page when the fallback is down too", func() {
+		iRule := fallbackIRule()
+		Expect(iRule).To(ContainSubstring(
+			`set fallback_class "[virtual name]_fallback_dg"`))
+		Expect(iRule).To(ContainSubstring("[active_members $selected_pool] > 0"))
+		Expect(iRule).To(ContainSubstring("pool $fallback_pool"))
+		Expect(iRule).To(ContainSubstring("HTTP::respond $status content"))
+	})
+})
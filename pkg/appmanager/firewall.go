@@ -0,0 +1,222 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+
+	log "github.com/F5Networks/k8s-bigip-ctlr/pkg/vlogger"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// Actions of firewall rules
+const (
+	firewallAccept = "accept"
+	firewallDrop   = "drop"
+	firewallReject = "reject"
+)
+
+func formatFirewallPolicyName(vsName string) string {
+	return vsName + "_firewall"
+}
+
+// Return the firewall rules annotation of an object, or nil if it has none
+func annotationFirewallRules(annotations map[string]string) json.RawMessage {
+	val, ok := annotations[f5VsFirewallRulesAnnotation]
+	if !ok {
+		return nil
+	}
+	return json.RawMessage(val)
+}
+
+// Return the firewall rules of an F5 resource ConfigMap
+func configMapFirewallRules(cm *v1.ConfigMap) json.RawMessage {
+	var cfgMap ConfigMap
+	if err := json.Unmarshal([]byte(cm.Data["data"]), &cfgMap); nil != err {
+		return nil
+	}
+	return cfgMap.VirtualServer.Frontend.FirewallRules
+}
+
+// Check a port or range of ports of a firewall rule, returning it as the
+// BIG-IP expects it
+func parseFirewallPorts(raw json.RawMessage) (string, error) {
+	ports := strings.Trim(string(raw), "\" ")
+	bounds := strings.SplitN(ports, "-", 2)
+	var nums []int
+	for _, bound := range bounds {
+		num, err := strconv.Atoi(strings.TrimSpace(bound))
+		if nil != err || num < 1 || num > 65535 {
+			return "", fmt.Errorf("'%s' is not a port or range of ports", ports)
+		}
+		nums = append(nums, num)
+	}
+	if 1 == len(nums) {
+		return strconv.Itoa(nums[0]), nil
+	}
+	if nums[0] > nums[1] {
+		return "", fmt.Errorf("'%s' is not a port or range of ports", ports)
+	}
+	return fmt.Sprintf("%d-%d", nums[0], nums[1]), nil
+}
+
+// Parse and check firewall rules, returning the rules of the policy for
+// them
+func parseFirewallRules(raw json.RawMessage) ([]FirewallPolicyRule, error) {
+	var rules []firewallRule
+	if err := json.Unmarshal(raw, &rules); nil != err {
+		return nil, fmt.Errorf("firewall rules must be a JSON array: %v", err)
+	}
+	var policyRules []FirewallPolicyRule
+	for i, rule := range rules {
+		pr := FirewallPolicyRule{
+			Name:   fmt.Sprintf("rule-%d", i+1),
+			Action: strings.ToLower(rule.Action),
+		}
+		switch pr.Action {
+		case firewallAccept, firewallDrop, firewallReject:
+		default:
+			return nil, fmt.Errorf("rule %d: action must be %s, %s or %s, not "+
+				"'%s'", i+1, firewallAccept, firewallDrop, firewallReject,
+				rule.Action)
+		}
+		switch protocol := strings.ToLower(rule.Protocol); protocol {
+		case "", "any":
+		case "tcp", "udp", "icmp":
+			pr.IpProtocol = protocol
+		default:
+			return nil, fmt.Errorf("rule %d: protocol must be tcp, udp, icmp or "+
+				"any, not '%s'", i+1, rule.Protocol)
+		}
+		for _, src := range rule.Sources {
+			src = strings.TrimSpace(src)
+			if nil == net.ParseIP(src) {
+				if _, _, err := net.ParseCIDR(src); nil != err {
+					return nil, fmt.Errorf("rule %d: invalid source '%s'", i+1, src)
+				}
+			}
+			pr.SourceAddresses = append(pr.SourceAddresses, src)
+		}
+		if len(rule.Ports) > 0 && pr.IpProtocol != "tcp" &&
+			pr.IpProtocol != "udp" {
+			return nil, fmt.Errorf("rule %d: ports need protocol tcp or udp", i+1)
+		}
+		for _, ports := range rule.Ports {
+			p, err := parseFirewallPorts(ports)
+			if nil != err {
+				return nil, fmt.Errorf("rule %d: %v", i+1, err)
+			}
+			pr.DestinationPorts = append(pr.DestinationPorts, p)
+		}
+		policyRules = append(policyRules, pr)
+	}
+	return policyRules, nil
+}
+
+// Enforce a firewall policy made from the rules an object asks for on its
+// virtual server, with the same ownership of shared virtuals as security
+// policies. Invalid rules enforce no policy.
+func (appMgr *Manager) handleFirewallRules(
+	rsCfg *ResourceConfig,
+	obj runtime.Object,
+	meta metav1.ObjectMeta,
+	raw json.RawMessage,
+) {
+	if rsCfg.MetaData.ResourceType == "iapp" ||
+		nil == rsCfg.Virtual.VirtualAddress ||
+		rsCfg.Virtual.VirtualAddress.BindAddr == "" {
+		// Nothing to enforce for iApps and pool-only mode
+		return
+	}
+	owner := meta.Namespace + "/" + meta.Name
+	detach := func() { firewallRuleSetting.detach(rsCfg, owner) }
+	if nil == raw {
+		detach()
+		return
+	}
+	rules, err := parseFirewallRules(raw)
+	if nil != err {
+		msg := fmt.Sprintf("Not enforcing firewall rules for %s: %v",
+			meta.Name, err)
+		log.Warning(msg)
+		appMgr.recordEvent(obj, meta.Namespace, v1.EventTypeWarning,
+			"InvalidFirewallRule", msg)
+		detach()
+		return
+	}
+	if 0 == len(rules) {
+		detach()
+		return
+	}
+	if !appMgr.checkDriverFeature(obj, meta, driverFeatureFirewallPolicies,
+		"firewall rules") {
+		detach()
+		return
+	}
+	if !appMgr.mayOwnSetting(firewallRuleSetting, rsCfg, obj, meta,
+		nil != rsCfg.FirewallPolicy &&
+			reflect.DeepEqual(rsCfg.FirewallPolicy.Rules, rules)) {
+		return
+	}
+	policy := FirewallPolicy{
+		Name:      formatFirewallPolicyName(rsCfg.Virtual.Name),
+		Partition: rsCfg.Virtual.Partition,
+		Rules:     rules,
+	}
+	rsCfg.FirewallPolicy = &policy
+	rsCfg.Virtual.FirewallPolicy = joinBigipPath(policy.Partition, policy.Name)
+	rsCfg.MetaData.FirewallOwner = owner
+}
+
+// Stop enforcing the firewall policy of a virtual server
+func resetFirewallPolicy(rsCfg *ResourceConfig) {
+	rsCfg.FirewallPolicy = nil
+	rsCfg.Virtual.FirewallPolicy = ""
+	rsCfg.MetaData.FirewallOwner = ""
+}
+
+var firewallRuleSetting = ownedSetting{
+	action:         "enforcing",
+	name:           "firewall rules",
+	conflictReason: "FirewallRuleConflict",
+	owner: func(rsCfg *ResourceConfig) *string {
+		return &rsCfg.MetaData.FirewallOwner
+	},
+	reset: resetFirewallPolicy,
+}
+
+// Add a firewall policy to a list, replacing the one with the same name
+func appendFirewallPolicy(
+	policies []FirewallPolicy,
+	p FirewallPolicy,
+) []FirewallPolicy {
+	for i, policy := range policies {
+		if policy.Name == p.Name {
+			policies[i] = p
+			return policies
+		}
+	}
+	return append(policies, p)
+}
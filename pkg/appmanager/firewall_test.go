@@ -0,0 +1,58 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Firewall Rule Tests", func() {
+	It("parses and checks firewall rules", func() {
+		rules, err := parseFirewallRules(json.RawMessage(`[
+			{"action": "Accept", "sources": ["10.1.0.0/16", "192.168.1.1"],
+			 "protocol": "tcp", "ports": [443, "8000-8080"]},
+			{"action": "reject", "protocol": "any"}
+		]`))
+		Expect(err).To(BeNil())
+		Expect(rules).To(Equal([]FirewallPolicyRule{
+			{
+				Name:             "rule-1",
+				Action:           firewallAccept,
+				IpProtocol:       "tcp",
+				SourceAddresses:  []string{"10.1.0.0/16", "192.168.1.1"},
+				DestinationPorts: []string{"443", "8000-8080"},
+			},
+			{Name: "rule-2", Action: firewallReject},
+		}))
+
+		for _, bad := range []string{
+			`{"action": "accept"}`,
+			`[{"action": "allow"}]`,
+			`[{"action": "drop", "protocol": "sctp"}]`,
+			`[{"action": "drop", "sources": ["10.0.0.0/33"]}]`,
+			`[{"action": "drop", "ports": [80]}]`,
+			`[{"action": "drop", "protocol": "udp", "ports": [0]}]`,
+			`[{"action": "drop", "protocol": "udp", "ports": ["90-80"]}]`,
+		} {
+			_, err = parseFirewallRules(json.RawMessage(bad))
+			Expect(err).ToNot(BeNil(), bad)
+		}
+	})
+})
@@ -0,0 +1,266 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
+)
+
+// How the paths of an Ingress are matched against the request path
+const (
+	pathTypePrefix = "Prefix"
+	pathTypeExact  = "Exact"
+	pathTypeRegex  = "Regex"
+)
+
+const ingressPathRegexIRuleName = "ingress_path_regex_irule"
+
+// Suffix of the rule that matches the paths below a Prefix path
+const subPathRuleSuffix = "_sub_paths"
+
+// Suffix of the internal data group that holds the Ingress paths of a
+// virtual matched by regular expression. The key is the host, a space and
+// the expression; the data is the pool.
+const ingressPathRegexDgSuffix = "_path_regex_dg"
+
+func formatIngressPathRegexDgName(vsName string) string {
+	return vsName + ingressPathRegexDgSuffix
+}
+
+// Return the path type set on an Ingress, Prefix if none is set
+func getIngressPathType(ing *v1beta1.Ingress) (string, error) {
+	pathType, ok := ing.ObjectMeta.Annotations[f5VsPathTypeAnnotation]
+	if !ok {
+		return pathTypePrefix, nil
+	}
+	switch pathType {
+	case pathTypePrefix, pathTypeExact:
+	case pathTypeRegex:
+		for _, annotation := range []string{
+			f5VsRuleConditionsAnnotation,
+			f5VsRuleActionsAnnotation,
+		} {
+			if _, ok := ing.ObjectMeta.Annotations[annotation]; ok {
+				return "", fmt.Errorf("%s cannot be used with %s %s",
+					annotation, f5VsPathTypeAnnotation, pathType)
+			}
+		}
+		for _, rule := range ing.Spec.Rules {
+			if nil == rule.IngressRuleValue.HTTP {
+				continue
+			}
+			for _, path := range rule.IngressRuleValue.HTTP.Paths {
+				if _, err := regexp.Compile(path.Path); nil != err {
+					return "", fmt.Errorf("invalid path expression '%s': %v",
+						path.Path, err)
+				}
+			}
+		}
+	default:
+		return "", fmt.Errorf("invalid %s annotation '%s'",
+			f5VsPathTypeAnnotation, pathType)
+	}
+	return pathType, nil
+}
+
+// Create a policy rule for an Ingress host and path. Exact paths match
+// only themselves. Prefix paths match element by element: the rule matches
+// the path itself, without any trailing '/', and createSubPathRule adds the
+// rule for the paths below it, so /api does not match /apiary.
+func createIngressRule(
+	host, path, poolName, partition, ruleName, pathType string,
+) (*Rule, error) {
+	rl, err := createRule(host, poolName, partition, ruleName)
+	if nil != err {
+		return nil, err
+	}
+	rl.FullURI = host + path
+	if pathType == pathTypePrefix {
+		path = strings.TrimSuffix(path, "/")
+	}
+	if path == "" {
+		return rl, nil
+	}
+	rl.Conditions = append(rl.Conditions, &condition{
+		Equals:  true,
+		HTTPURI: true,
+		Path:    true,
+		Name:    strconv.Itoa(len(rl.Conditions)),
+		Request: true,
+		Values:  []string{path},
+	})
+	return rl, nil
+}
+
+// Return the rule for the paths below the path of a Prefix rule, with the
+// same conditions and actions, or nil if the rule matches every path.
+func createSubPathRule(rl *Rule) *Rule {
+	path, exact := rulePath(rl)
+	if !exact {
+		return nil
+	}
+	sub := *rl
+	sub.Name = rl.Name + subPathRuleSuffix
+	sub.Actions = make([]*action, len(rl.Actions))
+	copy(sub.Actions, rl.Actions)
+	sub.Conditions = make([]*condition, len(rl.Conditions))
+	for i, c := range rl.Conditions {
+		if c.HTTPURI && c.Path && c.Equals {
+			pc := *c
+			pc.Equals = false
+			pc.StartsWith = true
+			pc.Values = []string{path + "/"}
+			c = &pc
+		}
+		sub.Conditions[i] = c
+	}
+	return &sub
+}
+
+// Return the path of a rule and whether it must match exactly
+func rulePath(rl *Rule) (string, bool) {
+	for _, c := range rl.Conditions {
+		if c.HTTPURI && c.Path && len(c.Values) > 0 {
+			return c.Values[0], c.Equals
+		}
+	}
+	return "", false
+}
+
+type ingressRuleOrder Rules
+
+func (r ingressRuleOrder) Len() int      { return len(r) }
+func (r ingressRuleOrder) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+
+func (r ingressRuleOrder) Less(i, j int) bool {
+	wi := strings.HasPrefix(r[i].FullURI, "*.")
+	wj := strings.HasPrefix(r[j].FullURI, "*.")
+	if wi != wj {
+		return wj
+	}
+	pi, ei := rulePath(r[i])
+	pj, ej := rulePath(r[j])
+	if len(pi) != len(pj) {
+		return len(pi) > len(pj)
+	}
+	if ei != ej {
+		return ei
+	}
+	if len(r[i].Conditions) != len(r[j].Conditions) {
+		return len(r[i].Conditions) > len(r[j].Conditions)
+	}
+	if r[i].FullURI != r[j].FullURI {
+		return r[i].FullURI < r[j].FullURI
+	}
+	return r[i].Name < r[j].Name
+}
+
+// Order the rules of an Ingress policy so the most specific one matches:
+// named hosts before wildcards, then the longest path, exact paths before
+// prefixes and rules with more conditions first. Ordinals follow the order,
+// so the result is the same whichever Ingress was processed first.
+func orderIngressRules(rls Rules) {
+	sort.Sort(ingressRuleOrder(rls))
+	for i, rl := range rls {
+		rl.Ordinal = i
+	}
+}
+
+// Select the pool for Ingress paths matched by regular expression. The
+// longest matching expression for the host wins.
+func ingressPathRegexIRule() string {
+	iRuleCode := fmt.Sprintf(`
+		when HTTP_REQUEST {
+			set regex_class "[virtual name]%s"
+			if { not [class exists $regex_class] } {
+				return
+			}
+			set host [string tolower [getfield [HTTP::host] ":" 1]]
+			set selected_pool ""
+			set selected_len -1
+			foreach record [class get $regex_class] {
+				set key [lindex $record 0]
+				set sep [string first " " $key]
+				set rule_host [string range $key 0 [expr {$sep - 1}]]
+				set pattern [string range $key [expr {$sep + 1}] end]
+				if { [string match $rule_host $host] &&
+					[string length $pattern] > $selected_len &&
+					[regexp -- $pattern [HTTP::path]] } {
+					set selected_pool [lindex $record 1]
+					set selected_len [string length $pattern]
+				}
+			}
+			if { $selected_pool != "" } {
+				pool $selected_pool
+			}
+		}`, ingressPathRegexDgSuffix)
+
+	return iRuleCode
+}
+
+// Add the regex paths of an Ingress to the data group map, and the iRule
+// that uses them to the Ingress virtual server
+func (appMgr *Manager) handleIngressPathRegex(
+	rsCfg *ResourceConfig,
+	ing *v1beta1.Ingress,
+	dgMap InternalDataGroupMap,
+) {
+	if pathType, err := getIngressPathType(ing); nil != err ||
+		pathType != pathTypeRegex {
+		return
+	}
+	for _, rule := range ing.Spec.Rules {
+		if nil == rule.IngressRuleValue.HTTP {
+			continue
+		}
+		host := strings.ToLower(rule.Host)
+		if host == "" {
+			host = "*"
+		}
+		for _, path := range rule.IngressRuleValue.HTTP.Paths {
+			poolName := formatIngressPoolName(
+				ing.ObjectMeta.Namespace, path.Backend.ServiceName)
+			for _, pool := range rsCfg.Pools {
+				if pool.Name == poolName {
+					updateDataGroup(dgMap,
+						formatIngressPathRegexDgName(rsCfg.Virtual.Name),
+						rsCfg.Virtual.Partition, ing.ObjectMeta.Namespace,
+						host+" "+path.Path,
+						joinBigipPath(rsCfg.Virtual.Partition, poolName))
+					break
+				}
+			}
+		}
+	}
+	partition := rsCfg.Virtual.Partition
+	appMgr.addIRule(ingressPathRegexIRuleName, partition,
+		ingressPathRegexIRule())
+	rsCfg.Virtual.AddIRule(joinBigipPath(partition, ingressPathRegexIRuleName))
+}
+
+// Remove the regex path iRule from virtuals that no longer have regex
+// paths, and delete it if no virtual uses it
+func (appMgr *Manager) syncIngressPathRegexIRules() {
+	appMgr.syncHostPathIRule(ingressPathRegexIRuleName,
+		formatIngressPathRegexDgName)
+}
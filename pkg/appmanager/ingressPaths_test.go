@@ -0,0 +1,345 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	"strings"
+
+	"github.com/F5Networks/k8s-bigip-ctlr/pkg/test"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
+)
+
+var _ = Describe("Ingress Path Tests", func() {
+	namespace := "default"
+
+	newIngress := func(name string, annotations map[string]string,
+		paths map[string]string) *v1beta1.Ingress {
+		var httpPaths []v1beta1.HTTPIngressPath
+		for path, svcName := range paths {
+			httpPaths = append(httpPaths, v1beta1.HTTPIngressPath{
+				Path: path,
+				Backend: v1beta1.IngressBackend{
+					ServiceName: svcName,
+					ServicePort: intstr.IntOrString{IntVal: 80},
+				},
+			})
+		}
+		spec := v1beta1.IngressSpec{
+			Rules: []v1beta1.IngressRule{
+				{Host: "foo.com",
+					IngressRuleValue: v1beta1.IngressRuleValue{
+						HTTP: &v1beta1.HTTPIngressRuleValue{Paths: httpPaths},
+					},
+				},
+			},
+		}
+		return test.NewIngress(name, "1", namespace, spec, annotations)
+	}
+
+	It("creates prefix and exact path conditions", func() {
+		rule, err := createIngressRule("foo.com", "/api/", "pool", "velcro",
+			"rule", pathTypePrefix)
+		Expect(err).To(BeNil())
+		Expect(rule.FullURI).To(Equal("foo.com/api/"))
+		Expect(len(rule.Conditions)).To(Equal(2))
+		Expect(rule.Conditions[1]).To(Equal(&condition{
+			Name:    "1",
+			Equals:  true,
+			HTTPURI: true,
+			Path:    true,
+			Request: true,
+			Values:  []string{"/api"},
+		}))
+		sub := createSubPathRule(rule)
+		Expect(sub.Name).To(Equal("rule" + subPathRuleSuffix))
+		Expect(sub.FullURI).To(Equal("foo.com/api/"))
+		Expect(sub.Actions).To(Equal(rule.Actions))
+		Expect(sub.Conditions[0]).To(Equal(rule.Conditions[0]))
+		Expect(sub.Conditions[1]).To(Equal(&condition{
+			Name:       "1",
+			HTTPURI:    true,
+			Path:       true,
+			Request:    true,
+			StartsWith: true,
+			Values:     []string{"/api/"},
+		}))
+		// The rule is left as it was
+		Expect(rule.Conditions[1].Values).To(Equal([]string{"/api"}))
+
+		rule, err = createIngressRule("foo.com", "/api", "pool", "velcro",
+			"rule", pathTypeExact)
+		Expect(err).To(BeNil())
+		Expect(rule.Conditions[1]).To(Equal(&condition{
+			Name:    "1",
+			Equals:  true,
+			HTTPURI: true,
+			Path:    true,
+			Request: true,
+			Values:  []string{"/api"},
+		}))
+
+		// A prefix of / matches everything for the host
+		rule, err = createIngressRule("foo.com", "/", "pool", "velcro",
+			"rule", pathTypePrefix)
+		Expect(err).To(BeNil())
+		Expect(len(rule.Conditions)).To(Equal(1))
+		Expect(rule.Conditions[0].HTTPHost).To(BeTrue())
+		Expect(createSubPathRule(rule)).To(BeNil())
+	})
+
+	It("matches prefix paths element by element", func() {
+		// Return true if the path conditions of a rule match a request path
+		matches := func(rl *Rule, reqPath string) bool {
+			for _, c := range rl.Conditions {
+				if !c.HTTPURI || !c.Path {
+					continue
+				}
+				if c.Equals {
+					return reqPath == c.Values[0]
+				}
+				return strings.HasPrefix(reqPath, c.Values[0])
+			}
+			return true
+		}
+		for _, path := range []string{"/api", "/api/"} {
+			rule, err := createIngressRule("foo.com", path, "pool", "velcro",
+				"rule", pathTypePrefix)
+			Expect(err).To(BeNil())
+			rules := Rules{rule, createSubPathRule(rule)}
+			for reqPath, matched := range map[string]bool{
+				"/api":        true,
+				"/api/":       true,
+				"/api/v1":     true,
+				"/apiary":     false,
+				"/apiary/v1":  false,
+				"/ap":         false,
+				"/other/api/": false,
+			} {
+				Expect(matches(rules[0], reqPath) ||
+					matches(rules[1], reqPath)).To(Equal(matched), path+" "+reqPath)
+			}
+		}
+	})
+
+	It("validates the path type annotation", func() {
+		paths := map[string]string{"/api/v[0-9]+": "foo"}
+		pathType, err := getIngressPathType(newIngress("ing", nil, paths))
+		Expect(err).To(BeNil())
+		Expect(pathType).To(Equal(pathTypePrefix))
+
+		pathType, err = getIngressPathType(newIngress("ing", map[string]string{
+			f5VsPathTypeAnnotation: pathTypeRegex}, paths))
+		Expect(err).To(BeNil())
+		Expect(pathType).To(Equal(pathTypeRegex))
+
+		_, err = getIngressPathType(newIngress("ing", map[string]string{
+			f5VsPathTypeAnnotation: "prefix"}, paths))
+		Expect(err).ToNot(BeNil())
+		_, err = getIngressPathType(newIngress("ing", map[string]string{
+			f5VsPathTypeAnnotation: pathTypeRegex},
+			map[string]string{"/api/(v1": "foo"}))
+		Expect(err).ToNot(BeNil())
+		_, err = getIngressPathType(newIngress("ing", map[string]string{
+			f5VsPathTypeAnnotation:       pathTypeRegex,
+			f5VsRuleConditionsAnnotation: "[]"}, paths))
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("orders rules by specificity", func() {
+		newRule := func(host, path, pathType string) *Rule {
+			rl, err := createIngressRule(host, path, "pool", "velcro",
+				formatIngressRuleName(host, path, pathType), pathType)
+			Expect(err).To(BeNil())
+			return rl
+		}
+		canary := newRule("foo.com", "/api", pathTypePrefix)
+		addRuleConditions(canary, []RuleCondition{
+			{Type: conditionHeader, Name: "X-Canary", Values: []string{"true"}},
+		})
+		v1 := newRule("foo.com", "/api/v1", pathTypePrefix)
+		api := newRule("foo.com", "/api", pathTypePrefix)
+		expected := Rules{
+			createSubPathRule(v1),
+			v1,
+			createSubPathRule(api),
+			canary,
+			newRule("foo.com", "/api", pathTypeExact),
+			api,
+			newRule("bar.com", "/", pathTypePrefix),
+			newRule("foo.com", "", pathTypePrefix),
+			newRule("*.foo.com", "/api/v1/users", pathTypePrefix),
+		}
+		for _, order := range [][]int{
+			{0, 1, 2, 3, 4, 5, 6, 7, 8},
+			{8, 7, 6, 5, 4, 3, 2, 1, 0},
+			{3, 6, 1, 8, 4, 0, 5, 7, 2},
+		} {
+			var rules Rules
+			for _, i := range order {
+				rules = append(rules, expected[i])
+			}
+			orderIngressRules(rules)
+			Expect(rules).To(Equal(expected))
+			for i, rl := range rules {
+				Expect(rl.Ordinal).To(Equal(i))
+			}
+		}
+	})
+
+	Describe("Using Mock Manager", func() {
+		var mockMgr *mockAppManager
+
+		BeforeEach(func() {
+			RegisterBigIPSchemaTypes()
+			mw := &test.MockWriter{
+				FailStyle: test.Success,
+				Sections:  make(map[string]interface{}),
+			}
+			mockMgr = newMockAppManager(&Params{
+				KubeClient:      fake.NewSimpleClientset(),
+				ConfigWriter:    mw,
+				restClient:      test.CreateFakeHTTPClient(),
+				IsNodePort:      true,
+				broadcasterFunc: NewFakeEventBroadcaster,
+			})
+			err := mockMgr.startNonLabelMode([]string{namespace})
+			Expect(err).To(BeNil())
+			for _, name := range []string{"foo", "bar", "baz"} {
+				svc := test.NewService(name, "1", namespace, "NodePort",
+					[]v1.ServicePort{{Port: 80, NodePort: 37001}})
+				Expect(mockMgr.addService(svc)).To(BeTrue())
+			}
+		})
+		AfterEach(func() {
+			mockMgr.shutdown()
+		})
+
+		vsName := formatIngressVSName("1.2.3.4", 80)
+		annotations := func(pathType string) map[string]string {
+			return map[string]string{
+				f5VsBindAddrAnnotation: "1.2.3.4",
+				f5VsPathTypeAnnotation: pathType,
+			}
+		}
+		ruleOrder := func() []string {
+			rs, ok := mockMgr.resources().Get(
+				serviceKey{"foo", 80, namespace}, vsName)
+			Expect(ok).To(BeTrue())
+			var names []string
+			for i, rl := range rs.Policies[0].Rules {
+				Expect(rl.Ordinal).To(Equal(i))
+				names = append(names, rl.Name)
+			}
+			return names
+		}
+
+		It("orders rules across Ingresses on one virtual", func() {
+			Expect(mockMgr.addIngress(newIngress("short", annotations(pathTypePrefix),
+				map[string]string{"/api": "foo"}))).To(BeTrue())
+			Expect(mockMgr.addIngress(newIngress("exact", annotations(pathTypeExact),
+				map[string]string{"/api": "bar"}))).To(BeTrue())
+			Expect(mockMgr.addIngress(newIngress("long", annotations(pathTypePrefix),
+				map[string]string{"/api/v1": "baz"}))).To(BeTrue())
+
+			apiRule := func(svcName string) string {
+				return formatIngressRuleName("foo.com", "/api",
+					formatIngressPoolName(namespace, svcName))
+			}
+			// The Exact path keeps the requests for /api itself
+			v1Rule := formatIngressRuleName("foo.com", "/api/v1",
+				formatIngressPoolName(namespace, "baz"))
+			Expect(ruleOrder()).To(Equal([]string{
+				v1Rule + subPathRuleSuffix,
+				v1Rule,
+				apiRule("foo") + subPathRuleSuffix,
+				apiRule("bar"),
+			}))
+		})
+
+		It("matches regex paths with an iRule", func() {
+			ing := newIngress("regex", annotations(pathTypeRegex),
+				map[string]string{"^/api/v[0-9]+/users$": "foo"})
+			Expect(mockMgr.addIngress(ing)).To(BeTrue())
+
+			rs, ok := mockMgr.resources().Get(
+				serviceKey{"foo", 80, namespace}, vsName)
+			Expect(ok).To(BeTrue())
+			Expect(rs.Policies).To(BeEmpty())
+			Expect(rs.Virtual.IRules).To(Equal([]string{
+				joinBigipPath(DEFAULT_PARTITION, ingressPathRegexIRuleName)}))
+			grpRef := nameRef{
+				Name:      formatIngressPathRegexDgName(vsName),
+				Partition: DEFAULT_PARTITION,
+			}
+			nsMap, found := mockMgr.appMgr.intDgMap[grpRef]
+			Expect(found).To(BeTrue())
+			flatDg := nsMap.FlattenNamespaces()
+			Expect(len(flatDg.Records)).To(Equal(1))
+			Expect(flatDg.Records[0].Name).To(Equal("foo.com ^/api/v[0-9]+/users$"))
+			Expect(flatDg.Records[0].Data).To(Equal(joinBigipPath(
+				DEFAULT_PARTITION, formatIngressPoolName(namespace, "foo"))))
+
+			// Back to prefix paths, the data group and iRule go away
+			ing.ObjectMeta.Annotations[f5VsPathTypeAnnotation] = pathTypePrefix
+			ing.Spec.Rules[0].HTTP.Paths[0].Path = "/api"
+			Expect(mockMgr.updateIngress(ing)).To(BeTrue())
+			_, found = mockMgr.appMgr.intDgMap[grpRef]
+			Expect(found).To(BeFalse())
+			rs, _ = mockMgr.resources().Get(serviceKey{"foo", 80, namespace}, vsName)
+			Expect(rs.Virtual.IRules).To(BeEmpty())
+			Expect(len(rs.Policies)).To(Equal(1))
+		})
+
+		It("keeps the regex paths of each virtual apart", func() {
+			paths := map[string]string{"^/api/v[0-9]+$": "foo"}
+			Expect(mockMgr.addIngress(newIngress("first",
+				annotations(pathTypeRegex), paths))).To(BeTrue())
+			ann := annotations(pathTypeRegex)
+			ann[f5VsBindAddrAnnotation] = "5.6.7.8"
+			paths = map[string]string{"^/api/v[0-9]+$": "bar"}
+			Expect(mockMgr.addIngress(newIngress("second", ann,
+				paths))).To(BeTrue())
+
+			for vs, svcName := range map[string]string{
+				vsName:                             "foo",
+				formatIngressVSName("5.6.7.8", 80): "bar",
+			} {
+				rs, ok := mockMgr.resources().Get(
+					serviceKey{svcName, 80, namespace}, vs)
+				Expect(ok).To(BeTrue())
+				Expect(rs.Virtual.IRules).To(Equal([]string{
+					joinBigipPath(DEFAULT_PARTITION, ingressPathRegexIRuleName)}))
+				nsMap, found := mockMgr.appMgr.intDgMap[nameRef{
+					Name:      formatIngressPathRegexDgName(vs),
+					Partition: DEFAULT_PARTITION,
+				}]
+				Expect(found).To(BeTrue())
+				flatDg := nsMap.FlattenNamespaces()
+				Expect(len(flatDg.Records)).To(Equal(1))
+				Expect(flatDg.Records[0].Name).To(Equal("foo.com ^/api/v[0-9]+$"))
+				Expect(flatDg.Records[0].Data).To(Equal(joinBigipPath(
+					DEFAULT_PARTITION, formatIngressPoolName(namespace, svcName))))
+			}
+		})
+	})
+})
@@ -0,0 +1,647 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	bigIPPrometheus "github.com/F5Networks/k8s-bigip-ctlr/pkg/prometheus"
+	log "github.com/F5Networks/k8s-bigip-ctlr/pkg/vlogger"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Key in the allocations ConfigMap that holds the persisted allocations
+const ipamAllocationsKey = "allocations"
+
+// An inclusive range of IPv4 addresses that may be handed out
+type ipRange struct {
+	start uint32
+	end   uint32
+}
+
+// Parse an IP range given either as a CIDR ("10.1.1.0/24") or as a
+// start and end address separated by a dash ("10.1.1.10-10.1.1.20").
+// For CIDRs the network and broadcast addresses are excluded.
+func parseIPRange(str string) (ipRange, error) {
+	str = strings.TrimSpace(str)
+	if strings.Contains(str, "/") {
+		_, ipNet, err := net.ParseCIDR(str)
+		if nil != err {
+			return ipRange{}, err
+		}
+		if nil == ipNet.IP.To4() {
+			return ipRange{}, fmt.Errorf("IP range '%s' is not IPv4", str)
+		}
+		ones, bits := ipNet.Mask.Size()
+		start := ipToUint32(ipNet.IP)
+		end := start | (1<<uint(bits-ones) - 1)
+		if end-start > 1 {
+			start++
+			end--
+		}
+		return ipRange{start: start, end: end}, nil
+	}
+	bounds := strings.Split(str, "-")
+	if len(bounds) > 2 {
+		return ipRange{}, fmt.Errorf("IP range '%s' is formatted incorrectly", str)
+	}
+	start := net.ParseIP(strings.TrimSpace(bounds[0])).To4()
+	end := start
+	if len(bounds) == 2 {
+		end = net.ParseIP(strings.TrimSpace(bounds[1])).To4()
+	}
+	if nil == start || nil == end {
+		return ipRange{}, fmt.Errorf("IP range '%s' does not contain valid IPv4 addresses", str)
+	}
+	rng := ipRange{start: ipToUint32(start), end: ipToUint32(end)}
+	if rng.start > rng.end {
+		return ipRange{}, fmt.Errorf("IP range '%s' starts after it ends", str)
+	}
+	return rng, nil
+}
+
+// Parse a list of IP ranges, returning the valid ones and the errors
+// for the rest.
+func parseIPRanges(strs []string) ([]ipRange, []error) {
+	var ranges []ipRange
+	var errs []error
+	for _, str := range strs {
+		if strings.TrimSpace(str) == "" {
+			continue
+		}
+		rng, err := parseIPRange(str)
+		if nil != err {
+			errs = append(errs, err)
+			continue
+		}
+		ranges = append(ranges, rng)
+	}
+	return ranges, errs
+}
+
+func (r ipRange) contains(ip string) bool {
+	addr := net.ParseIP(ip).To4()
+	if nil == addr {
+		return false
+	}
+	val := ipToUint32(addr)
+	return val >= r.start && val <= r.end
+}
+
+func ipToUint32(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func uint32ToIP(val uint32) string {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, val)
+	return ip.String()
+}
+
+// An address held by a resource, and the named range it came from
+type ipamAllocation struct {
+	IP    string `json:"ip"`
+	Label string `json:"label,omitempty"`
+}
+
+// format the owner of an allocation, e.g. "Ingress/default/myingress"
+func formatIPAMOwner(kind, namespace, name string) string {
+	return fmt.Sprintf("%s/%s/%s", kind, namespace, name)
+}
+
+func splitIPAMOwner(owner string) (kind, namespace, name string) {
+	parts := strings.SplitN(owner, "/", 3)
+	if len(parts) != 3 {
+		return "", "", ""
+	}
+	return parts[0], parts[1], parts[2]
+}
+
+// Hands out virtual addresses from named sets of ranges and remembers which
+// resource owns each address so that it can be released later. The unnamed
+// ("") set holds the default ranges for Services of type LoadBalancer.
+type ipAllocator struct {
+	sync.Mutex
+	ranges map[string][]ipRange
+	// address -> owner
+	allocated map[string]string
+	// owner -> allocation
+	owners map[string]ipamAllocation
+	// Allocations changed since they were last persisted
+	dirty bool
+}
+
+func newIPAllocator(defaultRanges []string) *ipAllocator {
+	alloc := &ipAllocator{
+		ranges:    make(map[string][]ipRange),
+		allocated: make(map[string]string),
+		owners:    make(map[string]ipamAllocation),
+	}
+	ranges, errs := parseIPRanges(defaultRanges)
+	for _, err := range errs {
+		log.Warningf("Ignoring invalid load balancer IP range: %v", err)
+	}
+	alloc.ranges[""] = ranges
+	return alloc
+}
+
+// Replace the named ranges, keeping the default LoadBalancer ranges
+func (alloc *ipAllocator) SetLabelRanges(ranges map[string][]ipRange) {
+	alloc.Lock()
+	defer alloc.Unlock()
+	defaults := alloc.ranges[""]
+	alloc.ranges = make(map[string][]ipRange)
+	for label, rngs := range ranges {
+		alloc.ranges[label] = rngs
+	}
+	alloc.ranges[""] = defaults
+}
+
+// Return whether any ranges are defined for label
+func (alloc *ipAllocator) HasRanges(label string) bool {
+	alloc.Lock()
+	defer alloc.Unlock()
+	return len(alloc.ranges[label]) > 0
+}
+
+// Return the address held by owner, if any
+func (alloc *ipAllocator) Lookup(owner string) (string, bool) {
+	alloc.Lock()
+	defer alloc.Unlock()
+	rec, found := alloc.owners[owner]
+	return rec.IP, found
+}
+
+// Return all owners, sorted
+func (alloc *ipAllocator) Owners() []string {
+	alloc.Lock()
+	defer alloc.Unlock()
+	var owners []string
+	for owner := range alloc.owners {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+	return owners
+}
+
+// Allocate an address for owner from the ranges named by label. A requested
+// address is always honoured unless another owner holds it. Otherwise the
+// owner keeps its current address, then the hint (normally a previously
+// reported status address) is tried, and finally the first address in the
+// ranges that is neither allocated nor in use by an existing virtual.
+func (alloc *ipAllocator) Allocate(
+	owner, label, requested, hint string,
+	inUse map[string]bool,
+) (string, error) {
+	alloc.Lock()
+	defer alloc.Unlock()
+
+	if requested != "" {
+		if nil == net.ParseIP(requested) {
+			return "", fmt.Errorf("requested address '%s' is not a valid IP", requested)
+		}
+		if holder, taken := alloc.allocated[requested]; taken && holder != owner {
+			return "", fmt.Errorf("requested address '%s' is already allocated to '%s'",
+				requested, holder)
+		}
+		alloc.assignLocked(owner, ipamAllocation{IP: requested, Label: label})
+		return requested, nil
+	}
+	ranges, found := alloc.ranges[label]
+	if !found {
+		return "", fmt.Errorf("no IP ranges are defined for label '%s'", label)
+	}
+	inRanges := func(ip string) bool {
+		for _, rng := range ranges {
+			if rng.contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	if current, found := alloc.owners[owner]; found &&
+		current.Label == label && inRanges(current.IP) {
+		return current.IP, nil
+	}
+	if hint != "" && inRanges(hint) {
+		if holder, taken := alloc.allocated[hint]; !taken || holder == owner {
+			alloc.assignLocked(owner, ipamAllocation{IP: hint, Label: label})
+			return hint, nil
+		}
+	}
+	for _, rng := range ranges {
+		for val := rng.start; ; val++ {
+			ip := uint32ToIP(val)
+			if _, taken := alloc.allocated[ip]; !taken && !inUse[ip] {
+				alloc.assignLocked(owner, ipamAllocation{IP: ip, Label: label})
+				return ip, nil
+			}
+			if val == rng.end {
+				break
+			}
+		}
+	}
+	return "", fmt.Errorf("no addresses available for label '%s'", label)
+}
+
+// Restore a persisted allocation, refusing addresses held by another owner
+func (alloc *ipAllocator) Restore(owner string, rec ipamAllocation) error {
+	alloc.Lock()
+	defer alloc.Unlock()
+	if nil == net.ParseIP(rec.IP) {
+		return fmt.Errorf("address '%s' for '%s' is not a valid IP", rec.IP, owner)
+	}
+	if holder, taken := alloc.allocated[rec.IP]; taken && holder != owner {
+		return fmt.Errorf("address '%s' for '%s' is already allocated to '%s'",
+			rec.IP, owner, holder)
+	}
+	alloc.assignLocked(owner, rec)
+	return nil
+}
+
+// Release the address held by owner, returning it ("" if none was held)
+func (alloc *ipAllocator) Release(owner string) string {
+	alloc.Lock()
+	defer alloc.Unlock()
+	rec, found := alloc.owners[owner]
+	if !found {
+		return ""
+	}
+	delete(alloc.owners, owner)
+	delete(alloc.allocated, rec.IP)
+	alloc.dirty = true
+	return rec.IP
+}
+
+// Return a copy of all allocations, and whether they changed since the
+// last call.
+func (alloc *ipAllocator) Snapshot() (map[string]ipamAllocation, bool) {
+	alloc.Lock()
+	defer alloc.Unlock()
+	snapshot := make(map[string]ipamAllocation)
+	for owner, rec := range alloc.owners {
+		snapshot[owner] = rec
+	}
+	dirty := alloc.dirty
+	alloc.dirty = false
+	return snapshot, dirty
+}
+
+// Flag the allocations as changed again after a snapshot could not be
+// persisted, so the next call to Snapshot reports them.
+func (alloc *ipAllocator) MarkDirty() {
+	alloc.Lock()
+	defer alloc.Unlock()
+	alloc.dirty = true
+}
+
+// Return the number of allocations for each label
+func (alloc *ipAllocator) Counts() map[string]int {
+	alloc.Lock()
+	defer alloc.Unlock()
+	counts := make(map[string]int)
+	for label := range alloc.ranges {
+		counts[label] = 0
+	}
+	for _, rec := range alloc.owners {
+		counts[rec.Label]++
+	}
+	return counts
+}
+
+func (alloc *ipAllocator) assignLocked(owner string, rec ipamAllocation) {
+	if current, found := alloc.owners[owner]; found {
+		if current == rec {
+			return
+		}
+		delete(alloc.allocated, current.IP)
+	}
+	alloc.owners[owner] = rec
+	alloc.allocated[rec.IP] = owner
+	alloc.dirty = true
+}
+
+// Watch the ConfigMap that defines the named IPAM ranges
+func (appMgr *Manager) newIPAMInformer(resyncPeriod time.Duration) {
+	appMgr.ipamInformer = cache.NewSharedIndexInformer(
+		cache.NewListWatchFromClient(
+			appMgr.restClientv1,
+			"configmaps",
+			appMgr.ipamNamespace,
+			fields.OneTermEqualSelector("metadata.name", appMgr.ipamName),
+		),
+		&v1.ConfigMap{},
+		resyncPeriod,
+		cache.Indexers{},
+	)
+	appMgr.ipamInformer.AddEventHandlerWithResyncPeriod(
+		&cache.ResourceEventHandlerFuncs{
+			AddFunc:    func(obj interface{}) { appMgr.updateIPAMRanges(obj) },
+			UpdateFunc: func(old, cur interface{}) { appMgr.updateIPAMRanges(cur) },
+			DeleteFunc: func(obj interface{}) {
+				log.Warningf("IPAM ConfigMap '%s/%s' was deleted.",
+					appMgr.ipamNamespace, appMgr.ipamName)
+				appMgr.ipam.SetLabelRanges(nil)
+			},
+		},
+		resyncPeriod,
+	)
+}
+
+func (appMgr *Manager) startAndSyncIPAMInformer(stopCh <-chan struct{}) {
+	go appMgr.ipamInformer.Run(stopCh)
+	cache.WaitForCacheSync(stopCh, appMgr.ipamInformer.HasSynced)
+	appMgr.loadIPAMAllocations()
+}
+
+// Each key in the IPAM ConfigMap is a label, and each value a comma
+// separated list of ranges.
+func (appMgr *Manager) updateIPAMRanges(obj interface{}) {
+	cm, ok := obj.(*v1.ConfigMap)
+	if !ok {
+		return
+	}
+	ranges := make(map[string][]ipRange)
+	for label, value := range cm.Data {
+		rngs, errs := parseIPRanges(strings.Split(value, ","))
+		for _, err := range errs {
+			msg := fmt.Sprintf("Ignoring invalid range for IPAM label '%s': %v",
+				label, err)
+			log.Warning(msg)
+			appMgr.recordEvent(cm, cm.ObjectMeta.Namespace,
+				v1.EventTypeWarning, "InvalidIPRange", msg)
+		}
+		ranges[label] = rngs
+	}
+	appMgr.ipam.SetLabelRanges(ranges)
+	appMgr.updateIPAMMetrics()
+}
+
+func (appMgr *Manager) ipamAllocationsName() string {
+	return appMgr.ipamName + "-allocations"
+}
+
+// Load the allocations persisted by a previous run
+func (appMgr *Manager) loadIPAMAllocations() {
+	cm, err := appMgr.kubeClient.CoreV1().ConfigMaps(appMgr.ipamNamespace).
+		Get(appMgr.ipamAllocationsName(), metav1.GetOptions{})
+	if nil != err {
+		log.Infof("No IPAM allocations loaded from '%s/%s': %v",
+			appMgr.ipamNamespace, appMgr.ipamAllocationsName(), err)
+		return
+	}
+	var allocs map[string]ipamAllocation
+	if data, ok := cm.Data[ipamAllocationsKey]; ok {
+		err = json.Unmarshal([]byte(data), &allocs)
+		if nil != err {
+			log.Warningf("Unable to parse IPAM allocations in '%s/%s': %v",
+				appMgr.ipamNamespace, appMgr.ipamAllocationsName(), err)
+			return
+		}
+	}
+	var owners []string
+	for owner := range allocs {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+	for _, owner := range owners {
+		if err := appMgr.ipam.Restore(owner, allocs[owner]); nil != err {
+			log.Warningf("Dropping IPAM allocation: %v", err)
+		}
+	}
+	log.Infof("Loaded %d IPAM allocations.", len(owners))
+	appMgr.updateIPAMMetrics()
+}
+
+// Persist the allocations if they changed, so a restart hands out the same
+// addresses. If they cannot be written they stay flagged as changed and the
+// error is returned, so the caller can retry.
+func (appMgr *Manager) saveIPAMAllocations() error {
+	allocs, dirty := appMgr.ipam.Snapshot()
+	if !dirty {
+		return nil
+	}
+	appMgr.updateIPAMMetrics()
+	if appMgr.ipamName == "" {
+		return nil
+	}
+	data, err := json.Marshal(allocs)
+	if nil != err {
+		log.Warningf("Unable to marshal IPAM allocations: %v", err)
+		return err
+	}
+	cmIntf := appMgr.kubeClient.CoreV1().ConfigMaps(appMgr.ipamNamespace)
+	cm, err := cmIntf.Get(appMgr.ipamAllocationsName(), metav1.GetOptions{})
+	if nil != err {
+		cm = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      appMgr.ipamAllocationsName(),
+				Namespace: appMgr.ipamNamespace,
+			},
+			Data: map[string]string{ipamAllocationsKey: string(data)},
+		}
+		_, err = cmIntf.Create(cm)
+	} else {
+		if nil == cm.Data {
+			cm.Data = make(map[string]string)
+		}
+		cm.Data[ipamAllocationsKey] = string(data)
+		_, err = cmIntf.Update(cm)
+	}
+	if nil != err {
+		log.Warningf("Unable to save IPAM allocations to '%s/%s': %v",
+			appMgr.ipamNamespace, appMgr.ipamAllocationsName(), err)
+		appMgr.ipam.MarkDirty()
+	}
+	return err
+}
+
+func (appMgr *Manager) updateIPAMMetrics() {
+	for label, count := range appMgr.ipam.Counts() {
+		if label == "" {
+			label = "loadbalancer"
+		}
+		bigIPPrometheus.IPAMAllocations.WithLabelValues(label).Set(float64(count))
+	}
+}
+
+// Return the addresses of all virtuals, so IPAM does not hand them out
+func (appMgr *Manager) virtualAddressesInUse() map[string]bool {
+	appMgr.resources.Lock()
+	defer appMgr.resources.Unlock()
+	inUse := make(map[string]bool)
+	for _, cfg := range appMgr.resources.GetAllResources() {
+		if nil != cfg.Virtual.VirtualAddress &&
+			cfg.Virtual.VirtualAddress.BindAddr != "" {
+			ip, _ := split_ip_with_route_domain(cfg.Virtual.VirtualAddress.BindAddr)
+			inUse[ip] = true
+		}
+	}
+	return inUse
+}
+
+// Allocate an address for an Ingress or ConfigMap with the IPAM label
+// annotation, and record it in the virtual-server IP annotation. Returns
+// the address, or "" if none could be allocated.
+func (appMgr *Manager) allocateAnnotatedAddress(
+	obj runtime.Object,
+	kind string,
+	meta *metav1.ObjectMeta,
+	update func() error,
+) string {
+	label := meta.Annotations[ipamLabelAnnotation]
+	owner := formatIPAMOwner(kind, meta.Namespace, meta.Name)
+	ip, err := appMgr.ipam.Allocate(owner, label, "", "", appMgr.virtualAddressesInUse())
+	if nil != err {
+		msg := fmt.Sprintf("Unable to allocate an address for '%s': %v", owner, err)
+		log.Warning(msg)
+		appMgr.recordEvent(obj, meta.Namespace, v1.EventTypeWarning,
+			"IPAllocationFailed", msg)
+		return ""
+	}
+	meta.Annotations[f5VsBindAddrAnnotation] = ip
+	if err = update(); nil != err {
+		msg := fmt.Sprintf("Error while setting virtual-server IP for '%s': %v",
+			owner, err)
+		log.Warning(msg)
+		appMgr.recordEvent(obj, meta.Namespace, v1.EventTypeWarning,
+			"IPAnnotationError", msg)
+	} else {
+		msg := fmt.Sprintf("Allocated address %s from IPAM label '%s'; "+
+			"set '%s' annotation with address.", ip, label, f5VsBindAddrAnnotation)
+		log.Info(msg)
+		appMgr.recordEvent(obj, meta.Namespace, v1.EventTypeNormal, "IPAllocated", msg)
+	}
+	return ip
+}
+
+func (appMgr *Manager) allocateIngressAddress(ing *v1beta1.Ingress) string {
+	return appMgr.allocateAnnotatedAddress(ing, "Ingress", &ing.ObjectMeta,
+		func() error {
+			_, err := appMgr.kubeClient.ExtensionsV1beta1().
+				Ingresses(ing.ObjectMeta.Namespace).Update(ing)
+			return err
+		})
+}
+
+func (appMgr *Manager) allocateConfigMapAddress(cm *v1.ConfigMap) string {
+	return appMgr.allocateAnnotatedAddress(cm, "ConfigMap", &cm.ObjectMeta,
+		func() error {
+			updated, err := appMgr.kubeClient.CoreV1().
+				ConfigMaps(cm.ObjectMeta.Namespace).Update(cm)
+			if nil == err {
+				// Keep the cached copy current for the status annotation update
+				cm.ObjectMeta.ResourceVersion = updated.ObjectMeta.ResourceVersion
+			}
+			return err
+		})
+}
+
+// Reference the owner of an allocation, so that events can be recorded for
+// it after the object itself has been deleted.
+func ipamOwnerReference(owner string) *v1.ObjectReference {
+	kind, namespace, name := splitIPAMOwner(owner)
+	apiVersion := "v1"
+	if kind == "Ingress" {
+		apiVersion = "extensions/v1beta1"
+	}
+	return &v1.ObjectReference{
+		Kind:       kind,
+		APIVersion: apiVersion,
+		Namespace:  namespace,
+		Name:       name,
+	}
+}
+
+// Release the address held by owner and record an event against obj, or
+// against a reference to the owner if obj is nil (the owner was deleted).
+func (appMgr *Manager) releaseIPAMAddress(
+	owner string,
+	obj runtime.Object,
+	cause string,
+) {
+	ip := appMgr.ipam.Release(owner)
+	if ip == "" {
+		return
+	}
+	if nil == obj {
+		obj = ipamOwnerReference(owner)
+	}
+	_, namespace, _ := splitIPAMOwner(owner)
+	msg := fmt.Sprintf("Released address %s from '%s': %s.", ip, owner, cause)
+	log.Info(msg)
+	appMgr.recordEvent(obj, namespace, v1.EventTypeNormal, "IPReleased", msg)
+}
+
+// Release the addresses of Ingresses and ConfigMaps that have been deleted
+// or no longer have the IPAM label annotation, and of Services that have been
+// deleted or are no longer of type LoadBalancer. syncLoadBalancer releases
+// the address of a Service it syncs, but an allocation loaded at startup may
+// belong to a Service that was deleted while the controller was down.
+func (appMgr *Manager) releaseIPAMAddresses(appInf *appInformer, namespace string) {
+	for _, owner := range appMgr.ipam.Owners() {
+		kind, ns, name := splitIPAMOwner(owner)
+		if ns != namespace {
+			continue
+		}
+		key := ns + "/" + name
+		var obj runtime.Object
+		var annotations map[string]string
+		switch kind {
+		case "Ingress":
+			item, found, _ := appInf.ingInformer.GetIndexer().GetByKey(key)
+			if ing, ok := item.(*v1beta1.Ingress); found && ok {
+				obj, annotations = ing, ing.ObjectMeta.Annotations
+			}
+		case "ConfigMap":
+			item, found, _ := appInf.cfgMapInformer.GetIndexer().GetByKey(key)
+			if cm, ok := item.(*v1.ConfigMap); found && ok {
+				obj, annotations = cm, cm.ObjectMeta.Annotations
+			}
+		case "Service":
+			item, found, _ := appInf.svcInformer.GetIndexer().GetByKey(key)
+			if svc, ok := item.(*v1.Service); !found || !ok {
+				appMgr.releaseIPAMAddress(owner, nil, "it was deleted")
+			} else if svc.Spec.Type != v1.ServiceTypeLoadBalancer {
+				appMgr.releaseIPAMAddress(owner, svc,
+					"it is no longer of type LoadBalancer")
+			}
+			continue
+		default:
+			continue
+		}
+		if nil == obj {
+			appMgr.releaseIPAMAddress(owner, nil, "it was deleted")
+		} else if _, ipam := annotations[ipamLabelAnnotation]; !ipam {
+			appMgr.releaseIPAMAddress(owner, obj,
+				fmt.Sprintf("the '%s' annotation was removed", ipamLabelAnnotation))
+		}
+	}
+}
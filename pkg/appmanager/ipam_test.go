@@ -0,0 +1,413 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/F5Networks/k8s-bigip-ctlr/pkg/test"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+var _ = Describe("IPAM Tests", func() {
+	Describe("IP allocation", func() {
+		It("parses IP ranges", func() {
+			rng, err := parseIPRange("10.1.1.0/30")
+			Expect(err).To(BeNil())
+			Expect(rng.contains("10.1.1.0")).To(BeFalse())
+			Expect(rng.contains("10.1.1.1")).To(BeTrue())
+			Expect(rng.contains("10.1.1.2")).To(BeTrue())
+			Expect(rng.contains("10.1.1.3")).To(BeFalse())
+
+			rng, err = parseIPRange("10.1.1.10-10.1.1.12")
+			Expect(err).To(BeNil())
+			Expect(rng.contains("10.1.1.10")).To(BeTrue())
+			Expect(rng.contains("10.1.1.12")).To(BeTrue())
+			Expect(rng.contains("10.1.1.13")).To(BeFalse())
+
+			rng, err = parseIPRange("10.1.1.5")
+			Expect(err).To(BeNil())
+			Expect(rng.contains("10.1.1.5")).To(BeTrue())
+
+			_, err = parseIPRange("10.1.1.12-10.1.1.10")
+			Expect(err).ToNot(BeNil())
+			_, err = parseIPRange("10.1.1.1-10.1.1.2-10.1.1.3")
+			Expect(err).ToNot(BeNil())
+			_, err = parseIPRange("not-an-ip")
+			Expect(err).ToNot(BeNil())
+			_, err = parseIPRange("2001::/64")
+			Expect(err).ToNot(BeNil())
+
+			ranges, errs := parseIPRanges([]string{"10.1.1.1", " ", "bad"})
+			Expect(len(ranges)).To(Equal(1))
+			Expect(len(errs)).To(Equal(1))
+		})
+
+		It("allocates, honours requests and releases addresses", func() {
+			alloc := newIPAllocator([]string{"10.1.1.1-10.1.1.2", "bad"})
+			Expect(len(alloc.ranges[""])).To(Equal(1))
+
+			ip, err := alloc.Allocate("ns/a", "", "", "", nil)
+			Expect(err).To(BeNil())
+			Expect(ip).To(Equal("10.1.1.1"))
+			// Same owner keeps its address
+			ip, err = alloc.Allocate("ns/a", "", "", "", nil)
+			Expect(err).To(BeNil())
+			Expect(ip).To(Equal("10.1.1.1"))
+
+			// Hint is used when it is free and in range
+			ip, err = alloc.Allocate("ns/b", "", "", "10.1.1.2", nil)
+			Expect(err).To(BeNil())
+			Expect(ip).To(Equal("10.1.1.2"))
+
+			// Ranges are exhausted
+			_, err = alloc.Allocate("ns/c", "", "", "", nil)
+			Expect(err).ToNot(BeNil())
+
+			// Requested addresses need not be in a range, but must be free
+			ip, err = alloc.Allocate("ns/c", "", "192.168.1.1", "", nil)
+			Expect(err).To(BeNil())
+			Expect(ip).To(Equal("192.168.1.1"))
+			_, err = alloc.Allocate("ns/d", "", "10.1.1.1", "", nil)
+			Expect(err).ToNot(BeNil())
+			_, err = alloc.Allocate("ns/d", "", "bogus", "", nil)
+			Expect(err).ToNot(BeNil())
+
+			Expect(alloc.Release("ns/a")).To(Equal("10.1.1.1"))
+			Expect(alloc.Release("ns/a")).To(Equal(""))
+			ip, err = alloc.Allocate("ns/d", "", "", "", nil)
+			Expect(err).To(BeNil())
+			Expect(ip).To(Equal("10.1.1.1"))
+			_, found := alloc.Lookup("ns/d")
+			Expect(found).To(BeTrue())
+		})
+
+		It("allocates from named ranges", func() {
+			alloc := newIPAllocator(nil)
+			prod, _ := parseIPRanges([]string{"10.2.0.1-10.2.0.3"})
+			dev, _ := parseIPRanges([]string{"10.3.0.1"})
+			alloc.SetLabelRanges(map[string][]ipRange{"prod": prod, "dev": dev})
+
+			_, err := alloc.Allocate("ns/a", "unknown", "", "", nil)
+			Expect(err).ToNot(BeNil())
+			// Addresses in use by other virtuals are skipped
+			ip, err := alloc.Allocate("ns/a", "prod", "", "",
+				map[string]bool{"10.2.0.1": true})
+			Expect(err).To(BeNil())
+			Expect(ip).To(Equal("10.2.0.2"))
+			ip, err = alloc.Allocate("ns/b", "dev", "", "", nil)
+			Expect(err).To(BeNil())
+			Expect(ip).To(Equal("10.3.0.1"))
+			// Changing the label moves the owner to the new ranges
+			ip, err = alloc.Allocate("ns/a", "dev", "", "", nil)
+			Expect(err).ToNot(BeNil())
+			ip, err = alloc.Allocate("ns/b", "prod", "", "", nil)
+			Expect(err).To(BeNil())
+			Expect(ip).To(Equal("10.2.0.1"))
+
+			Expect(alloc.Counts()).To(Equal(map[string]int{
+				"": 0, "prod": 2, "dev": 0}))
+			snapshot, dirty := alloc.Snapshot()
+			Expect(dirty).To(BeTrue())
+			Expect(snapshot).To(Equal(map[string]ipamAllocation{
+				"ns/a": {IP: "10.2.0.2", Label: "prod"},
+				"ns/b": {IP: "10.2.0.1", Label: "prod"},
+			}))
+			_, dirty = alloc.Snapshot()
+			Expect(dirty).To(BeFalse())
+			alloc.MarkDirty()
+			_, dirty = alloc.Snapshot()
+			Expect(dirty).To(BeTrue())
+
+			// Restoring a conflicting allocation is refused
+			err = alloc.Restore("ns/c", ipamAllocation{IP: "10.2.0.1", Label: "prod"})
+			Expect(err).ToNot(BeNil())
+			err = alloc.Restore("ns/c", ipamAllocation{IP: "10.2.0.3", Label: "prod"})
+			Expect(err).To(BeNil())
+		})
+	})
+
+	Describe("Using Mock Manager", func() {
+		var mockMgr *mockAppManager
+		var fakeClient *fake.Clientset
+		namespace := "default"
+
+		BeforeEach(func() {
+			RegisterBigIPSchemaTypes()
+
+			mw := &test.MockWriter{
+				FailStyle: test.Success,
+				Sections:  make(map[string]interface{}),
+			}
+			fakeClient = fake.NewSimpleClientset()
+			mockMgr = newMockAppManager(&Params{
+				KubeClient:      fakeClient,
+				ConfigWriter:    mw,
+				restClient:      test.CreateFakeHTTPClient(),
+				IsNodePort:      false,
+				broadcasterFunc: NewFakeEventBroadcaster,
+				IPAMConfigMap:   "kube-system/f5-ipam",
+			})
+			err := mockMgr.startNonLabelMode([]string{namespace})
+			Expect(err).To(BeNil())
+			ranges := test.NewConfigMap("f5-ipam", "1", "kube-system",
+				map[string]string{
+					"prod": "10.20.0.1-10.20.0.2",
+					"dev":  "10.30.0.0/30, bad",
+				})
+			mockMgr.appMgr.updateIPAMRanges(ranges)
+		})
+		AfterEach(func() {
+			mockMgr.shutdown()
+		})
+
+		savedAllocations := func() map[string]ipamAllocation {
+			cm, err := fakeClient.CoreV1().ConfigMaps("kube-system").Get(
+				"f5-ipam-allocations", metav1.GetOptions{})
+			Expect(err).To(BeNil())
+			var allocs map[string]ipamAllocation
+			err = json.Unmarshal([]byte(cm.Data[ipamAllocationsKey]), &allocs)
+			Expect(err).To(BeNil())
+			return allocs
+		}
+
+		newIpamIngress := func(name, label string) *v1beta1.Ingress {
+			return test.NewIngress(name, "1", namespace,
+				v1beta1.IngressSpec{
+					Backend: &v1beta1.IngressBackend{
+						ServiceName: "foo",
+						ServicePort: intstr.IntOrString{IntVal: 80},
+					},
+				},
+				map[string]string{
+					ipamLabelAnnotation: label,
+				})
+		}
+
+		releasedEvents := func(ns string) []FakeEvent {
+			var released []FakeEvent
+			for _, ev := range mockMgr.getFakeEvents(ns) {
+				if ev.Reason == "IPReleased" {
+					released = append(released, ev)
+				}
+			}
+			return released
+		}
+
+		It("reports invalid ranges", func() {
+			events := mockMgr.getFakeEvents("kube-system")
+			Expect(len(events)).To(Equal(1))
+			Expect(events[0].Name).To(Equal("f5-ipam"))
+			Expect(events[0].Reason).To(Equal("InvalidIPRange"))
+			Expect(len(mockMgr.appMgr.ipam.ranges["dev"])).To(Equal(1))
+		})
+
+		It("allocates addresses for Ingresses and releases them on delete", func() {
+			svcPorts := []v1.ServicePort{newServicePort("port0", 80)}
+			svc := test.NewService("foo", "1", namespace, v1.ServiceTypeClusterIP,
+				svcPorts)
+			Expect(mockMgr.addService(svc)).To(BeTrue())
+
+			ing1 := newIpamIngress("ing1", "prod")
+			Expect(mockMgr.addIngress(ing1)).To(BeTrue())
+			Expect(ing1.ObjectMeta.Annotations[f5VsBindAddrAnnotation]).To(
+				Equal("10.20.0.1"))
+			_, ok := mockMgr.resources().Get(serviceKey{"foo", 80, namespace},
+				formatIngressVSName("10.20.0.1", 80))
+			Expect(ok).To(BeTrue())
+			Expect(savedAllocations()).To(Equal(map[string]ipamAllocation{
+				"Ingress/default/ing1": {IP: "10.20.0.1", Label: "prod"},
+			}))
+
+			ing2 := newIpamIngress("ing2", "prod")
+			Expect(mockMgr.addIngress(ing2)).To(BeTrue())
+			Expect(ing2.ObjectMeta.Annotations[f5VsBindAddrAnnotation]).To(
+				Equal("10.20.0.2"))
+
+			// The range is exhausted
+			ing3 := newIpamIngress("ing3", "prod")
+			Expect(mockMgr.addIngress(ing3)).To(BeTrue())
+			_, found := ing3.ObjectMeta.Annotations[f5VsBindAddrAnnotation]
+			Expect(found).To(BeFalse())
+			events := mockMgr.getFakeEvents(namespace)
+			var failed []FakeEvent
+			for _, ev := range events {
+				if ev.Reason == "IPAllocationFailed" {
+					failed = append(failed, ev)
+				}
+			}
+			Expect(len(failed)).ToNot(BeZero())
+			Expect(failed[0].Name).To(Equal("ing3"))
+			Expect(failed[0].EventType).To(Equal(v1.EventTypeWarning))
+
+			// Deleting an Ingress gives the address back
+			Expect(mockMgr.deleteIngress(ing1)).To(BeTrue())
+			_, found = mockMgr.appMgr.ipam.Lookup(
+				formatIPAMOwner("Ingress", namespace, "ing1"))
+			Expect(found).To(BeFalse())
+			Expect(savedAllocations()).To(Equal(map[string]ipamAllocation{
+				"Ingress/default/ing2": {IP: "10.20.0.2", Label: "prod"},
+			}))
+			released := releasedEvents(namespace)
+			Expect(len(released)).To(Equal(1))
+			Expect(released[0].Name).To(Equal("ing1"))
+			Expect(released[0].EventType).To(Equal(v1.EventTypeNormal))
+		})
+
+		It("releases addresses when the IPAM label annotation is removed", func() {
+			svcPorts := []v1.ServicePort{newServicePort("port0", 80)}
+			svc := test.NewService("foo", "1", namespace, v1.ServiceTypeClusterIP,
+				svcPorts)
+			Expect(mockMgr.addService(svc)).To(BeTrue())
+
+			ing := newIpamIngress("ing1", "prod")
+			Expect(mockMgr.addIngress(ing)).To(BeTrue())
+			owner := formatIPAMOwner("Ingress", namespace, "ing1")
+			_, found := mockMgr.appMgr.ipam.Lookup(owner)
+			Expect(found).To(BeTrue())
+
+			ing = newIpamIngress("ing1", "prod")
+			ing.ObjectMeta.ResourceVersion = "2"
+			delete(ing.ObjectMeta.Annotations, ipamLabelAnnotation)
+			ing.ObjectMeta.Annotations[f5VsBindAddrAnnotation] = "10.20.0.1"
+			Expect(mockMgr.updateIngress(ing)).To(BeTrue())
+			_, found = mockMgr.appMgr.ipam.Lookup(owner)
+			Expect(found).To(BeFalse())
+			Expect(savedAllocations()).To(BeEmpty())
+			released := releasedEvents(namespace)
+			Expect(len(released)).To(Equal(1))
+			Expect(released[0].Name).To(Equal("ing1"))
+		})
+
+		It("saves allocations again after a failed write", func() {
+			failing := true
+			fakeClient.PrependReactor("create", "configmaps",
+				func(action clienttesting.Action) (bool, runtime.Object, error) {
+					if failing {
+						return true, nil, fmt.Errorf("the server is down")
+					}
+					return false, nil, nil
+				})
+			svcPorts := []v1.ServicePort{newServicePort("port0", 80)}
+			svc := test.NewService("foo", "1", namespace, v1.ServiceTypeClusterIP,
+				svcPorts)
+			Expect(mockMgr.addService(svc)).To(BeTrue())
+			Expect(mockMgr.addIngress(newIpamIngress("ing1", "prod"))).To(BeTrue())
+			_, err := fakeClient.CoreV1().ConfigMaps("kube-system").Get(
+				"f5-ipam-allocations", metav1.GetOptions{})
+			Expect(err).ToNot(BeNil())
+
+			// The sync is retried, and writes the allocations that were
+			// not saved even though nothing changed since.
+			failing = false
+			sKey := serviceQueueKey{ServiceName: "foo", Namespace: namespace}
+			Expect(mockMgr.appMgr.syncVirtualServer(sKey)).To(BeNil())
+			Expect(savedAllocations()).To(Equal(map[string]ipamAllocation{
+				"Ingress/default/ing1": {IP: "10.20.0.1", Label: "prod"},
+			}))
+		})
+
+		It("allocates addresses for ConfigMaps", func() {
+			cfgData := `{
+			  "virtualServer": {
+			    "backend": {
+			      "serviceName": "foo",
+			      "servicePort": 80
+			    },
+			    "frontend": {
+			      "mode": "http",
+			      "partition": "velcro",
+			      "virtualAddress": {
+			        "port": 10000
+			      }
+			    }
+			  }
+			}`
+			cfgMap := test.NewConfigMap("ipamcfg", "1", namespace, map[string]string{
+				"schema": schemaUrl,
+				"data":   cfgData,
+			})
+			cfgMap.ObjectMeta.Annotations[ipamLabelAnnotation] = "dev"
+			_, err := fakeClient.CoreV1().ConfigMaps(namespace).Create(cfgMap)
+			Expect(err).To(BeNil())
+			Expect(mockMgr.addConfigMap(cfgMap)).To(BeTrue())
+
+			rs, ok := mockMgr.resources().Get(serviceKey{"foo", 80, namespace},
+				formatConfigMapVSName(cfgMap))
+			Expect(ok).To(BeTrue())
+			Expect(rs.Virtual.Destination).To(Equal("/velcro/10.30.0.1:10000"))
+			Expect(cfgMap.ObjectMeta.Annotations[f5VsBindAddrAnnotation]).To(
+				Equal("10.30.0.1"))
+
+			Expect(mockMgr.deleteConfigMap(cfgMap)).To(BeTrue())
+			_, found := mockMgr.appMgr.ipam.Lookup(
+				formatIPAMOwner("ConfigMap", namespace, "ipamcfg"))
+			Expect(found).To(BeFalse())
+		})
+
+		It("loads persisted allocations", func() {
+			allocs := map[string]ipamAllocation{
+				"Ingress/default/a": {IP: "10.20.0.2", Label: "prod"},
+				"Ingress/default/b": {IP: "10.20.0.2", Label: "prod"},
+			}
+			data, _ := json.Marshal(allocs)
+			cm := test.NewConfigMap("f5-ipam-allocations", "1", "kube-system",
+				map[string]string{ipamAllocationsKey: string(data)})
+			_, err := fakeClient.CoreV1().ConfigMaps("kube-system").Create(cm)
+			Expect(err).To(BeNil())
+
+			mockMgr.appMgr.loadIPAMAllocations()
+			ip, found := mockMgr.appMgr.ipam.Lookup("Ingress/default/a")
+			Expect(found).To(BeTrue())
+			Expect(ip).To(Equal("10.20.0.2"))
+			_, found = mockMgr.appMgr.ipam.Lookup("Ingress/default/b")
+			Expect(found).To(BeFalse())
+		})
+
+		It("releases loaded allocations of Services that are gone", func() {
+			allocs := map[string]ipamAllocation{
+				"Service/default/gone":  {IP: "10.20.0.1", Label: "prod"},
+				"Service/default/plain": {IP: "10.20.0.2", Label: "prod"},
+			}
+			data, _ := json.Marshal(allocs)
+			cm := test.NewConfigMap("f5-ipam-allocations", "1", "kube-system",
+				map[string]string{ipamAllocationsKey: string(data)})
+			_, err := fakeClient.CoreV1().ConfigMaps("kube-system").Create(cm)
+			Expect(err).To(BeNil())
+			mockMgr.appMgr.loadIPAMAllocations()
+			Expect(mockMgr.appMgr.ipam.Owners()).To(HaveLen(2))
+
+			// The first sync of the namespace releases both addresses
+			svc := test.NewService("plain", "1", namespace, v1.ServiceTypeClusterIP,
+				[]v1.ServicePort{newServicePort("port0", 80)})
+			Expect(mockMgr.addService(svc)).To(BeTrue())
+			Expect(mockMgr.appMgr.ipam.Owners()).To(BeEmpty())
+			Expect(releasedEvents(namespace)).To(HaveLen(2))
+			Expect(savedAllocations()).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,166 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	"fmt"
+
+	log "github.com/F5Networks/k8s-bigip-ctlr/pkg/vlogger"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// format the virtual server name for a LoadBalancer Service port
+func formatLoadBalancerVSName(namespace, svc string, port int32) string {
+	return fmt.Sprintf("loadbalancer_%s_%s_%d", namespace, svc, port)
+}
+
+// Create a ResourceConfig for one port of a LoadBalancer Service
+func createRSConfigFromLoadBalancer(
+	svc *v1.Service,
+	portSpec v1.ServicePort,
+	bindAddr string,
+	partition string,
+) *ResourceConfig {
+	var cfg ResourceConfig
+	name := formatLoadBalancerVSName(
+		svc.ObjectMeta.Namespace, svc.ObjectMeta.Name, portSpec.Port)
+
+	balance := DEFAULT_BALANCE
+	if bal, ok := svc.ObjectMeta.Annotations[f5VsBalanceAnnotation]; ok == true {
+		balance = bal
+	}
+
+	cfg.MetaData.ResourceType = "loadbalancer"
+	cfg.Virtual.Name = name
+	cfg.Virtual.Partition = partition
+	cfg.Virtual.Enabled = true
+	cfg.Virtual.PoolName = joinBigipPath(cfg.Virtual.Partition, name)
+	cfg.Virtual.SourceAddrTranslation = SourceAddrTranslation{
+		Type: DEFAULT_SOURCE_ADDR_TRANSLATION,
+	}
+	mode := DEFAULT_MODE
+	if portSpec.Protocol == v1.ProtocolUDP {
+		mode = "udp"
+	}
+	setProfilesForMode(mode, &cfg)
+	cfg.Virtual.SetVirtualAddress(bindAddr, portSpec.Port)
+
+	pool := Pool{
+		Name:        name,
+		Partition:   cfg.Virtual.Partition,
+		Balance:     balance,
+		ServiceName: svc.ObjectMeta.Name,
+		ServicePort: portSpec.Port,
+	}
+	cfg.Pools = append(cfg.Pools, pool)
+	return &cfg
+}
+
+func (appMgr *Manager) syncLoadBalancer(
+	stats *vsSyncStats,
+	sKey serviceQueueKey,
+	rsMap ResourceMap,
+	svcPortMap map[int32]bool,
+	svc *v1.Service,
+	appInf *appInformer,
+) {
+	// Any virtuals left over for this service are removed from rsMap by
+	// deleteUnusedConfigs, only the address has to be given back.
+	owner := formatIPAMOwner("Service", sKey.Namespace, sKey.ServiceName)
+	if nil == svc {
+		appMgr.releaseIPAMAddress(owner, nil, "it was deleted")
+		return
+	}
+	if svc.Spec.Type != v1.ServiceTypeLoadBalancer {
+		appMgr.releaseIPAMAddress(owner, svc, "it is no longer of type LoadBalancer")
+		return
+	}
+	// Without load balancer ranges the controller only handles the Services
+	// that ask for an IPAM label, and leaves the rest to another load balancer
+	label, labeled := svc.ObjectMeta.Annotations[ipamLabelAnnotation]
+	if !labeled && !appMgr.ipam.HasRanges("") {
+		appMgr.releaseIPAMAddress(owner, svc,
+			fmt.Sprintf("it has no '%s' annotation", ipamLabelAnnotation))
+		return
+	}
+	partition, ok := svc.ObjectMeta.Annotations[f5VsPartitionAnnotation]
+	if !ok {
+		partition = appMgr.namespacePartition(sKey.Namespace)
+	}
+	if !appMgr.checkPartition(svc, svc.ObjectMeta, partition) {
+		appMgr.releaseIPAMAddress(owner, svc,
+			fmt.Sprintf("partition '%s' is not managed", partition))
+		return
+	}
+
+	var hint string
+	if len(svc.Status.LoadBalancer.Ingress) > 0 {
+		hint = svc.Status.LoadBalancer.Ingress[0].IP
+	}
+	ip, err := appMgr.ipam.Allocate(
+		owner, label, svc.Spec.LoadBalancerIP, hint, appMgr.virtualAddressesInUse())
+	if nil != err {
+		msg := fmt.Sprintf("Unable to allocate an address for '%s': %v", owner, err)
+		log.Warning(msg)
+		appMgr.recordServiceEvent(svc, v1.EventTypeWarning, "IPAllocationFailed", msg)
+		return
+	}
+
+	for _, portSpec := range svc.Spec.Ports {
+		rsCfg := createRSConfigFromLoadBalancer(svc, portSpec, ip, partition)
+		appMgr.handlePersistence(rsCfg, svc, svc.ObjectMeta,
+			annotationPersistence(svc.ObjectMeta.Annotations), svc)
+		rsName := rsCfg.GetName()
+		_, found, updated := appMgr.handleConfigForType(
+			rsCfg, sKey, rsMap, rsName, svcPortMap,
+			svc, appInf, []string{}, nil)
+		stats.vsFound += found
+		stats.vsUpdated += updated
+	}
+
+	if nil != appMgr.setServiceStatus(svc, ip) {
+		stats.statusErrors++
+	}
+}
+
+// Set the Service status to include the allocated virtual address.
+// Returns an error if the status could not be written.
+func (appMgr *Manager) setServiceStatus(svc *v1.Service, ip string) error {
+	lbIngress := []v1.LoadBalancerIngress{{IP: ip}}
+	if len(svc.Status.LoadBalancer.Ingress) == 1 &&
+		svc.Status.LoadBalancer.Ingress[0].IP == ip {
+		return nil
+	}
+	// The Service is the one in the informer cache, which only changes once
+	// the status is written, so the status is set on a copy
+	updated := *svc
+	updated.Status.LoadBalancer.Ingress = lbIngress
+	_, err := appMgr.kubeClient.CoreV1().
+		Services(svc.ObjectMeta.Namespace).UpdateStatus(&updated)
+	if nil != err {
+		warning := fmt.Sprintf(
+			"Error when setting Service status IP %s for '%s/%s': %v",
+			ip, svc.ObjectMeta.Namespace, svc.ObjectMeta.Name, err)
+		log.Warning(warning)
+		appMgr.recordServiceEvent(svc, v1.EventTypeWarning, "StatusIPError", warning)
+		return err
+	}
+	msg := fmt.Sprintf("Assigned load balancer address %s.", ip)
+	appMgr.recordServiceEvent(svc, v1.EventTypeNormal, "IPAllocated", msg)
+	return nil
+}
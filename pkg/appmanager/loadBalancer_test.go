@@ -0,0 +1,264 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	"fmt"
+
+	"github.com/F5Networks/k8s-bigip-ctlr/pkg/test"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/pkg/api/v1"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+var _ = Describe("LoadBalancer Service Tests", func() {
+	Describe("Using Mock Manager", func() {
+		var mockMgr *mockAppManager
+		var fakeClient *fake.Clientset
+		namespace := "default"
+
+		BeforeEach(func() {
+			mw := &test.MockWriter{
+				FailStyle: test.Success,
+				Sections:  make(map[string]interface{}),
+			}
+			fakeClient = fake.NewSimpleClientset()
+			mockMgr = newMockAppManager(&Params{
+				KubeClient:           fakeClient,
+				ConfigWriter:         mw,
+				restClient:           test.CreateFakeHTTPClient(),
+				IsNodePort:           false,
+				broadcasterFunc:      NewFakeEventBroadcaster,
+				LoadBalancerIPRanges: []string{"10.10.10.1-10.10.10.2"},
+			})
+			err := mockMgr.startNonLabelMode([]string{namespace})
+			Expect(err).To(BeNil())
+		})
+		AfterEach(func() {
+			mockMgr.shutdown()
+		})
+
+		newLBService := func(name string, ports []v1.ServicePort) *v1.Service {
+			svc := test.NewService(name, "1", namespace,
+				v1.ServiceTypeLoadBalancer, ports)
+			_, err := fakeClient.CoreV1().Services(namespace).Create(svc)
+			Expect(err).To(BeNil())
+			return svc
+		}
+
+		It("creates a virtual per port and writes the Service status", func() {
+			udpPort := newServicePort("dns", 53)
+			udpPort.Protocol = v1.ProtocolUDP
+			svcPorts := []v1.ServicePort{newServicePort("http", 80), udpPort}
+			svc := newLBService("foo", svcPorts)
+			endpts := test.NewEndpoints("foo", "1", namespace,
+				[]string{"10.2.96.1"}, []string{},
+				convertSvcPortsToEndpointPorts(svcPorts))
+			Expect(mockMgr.addEndpoints(endpts)).To(BeTrue())
+			Expect(mockMgr.addService(svc)).To(BeTrue())
+
+			resources := mockMgr.resources()
+			Expect(resources.VirtualCount()).To(Equal(2))
+			rs, ok := resources.Get(serviceKey{"foo", 80, namespace},
+				formatLoadBalancerVSName(namespace, "foo", 80))
+			Expect(ok).To(BeTrue())
+			Expect(rs.MetaData.Active).To(BeTrue())
+			Expect(rs.Virtual.Destination).To(Equal("/velcro/10.10.10.1:80"))
+			Expect(rs.Virtual.IpProtocol).To(Equal("tcp"))
+			Expect(rs.Pools[0].Members).To(Equal(
+				generateExpectedAddrs(80, []string{"10.2.96.1"})))
+			rs, ok = resources.Get(serviceKey{"foo", 53, namespace},
+				formatLoadBalancerVSName(namespace, "foo", 53))
+			Expect(ok).To(BeTrue())
+			Expect(rs.Virtual.Destination).To(Equal("/velcro/10.10.10.1:53"))
+			Expect(rs.Virtual.IpProtocol).To(Equal("udp"))
+
+			updated, err := fakeClient.CoreV1().Services(namespace).Get(
+				"foo", metav1.GetOptions{})
+			Expect(err).To(BeNil())
+			Expect(updated.Status.LoadBalancer.Ingress).To(Equal(
+				[]v1.LoadBalancerIngress{{IP: "10.10.10.1"}}))
+			// The cached Service is left alone until the status comes back
+			Expect(svc.Status.LoadBalancer.Ingress).To(BeEmpty())
+			events := mockMgr.getFakeEvents(namespace)
+			Expect(len(events)).To(Equal(1))
+			Expect(events[0].Reason).To(Equal("IPAllocated"))
+
+			// Deleting the service removes the virtuals and frees the address
+			Expect(mockMgr.deleteService(svc)).To(BeTrue())
+			Expect(resources.VirtualCount()).To(Equal(0))
+			_, found := mockMgr.appMgr.ipam.Lookup(
+				formatIPAMOwner("Service", namespace, "foo"))
+			Expect(found).To(BeFalse())
+		})
+
+		It("leaves Services to another load balancer without ranges", func() {
+			mockMgr.appMgr.ipam = newIPAllocator(nil)
+			svcPorts := []v1.ServicePort{newServicePort("http", 80)}
+			foo := newLBService("foo", svcPorts)
+			foo.Spec.LoadBalancerIP = "172.16.0.10"
+			Expect(mockMgr.addService(foo)).To(BeTrue())
+			Expect(mockMgr.resources().VirtualCount()).To(Equal(0))
+			Expect(mockMgr.getFakeEvents(namespace)).To(BeEmpty())
+			updated, err := fakeClient.CoreV1().Services(namespace).Get(
+				"foo", metav1.GetOptions{})
+			Expect(err).To(BeNil())
+			Expect(updated.Status.LoadBalancer.Ingress).To(BeEmpty())
+
+			// An IPAM label asks the controller to handle the Service
+			rng, err := parseIPRange("10.20.0.5")
+			Expect(err).To(BeNil())
+			mockMgr.appMgr.ipam.SetLabelRanges(map[string][]ipRange{"prod": {rng}})
+			bar := newLBService("bar", svcPorts)
+			bar.ObjectMeta.Annotations = map[string]string{
+				ipamLabelAnnotation: "prod",
+			}
+			Expect(mockMgr.addService(bar)).To(BeTrue())
+			rs, ok := mockMgr.resources().Get(serviceKey{"bar", 80, namespace},
+				formatLoadBalancerVSName(namespace, "bar", 80))
+			Expect(ok).To(BeTrue())
+			Expect(rs.Virtual.Destination).To(Equal("/velcro/10.20.0.5:80"))
+
+			// Removing the label gives the Service back
+			bar.ObjectMeta.Annotations = nil
+			Expect(mockMgr.updateService(bar)).To(BeTrue())
+			Expect(mockMgr.resources().VirtualCount()).To(Equal(0))
+			_, found := mockMgr.appMgr.ipam.Lookup(
+				formatIPAMOwner("Service", namespace, "bar"))
+			Expect(found).To(BeFalse())
+		})
+
+		It("honours spec.loadBalancerIP and reports conflicts", func() {
+			svcPorts := []v1.ServicePort{newServicePort("http", 80)}
+			foo := newLBService("foo", svcPorts)
+			foo.Spec.LoadBalancerIP = "172.16.0.10"
+			Expect(mockMgr.addService(foo)).To(BeTrue())
+			rs, ok := mockMgr.resources().Get(serviceKey{"foo", 80, namespace},
+				formatLoadBalancerVSName(namespace, "foo", 80))
+			Expect(ok).To(BeTrue())
+			Expect(rs.Virtual.Destination).To(Equal("/velcro/172.16.0.10:80"))
+
+			bar := newLBService("bar", svcPorts)
+			bar.Spec.LoadBalancerIP = "172.16.0.10"
+			Expect(mockMgr.addService(bar)).To(BeTrue())
+			_, ok = mockMgr.resources().Get(serviceKey{"bar", 80, namespace},
+				formatLoadBalancerVSName(namespace, "bar", 80))
+			Expect(ok).To(BeFalse())
+			events := mockMgr.getFakeEvents(namespace)
+			Expect(events[len(events)-1].Name).To(Equal("bar"))
+			Expect(events[len(events)-1].Reason).To(Equal("IPAllocationFailed"))
+			Expect(events[len(events)-1].EventType).To(Equal(v1.EventTypeWarning))
+
+			// Changing the type away from LoadBalancer removes the virtual
+			foo.Spec.Type = v1.ServiceTypeClusterIP
+			Expect(mockMgr.updateService(foo)).To(BeTrue())
+			Expect(mockMgr.resources().VirtualCount()).To(Equal(0))
+			_, found := mockMgr.appMgr.ipam.Lookup(
+				formatIPAMOwner("Service", namespace, "foo"))
+			Expect(found).To(BeFalse())
+			events = mockMgr.getFakeEvents(namespace)
+			Expect(events[len(events)-1].Reason).To(Equal("IPReleased"))
+		})
+
+		It("retries the Service status until it is written", func() {
+			failing := true
+			fakeClient.PrependReactor("update", "services",
+				func(action clienttesting.Action) (bool, runtime.Object, error) {
+					if failing {
+						return true, nil, fmt.Errorf("the server is down")
+					}
+					return false, nil, nil
+				})
+			svc := newLBService("foo", []v1.ServicePort{newServicePort("http", 80)})
+			Expect(mockMgr.addService(svc)).To(BeTrue())
+			sKey := serviceQueueKey{ServiceName: "foo", Namespace: namespace}
+			Expect(mockMgr.appMgr.syncVirtualServer(sKey)).ToNot(BeNil())
+			events := mockMgr.getFakeEvents(namespace)
+			Expect(events[len(events)-1].Reason).To(Equal("StatusIPError"))
+
+			failing = false
+			Expect(mockMgr.appMgr.syncVirtualServer(sKey)).To(BeNil())
+			updated, err := fakeClient.CoreV1().Services(namespace).Get(
+				"foo", metav1.GetOptions{})
+			Expect(err).To(BeNil())
+			Expect(updated.Status.LoadBalancer.Ingress).To(Equal(
+				[]v1.LoadBalancerIngress{{IP: "10.10.10.1"}}))
+		})
+
+		It("places virtuals in the partition of the Service", func() {
+			mockMgr.appMgr.partitions = []string{DEFAULT_PARTITION, "tenant"}
+			ns := test.NewNamespace(namespace, "1", nil)
+			ns.ObjectMeta.Annotations = map[string]string{
+				f5VsPartitionAnnotation: "tenant",
+			}
+			_, err := fakeClient.CoreV1().Namespaces().Create(ns)
+			Expect(err).To(BeNil())
+			vsName := formatLoadBalancerVSName(namespace, "foo", 80)
+
+			svc := newLBService("foo", []v1.ServicePort{newServicePort("http", 80)})
+			Expect(mockMgr.addService(svc)).To(BeTrue())
+			rs, ok := mockMgr.resources().Get(serviceKey{"foo", 80, namespace},
+				vsName)
+			Expect(ok).To(BeTrue())
+			Expect(rs.Virtual.Partition).To(Equal("tenant"))
+			Expect(rs.Virtual.Destination).To(Equal("/tenant/10.10.10.1:80"))
+			Expect(rs.Pools[0].Partition).To(Equal("tenant"))
+
+			// The Service annotation wins, and unmanaged partitions are refused
+			svc.ObjectMeta.Annotations = map[string]string{
+				f5VsPartitionAnnotation: "Common",
+			}
+			Expect(mockMgr.updateService(svc)).To(BeTrue())
+			Expect(mockMgr.resources().VirtualCount()).To(Equal(0))
+			events := mockMgr.getFakeEvents(namespace)
+			Expect(events[len(events)-2].Reason).To(Equal("InvalidPartition"))
+			Expect(events[len(events)-1].Reason).To(Equal("IPReleased"))
+			_, found := mockMgr.appMgr.ipam.Lookup(
+				formatIPAMOwner("Service", namespace, "foo"))
+			Expect(found).To(BeFalse())
+		})
+
+		It("maps ClientIP session affinity to source address persistence", func() {
+			svc := newLBService("foo",
+				[]v1.ServicePort{newServicePort("http", 80)})
+			svc.Spec.SessionAffinity = v1.ServiceAffinityClientIP
+			Expect(mockMgr.addService(svc)).To(BeTrue())
+
+			vsName := formatLoadBalancerVSName(namespace, "foo", 80)
+			rs, ok := mockMgr.resources().Get(serviceKey{"foo", 80, namespace}, vsName)
+			Expect(ok).To(BeTrue())
+			Expect(rs.Virtual.Persist).To(Equal([]persistenceRef{{
+				Name:      "source_addr",
+				Partition: "Common",
+				TmDefault: "yes",
+			}}))
+
+			// The annotation takes precedence over the session affinity
+			svc.ObjectMeta.Annotations = map[string]string{
+				f5VsPersistenceAnnotation: persistNone,
+			}
+			Expect(mockMgr.updateService(svc)).To(BeTrue())
+			rs, _ = mockMgr.resources().Get(serviceKey{"foo", 80, namespace}, vsName)
+			Expect(rs.Virtual.Persist).To(BeEmpty())
+		})
+	})
+})
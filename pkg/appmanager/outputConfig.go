@@ -84,6 +84,14 @@ func (appMgr *Manager) outputConfigLocked() {
 				initPartitionData(resources, p.Partition)
 				resources[p.Partition].Policies = appendPolicy(resources[p.Partition].Policies, p)
 			}
+			for _, p := range cfg.TunedProfiles {
+				initPartitionData(resources, p.Partition)
+				resources[p.Partition].TunedProfiles = appendTunedProfile(resources[p.Partition].TunedProfiles, p)
+			}
+			if fw := cfg.FirewallPolicy; nil != fw {
+				initPartitionData(resources, fw.Partition)
+				resources[fw.Partition].FirewallPolicies = appendFirewallPolicy(resources[fw.Partition].FirewallPolicies, *fw)
+			}
 		}
 	}
 
@@ -256,6 +264,12 @@ func copyResourceData(resources PartitionMap) PartitionMap {
 		resourceLog[partition].Policies = make([]Policy, len(cfg.Policies))
 		copy(resourceLog[partition].Policies, cfg.Policies)
 
+		resourceLog[partition].TunedProfiles = make([]TunedProfile, len(cfg.TunedProfiles))
+		copy(resourceLog[partition].TunedProfiles, cfg.TunedProfiles)
+
+		resourceLog[partition].FirewallPolicies = make([]FirewallPolicy, len(cfg.FirewallPolicies))
+		copy(resourceLog[partition].FirewallPolicies, cfg.FirewallPolicies)
+
 		resourceLog[partition].IRules = make([]IRule, len(cfg.IRules))
 		copy(resourceLog[partition].IRules, cfg.IRules)
 
@@ -0,0 +1,153 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/F5Networks/k8s-bigip-ctlr/pkg/vlogger"
+
+	routeapi "github.com/openshift/origin/pkg/route/api"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
+)
+
+// Return true if the controller manages the partition
+func (appMgr *Manager) managesPartition(partition string) bool {
+	if partition == DEFAULT_PARTITION {
+		return true
+	}
+	for _, p := range appMgr.partitions {
+		if p == partition {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the partition a namespace maps its objects to with the partition
+// annotation, or DEFAULT_PARTITION if it has none
+func (appMgr *Manager) namespacePartition(namespace string) string {
+	var annotations map[string]string
+	ns, err := appMgr.getNamespace(namespace)
+	if nil != err {
+		log.Debugf("Unable to get namespace '%s', using partition %s: %v",
+			namespace, DEFAULT_PARTITION, err)
+	} else {
+		annotations = ns.ObjectMeta.Annotations
+	}
+	if partition := strings.TrimSpace(
+		annotations[f5VsPartitionAnnotation]); partition != "" {
+		return partition
+	}
+	return DEFAULT_PARTITION
+}
+
+// Queue the Ingresses, Routes and LoadBalancer Services of a namespace whose
+// partition annotation changed, so their virtual servers move to the new
+// partition
+func (appMgr *Manager) enqueueNamespacePartition(old, cur interface{}) {
+	oldNs, ok := old.(*v1.Namespace)
+	if !ok {
+		return
+	}
+	curNs, ok := cur.(*v1.Namespace)
+	if !ok {
+		return
+	}
+	if oldNs.ObjectMeta.Annotations[f5VsPartitionAnnotation] ==
+		curNs.ObjectMeta.Annotations[f5VsPartitionAnnotation] {
+		return
+	}
+	namespace := curNs.ObjectMeta.Name
+	appInf, found := appMgr.getNamespaceInformer(namespace)
+	if !found {
+		return
+	}
+	log.Debugf("Partition of namespace '%s' changed, queueing its objects.",
+		namespace)
+	ings, _ := appInf.ingInformer.GetIndexer().ByIndex("namespace", namespace)
+	for _, obj := range ings {
+		appMgr.enqueueIngress(obj.(*v1beta1.Ingress))
+	}
+	svcs, _ := appInf.svcInformer.GetIndexer().ByIndex("namespace", namespace)
+	for _, obj := range svcs {
+		if svc := obj.(*v1.Service); svc.Spec.Type == v1.ServiceTypeLoadBalancer {
+			appMgr.enqueueService(svc)
+		}
+	}
+	if nil == appInf.routeInformer {
+		return
+	}
+	routes, _ := appInf.routeInformer.GetIndexer().ByIndex("namespace", namespace)
+	for _, obj := range routes {
+		appMgr.enqueueRoute(obj.(*routeapi.Route))
+	}
+}
+
+// Return the partitions the controller manages, the default one first
+func (appMgr *Manager) managedPartitions() []string {
+	managed := []string{DEFAULT_PARTITION}
+	for _, p := range appMgr.partitions {
+		if p != DEFAULT_PARTITION {
+			managed = append(managed, p)
+		}
+	}
+	return managed
+}
+
+// Return true if the controller manages the partition of an object,
+// recording an event on the object if it does not
+func (appMgr *Manager) checkPartition(
+	obj runtime.Object,
+	meta metav1.ObjectMeta,
+	partition string,
+) bool {
+	if appMgr.managesPartition(partition) {
+		return true
+	}
+	msg := fmt.Sprintf("Not managing %s: partition '%s' is not one of the "+
+		"partitions the controller manages (%s)", meta.Name, partition,
+		strings.Join(appMgr.managedPartitions(), ", "))
+	log.Warning(msg)
+	appMgr.recordEvent(obj, meta.Namespace, v1.EventTypeWarning,
+		"InvalidPartition", msg)
+	return false
+}
+
+// Name of a Route virtual server in a partition. Route virtuals in the
+// default partition keep their configured names; others get the partition
+// appended, since virtuals are tracked by name.
+func formatPartitionVSName(vsName, partition string) string {
+	if partition == DEFAULT_PARTITION {
+		return vsName
+	}
+	return fmt.Sprintf("%s_%s", vsName, partition)
+}
+
+// Delete the copies of an iRule, in any partition, that no virtual uses.
+// Must be called with the irulesMutex held.
+func (appMgr *Manager) deleteUnusedIRule(name string, inUse map[string]bool) {
+	for ref := range appMgr.irulesMap {
+		if ref.Name == name && !inUse[joinBigipPath(ref.Partition, ref.Name)] {
+			delete(appMgr.irulesMap, ref)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	"strings"
+
+	"github.com/F5Networks/k8s-bigip-ctlr/pkg/test"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	routeapi "github.com/openshift/origin/pkg/route/api"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
+)
+
+var _ = Describe("Partition Tests", func() {
+	It("names virtuals after their partition", func() {
+		Expect(formatPartitionVSName("ose-vserver", DEFAULT_PARTITION)).To(
+			Equal("ose-vserver"))
+		Expect(formatPartitionVSName("ose-vserver", "tenant")).To(
+			Equal("ose-vserver_tenant"))
+	})
+
+	Describe("Using Mock Manager", func() {
+		var mockMgr *mockAppManager
+		namespace := "default"
+
+		BeforeEach(func() {
+			RegisterBigIPSchemaTypes()
+			mockMgr = newMockAppManager(&Params{
+				KubeClient: fake.NewSimpleClientset(),
+				ConfigWriter: &test.MockWriter{
+					FailStyle: test.Success,
+					Sections:  make(map[string]interface{}),
+				},
+				restClient:      test.CreateFakeHTTPClient(),
+				RouteClientV1:   test.CreateFakeHTTPClient(),
+				IsNodePort:      true,
+				Partitions:      []string{"velcro", "tenant"},
+				broadcasterFunc: NewFakeEventBroadcaster,
+			})
+			mockMgr.appMgr.routeConfig = RouteConfig{
+				RouteVSAddr: "10.1.1.1",
+				HttpVs:      "ose-vserver",
+				HttpsVs:     "https-ose-vserver",
+			}
+			err := mockMgr.startNonLabelMode([]string{namespace})
+			Expect(err).To(BeNil())
+			svc := test.NewService("foo", "1", namespace, "NodePort",
+				[]v1.ServicePort{{Port: 80, NodePort: 37001},
+					{Port: 443, NodePort: 37002}})
+			Expect(mockMgr.addService(svc)).To(BeTrue())
+		})
+		AfterEach(func() {
+			mockMgr.shutdown()
+		})
+
+		reasons := func() []string {
+			var reasons []string
+			for _, ev := range mockMgr.getFakeEvents(namespace) {
+				reasons = append(reasons, ev.Reason)
+			}
+			return reasons
+		}
+		setNamespacePartition := func(partition string) {
+			ns := test.NewNamespace(namespace, "1", nil)
+			ns.ObjectMeta.Annotations = map[string]string{
+				f5VsPartitionAnnotation: partition,
+			}
+			_, err := mockMgr.appMgr.kubeClient.CoreV1().Namespaces().Create(ns)
+			Expect(err).To(BeNil())
+		}
+
+		It("knows the partitions it manages", func() {
+			Expect(mockMgr.appMgr.managesPartition("velcro")).To(BeTrue())
+			Expect(mockMgr.appMgr.managesPartition("tenant")).To(BeTrue())
+			Expect(mockMgr.appMgr.managesPartition("Common")).To(BeFalse())
+
+			Expect(mockMgr.appMgr.namespacePartition(namespace)).To(
+				Equal(DEFAULT_PARTITION))
+			setNamespacePartition("tenant")
+			Expect(mockMgr.appMgr.namespacePartition(namespace)).To(
+				Equal("tenant"))
+		})
+
+		It("places Routes in the partition of their namespace", func() {
+			setNamespacePartition("tenant")
+			spec := routeapi.RouteSpec{
+				Host: "foo.com",
+				To: routeapi.RouteTargetReference{
+					Kind: "Service",
+					Name: "foo",
+				},
+				TLS: &routeapi.TLSConfig{
+					Termination: routeapi.TLSTerminationPassthrough,
+				},
+			}
+			route := test.NewRoute("route", "1", namespace, spec, nil)
+			Expect(mockMgr.addRoute(route)).To(BeTrue())
+
+			rs, ok := mockMgr.resources().GetByName("https-ose-vserver_tenant")
+			Expect(ok).To(BeTrue())
+			Expect(rs.Virtual.Partition).To(Equal("tenant"))
+			Expect(rs.Pools[0].Partition).To(Equal("tenant"))
+			_, ok = mockMgr.resources().GetByName("https-ose-vserver")
+			Expect(ok).To(BeFalse())
+
+			// The iRule and its data group are kept in the same partition
+			Expect(rs.Virtual.IRules).To(Equal(
+				[]string{"/tenant/" + sslPassthroughIRuleName}))
+			irule, found := mockMgr.appMgr.irulesMap[nameRef{
+				Name:      sslPassthroughIRuleName,
+				Partition: "tenant",
+			}]
+			Expect(found).To(BeTrue())
+			Expect(irule.Code).To(ContainSubstring(
+				"/tenant/" + passthroughHostsDgName))
+			Expect(irule.Code).ToNot(ContainSubstring("/velcro/"))
+			_, found = mockMgr.appMgr.intDgMap[nameRef{
+				Name:      passthroughHostsDgName,
+				Partition: "tenant",
+			}]
+			Expect(found).To(BeTrue())
+			_, found = mockMgr.appMgr.irulesMap[nameRef{
+				Name:      sslPassthroughIRuleName,
+				Partition: DEFAULT_PARTITION,
+			}]
+			Expect(found).To(BeFalse())
+		})
+
+		It("rejects Routes in namespaces of unmanaged partitions", func() {
+			setNamespacePartition("other")
+			spec := routeapi.RouteSpec{
+				Host: "foo.com",
+				To: routeapi.RouteTargetReference{
+					Kind: "Service",
+					Name: "foo",
+				},
+			}
+			route := test.NewRoute("route", "1", namespace, spec, nil)
+			mockMgr.addRoute(route)
+			Expect(mockMgr.resources().VirtualCount()).To(Equal(0))
+			Expect(reasons()).To(ContainElement("InvalidPartition"))
+		})
+
+		It("moves virtuals when the partition of their namespace changes", func() {
+			ingSpec := v1beta1.IngressSpec{
+				Backend: &v1beta1.IngressBackend{
+					ServiceName: "foo",
+					ServicePort: intstr.IntOrString{IntVal: 80},
+				},
+			}
+			ing := test.NewIngress("ingress", "1", namespace, ingSpec,
+				map[string]string{f5VsBindAddrAnnotation: "1.2.3.4"})
+			Expect(mockMgr.addIngress(ing)).To(BeTrue())
+			routeSpec := routeapi.RouteSpec{
+				Host: "foo.com",
+				To: routeapi.RouteTargetReference{
+					Kind: "Service",
+					Name: "foo",
+				},
+			}
+			route := test.NewRoute("route", "1", namespace, routeSpec, nil)
+			Expect(mockMgr.addRoute(route)).To(BeTrue())
+			vsName := formatIngressVSName("1.2.3.4", 80)
+			_, ok := mockMgr.resources().GetByName(vsName)
+			Expect(ok).To(BeTrue())
+			_, ok = mockMgr.resources().GetByName("ose-vserver")
+			Expect(ok).To(BeTrue())
+
+			// The namespace watch queues the objects of the namespace
+			old := test.NewNamespace(namespace, "1", nil)
+			cur := test.NewNamespace(namespace, "2", nil)
+			cur.ObjectMeta.Annotations = map[string]string{
+				f5VsPartitionAnnotation: "tenant",
+			}
+			appInf, _ := mockMgr.appMgr.getNamespaceInformer(namespace)
+			appInf.nsInformer.GetStore().Add(cur)
+			mockMgr.appMgr.enqueueNamespacePartition(old, old)
+			Expect(mockMgr.appMgr.vsQueue.Len()).To(BeZero())
+			mockMgr.appMgr.enqueueNamespacePartition(old, cur)
+			queueLen := mockMgr.appMgr.vsQueue.Len()
+			Expect(queueLen).To(BeNumerically(">", 0))
+			for i := 0; i < queueLen; i++ {
+				mockMgr.appMgr.processNextVirtualServer()
+			}
+			// Ingress virtuals keep their names
+			rs, ok := mockMgr.resources().GetByName(vsName)
+			Expect(ok).To(BeTrue())
+			Expect(rs.Virtual.Partition).To(Equal("tenant"))
+			rs, ok = mockMgr.resources().GetByName("ose-vserver_tenant")
+			Expect(ok).To(BeTrue())
+			Expect(rs.Virtual.Partition).To(Equal("tenant"))
+			_, ok = mockMgr.resources().GetByName("ose-vserver")
+			Expect(ok).To(BeFalse())
+		})
+
+		It("places Ingresses in the partition of their namespace", func() {
+			setNamespacePartition("tenant")
+			spec := v1beta1.IngressSpec{
+				Backend: &v1beta1.IngressBackend{
+					ServiceName: "foo",
+					ServicePort: intstr.IntOrString{IntVal: 80},
+				},
+			}
+			ing := test.NewIngress("ingress", "1", namespace, spec,
+				map[string]string{f5VsBindAddrAnnotation: "1.2.3.4"})
+			Expect(mockMgr.addIngress(ing)).To(BeTrue())
+			vsName := formatIngressVSName("1.2.3.4", 80)
+			rs, ok := mockMgr.resources().Get(serviceKey{"foo", 80, namespace},
+				vsName)
+			Expect(ok).To(BeTrue())
+			Expect(rs.Virtual.Partition).To(Equal("tenant"))
+
+			// Moving the Ingress to another partition moves its virtual
+			ing.ObjectMeta.Annotations[f5VsPartitionAnnotation] = DEFAULT_PARTITION
+			Expect(mockMgr.updateIngress(ing)).To(BeTrue())
+			Expect(mockMgr.resources().VirtualCount()).To(Equal(1))
+			rs, ok = mockMgr.resources().Get(serviceKey{"foo", 80, namespace},
+				vsName)
+			Expect(ok).To(BeTrue())
+			Expect(rs.Virtual.Partition).To(Equal(DEFAULT_PARTITION))
+			ing.ObjectMeta.Annotations[f5VsPartitionAnnotation] = "tenant"
+			Expect(mockMgr.updateIngress(ing)).To(BeTrue())
+
+			// The Ingress annotation takes precedence, and must be managed
+			ing.ObjectMeta.Annotations[f5VsPartitionAnnotation] = "other"
+			mockMgr.updateIngress(ing)
+			Expect(reasons()).To(ContainElement("InvalidPartition"))
+			Expect(mockMgr.resources().VirtualCount()).To(Equal(0))
+		})
+
+		It("accepts ConfigMaps in any managed partition", func() {
+			tenantMap := test.NewConfigMap("tenantmap", "1", namespace,
+				map[string]string{
+					"schema": schemaUrl,
+					"data": strings.Replace(configmapFoo,
+						`"partition": "velcro"`, `"partition": "tenant"`, 1),
+				})
+			Expect(mockMgr.addConfigMap(tenantMap)).To(BeTrue())
+			rs, ok := mockMgr.resources().Get(serviceKey{"foo", 80, namespace},
+				formatConfigMapVSName(tenantMap))
+			Expect(ok).To(BeTrue())
+			Expect(rs.Virtual.Partition).To(Equal("tenant"))
+
+			otherMap := test.NewConfigMap("othermap", "1", namespace,
+				map[string]string{
+					"schema": schemaUrl,
+					"data": strings.Replace(configmapFoo,
+						`"partition": "velcro"`, `"partition": "other"`, 1),
+				})
+			Expect(mockMgr.addConfigMap(otherMap)).To(BeFalse())
+			Expect(reasons()).To(ContainElement("InvalidPartition"))
+			_, ok = mockMgr.resources().Get(serviceKey{"foo", 80, namespace},
+				formatConfigMapVSName(otherMap))
+			Expect(ok).To(BeFalse())
+		})
+	})
+})
@@ -0,0 +1,281 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	log "github.com/F5Networks/k8s-bigip-ctlr/pkg/vlogger"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Session persistence methods
+const (
+	persistCookie        = "cookie"
+	persistSourceAddress = "source-address"
+	persistUniversal     = "universal"
+	persistNone          = "none"
+)
+
+// Universal persistence keys on a request header with one iRule per header,
+// named with this prefix and the header in lower case with '_' for '-'
+const universalPersistIRulePrefix = "universal_persist_"
+
+var persistHeaderRegexp = regexp.MustCompile("^[A-Za-z0-9-]+$")
+
+// BIG-IP default profiles for the persistence methods
+var persistProfiles = map[string]string{
+	persistCookie:        "cookie",
+	persistSourceAddress: "source_addr",
+	persistUniversal:     "universal",
+}
+
+func formatUniversalPersistIRuleName(header string) string {
+	return universalPersistIRulePrefix +
+		strings.Replace(strings.ToLower(header), "-", "_", -1)
+}
+
+// Persist on the value of a request header
+func universalPersistIRule(header string) string {
+	iRuleCode := fmt.Sprintf(`
+		when HTTP_REQUEST {
+			set persist_key [HTTP::header "%s"]
+			if { $persist_key ne "" } {
+				persist uie $persist_key
+			}
+		}`, header)
+
+	return iRuleCode
+}
+
+// Check that the persistence can be set on a virtual server, which is an
+// HTTP virtual server if http is true
+func (p persistence) Validate(http bool) error {
+	switch p.Method {
+	case persistNone, persistSourceAddress:
+	case persistCookie, persistUniversal:
+		if !http {
+			return fmt.Errorf("%s persistence needs an HTTP virtual server",
+				p.Method)
+		}
+		if p.Method == persistUniversal && !persistHeaderRegexp.MatchString(p.Header) {
+			return fmt.Errorf("universal persistence needs a valid header, not '%s'",
+				p.Header)
+		}
+	default:
+		// Otherwise it names an existing profile
+		if 3 != len(strings.Split(p.Method, "/")) ||
+			!strings.HasPrefix(p.Method, "/") {
+			return fmt.Errorf("unknown persistence '%s'", p.Method)
+		}
+	}
+	return nil
+}
+
+// Return the persistence set by the annotations of an Ingress or Service
+func annotationPersistence(annotations map[string]string) *persistence {
+	method, ok := annotations[f5VsPersistenceAnnotation]
+	if !ok {
+		return nil
+	}
+	return &persistence{
+		Method: method,
+		Header: annotations[f5VsPersistenceHeaderAnnotation],
+	}
+}
+
+// Return the persistence in the frontend of an F5 resource ConfigMap
+func configMapPersistence(cm *v1.ConfigMap) *persistence {
+	var cfgMap ConfigMap
+	if err := json.Unmarshal([]byte(cm.Data["data"]), &cfgMap); nil != err {
+		return nil
+	}
+	return cfgMap.VirtualServer.Frontend.Persistence
+}
+
+// Set the persistence profile of a virtual server, and the iRule for
+// universal persistence. A nil persistence removes them.
+func setVirtualPersistence(v *Virtual, p *persistence) {
+	v.Persist = nil
+	var iRules []string
+	for _, irule := range v.IRules {
+		if !strings.HasPrefix(irule,
+			joinBigipPath(v.Partition, universalPersistIRulePrefix)) {
+			iRules = append(iRules, irule)
+		}
+	}
+	v.IRules = iRules
+	if nil == p || p.Method == persistNone {
+		return
+	}
+
+	ref := persistenceRef{TmDefault: "yes"}
+	if profile, ok := persistProfiles[p.Method]; ok {
+		ref.Partition = "Common"
+		ref.Name = profile
+	} else {
+		path := strings.Split(p.Method, "/")
+		ref.Partition = path[1]
+		ref.Name = path[2]
+	}
+	v.Persist = []persistenceRef{ref}
+	if p.Method == persistUniversal {
+		v.AddIRule(joinBigipPath(v.Partition,
+			formatUniversalPersistIRuleName(p.Header)))
+	}
+}
+
+var persistenceSetting = ownedSetting{
+	action:         "setting",
+	name:           "persistence",
+	conflictReason: "PersistenceConflict",
+	owner: func(rsCfg *ResourceConfig) *string {
+		return &rsCfg.MetaData.PersistOwner
+	},
+	reset: func(rsCfg *ResourceConfig) {
+		setVirtualPersistence(&rsCfg.Virtual, nil)
+	},
+}
+
+// Return whether the persistence of a virtual server is the given one
+func hasVirtualPersistence(v *Virtual, p *persistence) bool {
+	want := Virtual{Partition: v.Partition}
+	setVirtualPersistence(&want, p)
+	var iRules []string
+	for _, irule := range v.IRules {
+		if strings.HasPrefix(irule,
+			joinBigipPath(v.Partition, universalPersistIRulePrefix)) {
+			iRules = append(iRules, irule)
+		}
+	}
+	return reflect.DeepEqual(want.Persist, v.Persist) &&
+		reflect.DeepEqual(want.IRules, iRules)
+}
+
+// Return the first of the Services of an Ingress with ClientIP session
+// affinity, or nil if none has it
+func ingressAffinityService(
+	ing *v1beta1.Ingress,
+	svcIndexer cache.Indexer,
+) *v1.Service {
+	for _, name := range ingressServiceNames(ing) {
+		obj, found, _ := svcIndexer.GetByKey(ing.ObjectMeta.Namespace + "/" + name)
+		if !found {
+			continue
+		}
+		if svc := obj.(*v1.Service); svc.Spec.SessionAffinity ==
+			v1.ServiceAffinityClientIP {
+			return svc
+		}
+	}
+	return nil
+}
+
+// Return whether a virtual server has an HTTP profile
+func isHttpVirtual(rsCfg *ResourceConfig) bool {
+	if _, ok := rsCfg.MetaData.TunedProfs[tunedProfileHttp]; ok {
+		return true
+	}
+	for _, prof := range rsCfg.Virtual.Profiles {
+		if prof.Partition == "Common" && prof.Name == "http" {
+			return true
+		}
+	}
+	return false
+}
+
+// Set the persistence of a virtual server created for an object. Without
+// persistence settings, a Service with ClientIP session affinity gets source
+// address persistence. A virtual shared by several Ingresses keeps the
+// persistence of the one that set it until it stops asking for it, and
+// others asking for a different one get an event.
+func (appMgr *Manager) handlePersistence(
+	rsCfg *ResourceConfig,
+	obj runtime.Object,
+	meta metav1.ObjectMeta,
+	p *persistence,
+	svc *v1.Service,
+) {
+	if nil == p && nil != svc &&
+		svc.Spec.SessionAffinity == v1.ServiceAffinityClientIP {
+		p = &persistence{Method: persistSourceAddress}
+	}
+	owner := meta.Namespace + "/" + meta.Name
+	detach := func() { persistenceSetting.detach(rsCfg, owner) }
+	if nil == p {
+		detach()
+		return
+	}
+	if err := p.Validate(isHttpVirtual(rsCfg)); nil != err {
+		msg := fmt.Sprintf("Not setting persistence for %s: %v", meta.Name, err)
+		log.Warning(msg)
+		appMgr.recordEvent(obj, meta.Namespace, v1.EventTypeWarning,
+			"InvalidPersistence", msg)
+		detach()
+		return
+	}
+	if !appMgr.mayOwnSetting(persistenceSetting, rsCfg, obj, meta,
+		hasVirtualPersistence(&rsCfg.Virtual, p)) {
+		return
+	}
+	setVirtualPersistence(&rsCfg.Virtual, p)
+	rsCfg.MetaData.PersistOwner = owner
+}
+
+// Create the universal persistence iRules the virtual servers use, and
+// delete those no virtual server uses anymore
+func (appMgr *Manager) syncPersistenceIRules() {
+	inUse := appMgr.iRulesInUse()
+	for irule := range inUse {
+		partition, name := splitBigipPath(irule, false)
+		if !strings.HasPrefix(name, universalPersistIRulePrefix) {
+			continue
+		}
+		suffix := strings.TrimPrefix(name, universalPersistIRulePrefix)
+		appMgr.addIRule(name, partition,
+			universalPersistIRule(strings.Replace(suffix, "_", "-", -1)))
+	}
+
+	appMgr.irulesMutex.Lock()
+	defer appMgr.irulesMutex.Unlock()
+	for ref := range appMgr.irulesMap {
+		if strings.HasPrefix(ref.Name, universalPersistIRulePrefix) &&
+			!inUse[joinBigipPath(ref.Partition, ref.Name)] {
+			delete(appMgr.irulesMap, ref)
+		}
+	}
+}
+
+// Return the iRules referenced by any virtual server
+func (appMgr *Manager) iRulesInUse() map[string]bool {
+	inUse := make(map[string]bool)
+	for _, cfg := range appMgr.resources.GetAllResources() {
+		for _, irule := range cfg.Virtual.IRules {
+			inUse[irule] = true
+		}
+	}
+	return inUse
+}
@@ -0,0 +1,70 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Persistence Tests", func() {
+	It("validates persistence settings", func() {
+		for _, p := range []persistence{
+			{Method: persistNone},
+			{Method: persistSourceAddress},
+			{Method: persistCookie},
+			{Method: persistUniversal, Header: "X-Session-Id"},
+			{Method: "/Common/my_persist"},
+		} {
+			Expect(p.Validate(true)).To(BeNil(), p.Method)
+		}
+		Expect(persistence{Method: persistSourceAddress}.Validate(false)).To(BeNil())
+
+		for _, p := range []persistence{
+			{Method: "sticky"},
+			{Method: "Common/my_persist"},
+			{Method: persistUniversal},
+			{Method: persistUniversal, Header: "X Session"},
+		} {
+			Expect(p.Validate(true)).ToNot(BeNil(), p.Method)
+		}
+		Expect(persistence{Method: persistCookie}.Validate(false)).ToNot(BeNil())
+
+		Expect(annotationPersistence(map[string]string{})).To(BeNil())
+		Expect(annotationPersistence(map[string]string{
+			f5VsPersistenceAnnotation:       persistUniversal,
+			f5VsPersistenceHeaderAnnotation: "X-Session-Id",
+		})).To(Equal(&persistence{Method: persistUniversal, Header: "X-Session-Id"}))
+		Expect(formatUniversalPersistIRuleName("X-Session-Id")).To(
+			Equal("universal_persist_x_session_id"))
+	})
+
+	It("keeps A/B clients on their pool with a cookie", func() {
+		iRule := abDeploymentPathIRule(DEFAULT_PARTITION, "")
+		Expect(iRule).To(ContainSubstring("proc find_ab_rule {path}"))
+		Expect(iRule).To(ContainSubstring("proc ab_pool_active {ab_rule pool_name}"))
+		Expect(iRule).To(ContainSubstring(
+			`set ab_cookie "BIGIP_AB_[crc32 [lindex $ab_match 0]]"`))
+		Expect(iRule).To(ContainSubstring(
+			`HTTP::cookie insert name $ab_cookie value $ab_pool path "/"`))
+		// A keep-alive request does not reuse the pool of the one before
+		Expect(iRule).To(ContainSubstring("unset -nocomplain ab_pool"))
+		// Passthrough routes still select a pool per connection
+		Expect(sslPassthroughIRule(DEFAULT_PARTITION, "")).To(ContainSubstring(
+			"proc select_ab_pool {path default_pool }"))
+	})
+})
@@ -0,0 +1,181 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Kinds of request data a rule condition can match on
+const (
+	conditionHeader        = "header"
+	conditionCookie        = "cookie"
+	conditionMethod        = "method"
+	conditionQuery         = "query"
+	conditionQueryString   = "queryString"
+	conditionSourceAddress = "sourceAddress"
+)
+
+// Comparison operators for rule conditions
+const (
+	operatorEquals     = "equals"
+	operatorStartsWith = "startsWith"
+	operatorEndsWith   = "endsWith"
+	operatorContains   = "contains"
+	operatorPresent    = "present"
+)
+
+// An additional match criterion for the policy rules of an Ingress or Route,
+// taken from the rule-conditions annotation
+type RuleCondition struct {
+	Type            string   `json:"type"`
+	Name            string   `json:"name,omitempty"`
+	Operator        string   `json:"operator,omitempty"`
+	Negate          bool     `json:"negate,omitempty"`
+	CaseInsensitive bool     `json:"caseInsensitive,omitempty"`
+	Values          []string `json:"values,omitempty"`
+}
+
+// Check that a rule condition is complete and can be expressed on the BIG-IP
+func (rc RuleCondition) Validate() error {
+	switch rc.Type {
+	case conditionHeader, conditionCookie, conditionQuery:
+		if rc.Name == "" {
+			return fmt.Errorf("%s condition must have a name", rc.Type)
+		}
+	case conditionMethod, conditionQueryString:
+	case conditionSourceAddress:
+		if rc.Operator != "" && rc.Operator != operatorEquals {
+			return fmt.Errorf("sourceAddress condition only supports the " +
+				"equals operator")
+		}
+		for _, val := range rc.Values {
+			if nil != net.ParseIP(val) {
+				continue
+			}
+			if _, _, err := net.ParseCIDR(val); nil != err {
+				return fmt.Errorf("sourceAddress value '%s' is not an address "+
+					"or network", val)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown condition type '%s'", rc.Type)
+	}
+
+	switch rc.Operator {
+	case "", operatorEquals, operatorStartsWith, operatorEndsWith,
+		operatorContains:
+		if 0 == len(rc.Values) {
+			return fmt.Errorf("%s condition must have values", rc.Type)
+		}
+	case operatorPresent:
+		if rc.Type != conditionHeader && rc.Type != conditionCookie &&
+			rc.Type != conditionQuery {
+			return fmt.Errorf("%s condition does not support the present operator",
+				rc.Type)
+		}
+	default:
+		return fmt.Errorf("unknown condition operator '%s'", rc.Operator)
+	}
+	return nil
+}
+
+// Parse the rule-conditions annotation of an Ingress or Route
+func parseRuleConditions(annotations map[string]string) ([]RuleCondition, error) {
+	val, ok := annotations[f5VsRuleConditionsAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	var conds []RuleCondition
+	if err := json.Unmarshal([]byte(val), &conds); nil != err {
+		return nil, fmt.Errorf("invalid %s annotation: %v",
+			f5VsRuleConditionsAnnotation, err)
+	}
+	for _, rc := range conds {
+		if err := rc.Validate(); nil != err {
+			return nil, fmt.Errorf("invalid %s annotation: %v",
+				f5VsRuleConditionsAnnotation, err)
+		}
+	}
+	return conds, nil
+}
+
+// Convert a rule condition into its BIG-IP policy condition
+func (rc RuleCondition) policyCondition(name string) *condition {
+	c := condition{
+		Name:            name,
+		CaseInsensitive: rc.CaseInsensitive,
+		Not:             rc.Negate,
+		Request:         true,
+		Values:          append([]string{}, rc.Values...),
+	}
+	switch rc.Type {
+	case conditionHeader:
+		c.HTTPHeader = true
+		c.TmName = rc.Name
+	case conditionCookie:
+		c.HTTPCookie = true
+		c.TmName = rc.Name
+	case conditionMethod:
+		c.HTTPMethod = true
+		for i, v := range c.Values {
+			c.Values[i] = strings.ToUpper(v)
+		}
+	case conditionQuery:
+		c.HTTPURI = true
+		c.QueryParameter = true
+		c.TmName = rc.Name
+	case conditionQueryString:
+		c.HTTPURI = true
+		c.QueryString = true
+	case conditionSourceAddress:
+		// Client addresses are matched against addresses and networks
+		c.TCP = true
+		c.Address = true
+		c.Matches = true
+		c.Remote = true
+		c.CaseInsensitive = false
+		return &c
+	}
+
+	switch rc.Operator {
+	case operatorStartsWith:
+		c.StartsWith = true
+	case operatorEndsWith:
+		c.EndsWith = true
+	case operatorContains:
+		c.Contains = true
+	case operatorPresent:
+		c.Present = true
+		c.Values = []string{}
+	default:
+		c.Equals = true
+	}
+	return &c
+}
+
+// Add rule conditions to a policy rule after its host and path conditions
+func addRuleConditions(rl *Rule, conds []RuleCondition) {
+	for _, rc := range conds {
+		name := strconv.Itoa(len(rl.Conditions))
+		rl.Conditions = append(rl.Conditions, rc.policyCondition(name))
+	}
+}
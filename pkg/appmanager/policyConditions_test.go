@@ -0,0 +1,319 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	"github.com/F5Networks/k8s-bigip-ctlr/pkg/test"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	routeapi "github.com/openshift/origin/pkg/route/api"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
+)
+
+var _ = Describe("Policy Condition Tests", func() {
+	parse := func(val string) ([]RuleCondition, error) {
+		return parseRuleConditions(
+			map[string]string{f5VsRuleConditionsAnnotation: val})
+	}
+
+	It("parses rule conditions", func() {
+		conds, err := parseRuleConditions(map[string]string{})
+		Expect(err).To(BeNil())
+		Expect(conds).To(BeNil())
+
+		conds, err = parse(`[
+			{"type": "header", "name": "X-Canary", "values": ["true"]},
+			{"type": "cookie", "name": "session", "operator": "present"},
+			{"type": "method", "values": ["get", "head"]},
+			{"type": "query", "name": "version", "operator": "startsWith",
+			 "values": ["v2"], "caseInsensitive": true},
+			{"type": "queryString", "operator": "contains", "values": ["debug"],
+			 "negate": true},
+			{"type": "sourceAddress", "values": ["10.0.0.0/8", "192.168.1.1"]}
+		]`)
+		Expect(err).To(BeNil())
+		Expect(len(conds)).To(Equal(6))
+
+		for _, val := range []string{
+			`{"type": "header"}`,
+			`[{"type": "body", "values": ["x"]}]`,
+			`[{"type": "header", "values": ["x"]}]`,
+			`[{"type": "header", "name": "X-Canary"}]`,
+			`[{"type": "header", "name": "X-Canary", "operator": "matches",
+			  "values": ["x"]}]`,
+			`[{"type": "method", "operator": "present"}]`,
+			`[{"type": "sourceAddress", "values": ["10.0.0.0/33"]}]`,
+			`[{"type": "sourceAddress", "operator": "startsWith",
+			  "values": ["10."]}]`,
+		} {
+			_, err = parse(val)
+			Expect(err).ToNot(BeNil(), val)
+		}
+	})
+
+	It("compares parsed rule conditions", func() {
+		annotations := func(val string) map[string]string {
+			return map[string]string{f5VsRuleConditionsAnnotation: val}
+		}
+		conds := annotations(`[
+			{"type": "header", "name": "X-Canary", "values": ["true"]},
+			{"type": "method", "values": ["get"]}
+		]`)
+		reordered := annotations(`[{"type":"method","values":["get"]},` +
+			`{"values":["true"],"name":"X-Canary","type":"header"}]`)
+		Expect(sameRuleConditions(conds, reordered)).To(BeTrue())
+		Expect(sameRuleConditions(map[string]string{}, annotations(""))).To(
+			BeTrue())
+
+		changed := annotations(`[{"type": "method", "values": ["post"]},
+			{"type": "header", "name": "X-Canary", "values": ["true"]}]`)
+		Expect(sameRuleConditions(conds, changed)).To(BeFalse())
+		Expect(sameRuleConditions(conds, map[string]string{})).To(BeFalse())
+	})
+
+	It("renders rule conditions as policy conditions", func() {
+		rule, err := createRule("foo.com/bar", "pool", "velcro", "rule")
+		Expect(err).To(BeNil())
+		conds, err := parse(`[
+			{"type": "header", "name": "X-Canary", "values": ["true"],
+			 "caseInsensitive": true},
+			{"type": "cookie", "name": "session", "operator": "present"},
+			{"type": "method", "values": ["post"], "negate": true},
+			{"type": "query", "name": "version", "operator": "endsWith",
+			 "values": ["beta"]},
+			{"type": "sourceAddress", "values": ["10.0.0.0/8"]}
+		]`)
+		Expect(err).To(BeNil())
+		addRuleConditions(rule, conds)
+
+		Expect(len(rule.Conditions)).To(Equal(7))
+		Expect(rule.Conditions[2]).To(Equal(&condition{
+			Name:            "2",
+			CaseInsensitive: true,
+			Equals:          true,
+			HTTPHeader:      true,
+			Request:         true,
+			TmName:          "X-Canary",
+			Values:          []string{"true"},
+		}))
+		Expect(rule.Conditions[3]).To(Equal(&condition{
+			Name:       "3",
+			HTTPCookie: true,
+			Present:    true,
+			Request:    true,
+			TmName:     "session",
+			Values:     []string{},
+		}))
+		Expect(rule.Conditions[4]).To(Equal(&condition{
+			Name:       "4",
+			Equals:     true,
+			HTTPMethod: true,
+			Not:        true,
+			Request:    true,
+			Values:     []string{"POST"},
+		}))
+		Expect(rule.Conditions[5]).To(Equal(&condition{
+			Name:           "5",
+			EndsWith:       true,
+			HTTPURI:        true,
+			QueryParameter: true,
+			Request:        true,
+			TmName:         "version",
+			Values:         []string{"beta"},
+		}))
+		Expect(rule.Conditions[6]).To(Equal(&condition{
+			Name:    "6",
+			Address: true,
+			Matches: true,
+			Remote:  true,
+			Request: true,
+			TCP:     true,
+			Values:  []string{"10.0.0.0/8"},
+		}))
+		// The annotation values are left as they were
+		Expect(conds[2].Values).To(Equal([]string{"post"}))
+	})
+
+	It("orders rules with more conditions first", func() {
+		plain, _ := createRule("foo.com/bar", "pool1", "velcro", "plain")
+		canary, _ := createRule("foo.com/bar", "pool2", "velcro", "canary")
+		addRuleConditions(canary, []RuleCondition{
+			{Type: conditionHeader, Name: "X-Canary", Values: []string{"true"}},
+		})
+		rules := Rules{plain, canary}
+		Expect(rules.Less(0, 1)).To(BeTrue())
+		Expect(rules.Less(1, 0)).To(BeFalse())
+	})
+
+	Describe("Using Mock Manager", func() {
+		var mockMgr *mockAppManager
+		namespace := "default"
+
+		BeforeEach(func() {
+			RegisterBigIPSchemaTypes()
+			mw := &test.MockWriter{
+				FailStyle: test.Success,
+				Sections:  make(map[string]interface{}),
+			}
+			mockMgr = newMockAppManager(&Params{
+				KubeClient:      fake.NewSimpleClientset(),
+				ConfigWriter:    mw,
+				restClient:      test.CreateFakeHTTPClient(),
+				RouteClientV1:   test.CreateFakeHTTPClient(),
+				IsNodePort:      true,
+				broadcasterFunc: NewFakeEventBroadcaster,
+			})
+			err := mockMgr.startNonLabelMode([]string{namespace})
+			Expect(err).To(BeNil())
+			for _, name := range []string{"foo", "bar"} {
+				svc := test.NewService(name, "1", namespace, "NodePort",
+					[]v1.ServicePort{{Port: 80, NodePort: 37001}})
+				Expect(mockMgr.addService(svc)).To(BeTrue())
+			}
+		})
+		AfterEach(func() {
+			mockMgr.shutdown()
+		})
+
+		policyRules := func(svcName, rsName string) Rules {
+			rs, ok := mockMgr.resources().Get(
+				serviceKey{svcName, 80, namespace}, rsName)
+			Expect(ok).To(BeTrue())
+			Expect(len(rs.Policies)).To(Equal(1))
+			return rs.Policies[0].Rules
+		}
+
+		It("adds rule conditions to Ingress rules", func() {
+			newIngress := func(name, svcName string,
+				annotations map[string]string) *v1beta1.Ingress {
+				annotations[f5VsBindAddrAnnotation] = "1.2.3.4"
+				spec := v1beta1.IngressSpec{
+					Rules: []v1beta1.IngressRule{
+						{Host: "foo.com",
+							IngressRuleValue: v1beta1.IngressRuleValue{
+								HTTP: &v1beta1.HTTPIngressRuleValue{
+									Paths: []v1beta1.HTTPIngressPath{
+										{Path: "/api",
+											Backend: v1beta1.IngressBackend{
+												ServiceName: svcName,
+												ServicePort: intstr.IntOrString{IntVal: 80},
+											},
+										},
+									},
+								},
+							},
+						},
+					},
+				}
+				return test.NewIngress(name, "1", namespace, spec, annotations)
+			}
+			Expect(mockMgr.addIngress(
+				newIngress("ingress", "foo", map[string]string{}))).To(BeTrue())
+			canary := newIngress("canary", "bar", map[string]string{
+				f5VsRuleConditionsAnnotation: `[{"type": "header",
+					"name": "X-Canary", "values": ["true"]}]`,
+			})
+			Expect(mockMgr.addIngress(canary)).To(BeTrue())
+
+			// Both Ingresses keep a rule for the same host and path, along
+			// with one for the paths below it
+			rules := policyRules("foo", formatIngressVSName("1.2.3.4", 80))
+			Expect(len(rules)).To(Equal(4))
+			Expect(rules[0].Name).To(HaveSuffix(subPathRuleSuffix))
+			Expect(len(rules[0].Conditions)).To(Equal(3))
+			Expect(rules[0].Conditions[1].StartsWith).To(BeTrue())
+			Expect(rules[0].Conditions[1].Values).To(Equal([]string{"/api/"}))
+			rules = rules[2:]
+			Expect(rules[0].FullURI).To(Equal(rules[1].FullURI))
+			Expect(len(rules[0].Conditions)).To(Equal(3))
+			Expect(len(rules[1].Conditions)).To(Equal(2))
+			Expect(rules[0].Conditions[2].HTTPHeader).To(BeTrue())
+			Expect(rules[0].Actions[0].Pool).To(Equal(
+				"/velcro/" + formatIngressPoolName(namespace, "bar")))
+
+			// An invalid annotation leaves out the Ingress's rules
+			invalid := newIngress("invalid", "bar", map[string]string{
+				f5VsRuleConditionsAnnotation: `[{"type": "header"}]`,
+			})
+			invalid.Spec.Rules[0].Host = "bar.com"
+			Expect(mockMgr.addIngress(invalid)).To(BeTrue())
+			Expect(len(policyRules(
+				"foo", formatIngressVSName("1.2.3.4", 80)))).To(Equal(4))
+			events := mockMgr.getFakeEvents(namespace)
+			Expect(events[len(events)-1].Name).To(Equal("invalid"))
+			Expect(events[len(events)-1].Reason).To(Equal("InvalidRuleConditions"))
+		})
+
+		It("adds rule conditions to Route rules", func() {
+			mockMgr.appMgr.routeConfig = RouteConfig{
+				HttpVs:  "ose-vserver",
+				HttpsVs: "https-ose-vserver",
+			}
+			newRoute := func(name, svcName string,
+				annotations map[string]string) *routeapi.Route {
+				spec := routeapi.RouteSpec{
+					Host: "foo.com",
+					Path: "/api",
+					To: routeapi.RouteTargetReference{
+						Kind: "Service",
+						Name: svcName,
+					},
+				}
+				return test.NewRoute(name, "1", namespace, spec, annotations)
+			}
+			mockMgr.recordRouteStatus()
+			Expect(mockMgr.addRoute(newRoute("route", "foo", nil))).To(BeTrue())
+			canary := newRoute("canary", "bar", map[string]string{
+				f5VsRuleConditionsAnnotation: `[{"type": "cookie",
+					"name": "canary", "operator": "present"}]`,
+			})
+			Expect(mockMgr.addRoute(canary)).To(BeTrue())
+
+			// The same path with other conditions does not conflict
+			written := mockMgr.routeStatus(canary)
+			Expect(len(written.Status.Ingress)).To(Equal(1))
+			Expect(written.Status.Ingress[0].Conditions[0].Reason).To(BeEmpty())
+			rules := policyRules("foo", "ose-vserver")
+			Expect(len(rules)).To(Equal(2))
+			Expect(rules[1].Name).To(Equal("openshift_route_default_canary"))
+			Expect(rules[1].Conditions[2]).To(Equal(&condition{
+				Name:       "2",
+				HTTPCookie: true,
+				Present:    true,
+				Request:    true,
+				TmName:     "canary",
+				Values:     []string{},
+			}))
+
+			// An invalid annotation rejects the Route
+			invalid := newRoute("invalid", "bar", map[string]string{
+				f5VsRuleConditionsAnnotation: "not json",
+			})
+			invalid.Spec.Path = "/other"
+			Expect(mockMgr.addRoute(invalid)).To(BeTrue())
+			written = mockMgr.routeStatus(invalid)
+			Expect(len(written.Status.Ingress)).To(Equal(1))
+			Expect(written.Status.Ingress[0].Conditions[0].Reason).To(
+				Equal(routeReasonRuleFailed))
+			Expect(len(policyRules("foo", "ose-vserver"))).To(Equal(2))
+		})
+	})
+})
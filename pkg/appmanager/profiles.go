@@ -26,6 +26,7 @@ import (
 	log "github.com/F5Networks/k8s-bigip-ctlr/pkg/vlogger"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/pkg/api/v1"
 	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
 
@@ -42,15 +43,16 @@ func (appMgr *Manager) setClientSslProfile(
 	sKey serviceQueueKey,
 	rsCfg *ResourceConfig,
 	route *routeapi.Route,
+	routeConfig RouteConfig,
 ) {
 	appMgr.customProfiles.Lock()
 	defer appMgr.customProfiles.Unlock()
 
 	// First handle the Default for SNI profile
-	if appMgr.routeConfig.ClientSSL != "" {
+	if routeConfig.ClientSSL != "" {
 		// User has provided a name
 		prof := convertStringToProfileRef(
-			appMgr.routeConfig.ClientSSL, customProfileClient, sKey.Namespace)
+			routeConfig.ClientSSL, customProfileClient, sKey.Namespace)
 		rsCfg.Virtual.AddOrUpdateProfile(prof)
 	} else {
 		// No provided name, so we create a default
@@ -104,6 +106,12 @@ func (appMgr *Manager) setClientSslProfile(
 		if "" != route.Spec.TLS.Certificate && "" != route.Spec.TLS.Key {
 			profile := makeRouteClientSSLProfileRef(
 				rsCfg.Virtual.Partition, sKey.Namespace, route.ObjectMeta.Name)
+			crt, err := appMgr.checkCertificate(route, route.ObjectMeta,
+				profile.Name, route.Spec.TLS.Certificate, route.Spec.TLS.Key)
+			if nil != err {
+				// Keep the profile this Route had before
+				return
+			}
 
 			cp := NewCustomProfile(
 				profile,
@@ -114,6 +122,9 @@ func (appMgr *Manager) setClientSslProfile(
 				"", // peerCertMode
 				"", // caFile
 			)
+			if policy := appMgr.tlsPolicyFor(route, route.ObjectMeta); nil != policy {
+				policy.apply(&cp)
+			}
 
 			skey := secretKey{
 				Name:         cp.Name,
@@ -125,6 +136,7 @@ func (appMgr *Manager) setClientSslProfile(
 				}
 			}
 			appMgr.customProfiles.profs[skey] = cp
+			appMgr.setCertificateExpiry(skey, crt, route.ObjectMeta, cp.Name)
 			profRef.Partition = cp.Partition
 			profRef.Name = cp.Name
 		}
@@ -151,6 +163,7 @@ func (appMgr *Manager) setServerSslProfile(
 	sKey serviceQueueKey,
 	rsCfg *ResourceConfig,
 	route *routeapi.Route,
+	routeConfig RouteConfig,
 ) string {
 	// Check to see if the server ssl profile should validate its peer
 	peerCert := peerCertIgnored
@@ -160,7 +173,7 @@ func (appMgr *Manager) setServerSslProfile(
 	}
 
 	// Handle the Default for SNI profile
-	appMgr.handleServerSNIDefaultProfile(rsCfg, peerCert)
+	appMgr.handleServerSNIDefaultProfile(rsCfg, peerCert, routeConfig.ServerSSL)
 
 	if prof, ok := route.ObjectMeta.Annotations[f5ServerSslProfileAnnotation]; ok {
 		serverSsl, updated := appMgr.handleServerSslProfileAnnotation(
@@ -191,11 +204,12 @@ func (appMgr *Manager) setServerSslProfile(
 func (appMgr *Manager) handleServerSNIDefaultProfile(
 	rsCfg *ResourceConfig,
 	peerCert string,
+	serverSSL string,
 ) {
-	if appMgr.routeConfig.ServerSSL != "" {
+	if serverSSL != "" {
 		// User has provided a name
 		profile := ProfileRef{
-			Name:      appMgr.routeConfig.ServerSSL,
+			Name:      serverSSL,
 			Partition: rsCfg.Virtual.Partition,
 			Context:   customProfileServer,
 		}
@@ -308,6 +322,9 @@ func (appMgr *Manager) handleDestCACert(
 		peerCert,
 		caFile,
 	)
+	if policy := appMgr.tlsPolicyFor(route, route.ObjectMeta); nil != policy {
+		policy.apply(&svrProf)
+	}
 
 	skey := secretKey{
 		Name:         svrProf.Name,
@@ -340,9 +357,15 @@ func (appMgr *Manager) handleDestCACert(
 }
 
 // Creates a default SNI profile (if needed) and a new profile from a Secret
+// for a server name, along with the CA file profile for client certificates
 func (appMgr *Manager) createSecretSslProfile(
 	rsCfg *ResourceConfig,
+	obj runtime.Object,
+	meta metav1.ObjectMeta,
 	secret *v1.Secret,
+	serverName string,
+	policy *tlsPolicy,
+	auth *clientAuth,
 ) (error, bool) {
 	if _, ok := secret.Data["tls.crt"]; !ok {
 		err := fmt.Errorf("Invalid Secret '%v': 'tls.crt' field not specified.",
@@ -354,10 +377,17 @@ func (appMgr *Manager) createSecretSslProfile(
 			secret.ObjectMeta.Name)
 		return err, false
 	}
+	profName := formatSecretProfileName(secret.ObjectMeta.Name, serverName)
+	crt, err := appMgr.checkCertificate(obj, meta, profName,
+		string(secret.Data["tls.crt"]), string(secret.Data["tls.key"]))
+	if nil != err {
+		return fmt.Errorf("Invalid Secret '%v': %v", secret.ObjectMeta.Name, err),
+			false
+	}
 
 	// Create Default for SNI profile
 	skey := secretKey{
-		Name:         fmt.Sprintf("default-clientssl-%s", rsCfg.GetName()),
+		Name:         formatDefaultClientSslName(rsCfg.GetName()),
 		ResourceName: rsCfg.GetName(),
 	}
 	sni := ProfileRef{
@@ -374,7 +404,7 @@ func (appMgr *Manager) createSecretSslProfile(
 
 	// Now add the resource profile
 	profRef := ProfileRef{
-		Name:      secret.ObjectMeta.Name,
+		Name:      profName,
 		Partition: rsCfg.Virtual.Partition,
 		Context:   customProfileClient,
 		Namespace: secret.ObjectMeta.Namespace,
@@ -383,27 +413,41 @@ func (appMgr *Manager) createSecretSslProfile(
 		profRef,
 		string(secret.Data["tls.crt"]),
 		string(secret.Data["tls.key"]),
-		"",    // serverName
+		serverName,
 		false, // sni
 		"",    // peerCertMode
 		"",    // caFile
 	)
+	if nil != policy {
+		policy.apply(&cp)
+	}
 	skey = secretKey{
 		Name:         cp.Name,
 		ResourceName: rsCfg.GetName(),
 	}
 	appMgr.customProfiles.Lock()
 	defer appMgr.customProfiles.Unlock()
+	appMgr.setCertificateExpiry(skey, crt, meta, cp.Name)
+	caUpdated := false
+	if nil != auth {
+		auth.apply(&cp)
+		caKey := secretKey{Name: auth.ca.Name}
+		if prof, ok := appMgr.customProfiles.profs[caKey]; !ok ||
+			!reflect.DeepEqual(prof, auth.ca) {
+			appMgr.customProfiles.profs[caKey] = auth.ca
+			caUpdated = true
+		}
+	}
 	if prof, ok := appMgr.customProfiles.profs[skey]; ok {
 		if !reflect.DeepEqual(prof, cp) {
 			appMgr.customProfiles.profs[skey] = cp
 			return nil, true
 		} else {
-			return nil, false
+			return nil, caUpdated
 		}
 	}
 	appMgr.customProfiles.profs[skey] = cp
-	return nil, false
+	return nil, caUpdated
 }
 
 func (appMgr *Manager) deleteUnusedProfiles(
@@ -433,7 +477,7 @@ func (appMgr *Manager) deleteUnusedProfiles(
 			// Don't process our default profiles (they'll be deleted when the VS is deleted)
 			if prof.Name == "http" ||
 				prof.Name == "tcp" ||
-				prof.Name == fmt.Sprintf("default-clientssl-%s", cfg.GetName()) ||
+				prof.Name == formatDefaultClientSslName(cfg.GetName()) ||
 				prof.Name == "default-route-clientssl" ||
 				prof.Name == "default-route-serverssl" ||
 				prof.Name == "openshift_route_cluster_default-ca" {
@@ -480,16 +524,21 @@ func (appMgr *Manager) deleteUnusedProfiles(
 					"namespace", namespace)
 				for _, obj := range ingresses {
 					ing := obj.(*v1beta1.Ingress)
+					if hasBackendTls(ing) && prof == makeIngressServerSSLProfileRef(
+						cfg.Virtual.Partition, namespace, ing.ObjectMeta.Name) {
+						referenced = true
+						break
+					}
 					if 0 == len(ing.Spec.TLS) {
 						// Nothing to do if no TLS section
 						continue
 					}
 					for _, tls := range ing.Spec.TLS {
-						appMgr.checkProfile(
+						appMgr.checkIngressTlsProfile(
 							prof,
 							&toRemove,
 							ing.ObjectMeta.Namespace,
-							tls.SecretName,
+							tls,
 							&referenced,
 						)
 					}
@@ -540,11 +589,16 @@ func (appMgr *Manager) deleteUnusedProfiles(
 			cfg.Virtual.RemoveProfile(prof)
 			stats.cpUpdated += 1
 		}
+		if cfg.MetaData.ResourceType == "ingress" &&
+			removeUnusedServerSslDefault(cfg) {
+			stats.cpUpdated += 1
+		}
 	}
 
 	var found bool
 	appMgr.customProfiles.Lock()
 	defer appMgr.customProfiles.Unlock()
+	appMgr.setSniDefaults(stats)
 
 	// Build a map of CA files and maintain a reference count.
 	caRefs := make(map[string]int)
@@ -571,6 +625,7 @@ func (appMgr *Manager) deleteUnusedProfiles(
 		if !found {
 			// Profile is not used
 			delete(appMgr.customProfiles.profs, key)
+			appMgr.deleteCertificateExpiry(key)
 			stats.cpUpdated += 1
 		} else if profile.CAFile != "" {
 			// Add ref for this profile
@@ -587,16 +642,9 @@ func (appMgr *Manager) deleteUnusedProfiles(
 	}
 }
 
-// Compare a Virtual's profile with a ConfigMap/Ingress profile to see if
-// they are the same. If true, the profile is not deleted. If true but the
-// profile name is a Secret that no longer exists, then we delete the profile
-func (appMgr *Manager) checkProfile(
-	prof ProfileRef,
-	toRemove *[]ProfileRef,
-	namespace,
-	testName string,
-	referenced *bool,
-) {
+// Return whether a profile is the one named by a Secret or BIG-IP profile
+// name
+func profileMatchesName(prof ProfileRef, testName string) bool {
 	var profName string
 	// Trim leading "/" from secret name (if it exists)
 	secretName := strings.TrimSpace(strings.TrimPrefix(testName, "/"))
@@ -606,8 +654,21 @@ func (appMgr *Manager) checkProfile(
 	} else {
 		profName = prof.Name
 	}
+	return profName == secretName
+}
 
-	if profName == secretName {
+// Compare a Virtual's profile with a ConfigMap/Ingress profile to see if
+// they are the same. If true, the profile is not deleted. If true but the
+// profile name is a Secret that no longer exists, then we delete the profile
+func (appMgr *Manager) checkProfile(
+	prof ProfileRef,
+	toRemove *[]ProfileRef,
+	namespace,
+	testName string,
+	referenced *bool,
+) {
+	if profileMatchesName(prof, testName) {
+		secretName := strings.TrimSpace(strings.TrimPrefix(testName, "/"))
 		*referenced = true
 		// May reference a secret that no longer exists
 		if appMgr.useSecrets {
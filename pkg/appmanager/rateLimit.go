@@ -0,0 +1,265 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	log "github.com/F5Networks/k8s-bigip-ctlr/pkg/vlogger"
+
+	routeapi "github.com/openshift/origin/pkg/route/api"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
+)
+
+// Counts the requests of each client and answers those over the limit
+const rateLimitIRuleName = "rate_limit_irule"
+
+// Suffix of the internal data group that holds the rate limits of a
+// virtual. The key is the host, a space and the path; the data is the
+// limit, the action and the client key.
+const rateLimitDgSuffix = "_rate_limit_dg"
+
+// Ways to answer requests over the limit
+const (
+	rateLimitActionTooMany = "429"
+	rateLimitActionReset   = "reset"
+)
+
+// Clients are told apart by their address, or by a request header with
+// this prefix followed by the header name
+const (
+	rateLimitKeyClientIP = "client-ip"
+	rateLimitKeyHeader   = "header:"
+)
+
+// Rate limit for the requests of each client
+type rateLimit struct {
+	Limit  int
+	Action string
+	// Header that tells clients apart, or "" for the client address
+	Header string
+}
+
+func formatRateLimitDgName(vsName string) string {
+	return vsName + rateLimitDgSuffix
+}
+
+// Parse the rate limit annotations of an Ingress or Route. Returns nil if
+// there is no limit.
+func parseRateLimit(annotations map[string]string) (*rateLimit, error) {
+	val, ok := annotations[f5VsRateLimitAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	limit, err := strconv.Atoi(val)
+	if nil != err || limit < 1 {
+		return nil, fmt.Errorf("rate limit must be a positive number of "+
+			"requests per second, not '%s'", val)
+	}
+	rl := rateLimit{Limit: limit, Action: rateLimitActionTooMany}
+	if action, ok := annotations[f5VsRateLimitActionAnnotation]; ok {
+		if action != rateLimitActionTooMany && action != rateLimitActionReset {
+			return nil, fmt.Errorf("unknown rate limit action '%s'", action)
+		}
+		rl.Action = action
+	}
+	if key, ok := annotations[f5VsRateLimitKeyAnnotation]; ok &&
+		key != rateLimitKeyClientIP {
+		header := strings.TrimPrefix(key, rateLimitKeyHeader)
+		if header == key || !persistHeaderRegexp.MatchString(header) {
+			return nil, fmt.Errorf("rate limit key must be %s or %s<name>, "+
+				"not '%s'", rateLimitKeyClientIP, rateLimitKeyHeader, key)
+		}
+		rl.Header = header
+	}
+	return &rl, nil
+}
+
+// Return the data group value of a rate limit
+func (rl rateLimit) record() string {
+	key := rateLimitKeyClientIP
+	if rl.Header != "" {
+		key = rl.Header
+	}
+	return fmt.Sprintf("%d %s %s", rl.Limit, rl.Action, key)
+}
+
+// Count the requests of each client for the host and path of the record
+// with the longest matching path, in one second windows, and answer those
+// over the limit
+func rateLimitIRule() string {
+	iRuleCode := fmt.Sprintf(`
+		when HTTP_REQUEST {
+			set class "[virtual name]%s"
+			if { not [class exists $class] } {
+				return
+			}
+			%s
+			if { $selected_len < 0 } {
+				return
+			}
+			set settings $record
+			set limit_key $record_key
+			set client [IP::client_addr]
+			if { [lindex $settings 2] ne "%s" } {
+				set client_header [HTTP::header [lindex $settings 2]]
+				if { $client_header ne "" } {
+					set client $client_header
+				}
+			}
+			set counter "[virtual name] $limit_key $client"
+			# The window lasts a second from its first request, however
+			# many requests follow it. The request that creates the
+			# counter starts the window, so a window that ends between
+			# two requests cannot leave a counter that never expires.
+			set count [table incr -notouch $counter]
+			if { $count == 1 } {
+				table lifetime $counter 1
+			}
+			if { $count > [lindex $settings 0] } {
+				if { [lindex $settings 1] eq "%s" } {
+					reject
+				} else {
+					HTTP::respond 429 content "Too Many Requests" "Retry-After" "1" \
+						"Connection" "Close"
+				}
+				event disable all
+			}
+		}`, rateLimitDgSuffix, hostPathMatch, rateLimitKeyClientIP,
+		rateLimitActionReset)
+
+	return iRuleCode
+}
+
+// Record the rate limit of an object for the given keys of its virtual,
+// and add the rate limit iRule to the virtual
+func (appMgr *Manager) setRateLimit(
+	rsCfg *ResourceConfig,
+	obj runtime.Object,
+	meta metav1.ObjectMeta,
+	keys []string,
+	dgMap InternalDataGroupMap,
+) {
+	rl, err := parseRateLimit(meta.Annotations)
+	if nil != err {
+		msg := fmt.Sprintf("Not limiting the request rate for %s: %v",
+			meta.Name, err)
+		log.Warning(msg)
+		appMgr.recordEvent(obj, meta.Namespace, v1.EventTypeWarning,
+			"InvalidRateLimit", msg)
+		return
+	}
+	if nil == rl {
+		return
+	}
+	for _, key := range keys {
+		updateDataGroup(dgMap, formatRateLimitDgName(rsCfg.Virtual.Name),
+			rsCfg.Virtual.Partition, meta.Namespace, key, rl.record())
+	}
+	appMgr.addIRule(rateLimitIRuleName, rsCfg.Virtual.Partition,
+		rateLimitIRule())
+	appMgr.addRateLimitIRule(rsCfg)
+}
+
+// Add the rate limit of an Ingress for each of its hosts and paths
+func (appMgr *Manager) handleIngressRateLimit(
+	rsCfg *ResourceConfig,
+	ing *v1beta1.Ingress,
+	dgMap InternalDataGroupMap,
+) {
+	if nil == rsCfg.Virtual.VirtualAddress ||
+		rsCfg.Virtual.VirtualAddress.BindAddr == "" {
+		// Nothing to limit for pool-only mode
+		return
+	}
+	appMgr.setRateLimit(rsCfg, ing, ing.ObjectMeta, ingressHostPathKeys(ing),
+		dgMap)
+}
+
+// Add the rate limit of a Route for its host and path
+func (appMgr *Manager) handleRouteRateLimit(
+	rsCfg *ResourceConfig,
+	route *routeapi.Route,
+	dgMap InternalDataGroupMap,
+) {
+	keys := []string{sourceRangeKey(route.Spec.Host, route.Spec.Path)}
+	appMgr.setRateLimit(rsCfg, route, route.ObjectMeta, keys, dgMap)
+}
+
+// Add the rate limit iRule after the source range iRules of a virtual, so
+// clients that are turned away anyway are not counted, and ahead of the
+// other iRules
+func (appMgr *Manager) addRateLimitIRule(rsCfg *ResourceConfig) {
+	fullName := joinBigipPath(rsCfg.Virtual.Partition, rateLimitIRuleName)
+	rsCfg.Virtual.RemoveIRule(fullName)
+	var iRules []string
+	added := false
+	for _, irule := range rsCfg.Virtual.IRules {
+		if !added && irule != joinBigipPath(rsCfg.Virtual.Partition,
+			sourceRangeHttpIRuleName) {
+			iRules = append(iRules, fullName)
+			added = true
+		}
+		iRules = append(iRules, irule)
+	}
+	if !added {
+		iRules = append(iRules, fullName)
+	}
+	rsCfg.Virtual.IRules = iRules
+}
+
+// Remove the rate limit iRule from virtuals that no longer have rate
+// limits, and delete it if no virtual uses it
+func (appMgr *Manager) syncRateLimitIRules() {
+	appMgr.syncHostPathIRule(rateLimitIRuleName, formatRateLimitDgName)
+}
+
+// Remove an iRule that reads a per-virtual data group from the Ingress and
+// Route virtuals that no longer have the data group, and delete the iRule
+// if no virtual uses it
+func (appMgr *Manager) syncHostPathIRule(
+	iRuleName string,
+	dgName func(vsName string) string,
+) {
+	appMgr.intDgMutex.Lock()
+	for _, cfg := range appMgr.resources.GetAllResources() {
+		if cfg.MetaData.ResourceType != "ingress" &&
+			cfg.MetaData.ResourceType != "route" {
+			continue
+		}
+		grpRef := nameRef{
+			Name:      dgName(cfg.Virtual.Name),
+			Partition: cfg.Virtual.Partition,
+		}
+		if _, found := appMgr.intDgMap[grpRef]; !found {
+			cfg.Virtual.RemoveIRule(
+				joinBigipPath(cfg.Virtual.Partition, iRuleName))
+		}
+	}
+	appMgr.intDgMutex.Unlock()
+
+	inUse := appMgr.iRulesInUse()
+
+	appMgr.irulesMutex.Lock()
+	defer appMgr.irulesMutex.Unlock()
+	appMgr.deleteUnusedIRule(iRuleName, inUse)
+}
@@ -0,0 +1,76 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Rate Limit Tests", func() {
+	It("parses rate limit annotations", func() {
+		rl, err := parseRateLimit(map[string]string{})
+		Expect(err).To(BeNil())
+		Expect(rl).To(BeNil())
+
+		rl, err = parseRateLimit(map[string]string{f5VsRateLimitAnnotation: "10"})
+		Expect(err).To(BeNil())
+		Expect(*rl).To(Equal(rateLimit{Limit: 10, Action: rateLimitActionTooMany}))
+		Expect(rl.record()).To(Equal("10 429 client-ip"))
+
+		rl, err = parseRateLimit(map[string]string{
+			f5VsRateLimitAnnotation:       "5",
+			f5VsRateLimitKeyAnnotation:    "header:X-Api-Key",
+			f5VsRateLimitActionAnnotation: "reset",
+		})
+		Expect(err).To(BeNil())
+		Expect(rl.record()).To(Equal("5 reset X-Api-Key"))
+
+		for _, annotations := range []map[string]string{
+			{f5VsRateLimitAnnotation: "0"},
+			{f5VsRateLimitAnnotation: "many"},
+			{f5VsRateLimitAnnotation: "5", f5VsRateLimitActionAnnotation: "drop"},
+			{f5VsRateLimitAnnotation: "5", f5VsRateLimitKeyAnnotation: "X-Api-Key"},
+			{f5VsRateLimitAnnotation: "5", f5VsRateLimitKeyAnnotation: "header:X Key"},
+		} {
+			_, err = parseRateLimit(annotations)
+			Expect(err).ToNot(BeNil(), "%v", annotations)
+		}
+	})
+
+	It("counts requests in one second windows", func() {
+		iRule := rateLimitIRule()
+		Expect(iRule).To(ContainSubstring(
+			`set class "[virtual name]_rate_limit_dg"`))
+		Expect(iRule).To(ContainSubstring("set limit_key $record_key"))
+		// The first request of a window starts it, and later requests do
+		// not extend it
+		incr := strings.Index(iRule, "set count [table incr -notouch $counter]")
+		first := strings.Index(iRule, "if { $count == 1 } {")
+		lifetime := strings.Index(iRule, "table lifetime $counter 1")
+		Expect(incr).To(BeNumerically(">", 0))
+		Expect(first).To(BeNumerically(">", incr))
+		Expect(lifetime).To(BeNumerically(">", first))
+		Expect(iRule).ToNot(ContainSubstring("table set"))
+		Expect(iRule).ToNot(ContainSubstring("table timeout"))
+		Expect(iRule).To(ContainSubstring("HTTP::respond 429"))
+		// A limited client cannot send more requests on the connection
+		Expect(iRule).To(ContainSubstring(`"Connection" "Close"`))
+	})
+})
@@ -18,7 +18,6 @@ package appmanager
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
 	"net"
 	"reflect"
@@ -68,6 +67,7 @@ const customProfileServer string = "serverside"
 
 // Constants for CustomProfile.PeerCertMode
 const peerCertRequired = "require"
+const peerCertRequested = "request"
 const peerCertIgnored = "ignore"
 const peerCertDefault = peerCertIgnored
 
@@ -360,6 +360,11 @@ func makeCertificateFileName(name string) string {
 	return joinBigipPath("Common", name) + ".crt"
 }
 
+func makeCrlFileName(name string) string {
+	// CRLs live next to the certificates they belong to
+	return joinBigipPath("Common", name) + ".crl"
+}
+
 func extractCertificateName(fn string) string {
 	// performs the reverse of makeCertificateFileName
 	_, name := splitBigipPath(fn, false)
@@ -412,12 +417,15 @@ func convertStringToProfileRef(profileName, context, ns string) ProfileRef {
 type CustomProfileStore struct {
 	sync.Mutex
 	profs map[secretKey]CustomProfile
+	// Labels of the expiry metric of the profiles with certificates
+	certs map[secretKey][]string
 }
 
 // Contructor for CustomProfiles
 func NewCustomProfiles() *CustomProfileStore {
 	var cps CustomProfileStore
 	cps.profs = make(map[secretKey]CustomProfile)
+	cps.certs = make(map[secretKey][]string)
 	return &cps
 }
 
@@ -880,11 +888,6 @@ func parseConfigMap(cm *v1.ConfigMap, schemaDBPath string) (*ResourceConfig, err
 				return &cfg, err
 			}
 
-			//Check if we care about the partition specified in the configmap
-			if cfgMap.VirtualServer.Frontend.Partition != DEFAULT_PARTITION {
-				errStr := fmt.Sprintf("The partition '%s' in the ConfigMap does not match '%s' that the controller watches for", cfgMap.VirtualServer.Frontend.Partition, DEFAULT_PARTITION)
-				return &cfg, errors.New(errStr)
-			}
 			if result.Valid() {
 				ns := cm.ObjectMeta.Namespace
 
@@ -1056,7 +1059,10 @@ func (appMgr *Manager) createRSConfigFromIngress(
 	if partition, ok := ing.ObjectMeta.Annotations[f5VsPartitionAnnotation]; ok == true {
 		cfg.Virtual.Partition = partition
 	} else {
-		cfg.Virtual.Partition = DEFAULT_PARTITION
+		cfg.Virtual.Partition = appMgr.namespacePartition(ns)
+	}
+	if !appMgr.checkPartition(ing, ing.ObjectMeta, cfg.Virtual.Partition) {
+		return nil
 	}
 
 	bindAddr := ""
@@ -1078,10 +1084,52 @@ func (appMgr *Manager) createRSConfigFromIngress(
 		return nil
 	}
 
+	// Without valid conditions the rules could catch traffic meant for
+	// others, so they are left out until the annotation is fixed
+	conds, condErr := parseRuleConditions(ing.ObjectMeta.Annotations)
+	if nil != condErr {
+		msg := fmt.Sprintf("Not configuring rules for Ingress %s: %v",
+			ing.ObjectMeta.Name, condErr)
+		log.Warning(msg)
+		appMgr.recordEvent(ing, ing.ObjectMeta.Namespace, v1.EventTypeWarning,
+			"InvalidRuleConditions", msg)
+	}
+	acts, actErr := parseRuleActions(ing.ObjectMeta.Annotations)
+	if nil != actErr {
+		msg := fmt.Sprintf("Not configuring rules for Ingress %s: %v",
+			ing.ObjectMeta.Name, actErr)
+		log.Warning(msg)
+		appMgr.recordEvent(ing, ing.ObjectMeta.Namespace, v1.EventTypeWarning,
+			"InvalidRuleActions", msg)
+	}
+	pathType, pathErr := getIngressPathType(ing)
+	if nil != pathErr {
+		msg := fmt.Sprintf("Not configuring rules for Ingress %s: %v",
+			ing.ObjectMeta.Name, pathErr)
+		log.Warning(msg)
+		appMgr.recordEvent(ing, ing.ObjectMeta.Namespace, v1.EventTypeWarning,
+			"InvalidPathType", msg)
+	}
+	weights, weightErr := parseBackendWeights(ing.ObjectMeta.Annotations)
+	if nil != weightErr {
+		msg := fmt.Sprintf("Not weighting backends for Ingress %s: %v",
+			ing.ObjectMeta.Name, weightErr)
+		log.Warning(msg)
+		appMgr.recordEvent(ing, ing.ObjectMeta.Namespace, v1.EventTypeWarning,
+			"InvalidBackendWeights", msg)
+	}
+	// Canary settings are checked before the Ingress gets here
+	cnry, cnryErr := parseCanary(ing.ObjectMeta.Annotations)
+	if nil != cnryErr {
+		return nil
+	}
+
 	// Create our pools and policy/rules based on the Ingress
 	var pools Pools
 	var plcy *Policy
 	var rules *Rules
+	// Plain forwarding rules of a canary, which its own rules derive from
+	var canaryBase Rules
 	if nil != ing.Spec.Rules { //multi-service
 		for _, rule := range ing.Spec.Rules {
 			if nil != rule.IngressRuleValue.HTTP {
@@ -1116,8 +1164,35 @@ func (appMgr *Manager) createRSConfigFromIngress(
 				}
 			}
 		}
-		rules = processIngressRules(&ing.Spec, pools, cfg.Virtual.Partition)
-		plcy = createPolicy(*rules, cfg.Virtual.Name, cfg.Virtual.Partition)
+		// Paths listed with several Services share a weighted pool
+		var weightedNames map[string]string
+		if nil != weights && len(pools) > 1 && pathType != pathTypeRegex &&
+			appMgr.checkDriverFeature(ing, ing.ObjectMeta,
+				driverFeaturePoolMemberRatio, "backend weights") {
+			var weighted Pools
+			var err error
+			weighted, weightedNames, err = ingressWeightedPools(ing, pools, weights)
+			if nil != err {
+				msg := fmt.Sprintf("Not weighting backends for Ingress %s: %v",
+					ing.ObjectMeta.Name, err)
+				log.Warning(msg)
+				appMgr.recordEvent(ing, ing.ObjectMeta.Namespace,
+					v1.EventTypeWarning, "InvalidBackendWeights", msg)
+			}
+			pools = append(pools, weighted...)
+		}
+		// Regex paths are matched by an iRule rather than policy rules
+		if nil == condErr && nil == actErr && nil == pathErr &&
+			pathType != pathTypeRegex {
+			rules = processIngressRules(&ing.Spec, pools, weightedNames,
+				cfg.Virtual.Partition, pathType, conds, acts, pStruct.protocol)
+			if nil != cnry && nil != rules {
+				canaryBase = *rules
+				canaryRls := canaryHeaderRules(canaryBase, cnry)
+				rules = &canaryRls
+			}
+			plcy = createPolicy(*rules, cfg.Virtual.Name, cfg.Virtual.Partition)
+		}
 	} else { // single-service
 		pool := Pool{
 			Name: formatIngressPoolName(
@@ -1133,18 +1208,43 @@ func (appMgr *Manager) createRSConfigFromIngress(
 		cfg.Virtual.PoolName = joinBigipPath(cfg.Virtual.Partition, pool.Name)
 	}
 
+	// Pools that take over when the others are down
+	for _, pool := range fallbackPools(ing.ObjectMeta.Annotations,
+		ing.ObjectMeta.Namespace, cfg.Virtual.Partition, balance,
+		formatIngressPoolName) {
+		found := false
+		for _, pl := range pools {
+			if pl.Name == pool.Name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			pools = append(pools, pool)
+		}
+	}
+
 	resources.Lock()
 	defer resources.Unlock()
-	// Check to see if we already have any Ingresses for this IP:Port
-	if oldCfg, exists := resources.GetByName(cfg.Virtual.Name); exists {
+	// Check to see if we already have any Ingresses for this IP:Port, in the
+	// same partition. One in another partition is replaced, which moves the
+	// virtual when the partition of its Ingresses changes.
+	if oldCfg, exists := resources.GetByName(cfg.Virtual.Name); exists &&
+		oldCfg.Virtual.Partition == cfg.Virtual.Partition {
 		// If we do, use an existing config
 		cfg.copyConfig(oldCfg)
 
 		// If any of the new pools don't already exist, add them
 		for _, newPool := range pools {
+			if len(newPool.Backends) > 0 {
+				cfg.setWeightedPool(newPool)
+				continue
+			}
 			found := false
-			for _, pl := range cfg.Pools {
+			for i, pl := range cfg.Pools {
 				if pl.Name == newPool.Name {
+					// A pool some rule forwards to is no fallback
+					cfg.Pools[i].Fallback = pl.Fallback && newPool.Fallback
 					found = true
 					break
 				}
@@ -1153,17 +1253,74 @@ func (appMgr *Manager) createRSConfigFromIngress(
 				cfg.Pools = append(cfg.Pools, newPool)
 			}
 		}
-		if len(cfg.Pools) > 1 {
+		if cfg.servingPoolCount() > 1 {
 			cfg.Virtual.PoolName = ""
 		}
 		// If any of the new rules already exist, update them; else add them
 		if len(cfg.Policies) > 0 && rules != nil {
 			policy := cfg.Policies[0]
+			newRules := make(map[string]bool)
+			for _, newRule := range *rules {
+				newRules[newRule.Name] = true
+			}
+			// Rules are owned by the Ingress that has their plain form
+			owned := newRules
+			if nil != cnry {
+				owned = make(map[string]bool)
+				for _, rl := range canaryBase {
+					owned[rl.Name] = true
+				}
+				if cnry.Weight > 0 && appMgr.checkDriverFeature(ing, ing.ObjectMeta,
+					driverFeaturePoolMemberRatio, "the canary weight") {
+					weightedRls, weighted := canaryWeightedRules(canaryBase,
+						&policy, cfg.Pools, cnry.Weight, ing.ObjectMeta.Name)
+					for _, pool := range weighted {
+						cfg.setWeightedPool(pool)
+					}
+					// Rules of the primary are replaced before new rules are added
+					*rules = append(weightedRls, *rules...)
+					for _, rl := range weightedRls {
+						newRules[rl.Name] = true
+					}
+				}
+			}
+			// Drop application root redirects and canary rules the Ingress no
+			// longer asks for
+			var staleOffsets []int
+			for i, rl := range policy.Rules {
+				for _, suffix := range []string{appRootRuleSuffix, subPathRuleSuffix,
+					canaryHeaderRuleSuffix, canaryCookieRuleSuffix} {
+					baseName := strings.TrimSuffix(rl.Name, suffix)
+					if baseName != rl.Name && owned[baseName] && !newRules[rl.Name] {
+						staleOffsets = append(staleOffsets, i)
+						break
+					}
+				}
+			}
+			if policy.RemoveRules(staleOffsets) {
+				cfg.SetPolicy(policy)
+			}
+			// Rules of Prefix paths come with a rule for the paths below them
+			prefixRules := make(map[string]bool)
+			for _, rls := range []Rules{policy.Rules, *rules} {
+				for _, rl := range rls {
+					base := strings.TrimSuffix(rl.Name, subPathRuleSuffix)
+					if base != rl.Name {
+						prefixRules[base] = true
+					}
+				}
+			}
 			for _, newRule := range *rules {
 				found := false
 				for i, rl := range policy.Rules {
-					if rl.Name == newRule.Name || rl.FullURI == newRule.FullURI {
+					if rl.Name == newRule.Name || (rl.FullURI == newRule.FullURI &&
+						reflect.DeepEqual(rl.Conditions, newRule.Conditions)) {
 						found = true
+						if rl.Name != newRule.Name && !prefixRules[rl.Name] &&
+							prefixRules[newRule.Name] {
+							// The path of an Exact rule is left to it
+							break
+						}
 						policy.Rules[i] = newRule
 						break
 					}
@@ -1172,6 +1329,12 @@ func (appMgr *Manager) createRSConfigFromIngress(
 					cfg.AddRuleToPolicy(policy.Name, newRule)
 				}
 			}
+			// Rules from every Ingress on this virtual are ordered together
+			if merged := cfg.FindPolicy("forwarding"); nil != merged {
+				orderIngressRules(merged.Rules)
+				cfg.SetPolicy(*merged)
+			}
+			cfg.removeUnusedWeightedPools()
 		} else if len(cfg.Policies) == 0 && plcy != nil {
 			cfg.SetPolicy(*plcy)
 		}
@@ -1190,6 +1353,16 @@ func (appMgr *Manager) createRSConfigFromIngress(
 	return &cfg
 }
 
+// Return the port of the HTTPS virtual server of an Ingress
+func ingressHttpsPort(ing *v1beta1.Ingress) int32 {
+	if port, ok :=
+		ing.ObjectMeta.Annotations[f5VsHttpsPortAnnotation]; ok == true {
+		p, _ := strconv.ParseInt(port, 10, 32)
+		return int32(p)
+	}
+	return DEFAULT_HTTPS_PORT
+}
+
 // Return value is whether or not a custom profile was updated
 func (appMgr *Manager) handleIngressTls(
 	rsCfg *ResourceConfig,
@@ -1206,18 +1379,16 @@ func (appMgr *Manager) handleIngressTls(
 		return false
 	}
 
-	var httpsPort int32
-	if port, ok :=
-		ing.ObjectMeta.Annotations[f5VsHttpsPortAnnotation]; ok == true {
-		p, _ := strconv.ParseInt(port, 10, 32)
-		httpsPort = int32(p)
-	} else {
-		httpsPort = DEFAULT_HTTPS_PORT
-	}
+	httpsPort := ingressHttpsPort(ing)
 	// If we are processing the HTTPS server,
 	// then we don't need a redirect policy, only profiles
 	if rsCfg.Virtual.VirtualAddress.Port == httpsPort {
 		var cpUpdated, updateState bool
+		policy := appMgr.tlsPolicyFor(ing, ing.ObjectMeta)
+		var auth *clientAuth
+		if appMgr.useSecrets {
+			auth = appMgr.clientAuthFor(ing, ing.ObjectMeta, rsCfg.Virtual.Partition)
+		}
 		for _, tls := range ing.Spec.TLS {
 			// Check if profile is contained in a Secret
 			if appMgr.useSecrets {
@@ -1233,19 +1404,23 @@ func (appMgr *Manager) handleIngressTls(
 					rsCfg.Virtual.AddOrUpdateProfile(profRef)
 					continue
 				}
-				err, cpUpdated = appMgr.createSecretSslProfile(rsCfg, secret)
-				if err != nil {
-					log.Warningf("%v", err)
-					continue
-				}
-				updateState = updateState || cpUpdated
-				profRef := ProfileRef{
-					Partition: rsCfg.Virtual.Partition,
-					Name:      tls.SecretName,
-					Context:   customProfileClient,
-					Namespace: ing.ObjectMeta.Namespace,
+				// One profile for each host, so the BIG-IP picks it by SNI
+				for _, serverName := range ingressTlsServerNames(tls) {
+					err, cpUpdated = appMgr.createSecretSslProfile(rsCfg, ing,
+						ing.ObjectMeta, secret, serverName, policy, auth)
+					if err != nil {
+						log.Warningf("%v", err)
+						break
+					}
+					updateState = updateState || cpUpdated
+					profRef := ProfileRef{
+						Partition: rsCfg.Virtual.Partition,
+						Name:      formatSecretProfileName(tls.SecretName, serverName),
+						Context:   customProfileClient,
+						Namespace: ing.ObjectMeta.Namespace,
+					}
+					rsCfg.Virtual.AddOrUpdateProfile(profRef)
 				}
-				rsCfg.Virtual.AddOrUpdateProfile(profRef)
 			} else {
 				secretName := formatIngressSslProfileName(tls.SecretName)
 				profRef := convertStringToProfileRef(
@@ -1260,7 +1435,8 @@ func (appMgr *Manager) handleIngressTls(
 				secretName, customProfileServer, ing.ObjectMeta.Namespace)
 			rsCfg.Virtual.AddOrUpdateProfile(profRef)
 		}
-		return cpUpdated
+		appMgr.setIngressSniDefault(rsCfg, ing)
+		return updateState
 	}
 
 	// sslRedirect defaults to true, allowHttp defaults to false.
@@ -1283,10 +1459,10 @@ func (appMgr *Manager) handleIngressTls(
 		// State 2, set HTTP redirect iRule
 		log.Debugf("TLS: Applying HTTP redirect iRule.")
 		ruleName := fmt.Sprintf("%s_%d", httpRedirectIRuleName, httpsPort)
-		appMgr.addIRule(ruleName, DEFAULT_PARTITION,
-			httpRedirectIRule(httpsPort))
-		appMgr.addInternalDataGroup(httpsRedirectDgName, DEFAULT_PARTITION)
-		ruleName = joinBigipPath(DEFAULT_PARTITION, ruleName)
+		appMgr.addIRule(ruleName, rsCfg.Virtual.Partition,
+			httpRedirectIRule(httpsPort, httpsRedirectDgName))
+		appMgr.addInternalDataGroup(httpsRedirectDgName, rsCfg.Virtual.Partition)
+		ruleName = joinBigipPath(rsCfg.Virtual.Partition, ruleName)
 		rsCfg.Virtual.AddIRule(ruleName)
 		if nil != ing.Spec.Backend {
 			svcFwdRulesMap.AddEntry(ing.ObjectMeta.Namespace,
@@ -1320,6 +1496,7 @@ func (appMgr *Manager) createRSConfigFromRoute(
 	var rsCfg ResourceConfig
 	rsCfg.MetaData.RouteProfs = make(map[routeKey]string)
 	var policyName, rsName string
+	partition := appMgr.namespacePartition(route.ObjectMeta.Namespace)
 
 	if pStruct.protocol == "http" {
 		policyName = "openshift_insecure_routes"
@@ -1357,18 +1534,38 @@ func (appMgr *Manager) createRSConfigFromRoute(
 	// Create the pool
 	pool := Pool{
 		Name:        formatRoutePoolName(route.ObjectMeta.Namespace, svcName),
-		Partition:   DEFAULT_PARTITION,
+		Partition:   partition,
 		Balance:     balance,
 		ServiceName: svcName,
 		ServicePort: backendPort,
 	}
-	// Create the rule
+	// Create the rule, which forwards to the weighted pool of an A/B Route
+	// that splits its traffic with pool member ratios
+	ratioAB := appMgr.useRouteWeightedPool(route)
+	rulePool := pool.Name
+	if ratioAB {
+		rulePool = formatRouteWeightedPoolName(
+			route.ObjectMeta.Namespace, route.ObjectMeta.Name)
+	}
 	uri := route.Spec.Host + route.Spec.Path
-	rule, err := createRule(uri, pool.Name, pool.Partition, formatRouteRuleName(route))
+	rule, err := createRule(uri, rulePool, pool.Partition, formatRouteRuleName(route))
+	if nil != err {
+		err = fmt.Errorf("Error configuring rule for Route %s: %v", route.ObjectMeta.Name, err)
+		return &rsCfg, err, Pool{}
+	}
+	conds, err := parseRuleConditions(route.ObjectMeta.Annotations)
 	if nil != err {
 		err = fmt.Errorf("Error configuring rule for Route %s: %v", route.ObjectMeta.Name, err)
 		return &rsCfg, err, Pool{}
 	}
+	addRuleConditions(rule, conds)
+	acts, err := parseRuleActions(route.ObjectMeta.Annotations)
+	if nil != err {
+		err = fmt.Errorf("Error configuring rule for Route %s: %v", route.ObjectMeta.Name, err)
+		return &rsCfg, err, Pool{}
+	}
+	appRoot := applyRuleActions(rule, route.Spec.Host, route.Spec.Path, acts,
+		pStruct.protocol)
 
 	sourceAddrTranslation, err := setSourceAddrTranslation(route.ObjectMeta.Annotations, route.ObjectMeta.Name)
 	if err != nil {
@@ -1391,6 +1588,7 @@ func (appMgr *Manager) createRSConfigFromRoute(
 				if pl.ServicePort != pool.ServicePort {
 					rsCfg.Pools[i].ServicePort = pool.ServicePort
 				}
+				rsCfg.Pools[i].Fallback = false
 				found = true
 			}
 		}
@@ -1403,7 +1601,7 @@ func (appMgr *Manager) createRSConfigFromRoute(
 		rsCfg.Virtual.Enabled = true
 		setProfilesForMode("http", &rsCfg)
 		rsCfg.Virtual.SourceAddrTranslation = sourceAddrTranslation
-		rsCfg.Virtual.Partition = DEFAULT_PARTITION
+		rsCfg.Virtual.Partition = partition
 		bindAddr := ""
 		if routeConfig.RouteVSAddr != "" {
 			bindAddr = routeConfig.RouteVSAddr
@@ -1412,14 +1610,24 @@ func (appMgr *Manager) createRSConfigFromRoute(
 		rsCfg.Pools = append(rsCfg.Pools, pool)
 	}
 
-	abDeployment := isRouteABDeployment(route)
+	if ratioAB {
+		rsCfg.setWeightedPool(routeWeightedPool(route, partition))
+	}
+	rsCfg.addFallbackPools(fallbackPools(route.ObjectMeta.Annotations,
+		route.ObjectMeta.Namespace, partition, balance,
+		formatRoutePoolName))
+
+	abDeployment := isRouteABDeployment(route) && !ratioAB
 	appMgr.handleRouteTls(&rsCfg,
 		route,
 		pStruct.protocol,
 		policyName,
 		rule,
 		svcFwdRulesMap,
-		abDeployment)
+		abDeployment,
+		routeConfig.Shard)
+	rsCfg.setAppRootRule(policyName, rule, appRoot)
+	rsCfg.removeUnusedWeightedPools()
 
 	return &rsCfg, nil, pool
 }
@@ -1452,6 +1660,11 @@ func (rc *ResourceConfig) copyConfig(cfg *ResourceConfig) {
 		rc.Policies[i].Rules = make([]*Rule, len(cfg.Policies[i].Rules))
 		copy(rc.Policies[i].Rules, cfg.Policies[i].Rules)
 	}
+	// Tuned profiles
+	rc.TunedProfiles = make([]TunedProfile, len(cfg.TunedProfiles))
+	copy(rc.TunedProfiles, cfg.TunedProfiles)
+	// Firewall policy, which is replaced rather than changed
+	rc.FirewallPolicy = cfg.FirewallPolicy
 }
 
 func (appMgr *Manager) handleRouteTls(
@@ -1462,9 +1675,15 @@ func (appMgr *Manager) handleRouteTls(
 	rule *Rule,
 	svcFwdRulesMap ServiceFwdRuleMap,
 	abDeployment bool,
+	shard string,
 ) {
 	tls := route.Spec.TLS
-	abPathIRuleName := joinBigipPath(DEFAULT_PARTITION, abDeploymentPathIRuleName)
+	partition := rc.Virtual.Partition
+	// The virtual servers of each shard have their own iRules and data groups
+	abPathIRule := formatShardName(abDeploymentPathIRuleName, shard)
+	abPathIRuleName := joinBigipPath(partition, abPathIRule)
+	abDg := formatShardName(abDeploymentDgName, shard)
+	passThroughIRule := formatShardName(sslPassthroughIRuleName, shard)
 
 	if abDeployment {
 		rc.DeleteRuleFromPolicy(policyName, rule)
@@ -1474,8 +1693,8 @@ func (appMgr *Manager) handleRouteTls(
 		if nil == tls || len(tls.Termination) == 0 {
 			if abDeployment {
 				appMgr.addIRule(
-					abDeploymentPathIRuleName, DEFAULT_PARTITION, abDeploymentPathIRule())
-				appMgr.addInternalDataGroup(abDeploymentDgName, DEFAULT_PARTITION)
+					abPathIRule, partition, abDeploymentPathIRule(partition, shard))
+				appMgr.addInternalDataGroup(abDg, partition)
 				rc.Virtual.AddIRule(abPathIRuleName)
 			} else {
 				rc.AddRuleToPolicy(policyName, rule)
@@ -1493,11 +1712,12 @@ func (appMgr *Manager) handleRouteTls(
 						rc.AddRuleToPolicy(policyName, rule)
 					}
 				case routeapi.InsecureEdgeTerminationPolicyRedirect:
-					redirectIRuleName := joinBigipPath(DEFAULT_PARTITION,
-						httpRedirectIRuleName)
-					appMgr.addIRule(httpRedirectIRuleName, DEFAULT_PARTITION,
-						httpRedirectIRule(DEFAULT_HTTPS_PORT))
-					appMgr.addInternalDataGroup(httpsRedirectDgName, DEFAULT_PARTITION)
+					redirectIRule := formatShardName(httpRedirectIRuleName, shard)
+					redirectDg := formatShardName(httpsRedirectDgName, shard)
+					appMgr.addIRule(redirectIRule, partition,
+						httpRedirectIRule(DEFAULT_HTTPS_PORT, redirectDg))
+					appMgr.addInternalDataGroup(redirectDg, partition)
+					redirectIRuleName := joinBigipPath(partition, redirectIRule)
 					rc.Virtual.AddIRule(redirectIRuleName)
 					// TLS config indicates to forward http to https.
 					path := "/"
@@ -1512,28 +1732,30 @@ func (appMgr *Manager) handleRouteTls(
 	} else {
 		// https
 		if nil != tls {
-			passThroughIRuleName := joinBigipPath(DEFAULT_PARTITION,
-				sslPassthroughIRuleName)
+			passThroughIRuleName := joinBigipPath(partition, passThroughIRule)
 			switch tls.Termination {
 			case routeapi.TLSTerminationEdge:
 				if abDeployment {
 					appMgr.addIRule(
-						abDeploymentPathIRuleName, DEFAULT_PARTITION, abDeploymentPathIRule())
-					appMgr.addInternalDataGroup(abDeploymentDgName, DEFAULT_PARTITION)
+						abPathIRule, partition, abDeploymentPathIRule(partition, shard))
+					appMgr.addInternalDataGroup(abDg, partition)
 					rc.Virtual.AddIRule(abPathIRuleName)
 				} else {
 					rc.AddRuleToPolicy(policyName, rule)
 				}
 			case routeapi.TLSTerminationPassthrough:
 				appMgr.addIRule(
-					sslPassthroughIRuleName, DEFAULT_PARTITION, sslPassthroughIRule())
-				appMgr.addInternalDataGroup(passthroughHostsDgName, DEFAULT_PARTITION)
+					passThroughIRule, partition, sslPassthroughIRule(partition, shard))
+				appMgr.addInternalDataGroup(
+					formatShardName(passthroughHostsDgName, shard), partition)
 				rc.Virtual.AddIRule(passThroughIRuleName)
 			case routeapi.TLSTerminationReencrypt:
 				appMgr.addIRule(
-					sslPassthroughIRuleName, DEFAULT_PARTITION, sslPassthroughIRule())
-				appMgr.addInternalDataGroup(reencryptHostsDgName, DEFAULT_PARTITION)
-				appMgr.addInternalDataGroup(reencryptServerSslDgName, DEFAULT_PARTITION)
+					passThroughIRule, partition, sslPassthroughIRule(partition, shard))
+				appMgr.addInternalDataGroup(
+					formatShardName(reencryptHostsDgName, shard), partition)
+				appMgr.addInternalDataGroup(
+					formatShardName(reencryptServerSslDgName, shard), partition)
 				rc.Virtual.AddIRule(passThroughIRuleName)
 				if !abDeployment {
 					rc.AddRuleToPolicy(policyName, rule)
@@ -1743,21 +1965,31 @@ func (rc *ResourceConfig) RemovePool(
 		cfgChanged = rc.RemovePoolAt(i)
 		break
 	}
-	fullPoolName = joinBigipPath(DEFAULT_PARTITION, poolName)
+	fullPoolName = joinBigipPath(rc.Virtual.Partition, poolName)
 
 	// Delete forwarding rule for the pool
 	policy := rc.FindPolicy("forwarding")
 	if nil != policy {
 		// Loop through rules to find which one to remove
 		ruleOffsets := []int{}
+		removedRules := make(map[string]bool)
 		for i, rule := range policy.Rules {
 			if len(rule.Actions) > 0 && rule.Actions[0].Pool == fullPoolName {
 				if rc.MetaData.ResourceType == "route" {
 					resourceName = strings.Split(rule.Name, "_")[3]
 				}
 				ruleOffsets = append(ruleOffsets, i)
+				removedRules[rule.Name] = true
 			}
 		}
+		// Application root redirects go along with the rule they belong to
+		for i, rule := range policy.Rules {
+			if strings.HasSuffix(rule.Name, appRootRuleSuffix) &&
+				removedRules[strings.TrimSuffix(rule.Name, appRootRuleSuffix)] {
+				ruleOffsets = append(ruleOffsets, i)
+			}
+		}
+		sort.Ints(ruleOffsets)
 		polChanged := policy.RemoveRules(ruleOffsets)
 		// Update or remove the policy
 		if 0 == len(policy.Rules) {
@@ -1784,6 +2016,14 @@ func (rc *ResourceConfig) RemovePool(
 		}
 	}
 
+	// Weighted pools go along with the last of their backends
+	for _, name := range rc.removeWeightedPoolBackend(poolName) {
+		if changed, _ := rc.RemovePool(namespace, name); changed {
+			cfgChanged = true
+		}
+	}
+	rc.updateWeightedPools()
+
 	return cfgChanged, svcKey
 }
 
@@ -1993,6 +2233,15 @@ func (idg *InternalDataGroup) AddOrUpdateRecord(name, data string) bool {
 	return true
 }
 
+func (idg *InternalDataGroup) HasRecord(name string) bool {
+	// The records are maintained as a sorted array.
+	nameKeyFunc := func(i int) bool {
+		return idg.Records[i].Name >= name
+	}
+	i := sort.Search(idg.Records.Len(), nameKeyFunc)
+	return i < idg.Records.Len() && idg.Records[i].Name == name
+}
+
 func (idg *InternalDataGroup) RemoveRecord(name string) bool {
 	// The records are maintained as a sorted array.
 	nameKeyFunc := func(i int) bool {
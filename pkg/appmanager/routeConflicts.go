@@ -0,0 +1,251 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	log "github.com/F5Networks/k8s-bigip-ctlr/pkg/vlogger"
+
+	routeapi "github.com/openshift/origin/pkg/route/api"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// Return true if route1 was created before route2. Ties are broken by UID,
+// then by namespace and name so the result is always stable.
+func routeOlderThan(route1, route2 *routeapi.Route) bool {
+	if routeapi.RouteLessThan(route1, route2) {
+		return true
+	}
+	if routeapi.RouteLessThan(route2, route1) {
+		return false
+	}
+	key1 := route1.ObjectMeta.Namespace + "/" + route1.ObjectMeta.Name
+	key2 := route2.ObjectMeta.Namespace + "/" + route2.ObjectMeta.Name
+	return key1 < key2
+}
+
+// Return the Routes in all watched namespaces that use the given host
+func (appMgr *Manager) getRoutesForHost(host string) Routes {
+	appMgr.informersMutex.Lock()
+	defer appMgr.informersMutex.Unlock()
+	var routes Routes
+	for _, appInf := range appMgr.appInformers {
+		if nil == appInf.routeInformer {
+			continue
+		}
+		for _, obj := range appInf.routeInformer.GetStore().List() {
+			route := obj.(*routeapi.Route)
+			if route.Spec.Host == host {
+				routes = append(routes, route)
+			}
+		}
+	}
+	return routes
+}
+
+// Return a namespace, from the namespace informers if we have them.
+// Otherwise it is read from the API once per sync.
+func (appMgr *Manager) getNamespace(namespace string) (*v1.Namespace, error) {
+	if appInf, found := appMgr.getNamespaceInformer(namespace); found {
+		obj, found, err := appInf.nsInformer.GetIndexer().GetByKey(namespace)
+		if nil == err && found {
+			return obj.(*v1.Namespace), nil
+		}
+	}
+	if nil != appMgr.nsInformer {
+		obj, found, err := appMgr.nsInformer.GetIndexer().GetByKey(namespace)
+		if nil != err {
+			return nil, err
+		}
+		if found {
+			return obj.(*v1.Namespace), nil
+		}
+	}
+	appMgr.nsCacheMutex.Lock()
+	defer appMgr.nsCacheMutex.Unlock()
+	if ns, found := appMgr.nsCache[namespace]; found {
+		return ns, nil
+	}
+	if nil == appMgr.kubeClient {
+		return nil, fmt.Errorf("no client to read namespace '%s' with", namespace)
+	}
+	ns, err := appMgr.kubeClient.CoreV1().Namespaces().Get(
+		namespace, metav1.GetOptions{})
+	if nil != err {
+		return nil, err
+	}
+	if nil == appMgr.nsCache {
+		appMgr.nsCache = make(map[string]*v1.Namespace)
+	}
+	appMgr.nsCache[namespace] = ns
+	return ns, nil
+}
+
+// Forget the namespaces read from the API, so each sync sees their changes
+func (appMgr *Manager) resetNamespaceCache() {
+	appMgr.nsCacheMutex.Lock()
+	defer appMgr.nsCacheMutex.Unlock()
+	appMgr.nsCache = nil
+}
+
+// Return the labels of a namespace
+func (appMgr *Manager) getNamespaceLabels(namespace string) (labels.Set, error) {
+	ns, err := appMgr.getNamespace(namespace)
+	if nil != err {
+		return nil, err
+	}
+	return labels.Set(ns.ObjectMeta.Labels), nil
+}
+
+// Return true if Routes in the two namespaces may share host names
+func (appMgr *Manager) namespacesShareHosts(ns1, ns2 string) bool {
+	if appMgr.routeConfig.HostSharingLabel == "" {
+		return false
+	}
+	selector, err := labels.Parse(appMgr.routeConfig.HostSharingLabel)
+	if nil != err {
+		log.Errorf("Failed to parse host sharing label selector '%s': %v",
+			appMgr.routeConfig.HostSharingLabel, err)
+		return false
+	}
+	for _, ns := range []string{ns1, ns2} {
+		nsLabels, err := appMgr.getNamespaceLabels(ns)
+		if nil != err {
+			log.Warningf("Unable to get labels for namespace '%s': %v", ns, err)
+			return false
+		}
+		if !selector.Matches(nsLabels) {
+			return false
+		}
+	}
+	return true
+}
+
+// Check whether an older Route already claims the host and path of this one.
+// The oldest Route for a host owns it: later Routes may only add other paths,
+// or the same path with other rule conditions, from the same namespace or
+// from a namespace allowed to share hosts.
+func (appMgr *Manager) checkRouteHostClaim(route *routeapi.Route) (bool, string) {
+	if route.Spec.Host == "" {
+		return false, ""
+	}
+	for _, other := range appMgr.getRoutesForHost(route.Spec.Host) {
+		if other.ObjectMeta.Namespace == route.ObjectMeta.Namespace &&
+			other.ObjectMeta.Name == route.ObjectMeta.Name {
+			continue
+		}
+		if !routeOlderThan(other, route) {
+			continue
+		}
+		if _, ok := appMgr.routeConfigForRoute(other); !ok {
+			// Routes this controller does not handle claim nothing
+			continue
+		}
+		if other.Spec.Path == route.Spec.Path &&
+			sameRuleConditions(other.ObjectMeta.Annotations,
+				route.ObjectMeta.Annotations) {
+			return true, fmt.Sprintf(
+				"Host '%s' and path '%s' are already claimed by Route '%s/%s'.",
+				route.Spec.Host, route.Spec.Path,
+				other.ObjectMeta.Namespace, other.ObjectMeta.Name)
+		}
+		if other.ObjectMeta.Namespace != route.ObjectMeta.Namespace &&
+			!appMgr.namespacesShareHosts(
+				other.ObjectMeta.Namespace, route.ObjectMeta.Namespace) {
+			return true, fmt.Sprintf(
+				"Host '%s' is already claimed by Route '%s/%s' in another namespace.",
+				route.Spec.Host, other.ObjectMeta.Namespace, other.ObjectMeta.Name)
+		}
+	}
+	return false, ""
+}
+
+// Return true if two objects ask for the same rule conditions. Conditions
+// that only differ in their order or JSON formatting are the same.
+func sameRuleConditions(annotations1, annotations2 map[string]string) bool {
+	conds1, err1 := parseRuleConditions(annotations1)
+	conds2, err2 := parseRuleConditions(annotations2)
+	if nil != err1 || nil != err2 {
+		return annotations1[f5VsRuleConditionsAnnotation] ==
+			annotations2[f5VsRuleConditionsAnnotation]
+	}
+	canonical := func(conds []RuleCondition) []string {
+		var keys []string
+		for _, rc := range conds {
+			key, _ := json.Marshal(rc)
+			keys = append(keys, string(key))
+		}
+		sort.Strings(keys)
+		return keys
+	}
+	return reflect.DeepEqual(canonical(conds1), canonical(conds2))
+}
+
+// Remove the policy rules of Routes in a namespace that were deleted,
+// rejected or moved to another shard from the Route virtual servers.
+// Rules are kept for the Routes named in active for each virtual.
+func (appMgr *Manager) pruneRouteRules(
+	namespace string,
+	active map[string]map[string]bool,
+) bool {
+	prefix := fmt.Sprintf("openshift_route_%s_", namespace)
+	appMgr.resources.Lock()
+	defer appMgr.resources.Unlock()
+	var changed bool
+	for _, rsName := range appMgr.routeVirtualNames() {
+		rsCfg, ok := appMgr.resources.GetByName(rsName)
+		if !ok {
+			continue
+		}
+		policy := rsCfg.FindPolicy("forwarding")
+		if nil == policy {
+			continue
+		}
+		var ruleOffsets []int
+		for i, rule := range policy.Rules {
+			// Application root redirects are kept along with their rule
+			ruleName := strings.TrimSuffix(rule.Name, appRootRuleSuffix)
+			if strings.HasPrefix(ruleName, prefix) && !active[rsName][ruleName] {
+				ruleOffsets = append(ruleOffsets, i)
+				// The Route's SSL profiles go along with its rule
+				routeName := strings.TrimPrefix(ruleName, prefix)
+				rsCfg.Virtual.RemoveProfile(makeRouteClientSSLProfileRef(
+					rsCfg.Virtual.Partition, namespace, routeName))
+				rsCfg.Virtual.RemoveProfile(makeRouteServerSSLProfileRef(
+					rsCfg.Virtual.Partition, namespace, routeName))
+			}
+		}
+		if policy.RemoveRules(ruleOffsets) {
+			if 0 == len(policy.Rules) {
+				rsCfg.RemovePolicy(*policy)
+			} else {
+				rsCfg.SetPolicy(*policy)
+			}
+			// Along with the weighted pools of the Routes
+			rsCfg.removeUnusedWeightedPools()
+			changed = true
+		}
+	}
+	return changed
+}
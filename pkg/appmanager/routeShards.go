@@ -0,0 +1,168 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	"fmt"
+	"regexp"
+
+	log "github.com/F5Networks/k8s-bigip-ctlr/pkg/vlogger"
+
+	routeapi "github.com/openshift/origin/pkg/route/api"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// A set of Routes served by its own pair of virtual servers. Routes are
+// matched by their labels and the labels of their namespace; an empty
+// selector matches everything.
+type RouteShard struct {
+	Name           string `json:"name"`
+	RouteLabel     string `json:"routeLabel,omitempty"`
+	NamespaceLabel string `json:"namespaceLabel,omitempty"`
+	RouteVSAddr    string `json:"vserverAddr,omitempty"`
+	HttpVs         string `json:"httpVserver"`
+	HttpsVs        string `json:"httpsVserver"`
+	ClientSSL      string `json:"clientSSL,omitempty"`
+	ServerSSL      string `json:"serverSSL,omitempty"`
+}
+
+// Separates the name of a Route data group or iRule from its shard
+const shardNameSep = "_shard_"
+
+// Shard names become part of the names of BIG-IP data groups and iRules
+var shardNameRegexp = regexp.MustCompile("^[A-Za-z0-9_.-]+$")
+
+// Return the name of a Route data group or iRule of a shard. Those of the
+// default virtual servers keep their plain names.
+func formatShardName(name, shard string) string {
+	if shard == "" {
+		return name
+	}
+	return name + shardNameSep + shard
+}
+
+// Check that a shard definition is complete and its selectors parse
+func (shard RouteShard) Validate() error {
+	if shard.Name == "" {
+		return fmt.Errorf("Route shard must have a name")
+	}
+	if !shardNameRegexp.MatchString(shard.Name) {
+		return fmt.Errorf("Route shard name '%s' may only contain letters, "+
+			"digits, '.', '_' and '-'", shard.Name)
+	}
+	if shard.HttpVs == "" || shard.HttpsVs == "" {
+		return fmt.Errorf("Route shard '%s' must name its http and https "+
+			"virtual servers", shard.Name)
+	}
+	if shard.RouteVSAddr == "" {
+		return fmt.Errorf("Route shard '%s' must have a virtual server address",
+			shard.Name)
+	}
+	if _, err := labels.Parse(shard.RouteLabel); nil != err {
+		return fmt.Errorf("Route shard '%s' has an invalid route label: %v",
+			shard.Name, err)
+	}
+	if _, err := labels.Parse(shard.NamespaceLabel); nil != err {
+		return fmt.Errorf("Route shard '%s' has an invalid namespace label: %v",
+			shard.Name, err)
+	}
+	return nil
+}
+
+// Return true if the Route belongs to the shard
+func (appMgr *Manager) routeInShard(route *routeapi.Route, shard RouteShard) bool {
+	routeSel, err := labels.Parse(shard.RouteLabel)
+	if nil != err {
+		log.Errorf("Invalid route label for Route shard '%s': %v", shard.Name, err)
+		return false
+	}
+	if !routeSel.Matches(labels.Set(route.ObjectMeta.Labels)) {
+		return false
+	}
+	if shard.NamespaceLabel == "" {
+		return true
+	}
+	nsSel, err := labels.Parse(shard.NamespaceLabel)
+	if nil != err {
+		log.Errorf("Invalid namespace label for Route shard '%s': %v",
+			shard.Name, err)
+		return false
+	}
+	nsLabels, err := appMgr.getNamespaceLabels(route.ObjectMeta.Namespace)
+	if nil != err {
+		log.Warningf("Unable to get labels for namespace '%s': %v",
+			route.ObjectMeta.Namespace, err)
+		return false
+	}
+	return nsSel.Matches(nsLabels)
+}
+
+// Return the Route configuration for the shard a Route belongs to. Routes
+// that are in no shard use the default virtual servers; false is returned
+// if the Route is not handled by this controller at all.
+func (appMgr *Manager) routeConfigForRoute(route *routeapi.Route) (RouteConfig, bool) {
+	rc := appMgr.routeConfig
+	for _, shard := range rc.Shards {
+		if appMgr.routeInShard(route, shard) {
+			rc.RouteVSAddr = shard.RouteVSAddr
+			rc.HttpVs = shard.HttpVs
+			rc.HttpsVs = shard.HttpsVs
+			rc.ClientSSL = shard.ClientSSL
+			rc.ServerSSL = shard.ServerSSL
+			rc.Shard = shard.Name
+			return rc, true
+		}
+	}
+	if len(rc.Shards) > 0 && rc.RouteLabel != "" {
+		// The Route informer watches all Routes when there are shards,
+		// so the label for the default virtual servers is checked here.
+		sel, err := labels.Parse(rc.RouteLabel)
+		if nil != err || !sel.Matches(labels.Set(route.ObjectMeta.Labels)) {
+			return rc, false
+		}
+	}
+	return rc, true
+}
+
+// Return the names of the shards, along with the empty name of the default
+// virtual servers
+func (appMgr *Manager) routeShardNames() []string {
+	names := []string{""}
+	for _, shard := range appMgr.routeConfig.Shards {
+		names = append(names, shard.Name)
+	}
+	return names
+}
+
+// Return the names of all virtual servers used for Routes
+func (appMgr *Manager) routeVirtualNames() []string {
+	names := []string{appMgr.routeConfig.HttpVs, appMgr.routeConfig.HttpsVs}
+	for _, shard := range appMgr.routeConfig.Shards {
+		names = append(names, shard.HttpVs, shard.HttpsVs)
+	}
+	// Along with their copies in the other partitions
+	defaultNames := names
+	for _, partition := range appMgr.partitions {
+		if partition == DEFAULT_PARTITION {
+			continue
+		}
+		for _, name := range defaultNames {
+			names = append(names, formatPartitionVSName(name, partition))
+		}
+	}
+	return names
+}
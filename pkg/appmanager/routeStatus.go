@@ -0,0 +1,167 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	"fmt"
+
+	log "github.com/F5Networks/k8s-bigip-ctlr/pkg/vlogger"
+
+	routeapi "github.com/openshift/origin/pkg/route/api"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+	kapi "k8s.io/kubernetes/pkg/api"
+)
+
+// Router name written to Route status when none is configured
+const DEFAULT_ROUTER_NAME = "f5-bigip-ctlr"
+
+// Reasons reported in the Admitted condition of a Route
+const (
+	routeReasonRuleFailed      = "RuleCreationFailed"
+	routeReasonServiceNotFound = "ServiceNotFound"
+	routeReasonHostClaimed     = "HostAlreadyClaimed"
+)
+
+// Result of processing a Route, written back to its status
+type routeAdmission struct {
+	admitted bool
+	reason   string
+	message  string
+}
+
+// Mark a Route as rejected; the first rejection is the one reported
+func (ra *routeAdmission) reject(reason, message string) {
+	if !ra.admitted {
+		return
+	}
+	ra.admitted = false
+	ra.reason = reason
+	ra.message = message
+}
+
+// Return the names of the Route's services that do not exist
+func missingRouteServices(route *routeapi.Route, appInf *appInformer) []string {
+	var missing []string
+	for _, name := range getRouteServiceNames(route) {
+		key := route.ObjectMeta.Namespace + "/" + name
+		_, found, _ := appInf.svcInformer.GetIndexer().GetByKey(key)
+		if !found {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+// Write the admission result for this controller into the Route status.
+// Other routers' entries are left untouched, and nothing is written if
+// the status has not changed. Returns true if a changed status was written,
+// and an error if it could not be.
+func (appMgr *Manager) setRouteStatus(
+	route *routeapi.Route,
+	admission routeAdmission,
+) (bool, error) {
+	if nil == appMgr.routeClientV1 {
+		return false, nil
+	}
+	routerName := appMgr.routeConfig.RouterName
+	if routerName == "" {
+		routerName = DEFAULT_ROUTER_NAME
+	}
+
+	status := kapi.ConditionTrue
+	if !admission.admitted {
+		status = kapi.ConditionFalse
+	}
+	cond := routeapi.RouteIngressCondition{
+		Type:    routeapi.RouteAdmitted,
+		Status:  status,
+		Reason:  admission.reason,
+		Message: admission.message,
+	}
+
+	now := metav1.Now()
+	cond.LastTransitionTime = &now
+	idx := -1
+	for i, ingress := range route.Status.Ingress {
+		if ingress.RouterName == routerName {
+			idx = i
+			break
+		}
+	}
+	if idx >= 0 {
+		current := route.Status.Ingress[idx]
+		if current.Host == route.Spec.Host &&
+			current.WildcardPolicy == route.Spec.WildcardPolicy &&
+			len(current.Conditions) == 1 &&
+			current.Conditions[0].Type == cond.Type &&
+			current.Conditions[0].Status == cond.Status &&
+			current.Conditions[0].Reason == cond.Reason &&
+			current.Conditions[0].Message == cond.Message {
+			return false, nil
+		}
+		// The transition time only moves when the Admitted status does
+		for _, c := range current.Conditions {
+			if c.Type == cond.Type && c.Status == cond.Status &&
+				nil != c.LastTransitionTime {
+				cond.LastTransitionTime = c.LastTransitionTime
+			}
+		}
+	}
+
+	ingress := routeapi.RouteIngress{
+		Host:           route.Spec.Host,
+		RouterName:     routerName,
+		Conditions:     []routeapi.RouteIngressCondition{cond},
+		WildcardPolicy: route.Spec.WildcardPolicy,
+	}
+	// The Route is the one in the informer cache, which only changes once
+	// the status is written, so the status is set on a copy
+	updated := *route
+	updated.Status.Ingress = make([]routeapi.RouteIngress,
+		len(route.Status.Ingress))
+	copy(updated.Status.Ingress, route.Status.Ingress)
+	if idx >= 0 {
+		updated.Status.Ingress[idx] = ingress
+	} else {
+		updated.Status.Ingress = append(updated.Status.Ingress, ingress)
+	}
+
+	err := appMgr.routeClientV1.Put().
+		Namespace(route.ObjectMeta.Namespace).
+		Resource("routes").
+		Name(route.ObjectMeta.Name).
+		SubResource("status").
+		Body(&updated).
+		Do().
+		Error()
+	if nil != err {
+		// Several services may sync the same Route at once. The sync is
+		// retried without a warning; the cache has the newer Route by then.
+		if !apierrors.IsConflict(err) {
+			warning := fmt.Sprintf(
+				"Error when setting status for Route '%s/%s': %v",
+				route.ObjectMeta.Namespace, route.ObjectMeta.Name, err)
+			log.Warning(warning)
+			appMgr.recordEvent(route, route.ObjectMeta.Namespace,
+				v1.EventTypeWarning, "StatusError", warning)
+		}
+		return false, err
+	}
+	return true, nil
+}
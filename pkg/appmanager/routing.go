@@ -24,7 +24,6 @@ import (
 	"sort"
 	"strconv"
 	"strings"
-	"sync"
 
 	log "github.com/F5Networks/k8s-bigip-ctlr/pkg/vlogger"
 
@@ -63,9 +62,16 @@ var groupFlattenFuncMap = map[string]FlattenConflictFunc{
 	abDeploymentDgName:       flattenConflictConcat,
 }
 
-func (r Rules) Len() int           { return len(r) }
-func (r Rules) Less(i, j int) bool { return r[i].FullURI < r[j].FullURI }
-func (r Rules) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r Rules) Len() int      { return len(r) }
+func (r Rules) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+
+func (r Rules) Less(i, j int) bool {
+	// Rules for the same URI with more conditions are more specific
+	if r[i].FullURI == r[j].FullURI {
+		return len(r[i].Conditions) < len(r[j].Conditions)
+	}
+	return r[i].FullURI < r[j].FullURI
+}
 
 type Routes []*routeapi.Route
 
@@ -158,17 +164,20 @@ func createPolicy(rls Rules, policyName, partition string) *Policy {
 func processIngressRules(
 	ing *v1beta1.IngressSpec,
 	pools []Pool,
+	weighted map[string]string,
 	partition string,
+	pathType string,
+	conds []RuleCondition,
+	acts []RuleActions,
+	protocol string,
 ) *Rules {
-	var err error
-	var uri, poolName string
-	var rl *Rule
-	rlMap := make(ruleMap)
-	wildcards := make(ruleMap)
+	rls := Rules{}
+	// A host and path with a weighted pool has a single rule
+	weightedDone := make(map[string]bool)
 	for _, rule := range ing.Rules {
 		if nil != rule.IngressRuleValue.HTTP {
 			for _, path := range rule.IngressRuleValue.HTTP.Paths {
-				uri = rule.Host + path.Path
+				var poolName string
 				for _, pool := range pools {
 					if path.Backend.ServiceName == pool.ServiceName {
 						poolName = pool.Name
@@ -177,57 +186,48 @@ func processIngressRules(
 				if poolName == "" {
 					continue
 				}
+				if name, ok := weighted[rule.Host+path.Path]; ok {
+					if weightedDone[rule.Host+path.Path] {
+						continue
+					}
+					weightedDone[rule.Host+path.Path] = true
+					poolName = name
+				}
 				ruleName := formatIngressRuleName(rule.Host, path.Path, poolName)
-				// This blank name gets overridden by an ordinal later on
-				rl, err = createRule(uri, poolName, partition, ruleName)
+				rl, err := createIngressRule(rule.Host, path.Path, poolName,
+					partition, ruleName, pathType)
 				if nil != err {
 					log.Warningf("Error configuring rule: %v", err)
 					return nil
 				}
-				if true == strings.HasPrefix(uri, "*.") {
-					wildcards[uri] = rl
-				} else {
-					rlMap[uri] = rl
+				addRuleConditions(rl, conds)
+				appRoot := applyRuleActions(rl, rule.Host, path.Path, acts, protocol)
+				rls = append(rls, rl)
+				if nil != appRoot {
+					rls = append(rls, appRoot)
+				}
+				if pathType == pathTypePrefix {
+					if sub := createSubPathRule(rl); nil != sub {
+						rls = append(rls, sub)
+					}
 				}
-				poolName = ""
 			}
 		}
 	}
-	var wg sync.WaitGroup
-	wg.Add(2)
-	sortrules := func(r ruleMap, rls *Rules, ordinal int) {
-		for _, v := range r {
-			*rls = append(*rls, v)
-		}
-		sort.Sort(sort.Reverse(*rls))
-		for _, v := range *rls {
-			v.Ordinal = ordinal
-			ordinal++
-		}
-		wg.Done()
-	}
-	rls := Rules{}
-	go sortrules(rlMap, &rls, 0)
-
-	w := Rules{}
-	go sortrules(wildcards, &w, len(rlMap))
-
-	wg.Wait()
-
-	rls = append(rls, w...)
+	orderIngressRules(rls)
 	return &rls
 }
 
-func httpRedirectIRule(port int32) string {
+func httpRedirectIRule(port int32, dgName string) string {
 	// The key in the data group is the host name or * to match all.
 	// The data is a list of paths for the host delimited by '|' or '/' for all.
 	iRuleCode := fmt.Sprintf(`
 		when HTTP_REQUEST {
 			# Look for exact match for host name
-			set paths [class match -value [HTTP::host] equals https_redirect_dg]
+			set paths [class match -value [HTTP::host] equals %[2]s]
 			if {$paths == ""} {
 				# See if there's an entry that matches all hosts
-				set paths [class match -value "*" equals https_redirect_dg]
+				set paths [class match -value "*" equals %[2]s]
 			}
 			if {$paths != ""} {
 				set redir 0
@@ -240,30 +240,43 @@ func httpRedirectIRule(port int32) string {
 					}
 				}
 				if {$redir == 1} {
-					HTTP::redirect https://[getfield [HTTP::host] ":" 1]:%d[HTTP::uri]
+					HTTP::redirect https://[getfield [HTTP::host] ":" 1]:%[1]d[HTTP::uri]
 				}
 			}
-		}`, port)
+		}`, port, dgName)
 
 	return iRuleCode
 }
 
-func selectPoolIRuleFunc() string {
+func selectPoolIRuleFunc(partition, shard string) string {
 	iRuleFunc := fmt.Sprintf(`
-		proc select_ab_pool {path default_pool } {
+		proc find_ab_rule {path} {
 			set last_slash [string length $path]
-			set ab_class "/%s/ab_deployment_dg"
+			set ab_class "/%s/%s"
 			while {$last_slash >= 0} {
 				if {[class match $path equals $ab_class]} then {
-					break
+					return [list $path [class match -value $path equals $ab_class]]
 				}
 				set last_slash [string last "/" $path $last_slash]
 				incr last_slash -1
 				set path [string range $path 0 $last_slash]
 			}
+			return ""
+		}
+
+		proc ab_pool_active {ab_rule pool_name} {
+			foreach service_rule [split $ab_rule ";"] {
+				if {[lindex [split $service_rule ","] 0] eq $pool_name} then {
+					return 1
+				}
+			}
+			return 0
+		}
 
-			if {$last_slash >= 0} {
-				set ab_rule [class match -value $path equals $ab_class]
+		proc select_ab_pool {path default_pool } {
+			set ab_match [call find_ab_rule $path]
+			if {$ab_match != ""} then {
+				set ab_rule [lindex $ab_match 1]
 				if {$ab_rule != ""} then {
 					set weight_selection [expr {rand()}]
 					set service_rules [split $ab_rule ";"]
@@ -281,32 +294,56 @@ func selectPoolIRuleFunc() string {
 				HTTP::respond 503
 			}
 			return $default_pool
-		}`, DEFAULT_PARTITION)
+		}`, partition, formatShardName(abDeploymentDgName, shard))
 
 	return iRuleFunc
 }
 
-func abDeploymentPathIRule() string {
+func abDeploymentPathIRule(partition, shard string) string {
 	// For all A/B deployments that include a path.
 	// The key in the data group is the specific route (host/path) to examine.
 	// The data is a list of pool/weight pairs delimited by ';'. The pair values
 	// are delineated by ','. Finally, the weight value is normalized between
 	// 0.0 and 1.0 and the pairs should be listed in ascending order or weight
 	// values.
-	iRuleCode := fmt.Sprintf("%s\n\n%s", selectPoolIRuleFunc(), `
+	// A cookie named after the route keeps each client on the pool it was
+	// sent to first, for as long as that pool has a weight.
+	iRuleCode := fmt.Sprintf("%s\n\n%s", selectPoolIRuleFunc(partition, shard), `
 		when HTTP_REQUEST priority 200 {
 			set path [string tolower [HTTP::host]][HTTP::path]
+			set ab_cookie ""
+			# A keep-alive connection keeps the pool of its last request
+			unset -nocomplain ab_pool
+			set ab_match [call find_ab_rule $path]
+			if {$ab_match != ""} then {
+				set ab_cookie "BIGIP_AB_[crc32 [lindex $ab_match 0]]"
+				set sticky_pool [HTTP::cookie value $ab_cookie]
+				if {$sticky_pool != "" &&
+					[call ab_pool_active [lindex $ab_match 1] $sticky_pool]} then {
+					set ab_cookie ""
+					pool $sticky_pool
+					event disable
+					return
+				}
+			}
 			set selected_pool [call select_ab_pool $path ""]
 			if {$selected_pool != ""} then {
+				set ab_pool $selected_pool
 				pool $selected_pool
 				event disable
 			}
+		}
+
+		when HTTP_RESPONSE priority 200 {
+			if {$ab_cookie != "" && [info exists ab_pool]} then {
+				HTTP::cookie insert name $ab_cookie value $ab_pool path "/"
+			}
 		}`)
 
 	return iRuleCode
 }
 
-func sslPassthroughIRule() string {
+func sslPassthroughIRule(partition, shard string) string {
 	iRule := fmt.Sprintf(`
 		when CLIENT_ACCEPTED {
 			TCP::collect
@@ -390,8 +427,8 @@ func sslPassthroughIRule() string {
 								set servername_lower [string tolower $tls_servername]
 								SSL::disable serverside
 								set dflt_pool ""
-								set passthru_class "/%[1]s/ssl_passthrough_servername_dg"
-								set reencrypt_class "/%[1]s/ssl_reencrypt_servername_dg"
+								set passthru_class "/%[1]s/%[2]s"
+								set reencrypt_class "/%[1]s/%[3]s"
 								if { [class exists $passthru_class] } {
 									set dflt_pool [class match -value $servername_lower equals $passthru_class]
 									if { not ($dflt_pool equals "") } {
@@ -405,7 +442,7 @@ func sslPassthroughIRule() string {
 										SSL::enable serverside
 									}
 								}
-								set ab_class "/%[1]s/ab_deployment_dg"
+								set ab_class "/%[1]s/%[4]s"
 								if { not [class exists $ab_class] } {
 									if { $dflt_pool == "" } then {
 										log local0.debug "Failed to find pool for $servername_lower"
@@ -430,16 +467,20 @@ func sslPassthroughIRule() string {
 		}
 
 		when SERVER_CONNECTED {
-			set svrssl_class "/%[1]s/ssl_reencrypt_serverssl_dg"
+			set svrssl_class "/%[1]s/%[5]s"
 			if { [class exists $svrssl_class] } {
 				set profile [class match -value $servername_lower equals $svrssl_class]
 				if { not ($profile equals "") } {
 					SSL::profile $profile
 				}
 			}
-		}`, DEFAULT_PARTITION)
+		}`, partition,
+		formatShardName(passthroughHostsDgName, shard),
+		formatShardName(reencryptHostsDgName, shard),
+		formatShardName(abDeploymentDgName, shard),
+		formatShardName(reencryptServerSslDgName, shard))
 
-	iRuleCode := fmt.Sprintf("%s\n\n%s", selectPoolIRuleFunc(), iRule)
+	iRuleCode := fmt.Sprintf("%s\n\n%s", selectPoolIRuleFunc(partition, shard), iRule)
 
 	return iRuleCode
 }
@@ -483,13 +524,14 @@ func (appMgr *Manager) updatePassthroughRouteDataGroups(
 func updateDataGroupForPassthroughRoute(
 	route *routeapi.Route,
 	partition string,
+	shard string,
 	namespace string,
 	dgMap InternalDataGroupMap,
 ) {
 	hostName := route.Spec.Host
 	svcName := getRouteCanonicalServiceName(route)
 	poolName := formatRoutePoolName(route.ObjectMeta.Namespace, svcName)
-	updateDataGroup(dgMap, passthroughHostsDgName,
+	updateDataGroup(dgMap, formatShardName(passthroughHostsDgName, shard),
 		partition, namespace, hostName, poolName)
 }
 
@@ -497,26 +539,30 @@ func updateDataGroupForPassthroughRoute(
 func updateDataGroupForReencryptRoute(
 	route *routeapi.Route,
 	partition string,
+	shard string,
 	namespace string,
 	dgMap InternalDataGroupMap,
 ) {
 	hostName := route.Spec.Host
 	svcName := getRouteCanonicalServiceName(route)
 	poolName := formatRoutePoolName(route.ObjectMeta.Namespace, svcName)
-	updateDataGroup(dgMap, reencryptHostsDgName,
+	updateDataGroup(dgMap, formatShardName(reencryptHostsDgName, shard),
 		partition, namespace, hostName, poolName)
 }
 
 // Update a data group map based on a alternativeBackends route object.
-// (ignore an service with a 0 weight value)
+// (ignore an service with a 0 weight value). Routes split by a weighted
+// pool (ratioAB) need no entries.
 func updateDataGroupForABRoute(
 	route *routeapi.Route,
 	svcName string,
 	partition string,
+	shard string,
 	namespace string,
+	ratioAB bool,
 	dgMap InternalDataGroupMap,
 ) {
-	if !isRouteABDeployment(route) {
+	if !isRouteABDeployment(route) || ratioAB {
 		return
 	}
 
@@ -538,12 +584,13 @@ func updateDataGroupForABRoute(
 		}
 	}
 	key := route.Spec.Host + path
+	dgName := formatShardName(abDeploymentDgName, shard)
 
 	if weightTotal == 0 {
 		// If all services have 0 weight, openshift requires a 503 to be returned
 		// (see https://docs.openshift.com/container-platform/3.6/architecture
 		//  /networking/routes.html#alternateBackends)
-		updateDataGroup(dgMap, abDeploymentDgName, partition, namespace, key, "")
+		updateDataGroup(dgMap, dgName, partition, namespace, key, "")
 	} else {
 		// Place each service in a segment between 0.0 and 1.0 that corresponds to
 		// it's ratio percentage.  The order does not matter in regards to which
@@ -561,8 +608,7 @@ func updateDataGroupForABRoute(
 			entries = append(entries, entry)
 		}
 		value := strings.Join(entries, ";")
-		updateDataGroup(dgMap, abDeploymentDgName,
-			partition, namespace, key, value)
+		updateDataGroup(dgMap, dgName, partition, namespace, key, value)
 	}
 }
 
@@ -640,53 +686,56 @@ func (appMgr *Manager) syncDataGroups(
 
 // Finds which IRules have no data groups for them
 func (appMgr *Manager) syncIRules() {
-	// Verify which data groups are still in use
-	type iruleRef struct {
-		https       bool
-		ab          bool
-		passthrough bool
-		reencrypt   bool
-	}
-	var iRef iruleRef
+	// Verify which data groups are still in use, in each partition
+	inUse := make(map[nameRef]bool)
 	for mapKey, _ := range appMgr.intDgMap {
-		switch mapKey.Name {
-		case httpsRedirectDgName:
-			iRef.https = true
-		case abDeploymentDgName:
-			iRef.ab = true
-		case passthroughHostsDgName:
-			iRef.passthrough = true
-		case reencryptHostsDgName:
-			iRef.reencrypt = true
-		case reencryptServerSslDgName:
-			iRef.reencrypt = true
+		inUse[mapKey] = true
+	}
+	used := func(partition, shard string, dgNames ...string) bool {
+		for _, dgName := range dgNames {
+			key := nameRef{
+				Name:      formatShardName(dgName, shard),
+				Partition: partition,
+			}
+			if inUse[key] {
+				return true
+			}
 		}
+		return false
 	}
 	// Delete any IRules for datagroups that are gone
-	if !iRef.https {
-		// http redirect rule may have a port appended, so find it
-		for irule, _ := range appMgr.irulesMap {
-			if strings.HasPrefix(irule.Name, httpRedirectIRuleName) {
-				appMgr.deleteIRule(irule.Name)
+	for irule, _ := range appMgr.irulesMap {
+		unused := false
+		if strings.HasPrefix(irule.Name, httpRedirectIRuleName) {
+			// http redirect rule may have a port appended
+			unused = !used(irule.Partition, "", httpsRedirectDgName)
+		}
+		// The iRules of the Route shards use the data groups of their shard
+		for _, shard := range appMgr.routeShardNames() {
+			switch irule.Name {
+			case formatShardName(httpRedirectIRuleName, shard):
+				unused = !used(irule.Partition, shard, httpsRedirectDgName)
+			case formatShardName(abDeploymentPathIRuleName, shard):
+				unused = !used(irule.Partition, shard, abDeploymentDgName)
+			case formatShardName(sslPassthroughIRuleName, shard):
+				unused = !used(irule.Partition, shard, passthroughHostsDgName,
+					reencryptHostsDgName, reencryptServerSslDgName)
 			}
 		}
-	}
-	if !iRef.ab {
-		appMgr.deleteIRule(abDeploymentPathIRuleName)
-	}
-	if !iRef.passthrough && !iRef.reencrypt {
-		appMgr.deleteIRule(sslPassthroughIRuleName)
+		if unused {
+			appMgr.deleteIRule(irule.Name, irule.Partition)
+		}
 	}
 }
 
 // Deletes an IRule from the IRules map, and dereferences it from a Virtual
-func (appMgr *Manager) deleteIRule(rule string) {
+func (appMgr *Manager) deleteIRule(rule, partition string) {
 	ref := nameRef{
 		Name:      rule,
-		Partition: DEFAULT_PARTITION,
+		Partition: partition,
 	}
 	delete(appMgr.irulesMap, ref)
-	fullName := joinBigipPath(DEFAULT_PARTITION, rule)
+	fullName := joinBigipPath(partition, rule)
 	for _, cfg := range appMgr.resources.GetAllResources() {
 		if cfg.MetaData.ResourceType == "configmap" ||
 			cfg.MetaData.ResourceType == "iapp" {
@@ -735,6 +784,41 @@ type HostFwdRuleMap map[string]FwdRuleMap
 // key is path regex, data unused. Using a map as go doesn't have a set type.
 type FwdRuleMap map[string]bool
 
+// key is an https redirect data group, data is the rules of the data group.
+type PartitionFwdRuleMap map[nameRef]ServiceFwdRuleMap
+
+// Return the rules of the https redirect data group of a partition and
+// Route shard, adding them if the data group has none
+func (pfrm PartitionFwdRuleMap) ForPartition(
+	partition string,
+	shard string,
+) ServiceFwdRuleMap {
+	key := nameRef{
+		Name:      formatShardName(httpsRedirectDgName, shard),
+		Partition: partition,
+	}
+	sfrm, found := pfrm[key]
+	if !found {
+		sfrm = NewServiceFwdRuleMap()
+		pfrm[key] = sfrm
+	}
+	return sfrm
+}
+
+// Add the rules of each https redirect data group to it
+func (pfrm PartitionFwdRuleMap) AddToDataGroups(dgMap InternalDataGroupMap) {
+	for httpsRedirectDg, sfrm := range pfrm {
+		if len(sfrm) == 0 {
+			continue
+		}
+		if _, found := dgMap[httpsRedirectDg]; !found {
+			dgMap[httpsRedirectDg] = make(DataGroupNamespaceMap)
+		}
+		sfrm.AddToDataGroup(dgMap[httpsRedirectDg], httpsRedirectDg.Name,
+			httpsRedirectDg.Partition)
+	}
+}
+
 func (sfrm ServiceFwdRuleMap) AddEntry(ns, svc, host, path string) {
 	if path == "" {
 		path = "/"
@@ -755,14 +839,18 @@ func (sfrm ServiceFwdRuleMap) AddEntry(ns, svc, host, path string) {
 	}
 }
 
-func (sfrm ServiceFwdRuleMap) AddToDataGroup(dgMap DataGroupNamespaceMap) {
+func (sfrm ServiceFwdRuleMap) AddToDataGroup(
+	dgMap DataGroupNamespaceMap,
+	name string,
+	partition string,
+) {
 	// Multiple service keys may reference the same host, so flatten those first
 	for skey, hostMap := range sfrm {
 		nsGrp, found := dgMap[skey.Namespace]
 		if !found {
 			nsGrp = &InternalDataGroup{
-				Name:      httpsRedirectDgName,
-				Partition: DEFAULT_PARTITION,
+				Name:      name,
+				Partition: partition,
 			}
 			dgMap[skey.Namespace] = nsGrp
 		}
@@ -785,6 +873,24 @@ func (sfrm ServiceFwdRuleMap) AddToDataGroup(dgMap DataGroupNamespaceMap) {
 	}
 }
 
+// Return the conflict handler for a data group, including the data groups
+// of Route shards and the per virtual source range data groups
+func dataGroupFlattenFunc(name string) (FlattenConflictFunc, bool) {
+	if conflictFunc, ok := groupFlattenFuncMap[name]; ok {
+		return conflictFunc, true
+	}
+	if strings.HasSuffix(name, sourceRangeDgSuffix) {
+		// One source range data group per virtual
+		return flattenConflictWarn, true
+	}
+	for dgName, conflictFunc := range groupFlattenFuncMap {
+		if strings.HasPrefix(name, dgName+shardNameSep) {
+			return conflictFunc, true
+		}
+	}
+	return nil, false
+}
+
 func flattenConflictWarn(key, oldVal, newVal string) string {
 	fmt.Printf("Found mismatch for key '%v' old value: '%v' new value: '%v'\n", key, oldVal, newVal)
 	return oldVal
@@ -848,7 +954,7 @@ func (dgnm DataGroupNamespaceMap) FlattenNamespaces() *InternalDataGroup {
 			item, found := flatMap[rec.Name]
 			if found {
 				if item != rec.Data {
-					conflictFunc, ok := groupFlattenFuncMap[dg.Name]
+					conflictFunc, ok := dataGroupFlattenFunc(dg.Name)
 					if !ok {
 						log.Warningf("No DataGroup conflict handler defined for '%v'",
 							dg.Name)
@@ -0,0 +1,279 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Operations on request and response headers
+const (
+	headerInsert  = "insert"
+	headerReplace = "replace"
+	headerRemove  = "remove"
+)
+
+// Suffix of the name of the rule that redirects / to the application root
+const appRootRuleSuffix = "_app_root"
+
+// A header to insert, replace or remove
+type HeaderAction struct {
+	Action string `json:"action"`
+	Name   string `json:"name"`
+	Value  string `json:"value,omitempty"`
+}
+
+// Extra actions for the policy rules of an Ingress or Route, taken from the
+// rule-actions annotation. Host and Path select the Ingress paths they apply
+// to; empty values match every host or path.
+type RuleActions struct {
+	Host            string         `json:"host,omitempty"`
+	Path            string         `json:"path,omitempty"`
+	RewritePath     string         `json:"rewritePath,omitempty"`
+	HostHeader      string         `json:"hostHeader,omitempty"`
+	AppRoot         string         `json:"appRoot,omitempty"`
+	RequestHeaders  []HeaderAction `json:"requestHeaders,omitempty"`
+	ResponseHeaders []HeaderAction `json:"responseHeaders,omitempty"`
+	XForwardedFor   bool           `json:"xForwardedFor,omitempty"`
+	XForwardedProto bool           `json:"xForwardedProto,omitempty"`
+}
+
+// Check that a header action is complete
+func (ha HeaderAction) Validate() error {
+	switch ha.Action {
+	case headerInsert, headerReplace:
+		if ha.Value == "" {
+			return fmt.Errorf("header action %s must have a value", ha.Action)
+		}
+	case headerRemove:
+	default:
+		return fmt.Errorf("unknown header action '%s'", ha.Action)
+	}
+	if ha.Name == "" {
+		return fmt.Errorf("header action %s must have a name", ha.Action)
+	}
+	return nil
+}
+
+// Check that the rule actions can be expressed on the BIG-IP
+func (ra RuleActions) Validate() error {
+	if ra.RewritePath != "" && !strings.HasPrefix(ra.RewritePath, "/") {
+		return fmt.Errorf("rewritePath '%s' must start with /", ra.RewritePath)
+	}
+	if ra.AppRoot != "" && !strings.HasPrefix(ra.AppRoot, "/") {
+		return fmt.Errorf("appRoot '%s' must start with /", ra.AppRoot)
+	}
+	for _, ha := range append(ra.RequestHeaders, ra.ResponseHeaders...) {
+		if err := ha.Validate(); nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+// Parse the rule-actions annotation of an Ingress or Route
+func parseRuleActions(annotations map[string]string) ([]RuleActions, error) {
+	val, ok := annotations[f5VsRuleActionsAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	var acts []RuleActions
+	if err := json.Unmarshal([]byte(val), &acts); nil != err {
+		return nil, fmt.Errorf("invalid %s annotation: %v",
+			f5VsRuleActionsAnnotation, err)
+	}
+	for _, ra := range acts {
+		if err := ra.Validate(); nil != err {
+			return nil, fmt.Errorf("invalid %s annotation: %v",
+				f5VsRuleActionsAnnotation, err)
+		}
+	}
+	return acts, nil
+}
+
+// Return the first rule actions for a host and path
+func findRuleActions(acts []RuleActions, host, path string) *RuleActions {
+	for i, ra := range acts {
+		if (ra.Host == "" || ra.Host == host) && (ra.Path == "" || ra.Path == path) {
+			return &acts[i]
+		}
+	}
+	return nil
+}
+
+// Return the Tcl expression that replaces the prefix of the request path
+func rewritePathExpr(prefix, rewrite string) string {
+	pattern := "^" + regexp.QuoteMeta(strings.TrimSuffix(prefix, "/"))
+	if strings.HasSuffix(rewrite, "/") {
+		// Avoid a double slash when rewriting to a directory
+		pattern += "/?"
+	}
+	return fmt.Sprintf("tcl:[regsub {%s} [HTTP::path] {%s}]", pattern, rewrite)
+}
+
+// Return the policy actions for a header action
+func headerPolicyAction(ha HeaderAction, response bool) *action {
+	a := action{
+		HTTPHeader: true,
+		TmName:     ha.Name,
+		Value:      ha.Value,
+	}
+	if response {
+		a.Response = true
+	} else {
+		a.Request = true
+	}
+	switch ha.Action {
+	case headerInsert:
+		a.Insert = true
+	case headerReplace:
+		a.Replace = true
+	case headerRemove:
+		a.Remove = true
+		a.Value = ""
+	}
+	return &a
+}
+
+// Add the rule actions to a policy rule after its forward action. The
+// protocol of the virtual server sets X-Forwarded-Proto.
+func addRuleActions(rl *Rule, path string, ra *RuleActions, protocol string) {
+	var acts []*action
+	if ra.RewritePath != "" && path != "" {
+		acts = append(acts, &action{
+			HTTPURI: true,
+			Replace: true,
+			Path:    rewritePathExpr(path, ra.RewritePath),
+			Request: true,
+		})
+	}
+	if ra.HostHeader != "" {
+		acts = append(acts, &action{
+			HTTPHost: true,
+			Replace:  true,
+			Value:    ra.HostHeader,
+			Request:  true,
+		})
+	}
+	if ra.XForwardedFor {
+		acts = append(acts, headerPolicyAction(HeaderAction{
+			Action: headerInsert,
+			Name:   "X-Forwarded-For",
+			Value:  "tcl:[IP::client_addr]",
+		}, false))
+	}
+	if ra.XForwardedProto {
+		acts = append(acts, headerPolicyAction(HeaderAction{
+			Action: headerReplace,
+			Name:   "X-Forwarded-Proto",
+			Value:  protocol,
+		}, false))
+	}
+	for _, ha := range ra.RequestHeaders {
+		acts = append(acts, headerPolicyAction(ha, false))
+	}
+	for _, ha := range ra.ResponseHeaders {
+		acts = append(acts, headerPolicyAction(ha, true))
+	}
+	for _, a := range acts {
+		a.Name = strconv.Itoa(len(rl.Actions))
+		rl.Actions = append(rl.Actions, a)
+	}
+}
+
+// Create the rule that redirects requests for / on the host of a rule to
+// the application root
+func createAppRootRule(rl *Rule, host, appRoot string) *Rule {
+	var c []*condition
+	for _, cond := range rl.Conditions {
+		if cond.HTTPHost {
+			c = append(c, cond)
+		}
+	}
+	c = append(c, &condition{
+		Name:    strconv.Itoa(len(c)),
+		Equals:  true,
+		HTTPURI: true,
+		Path:    true,
+		Request: true,
+		Values:  []string{"/"},
+	})
+	return &Rule{
+		Name:    rl.Name + appRootRuleSuffix,
+		FullURI: host + "/",
+		Actions: []*action{{
+			Name:      "0",
+			HttpReply: true,
+			Redirect:  true,
+			Location:  appRoot,
+			Request:   true,
+		}},
+		Conditions: c,
+	}
+}
+
+// Apply the rule actions for a host and path to a rule. Returns the rule
+// that redirects to the application root, if one is configured.
+func applyRuleActions(
+	rl *Rule,
+	host, path string,
+	acts []RuleActions,
+	protocol string,
+) *Rule {
+	ra := findRuleActions(acts, host, path)
+	if nil == ra {
+		return nil
+	}
+	addRuleActions(rl, path, ra, protocol)
+	if ra.AppRoot != "" && (path == "" || path == "/") {
+		return createAppRootRule(rl, host, ra.AppRoot)
+	}
+	return nil
+}
+
+// Add the application root rule that goes with a rule to the policy, or
+// remove it if there is none. It is only added along with its rule.
+func (rc *ResourceConfig) setAppRootRule(policyName string, rl, appRoot *Rule) {
+	policy := rc.FindPolicy("forwarding")
+	if nil == policy {
+		return
+	}
+	var ruleFound bool
+	offset := -1
+	for i, r := range policy.Rules {
+		switch r.Name {
+		case rl.Name:
+			ruleFound = true
+		case rl.Name + appRootRuleSuffix:
+			offset = i
+		}
+	}
+	if nil != appRoot && ruleFound {
+		rc.AddRuleToPolicy(policyName, appRoot)
+	} else if offset >= 0 {
+		policy.RemoveRules([]int{offset})
+		if 0 == len(policy.Rules) {
+			rc.RemovePolicy(*policy)
+		} else {
+			rc.SetPolicy(*policy)
+		}
+	}
+}
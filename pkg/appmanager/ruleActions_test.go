@@ -0,0 +1,302 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	"github.com/F5Networks/k8s-bigip-ctlr/pkg/test"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	routeapi "github.com/openshift/origin/pkg/route/api"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
+)
+
+var _ = Describe("Rule Action Tests", func() {
+	parse := func(val string) ([]RuleActions, error) {
+		return parseRuleActions(
+			map[string]string{f5VsRuleActionsAnnotation: val})
+	}
+
+	It("parses rule actions", func() {
+		acts, err := parseRuleActions(map[string]string{})
+		Expect(err).To(BeNil())
+		Expect(acts).To(BeNil())
+
+		acts, err = parse(`[
+			{"path": "/api", "rewritePath": "/", "hostHeader": "api.internal",
+			 "xForwardedFor": true, "xForwardedProto": true},
+			{"appRoot": "/app",
+			 "requestHeaders": [{"action": "remove", "name": "X-Debug"}],
+			 "responseHeaders": [{"action": "insert", "name": "X-Served-By",
+			  "value": "bigip"}]}
+		]`)
+		Expect(err).To(BeNil())
+		Expect(len(acts)).To(Equal(2))
+
+		for _, val := range []string{
+			`{"appRoot": "/app"}`,
+			`[{"rewritePath": "api"}]`,
+			`[{"appRoot": "app"}]`,
+			`[{"requestHeaders": [{"action": "append", "name": "X-Foo",
+			  "value": "bar"}]}]`,
+			`[{"requestHeaders": [{"action": "insert", "name": "X-Foo"}]}]`,
+			`[{"responseHeaders": [{"action": "remove"}]}]`,
+		} {
+			_, err = parse(val)
+			Expect(err).ToNot(BeNil(), val)
+		}
+	})
+
+	It("renders rule actions as policy actions", func() {
+		rule, err := createIngressRule("foo.com", "/api", "pool", "velcro",
+			"rule", pathTypePrefix)
+		Expect(err).To(BeNil())
+		acts, err := parse(`[
+			{"host": "bar.com", "hostHeader": "wrong"},
+			{"host": "foo.com", "path": "/api", "rewritePath": "/v1/",
+			 "hostHeader": "api.internal", "xForwardedFor": true,
+			 "xForwardedProto": true,
+			 "requestHeaders": [{"action": "remove", "name": "X-Debug",
+			  "value": "ignored"}],
+			 "responseHeaders": [{"action": "replace", "name": "Server",
+			  "value": "bigip"}]}
+		]`)
+		Expect(err).To(BeNil())
+		appRoot := applyRuleActions(rule, "foo.com", "/api", acts, "https")
+		Expect(appRoot).To(BeNil())
+
+		Expect(len(rule.Actions)).To(Equal(7))
+		Expect(rule.Actions[0].Forward).To(BeTrue())
+		Expect(rule.Actions[1]).To(Equal(&action{
+			Name:    "1",
+			HTTPURI: true,
+			Path:    "tcl:[regsub {^/api/?} [HTTP::path] {/v1/}]",
+			Replace: true,
+			Request: true,
+		}))
+		Expect(rule.Actions[2]).To(Equal(&action{
+			Name:     "2",
+			HTTPHost: true,
+			Replace:  true,
+			Request:  true,
+			Value:    "api.internal",
+		}))
+		Expect(rule.Actions[3]).To(Equal(&action{
+			Name:       "3",
+			HTTPHeader: true,
+			Insert:     true,
+			Request:    true,
+			TmName:     "X-Forwarded-For",
+			Value:      "tcl:[IP::client_addr]",
+		}))
+		Expect(rule.Actions[4]).To(Equal(&action{
+			Name:       "4",
+			HTTPHeader: true,
+			Replace:    true,
+			Request:    true,
+			TmName:     "X-Forwarded-Proto",
+			Value:      "https",
+		}))
+		Expect(rule.Actions[5]).To(Equal(&action{
+			Name:       "5",
+			HTTPHeader: true,
+			Remove:     true,
+			Request:    true,
+			TmName:     "X-Debug",
+		}))
+		Expect(rule.Actions[6]).To(Equal(&action{
+			Name:       "6",
+			HTTPHeader: true,
+			Replace:    true,
+			Response:   true,
+			TmName:     "Server",
+			Value:      "bigip",
+		}))
+
+		// Paths are quoted for the regular expression
+		Expect(rewritePathExpr("/a.b/", "/c")).To(Equal(
+			"tcl:[regsub {^/a\\.b} [HTTP::path] {/c}]"))
+	})
+
+	It("creates application root redirects", func() {
+		rule, err := createIngressRule("foo.com", "/", "pool", "velcro",
+			"rule", pathTypePrefix)
+		Expect(err).To(BeNil())
+		acts, err := parse(`[{"appRoot": "/app"}]`)
+		Expect(err).To(BeNil())
+		appRoot := applyRuleActions(rule, "foo.com", "/", acts, "http")
+		Expect(appRoot).ToNot(BeNil())
+		Expect(appRoot.Name).To(Equal("rule" + appRootRuleSuffix))
+		Expect(appRoot.FullURI).To(Equal("foo.com/"))
+		Expect(appRoot.Actions).To(Equal([]*action{{
+			Name:      "0",
+			HttpReply: true,
+			Location:  "/app",
+			Redirect:  true,
+			Request:   true,
+		}}))
+		Expect(len(appRoot.Conditions)).To(Equal(2))
+		Expect(appRoot.Conditions[0].HTTPHost).To(BeTrue())
+		Expect(appRoot.Conditions[1]).To(Equal(&condition{
+			Name:    "1",
+			Equals:  true,
+			HTTPURI: true,
+			Path:    true,
+			Request: true,
+			Values:  []string{"/"},
+		}))
+
+		// Only the root of the host is redirected
+		rule, _ = createIngressRule("foo.com", "/api", "pool", "velcro",
+			"rule", pathTypePrefix)
+		Expect(applyRuleActions(rule, "foo.com", "/api", acts, "http")).To(BeNil())
+	})
+
+	Describe("Using Mock Manager", func() {
+		var mockMgr *mockAppManager
+		namespace := "default"
+
+		BeforeEach(func() {
+			RegisterBigIPSchemaTypes()
+			mw := &test.MockWriter{
+				FailStyle: test.Success,
+				Sections:  make(map[string]interface{}),
+			}
+			mockMgr = newMockAppManager(&Params{
+				KubeClient:      fake.NewSimpleClientset(),
+				ConfigWriter:    mw,
+				restClient:      test.CreateFakeHTTPClient(),
+				RouteClientV1:   test.CreateFakeHTTPClient(),
+				IsNodePort:      true,
+				broadcasterFunc: NewFakeEventBroadcaster,
+			})
+			err := mockMgr.startNonLabelMode([]string{namespace})
+			Expect(err).To(BeNil())
+			svc := test.NewService("foo", "1", namespace, "NodePort",
+				[]v1.ServicePort{{Port: 80, NodePort: 37001}})
+			Expect(mockMgr.addService(svc)).To(BeTrue())
+		})
+		AfterEach(func() {
+			mockMgr.shutdown()
+		})
+
+		ruleNames := func(rsName string) []string {
+			rs, ok := mockMgr.resources().Get(
+				serviceKey{"foo", 80, namespace}, rsName)
+			Expect(ok).To(BeTrue())
+			var names []string
+			for _, rl := range rs.Policies[0].Rules {
+				names = append(names, rl.Name)
+			}
+			return names
+		}
+
+		It("adds rule actions to Ingress rules", func() {
+			spec := v1beta1.IngressSpec{
+				Rules: []v1beta1.IngressRule{
+					{Host: "foo.com",
+						IngressRuleValue: v1beta1.IngressRuleValue{
+							HTTP: &v1beta1.HTTPIngressRuleValue{
+								Paths: []v1beta1.HTTPIngressPath{
+									{Path: "/",
+										Backend: v1beta1.IngressBackend{
+											ServiceName: "foo",
+											ServicePort: intstr.IntOrString{IntVal: 80},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			}
+			ing := test.NewIngress("ingress", "1", namespace, spec,
+				map[string]string{
+					f5VsBindAddrAnnotation:    "1.2.3.4",
+					f5VsRuleActionsAnnotation: `[{"appRoot": "/app", "xForwardedFor": true}]`,
+				})
+			Expect(mockMgr.addIngress(ing)).To(BeTrue())
+
+			vsName := formatIngressVSName("1.2.3.4", 80)
+			ruleName := formatIngressRuleName("foo.com", "/",
+				formatIngressPoolName(namespace, "foo"))
+			Expect(ruleNames(vsName)).To(Equal(
+				[]string{ruleName + appRootRuleSuffix, ruleName}))
+			rs, _ := mockMgr.resources().Get(serviceKey{"foo", 80, namespace}, vsName)
+			Expect(len(rs.Policies[0].Rules[1].Actions)).To(Equal(2))
+
+			// Without the annotation the redirect and header go away
+			delete(ing.ObjectMeta.Annotations, f5VsRuleActionsAnnotation)
+			Expect(mockMgr.updateIngress(ing)).To(BeTrue())
+			Expect(ruleNames(vsName)).To(Equal([]string{ruleName}))
+			rs, _ = mockMgr.resources().Get(serviceKey{"foo", 80, namespace}, vsName)
+			Expect(len(rs.Policies[0].Rules[0].Actions)).To(Equal(1))
+
+			// An invalid annotation is reported
+			ing.ObjectMeta.Annotations[f5VsRuleActionsAnnotation] = `[{"appRoot": "app"}]`
+			Expect(mockMgr.updateIngress(ing)).To(BeTrue())
+			events := mockMgr.getFakeEvents(namespace)
+			Expect(events[len(events)-1].Reason).To(Equal("InvalidRuleActions"))
+		})
+
+		It("adds rule actions to Route rules", func() {
+			mockMgr.appMgr.routeConfig = RouteConfig{
+				HttpVs:  "ose-vserver",
+				HttpsVs: "https-ose-vserver",
+			}
+			spec := routeapi.RouteSpec{
+				Host: "foo.com",
+				To: routeapi.RouteTargetReference{
+					Kind: "Service",
+					Name: "foo",
+				},
+			}
+			route := test.NewRoute("route", "1", namespace, spec,
+				map[string]string{
+					f5VsRuleActionsAnnotation: `[{"appRoot": "/app",
+						"requestHeaders": [{"action": "insert", "name": "X-Route",
+						"value": "foo"}]}]`,
+				})
+			Expect(mockMgr.addRoute(route)).To(BeTrue())
+			Expect(ruleNames("ose-vserver")).To(ConsistOf(
+				"openshift_route_default_route",
+				"openshift_route_default_route"+appRootRuleSuffix))
+
+			// The redirect is dropped along with the annotation
+			route.ObjectMeta.Annotations = nil
+			Expect(mockMgr.updateRoute(route)).To(BeTrue())
+			Expect(ruleNames("ose-vserver")).To(Equal(
+				[]string{"openshift_route_default_route"}))
+
+			// And along with its Route
+			route.ObjectMeta.Annotations = map[string]string{
+				f5VsRuleActionsAnnotation: `[{"appRoot": "/app"}]`,
+			}
+			Expect(mockMgr.updateRoute(route)).To(BeTrue())
+			Expect(len(ruleNames("ose-vserver"))).To(Equal(2))
+			Expect(mockMgr.deleteRoute(route)).To(BeTrue())
+			rs, ok := mockMgr.resources().Get(
+				serviceKey{"foo", 80, namespace}, "ose-vserver")
+			if ok {
+				Expect(rs.Policies).To(BeEmpty())
+			}
+		})
+	})
+})
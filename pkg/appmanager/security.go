@@ -0,0 +1,202 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	log "github.com/F5Networks/k8s-bigip-ctlr/pkg/vlogger"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// Security policies live in a partition, so their paths must name it
+var securityPathRegexp = regexp.MustCompile(`^/?[^/]+/[^/]+$`)
+
+// Return the path of a security policy or profile as /partition/name
+func formatSecurityPath(kind, path string) (string, error) {
+	if !securityPathRegexp.MatchString(path) {
+		return "", fmt.Errorf("%s '%s' is not a path of the form /partition/name",
+			kind, path)
+	}
+	return "/" + strings.TrimPrefix(path, "/"), nil
+}
+
+// Return the security policies of the annotations of an object, or nil if
+// it has none
+func annotationSecurityPolicies(annotations map[string]string) *securityPolicies {
+	var sec securityPolicies
+	found := false
+	for annotation, field := range map[string]*string{
+		f5VsWafPolicyAnnotation:         &sec.WafPolicy,
+		f5VsDosProfileAnnotation:        &sec.DosProfile,
+		f5VsBotDefenseProfileAnnotation: &sec.BotDefenseProfile,
+	} {
+		if val, ok := annotations[annotation]; ok {
+			*field = strings.TrimSpace(val)
+			found = true
+		}
+	}
+	if val, ok := annotations[f5VsSecurityLogProfilesAnnotation]; ok {
+		for _, prof := range strings.Split(val, ",") {
+			if prof = strings.TrimSpace(prof); "" != prof {
+				sec.LogProfiles = append(sec.LogProfiles, prof)
+			}
+		}
+		found = true
+	}
+	if !found {
+		return nil
+	}
+	return &sec
+}
+
+// Return the security policies of an F5 resource ConfigMap
+func configMapSecurityPolicies(cm *v1.ConfigMap) *securityPolicies {
+	var cfgMap ConfigMap
+	if err := json.Unmarshal([]byte(cm.Data["data"]), &cfgMap); nil != err {
+		return nil
+	}
+	return cfgMap.VirtualServer.Frontend.Security
+}
+
+// Check the security policies for a virtual server, returning them with
+// their paths in /partition/name form
+func checkSecurityPolicies(
+	rsCfg *ResourceConfig,
+	sec securityPolicies,
+) (securityPolicies, error) {
+	var err error
+	for _, field := range []struct {
+		kind string
+		path *string
+	}{
+		{"WAF policy", &sec.WafPolicy},
+		{"DoS profile", &sec.DosProfile},
+		{"bot defense profile", &sec.BotDefenseProfile},
+	} {
+		if "" == *field.path {
+			continue
+		}
+		if *field.path, err = formatSecurityPath(field.kind, *field.path); nil != err {
+			return securityPolicies{}, err
+		}
+	}
+	var logProfiles []string
+	seen := make(map[string]bool)
+	for _, prof := range sec.LogProfiles {
+		path, err := formatSecurityPath("security log profile", prof)
+		if nil != err {
+			return securityPolicies{}, err
+		}
+		if !seen[path] {
+			seen[path] = true
+			logProfiles = append(logProfiles, path)
+		}
+	}
+	sec.LogProfiles = logProfiles
+	if ("" != sec.WafPolicy || "" != sec.BotDefenseProfile) &&
+		!isHttpVirtual(rsCfg) {
+		return securityPolicies{}, fmt.Errorf("WAF policies and bot defense " +
+			"profiles need a virtual server in http mode")
+	}
+	return sec, nil
+}
+
+// Attach security policies to a virtual server. Nil detaches them.
+func setVirtualSecurityPolicies(v *Virtual, sec *securityPolicies) {
+	if nil == sec {
+		sec = &securityPolicies{}
+	}
+	v.WafPolicy = sec.WafPolicy
+	v.DosProfile = sec.DosProfile
+	v.BotDefenseProfile = sec.BotDefenseProfile
+	v.SecurityLogProfiles = sec.LogProfiles
+}
+
+var securityPolicySetting = ownedSetting{
+	action:         "attaching",
+	name:           "security policies",
+	conflictReason: "SecurityPolicyConflict",
+	owner: func(rsCfg *ResourceConfig) *string {
+		return &rsCfg.MetaData.SecurityOwner
+	},
+	reset: func(rsCfg *ResourceConfig) {
+		setVirtualSecurityPolicies(&rsCfg.Virtual, nil)
+	},
+}
+
+func virtualSecurityPolicies(v *Virtual) securityPolicies {
+	return securityPolicies{
+		WafPolicy:         v.WafPolicy,
+		DosProfile:        v.DosProfile,
+		BotDefenseProfile: v.BotDefenseProfile,
+		LogProfiles:       v.SecurityLogProfiles,
+	}
+}
+
+// Attach the security policies an object asks for to its virtual server.
+// A virtual shared by several Ingresses or Routes keeps the policies of the
+// object that attached them until it stops asking for them, and others
+// asking for different ones get an event. Invalid settings, or settings the
+// driver does not support, attach nothing.
+func (appMgr *Manager) handleSecurityPolicies(
+	rsCfg *ResourceConfig,
+	obj runtime.Object,
+	meta metav1.ObjectMeta,
+	sec *securityPolicies,
+) {
+	if rsCfg.MetaData.ResourceType == "iapp" ||
+		nil == rsCfg.Virtual.VirtualAddress ||
+		rsCfg.Virtual.VirtualAddress.BindAddr == "" {
+		// Nothing to attach for iApps and pool-only mode
+		return
+	}
+	owner := meta.Namespace + "/" + meta.Name
+	detach := func() { securityPolicySetting.detach(rsCfg, owner) }
+	if nil == sec {
+		detach()
+		return
+	}
+	checked, err := checkSecurityPolicies(rsCfg, *sec)
+	if nil != err {
+		msg := fmt.Sprintf("Not attaching security policies for %s: %v",
+			meta.Name, err)
+		log.Warning(msg)
+		appMgr.recordEvent(obj, meta.Namespace, v1.EventTypeWarning,
+			"InvalidSecurityPolicy", msg)
+		detach()
+		return
+	}
+	if !appMgr.checkDriverFeature(obj, meta, driverFeatureSecurityPolicies,
+		"security policies") {
+		detach()
+		return
+	}
+	if !appMgr.mayOwnSetting(securityPolicySetting, rsCfg, obj, meta,
+		reflect.DeepEqual(virtualSecurityPolicies(&rsCfg.Virtual), checked)) {
+		return
+	}
+	setVirtualSecurityPolicies(&rsCfg.Virtual, &checked)
+	rsCfg.MetaData.SecurityOwner = owner
+}
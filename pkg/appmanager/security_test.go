@@ -0,0 +1,65 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Security Policy Tests", func() {
+	It("parses and checks security policies", func() {
+		Expect(annotationSecurityPolicies(nil)).To(BeNil())
+		sec := annotationSecurityPolicies(map[string]string{
+			f5VsWafPolicyAnnotation:           " Common/waf ",
+			f5VsSecurityLogProfilesAnnotation: "/Common/log, Common/log,,/Common/bot-log",
+		})
+		Expect(sec).To(Equal(&securityPolicies{
+			WafPolicy:   "Common/waf",
+			LogProfiles: []string{"/Common/log", "Common/log", "/Common/bot-log"},
+		}))
+
+		var rsCfg ResourceConfig
+		setProfilesForMode("http", &rsCfg)
+		checked, err := checkSecurityPolicies(&rsCfg, *sec)
+		Expect(err).To(BeNil())
+		Expect(checked).To(Equal(securityPolicies{
+			WafPolicy:   "/Common/waf",
+			LogProfiles: []string{"/Common/log", "/Common/bot-log"},
+		}))
+
+		for _, bad := range []securityPolicies{
+			{WafPolicy: "waf"},
+			{DosProfile: "/Common/dos/extra"},
+			{BotDefenseProfile: "/Common/"},
+			{LogProfiles: []string{"log"}},
+		} {
+			_, err = checkSecurityPolicies(&rsCfg, bad)
+			Expect(err).ToNot(BeNil(), "%v", bad)
+		}
+
+		// WAF and bot defense need HTTP, DoS does not
+		rsCfg = ResourceConfig{}
+		setProfilesForMode("tcp", &rsCfg)
+		_, err = checkSecurityPolicies(&rsCfg, securityPolicies{
+			BotDefenseProfile: "/Common/bot"})
+		Expect(err).ToNot(BeNil())
+		_, err = checkSecurityPolicies(&rsCfg, securityPolicies{
+			DosProfile: "/Common/dos"})
+		Expect(err).To(BeNil())
+	})
+})
@@ -0,0 +1,194 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	log "github.com/F5Networks/k8s-bigip-ctlr/pkg/vlogger"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
+)
+
+// Name of the client SSL profile created from a Secret for a server name.
+// Profiles without a server name are named after the Secret, and wildcards
+// are spelled out since BIG-IP names cannot contain them.
+func formatSecretProfileName(secretName, serverName string) string {
+	if "" == serverName {
+		return secretName
+	}
+	return fmt.Sprintf("%s-%s", secretName,
+		strings.Replace(serverName, "*", "wildcard", 1))
+}
+
+// Server names of the client SSL profiles created for a TLS entry of an
+// Ingress: one for each of its hosts, or none if it lists no hosts
+func ingressTlsServerNames(tls v1beta1.IngressTLS) []string {
+	if 0 == len(tls.Hosts) {
+		return []string{""}
+	}
+	var names []string
+	seen := make(map[string]bool)
+	for _, host := range tls.Hosts {
+		if !seen[host] {
+			seen[host] = true
+			names = append(names, host)
+		}
+	}
+	return names
+}
+
+func formatDefaultClientSslName(vsName string) string {
+	return fmt.Sprintf("default-clientssl-%s", vsName)
+}
+
+// Record the client profile an Ingress asks to be the Default for SNI of
+// its virtual
+func (appMgr *Manager) setIngressSniDefault(
+	rsCfg *ResourceConfig,
+	ing *v1beta1.Ingress,
+) {
+	key := ing.ObjectMeta.Namespace + "/" + ing.ObjectMeta.Name
+	if nil == rsCfg.MetaData.SniDefaults {
+		rsCfg.MetaData.SniDefaults = make(map[string]string)
+	}
+	delete(rsCfg.MetaData.SniDefaults, key)
+	secretName, ok := ing.ObjectMeta.Annotations[f5VsSniDefaultAnnotation]
+	if !ok || !appMgr.useSecrets {
+		return
+	}
+	for _, tls := range ing.Spec.TLS {
+		if tls.SecretName == secretName {
+			rsCfg.MetaData.SniDefaults[key] = formatSecretProfileName(
+				secretName, ingressTlsServerNames(tls)[0])
+			return
+		}
+	}
+	msg := fmt.Sprintf("Secret '%s' of the %s annotation is not used by the "+
+		"TLS section of %s", secretName, f5VsSniDefaultAnnotation,
+		ing.ObjectMeta.Name)
+	log.Warning(msg)
+	appMgr.recordEvent(ing, ing.ObjectMeta.Namespace, v1.EventTypeWarning,
+		"InvalidSniDefault", msg)
+}
+
+// Whether profile a is a better Default for SNI than b: one an Ingress asks
+// for comes first, then one without a server name, then the first by name
+func sniDefaultBefore(a, b CustomProfile, preferred map[string]bool) bool {
+	if preferred[a.Name] != preferred[b.Name] {
+		return preferred[a.Name]
+	}
+	if ("" == a.ServerName) != ("" == b.ServerName) {
+		return "" == a.ServerName
+	}
+	return a.Name < b.Name
+}
+
+// Give the Default for SNI profile of each Ingress virtual the certificate
+// and settings of one of its client profiles, so the BIG-IP always has a
+// single, stable profile for clients that send no matching server name.
+// Must be called with the customProfiles lock held.
+func (appMgr *Manager) setSniDefaults(stats *vsSyncStats) {
+	for _, cfg := range appMgr.resources.GetAllResources() {
+		if cfg.MetaData.ResourceType != "ingress" {
+			continue
+		}
+		skey := secretKey{
+			Name:         formatDefaultClientSslName(cfg.GetName()),
+			ResourceName: cfg.GetName(),
+		}
+		sni, ok := appMgr.customProfiles.profs[skey]
+		if !ok {
+			continue
+		}
+		preferred := make(map[string]bool)
+		for _, name := range cfg.MetaData.SniDefaults {
+			preferred[name] = true
+		}
+		var chosen *CustomProfile
+		for key, prof := range appMgr.customProfiles.profs {
+			if key.ResourceName != cfg.GetName() ||
+				prof.Context != customProfileClient ||
+				prof.SNIDefault ||
+				!cfg.Virtual.ReferencesProfile(prof) {
+				continue
+			}
+			if nil == chosen || sniDefaultBefore(prof, *chosen, preferred) {
+				p := prof
+				chosen = &p
+			}
+		}
+		ref := ProfileRef{
+			Name:      sni.Name,
+			Partition: sni.Partition,
+			Context:   customProfileClient,
+		}
+		def := NewCustomProfile(ref, "", "", "", true, "", "")
+		if nil != chosen {
+			def = *chosen
+			def.Name = sni.Name
+			def.ServerName = ""
+			def.SNIDefault = true
+		}
+		if !reflect.DeepEqual(def, sni) {
+			appMgr.customProfiles.profs[skey] = def
+			stats.cpUpdated += 1
+		}
+	}
+}
+
+// Check a profile of an Ingress virtual against a TLS entry of an Ingress,
+// as checkProfile does, including the profiles created for its hosts
+func (appMgr *Manager) checkIngressTlsProfile(
+	prof ProfileRef,
+	toRemove *[]ProfileRef,
+	namespace string,
+	tls v1beta1.IngressTLS,
+	referenced *bool,
+) {
+	if 0 == len(tls.Hosts) || !appMgr.useSecrets {
+		appMgr.checkProfile(prof, toRemove, namespace, tls.SecretName, referenced)
+		return
+	}
+	hostProfile := false
+	for _, serverName := range ingressTlsServerNames(tls) {
+		if prof.Name == formatSecretProfileName(tls.SecretName, serverName) {
+			hostProfile = true
+			break
+		}
+	}
+	// Only profiles named after the TLS entry need the Secret looked up
+	if !hostProfile && !profileMatchesName(prof, tls.SecretName) {
+		return
+	}
+	_, err := appMgr.kubeClient.Core().Secrets(namespace).
+		Get(tls.SecretName, metav1.GetOptions{})
+	if nil != err {
+		// Either a BIG-IP profile or a Secret that no longer exists
+		appMgr.checkProfile(prof, toRemove, namespace, tls.SecretName, referenced)
+		return
+	}
+	// With the Secret the profiles of its hosts replace the profile named
+	// after it
+	if hostProfile {
+		*referenced = true
+	}
+}
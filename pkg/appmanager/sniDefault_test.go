@@ -0,0 +1,44 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
+)
+
+var _ = Describe("SNI Default Tests", func() {
+	It("names and orders the profiles of TLS entries", func() {
+		Expect(formatSecretProfileName("cert", "")).To(Equal("cert"))
+		Expect(formatSecretProfileName("cert", "*.foo.com")).To(
+			Equal("cert-wildcard.foo.com"))
+		Expect(ingressTlsServerNames(v1beta1.IngressTLS{})).To(Equal([]string{""}))
+		Expect(ingressTlsServerNames(v1beta1.IngressTLS{
+			Hosts: []string{"foo.com", "*.foo.com", "foo.com"},
+		})).To(Equal([]string{"foo.com", "*.foo.com"}))
+
+		a := CustomProfile{Name: "a", ServerName: "a.com"}
+		b := CustomProfile{Name: "b"}
+		Expect(sniDefaultBefore(a, b, nil)).To(BeFalse())
+		Expect(sniDefaultBefore(b, a, nil)).To(BeTrue())
+		Expect(sniDefaultBefore(a, b, map[string]bool{"a": true})).To(BeTrue())
+		b.ServerName = "b.com"
+		Expect(sniDefaultBefore(a, b, nil)).To(BeTrue())
+	})
+})
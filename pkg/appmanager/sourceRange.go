@@ -0,0 +1,381 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	log "github.com/F5Networks/k8s-bigip-ctlr/pkg/vlogger"
+
+	routeapi "github.com/openshift/origin/pkg/route/api"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
+)
+
+// Checks the client address against the source ranges of an HTTP virtual
+const sourceRangeHttpIRuleName = "source_range_http_irule"
+
+// Checks the client address against the source ranges of a ConfigMap virtual
+const sourceRangeIRuleName = "source_range_irule"
+
+// Suffix of the internal data group that holds the source ranges of a
+// virtual. The key is a host and path key, or * for the whole virtual; the
+// data is the allow and deny lists.
+const sourceRangeDgSuffix = "_source_range_dg"
+
+// Kinds of source range lists
+const (
+	sourceRangeAllow = "allow"
+	sourceRangeDeny  = "deny"
+)
+
+func formatSourceRangeDgName(vsName string) string {
+	return vsName + sourceRangeDgSuffix
+}
+
+// Return the data group value for the source range annotations, or "" if
+// there are none. Each list is its kind followed by its ranges, and lists
+// are separated by ';'. Malformed ranges are left out and returned in the
+// error; an allow list without ranges lets no client in.
+func getSourceRanges(annotations map[string]string) (string, error) {
+	var lists, invalid []string
+	for _, src := range []struct {
+		kind       string
+		annotation string
+	}{
+		{sourceRangeAllow, f5VsAllowSourceRangeAnnotation},
+		{sourceRangeDeny, f5VsDenySourceRangeAnnotation},
+	} {
+		val, ok := annotations[src.annotation]
+		if !ok {
+			continue
+		}
+		list := []string{src.kind}
+		for _, rng := range strings.Split(val, ",") {
+			rng = strings.TrimSpace(rng)
+			if rng == "" {
+				continue
+			}
+			if nil == net.ParseIP(rng) {
+				if _, _, err := net.ParseCIDR(rng); nil != err {
+					invalid = append(invalid, rng)
+					continue
+				}
+			}
+			list = append(list, rng)
+		}
+		lists = append(lists, strings.Join(list, " "))
+	}
+	var err error
+	if len(invalid) > 0 {
+		err = fmt.Errorf("invalid source ranges %s", strings.Join(invalid, ", "))
+	}
+	return strings.Join(lists, ";"), err
+}
+
+// Tcl that sets 'allowed' from the client address and the 'ranges' value
+// of a source range record
+const sourceRangeCheck = `
+			set allowed 1
+			set client [IP::client_addr]
+			foreach list [split $ranges ";"] {
+				set kind [lindex $list 0]
+				if { $kind eq "allow" } {
+					set allowed 0
+					foreach range [lrange $list 1 end] {
+						if { [IP::addr $client equals $range] } {
+							set allowed 1
+							break
+						}
+					}
+				} elseif { $kind eq "deny" && $allowed } {
+					foreach range [lrange $list 1 end] {
+						if { [IP::addr $client equals $range] } {
+							set allowed 0
+							break
+						}
+					}
+				}
+			}`
+
+// Tcl that sets 'record' to the value of the record of the data group
+// named by 'class' that matches the host and path of the request,
+// 'record_key' to its key, and 'selected_len' to the length of its path,
+// or -1 if none matches. Keys are
+// those of hostPathKey; the record with the longest matching path wins.
+const hostPathMatch = `
+			set host [string tolower [getfield [HTTP::host] ":" 1]]
+			set path [HTTP::path]
+			set record ""
+			set record_key ""
+			set selected_len -1
+			foreach rec [class get $class] {
+				set key [lindex $rec 0]
+				set sep [string first " " $key]
+				set rule_host [string range $key 0 [expr {$sep - 1}]]
+				set rule_path [string range $key [expr {$sep + 1}] end]
+				if { not [string match $rule_host $host] ||
+					[string length $rule_path] <= $selected_len } {
+					continue
+				}
+				switch -- [string index $rule_path 0] {
+					"=" {
+						set matched [expr { $path eq [string range $rule_path 1 end] }]
+					}
+					"~" {
+						set matched [regexp -- [string range $rule_path 1 end] $path]
+					}
+					default {
+						set prefix [string trimright $rule_path "/"]
+						set matched [expr { $path eq $prefix ||
+							[string first "$prefix/" $path] == 0 }]
+					}
+				}
+				if { $matched } {
+					set record [lindex $rec 1]
+					set record_key $key
+					set selected_len [string length $rule_path]
+				}
+			}`
+
+// Reject requests from clients outside the source ranges for their host
+// and path
+func sourceRangeHttpIRule() string {
+	iRuleCode := fmt.Sprintf(`
+		when HTTP_REQUEST {
+			set class "[virtual name]%s"
+			if { not [class exists $class] } {
+				return
+			}
+			%s
+			if { $selected_len < 0 } {
+				return
+			}
+			set ranges $record
+			%s
+			if { not $allowed } {
+				HTTP::respond 403 content "Forbidden" "Connection" "Close"
+				event disable all
+			}
+		}`, sourceRangeDgSuffix, hostPathMatch, sourceRangeCheck)
+
+	return iRuleCode
+}
+
+// Reject connections from clients outside the source ranges of a virtual
+func sourceRangeIRule() string {
+	iRuleCode := fmt.Sprintf(`
+		when CLIENT_ACCEPTED {
+			set range_class "[virtual name]%s"
+			if { not [class exists $range_class] } {
+				return
+			}
+			set ranges [class match -value "*" equals $range_class]
+			if { $ranges eq "" } {
+				return
+			}
+			%s
+			if { not $allowed } {
+				reject
+				event disable all
+			}
+		}`, sourceRangeDgSuffix, sourceRangeCheck)
+
+	return iRuleCode
+}
+
+// Record the source ranges of an object for the given keys of its virtual.
+// Returns whether there were any.
+func (appMgr *Manager) setSourceRanges(
+	rsCfg *ResourceConfig,
+	obj runtime.Object,
+	meta metav1.ObjectMeta,
+	keys []string,
+	dgMap InternalDataGroupMap,
+) bool {
+	ranges, err := getSourceRanges(meta.Annotations)
+	if nil != err {
+		msg := fmt.Sprintf("Leaving out source ranges for %s: %v", meta.Name, err)
+		log.Warning(msg)
+		appMgr.recordEvent(obj, meta.Namespace, v1.EventTypeWarning,
+			"InvalidSourceRange", msg)
+	}
+	if ranges == "" {
+		return false
+	}
+	for _, key := range keys {
+		updateDataGroup(dgMap, formatSourceRangeDgName(rsCfg.Virtual.Name),
+			rsCfg.Virtual.Partition, meta.Namespace, key, ranges)
+	}
+	return true
+}
+
+// Add the source ranges of an Ingress for each of its hosts and paths
+func (appMgr *Manager) handleIngressSourceRanges(
+	rsCfg *ResourceConfig,
+	ing *v1beta1.Ingress,
+	dgMap InternalDataGroupMap,
+) {
+	if nil == rsCfg.Virtual.VirtualAddress ||
+		rsCfg.Virtual.VirtualAddress.BindAddr == "" {
+		// Nothing to restrict for pool-only mode
+		return
+	}
+	keys := ingressHostPathKeys(ing)
+	if appMgr.setSourceRanges(rsCfg, ing, ing.ObjectMeta, keys, dgMap) {
+		appMgr.addSourceRangeIRule(rsCfg, sourceRangeHttpIRuleName,
+			sourceRangeHttpIRule())
+	}
+}
+
+// Add the source ranges of a Route for its host and path
+func (appMgr *Manager) handleRouteSourceRanges(
+	rsCfg *ResourceConfig,
+	route *routeapi.Route,
+	dgMap InternalDataGroupMap,
+) {
+	if nil != route.Spec.TLS &&
+		route.Spec.TLS.Termination == routeapi.TLSTerminationPassthrough {
+		// The virtual never sees the requests of a passthrough Route
+		_, allow := route.ObjectMeta.Annotations[f5VsAllowSourceRangeAnnotation]
+		_, deny := route.ObjectMeta.Annotations[f5VsDenySourceRangeAnnotation]
+		if allow || deny {
+			msg := fmt.Sprintf("Leaving out source ranges for %s: they are "+
+				"not supported for passthrough Routes", route.ObjectMeta.Name)
+			log.Warning(msg)
+			appMgr.recordEvent(route, route.ObjectMeta.Namespace,
+				v1.EventTypeWarning, "InvalidSourceRange", msg)
+		}
+		return
+	}
+	keys := []string{sourceRangeKey(route.Spec.Host, route.Spec.Path)}
+	if appMgr.setSourceRanges(rsCfg, route, route.ObjectMeta, keys, dgMap) {
+		appMgr.addSourceRangeIRule(rsCfg, sourceRangeHttpIRuleName,
+			sourceRangeHttpIRule())
+	}
+}
+
+// Add the source ranges of a ConfigMap for its whole virtual
+func (appMgr *Manager) handleConfigMapSourceRanges(
+	rsCfg *ResourceConfig,
+	cm *v1.ConfigMap,
+	dgMap InternalDataGroupMap,
+) {
+	if rsCfg.MetaData.ResourceType == "iapp" ||
+		nil == rsCfg.Virtual.VirtualAddress ||
+		rsCfg.Virtual.VirtualAddress.BindAddr == "" {
+		return
+	}
+	if appMgr.setSourceRanges(rsCfg, cm, cm.ObjectMeta, []string{"*"}, dgMap) {
+		appMgr.addSourceRangeIRule(rsCfg, sourceRangeIRuleName,
+			sourceRangeIRule())
+	}
+}
+
+// Return the data group key for a host and path: the host, a space and
+// the path. Exact paths are marked with '=' and regular expressions with
+// '~'; other paths match themselves and the paths below them.
+func hostPathKey(host, path, pathType string) string {
+	host = strings.ToLower(host)
+	if host == "" {
+		host = "*"
+	}
+	switch {
+	case path == "":
+		path = "/"
+	case pathType == pathTypeExact:
+		path = "=" + path
+	case pathType == pathTypeRegex:
+		path = "~" + path
+	}
+	return host + " " + path
+}
+
+// Return the key for a host and path that match as a prefix, as those of
+// Routes do
+func sourceRangeKey(host, path string) string {
+	return hostPathKey(host, path, pathTypePrefix)
+}
+
+// Return the host and path keys of each path of an Ingress, or the key for
+// all hosts and paths if it has no rules
+func ingressHostPathKeys(ing *v1beta1.Ingress) []string {
+	if nil == ing.Spec.Rules {
+		return []string{sourceRangeKey("", "")}
+	}
+	pathType, err := getIngressPathType(ing)
+	if nil != err {
+		pathType = pathTypePrefix
+	}
+	var keys []string
+	for _, rule := range ing.Spec.Rules {
+		if nil == rule.IngressRuleValue.HTTP {
+			continue
+		}
+		for _, path := range rule.IngressRuleValue.HTTP.Paths {
+			keys = append(keys, hostPathKey(rule.Host, path.Path, pathType))
+		}
+	}
+	return keys
+}
+
+// Add a source range iRule ahead of the other iRules of a virtual, so
+// rejected clients are not redirected or forwarded first
+func (appMgr *Manager) addSourceRangeIRule(
+	rsCfg *ResourceConfig,
+	name string,
+	code string,
+) {
+	appMgr.addIRule(name, rsCfg.Virtual.Partition, code)
+	fullName := joinBigipPath(rsCfg.Virtual.Partition, name)
+	rsCfg.Virtual.RemoveIRule(fullName)
+	rsCfg.Virtual.IRules = append([]string{fullName}, rsCfg.Virtual.IRules...)
+}
+
+// Remove the source range iRule from Ingress and Route virtuals that no
+// longer have source ranges, and delete the iRules no virtual uses.
+// ConfigMap virtuals are rebuilt on every sync.
+func (appMgr *Manager) syncSourceRangeIRules() {
+	appMgr.intDgMutex.Lock()
+	for _, cfg := range appMgr.resources.GetAllResources() {
+		if cfg.MetaData.ResourceType != "ingress" &&
+			cfg.MetaData.ResourceType != "route" {
+			continue
+		}
+		grpRef := nameRef{
+			Name:      formatSourceRangeDgName(cfg.Virtual.Name),
+			Partition: cfg.Virtual.Partition,
+		}
+		if _, found := appMgr.intDgMap[grpRef]; !found {
+			cfg.Virtual.RemoveIRule(
+				joinBigipPath(cfg.Virtual.Partition, sourceRangeHttpIRuleName))
+		}
+	}
+	appMgr.intDgMutex.Unlock()
+
+	inUse := appMgr.iRulesInUse()
+
+	appMgr.irulesMutex.Lock()
+	defer appMgr.irulesMutex.Unlock()
+	for _, name := range []string{sourceRangeHttpIRuleName, sourceRangeIRuleName} {
+		appMgr.deleteUnusedIRule(name, inUse)
+	}
+}
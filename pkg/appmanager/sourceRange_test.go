@@ -0,0 +1,72 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Source Range Tests", func() {
+	It("parses source range annotations", func() {
+		ranges, err := getSourceRanges(map[string]string{})
+		Expect(err).To(BeNil())
+		Expect(ranges).To(BeEmpty())
+
+		ranges, err = getSourceRanges(map[string]string{
+			f5VsAllowSourceRangeAnnotation: "10.0.0.0/8, 192.168.1.10,2001:db8::/32",
+			f5VsDenySourceRangeAnnotation:  "10.1.0.0/16",
+		})
+		Expect(err).To(BeNil())
+		Expect(ranges).To(Equal(
+			"allow 10.0.0.0/8 192.168.1.10 2001:db8::/32;deny 10.1.0.0/16"))
+
+		// Malformed ranges are left out, but the allow list still applies
+		ranges, err = getSourceRanges(map[string]string{
+			f5VsAllowSourceRangeAnnotation: "10.0.0.0/33,bogus",
+		})
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring("10.0.0.0/33, bogus"))
+		Expect(ranges).To(Equal("allow"))
+	})
+
+	It("keys hosts and paths by how they match", func() {
+		Expect(hostPathKey("Foo.com", "/api", pathTypePrefix)).To(Equal(
+			"foo.com /api"))
+		Expect(hostPathKey("foo.com", "/api", pathTypeExact)).To(Equal(
+			"foo.com =/api"))
+		Expect(hostPathKey("", "^/api/v[0-9]+$", pathTypeRegex)).To(Equal(
+			"* ~^/api/v[0-9]+$"))
+		Expect(hostPathKey("foo.com", "", pathTypeExact)).To(Equal("foo.com /"))
+
+		// Prefix paths match whole path elements
+		code := sourceRangeHttpIRule()
+		Expect(code).To(ContainSubstring(`[string first "$prefix/" $path] == 0`))
+		Expect(code).To(ContainSubstring(
+			"[regexp -- [string range $rule_path 1 end] $path]"))
+		// A denied client cannot send more requests on the connection
+		Expect(code).To(ContainSubstring(
+			`HTTP::respond 403 content "Forbidden" "Connection" "Close"`))
+
+		// The other iRules keyed by host and path match them the same way
+		for _, code := range []string{
+			hstsIRule(), rateLimitIRule(), clientCertIRule(),
+		} {
+			Expect(code).To(ContainSubstring(hostPathMatch))
+		}
+	})
+})
@@ -0,0 +1,308 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	log "github.com/F5Networks/k8s-bigip-ctlr/pkg/vlogger"
+
+	routeapi "github.com/openshift/origin/pkg/route/api"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
+)
+
+// Inserts the Strict-Transport-Security header into responses
+const hstsIRuleName = "hsts_irule"
+
+// Suffix of the internal data group that holds the Strict-Transport-Security
+// header of each host and path of a virtual
+const hstsDgSuffix = "_hsts_dg"
+
+// TLS versions in order, and the profile options that turn them off
+var tlsVersions = []string{"1.0", "1.1", "1.2", "1.3"}
+var tlsVersionOptions = map[string]string{
+	"1.0": "no-tlsv1",
+	"1.1": "no-tlsv1.1",
+	"1.2": "no-tlsv1.2",
+	"1.3": "no-tlsv1.3",
+}
+
+// Settings for the SSL profiles the controller creates for an object
+type tlsPolicy struct {
+	Ciphers        string `json:"ciphers,omitempty"`
+	MinVersion     string `json:"minVersion,omitempty"`
+	MaxVersion     string `json:"maxVersion,omitempty"`
+	Renegotiation  *bool  `json:"renegotiation,omitempty"`
+	SessionTickets *bool  `json:"sessionTickets,omitempty"`
+	OcspStapling   *bool  `json:"ocspStapling,omitempty"`
+	// BIG-IP OCSP cert validator that staples the responses
+	OcspResponder string `json:"ocspResponder,omitempty"`
+}
+
+func tlsVersionIndex(version string) int {
+	for i, v := range tlsVersions {
+		if v == version {
+			return i
+		}
+	}
+	return -1
+}
+
+// Parse the TLS policy annotation of an object. Returns nil if there is
+// none.
+func parseTlsPolicy(annotations map[string]string) (*tlsPolicy, error) {
+	val, ok := annotations[f5VsTlsPolicyAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	var policy tlsPolicy
+	dec := json.NewDecoder(bytes.NewReader([]byte(val)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&policy); nil != err {
+		return nil, fmt.Errorf("invalid TLS policy: %v", err)
+	}
+	if nil != policy.OcspStapling && *policy.OcspStapling {
+		if policy.OcspResponder == "" {
+			return nil, fmt.Errorf("OCSP stapling needs an ocspResponder")
+		}
+		responder, err := formatSecurityPath("OCSP responder",
+			policy.OcspResponder)
+		if nil != err {
+			return nil, err
+		}
+		policy.OcspResponder = responder
+	} else if policy.OcspResponder != "" {
+		return nil, fmt.Errorf("ocspResponder is only used for OCSP stapling")
+	}
+	if strings.ContainsAny(policy.Ciphers, " \t\"") {
+		return nil, fmt.Errorf("invalid cipher string '%s'", policy.Ciphers)
+	}
+	min, max := 0, len(tlsVersions)-1
+	if policy.MinVersion != "" {
+		if min = tlsVersionIndex(policy.MinVersion); min < 0 {
+			return nil, fmt.Errorf("unknown TLS version '%s'", policy.MinVersion)
+		}
+	}
+	if policy.MaxVersion != "" {
+		if max = tlsVersionIndex(policy.MaxVersion); max < 0 {
+			return nil, fmt.Errorf("unknown TLS version '%s'", policy.MaxVersion)
+		}
+	}
+	if min > max {
+		return nil, fmt.Errorf("minimum TLS version %s is above maximum %s",
+			policy.MinVersion, policy.MaxVersion)
+	}
+	return &policy, nil
+}
+
+func enabledString(enabled bool) string {
+	if enabled {
+		return "enabled"
+	}
+	return "disabled"
+}
+
+// Set the TLS settings of a profile. OCSP stapling only applies to client
+// profiles.
+func (p *tlsPolicy) apply(cp *CustomProfile) {
+	cp.Ciphers = p.Ciphers
+	cp.TmOptions = nil
+	if p.MinVersion != "" || p.MaxVersion != "" {
+		// SSLv3 is never allowed once versions are chosen
+		cp.TmOptions = append(cp.TmOptions, "no-sslv3")
+		min, max := 0, len(tlsVersions)-1
+		if p.MinVersion != "" {
+			min = tlsVersionIndex(p.MinVersion)
+		}
+		if p.MaxVersion != "" {
+			max = tlsVersionIndex(p.MaxVersion)
+		}
+		for i, version := range tlsVersions {
+			if i < min || i > max {
+				cp.TmOptions = append(cp.TmOptions, tlsVersionOptions[version])
+			}
+		}
+	}
+	if nil != p.Renegotiation {
+		cp.Renegotiation = enabledString(*p.Renegotiation)
+	}
+	if nil != p.SessionTickets {
+		cp.SessionTicket = enabledString(*p.SessionTickets)
+	}
+	if nil != p.OcspStapling && cp.Context == customProfileClient {
+		cp.OcspStapling = enabledString(*p.OcspStapling)
+		cp.Ocsp = p.OcspResponder
+	}
+}
+
+// Return the TLS policy of an object, recording an event if it is invalid
+// or the driver cannot apply it
+func (appMgr *Manager) tlsPolicyFor(
+	obj runtime.Object,
+	meta metav1.ObjectMeta,
+) *tlsPolicy {
+	policy, err := parseTlsPolicy(meta.Annotations)
+	if nil != err {
+		msg := fmt.Sprintf("Not applying the TLS policy of %s: %v",
+			meta.Name, err)
+		log.Warning(msg)
+		appMgr.recordEvent(obj, meta.Namespace, v1.EventTypeWarning,
+			"InvalidTlsPolicy", msg)
+		return nil
+	}
+	if nil != policy && !appMgr.checkDriverFeature(obj, meta,
+		driverFeatureSslProfileSettings, "the TLS policy") {
+		return nil
+	}
+	return policy
+}
+
+func formatHstsDgName(vsName string) string {
+	return vsName + hstsDgSuffix
+}
+
+// Return the Strict-Transport-Security header the annotations of an object
+// ask for, or "" for none
+func hstsHeader(annotations map[string]string) (string, error) {
+	val, ok := annotations[f5VsHstsMaxAgeAnnotation]
+	if !ok {
+		return "", nil
+	}
+	maxAge, err := strconv.Atoi(val)
+	if nil != err || maxAge < 0 {
+		return "", fmt.Errorf("HSTS max age must be a number of seconds, "+
+			"not '%s'", val)
+	}
+	header := fmt.Sprintf("max-age=%d", maxAge)
+	for _, directive := range []struct {
+		annotation string
+		name       string
+	}{
+		{f5VsHstsIncludeSubdomainsAnnotation, "includeSubDomains"},
+		{f5VsHstsPreloadAnnotation, "preload"},
+	} {
+		val, ok := annotations[directive.annotation]
+		if !ok {
+			continue
+		}
+		set, err := strconv.ParseBool(val)
+		if nil != err {
+			return "", fmt.Errorf("'%s' must be true or false, not '%s'",
+				directive.annotation, val)
+		}
+		if set {
+			header += "; " + directive.name
+		}
+	}
+	return header, nil
+}
+
+// Insert the Strict-Transport-Security header of the record with the
+// longest path matching the request
+func hstsIRule() string {
+	iRuleCode := fmt.Sprintf(`
+		when HTTP_REQUEST {
+			set hsts ""
+			set class "[virtual name]%s"
+			if { not [class exists $class] } {
+				return
+			}
+			%s
+			set hsts $record
+		}
+
+		when HTTP_RESPONSE {
+			if { $hsts ne "" } {
+				HTTP::header replace Strict-Transport-Security $hsts
+			}
+		}`, hstsDgSuffix, hostPathMatch)
+
+	return iRuleCode
+}
+
+// Record the Strict-Transport-Security header of an object for the given
+// keys of its HTTPS virtual, and add the HSTS iRule to the virtual
+func (appMgr *Manager) setHsts(
+	rsCfg *ResourceConfig,
+	obj runtime.Object,
+	meta metav1.ObjectMeta,
+	keys []string,
+	dgMap InternalDataGroupMap,
+) {
+	header, err := hstsHeader(meta.Annotations)
+	if nil != err {
+		msg := fmt.Sprintf("Not setting HSTS for %s: %v", meta.Name, err)
+		log.Warning(msg)
+		appMgr.recordEvent(obj, meta.Namespace, v1.EventTypeWarning,
+			"InvalidHsts", msg)
+		return
+	}
+	if header == "" {
+		return
+	}
+	for _, key := range keys {
+		updateDataGroup(dgMap, formatHstsDgName(rsCfg.Virtual.Name),
+			rsCfg.Virtual.Partition, meta.Namespace, key, header)
+	}
+	appMgr.addIRule(hstsIRuleName, rsCfg.Virtual.Partition, hstsIRule())
+	rsCfg.Virtual.AddIRule(joinBigipPath(rsCfg.Virtual.Partition, hstsIRuleName))
+}
+
+// Add the Strict-Transport-Security header of an Ingress for each of its
+// hosts and paths on its HTTPS virtual
+func (appMgr *Manager) handleIngressHsts(
+	rsCfg *ResourceConfig,
+	ing *v1beta1.Ingress,
+	dgMap InternalDataGroupMap,
+) {
+	if 0 == len(ing.Spec.TLS) ||
+		nil == rsCfg.Virtual.VirtualAddress ||
+		rsCfg.Virtual.VirtualAddress.Port != ingressHttpsPort(ing) {
+		return
+	}
+	appMgr.setHsts(rsCfg, ing, ing.ObjectMeta, ingressHostPathKeys(ing), dgMap)
+}
+
+// Add the Strict-Transport-Security header of a Route for its host and path
+// on the HTTPS virtual. Passthrough Routes are not decrypted, so the header
+// cannot be added.
+func (appMgr *Manager) handleRouteHsts(
+	rsCfg *ResourceConfig,
+	route *routeapi.Route,
+	protocol string,
+	dgMap InternalDataGroupMap,
+) {
+	if protocol != "https" || nil == route.Spec.TLS ||
+		route.Spec.TLS.Termination == routeapi.TLSTerminationPassthrough {
+		return
+	}
+	keys := []string{sourceRangeKey(route.Spec.Host, route.Spec.Path)}
+	appMgr.setHsts(rsCfg, route, route.ObjectMeta, keys, dgMap)
+}
+
+// Remove the HSTS iRule from virtuals that no longer insert the header, and
+// delete it if no virtual uses it
+func (appMgr *Manager) syncHstsIRules() {
+	appMgr.syncHostPathIRule(hstsIRuleName, formatHstsDgName)
+}
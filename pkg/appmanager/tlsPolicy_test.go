@@ -0,0 +1,100 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("TLS Policy Tests", func() {
+	It("parses and applies TLS policies", func() {
+		policy, err := parseTlsPolicy(map[string]string{})
+		Expect(err).To(BeNil())
+		Expect(policy).To(BeNil())
+
+		policy, err = parseTlsPolicy(map[string]string{
+			f5VsTlsPolicyAnnotation: `{"ciphers": "ECDHE+AESGCM:!SSLv3",
+				"minVersion": "1.1", "maxVersion": "1.2",
+				"renegotiation": false, "sessionTickets": true,
+				"ocspStapling": true, "ocspResponder": "Common/ocsp"}`,
+		})
+		Expect(err).To(BeNil())
+		client := CustomProfile{Name: "client", Context: customProfileClient}
+		policy.apply(&client)
+		Expect(client.Ciphers).To(Equal("ECDHE+AESGCM:!SSLv3"))
+		Expect(client.TmOptions).To(Equal(
+			[]string{"no-sslv3", "no-tlsv1", "no-tlsv1.3"}))
+		Expect(client.Renegotiation).To(Equal("disabled"))
+		Expect(client.SessionTicket).To(Equal("enabled"))
+		Expect(client.OcspStapling).To(Equal("enabled"))
+		Expect(client.Ocsp).To(Equal("/Common/ocsp"))
+		// OCSP stapling is for client profiles only
+		server := CustomProfile{Name: "server", Context: customProfileServer}
+		policy.apply(&server)
+		Expect(server.TmOptions).To(Equal(client.TmOptions))
+		Expect(server.OcspStapling).To(BeEmpty())
+		Expect(server.Ocsp).To(BeEmpty())
+
+		// Turning stapling off needs no responder
+		policy, err = parseTlsPolicy(map[string]string{
+			f5VsTlsPolicyAnnotation: `{"ocspStapling": false}`,
+		})
+		Expect(err).To(BeNil())
+		client = CustomProfile{Name: "client", Context: customProfileClient}
+		policy.apply(&client)
+		Expect(client.OcspStapling).To(Equal("disabled"))
+		Expect(client.Ocsp).To(BeEmpty())
+
+		for _, val := range []string{
+			`{"minVersion": "1.4"}`,
+			`{"minVersion": "1.3", "maxVersion": "1.2"}`,
+			`{"ciphers": "DEFAULT AES"}`,
+			`{"protocols": "TLSv1.2"}`,
+			`{"renegotiation": "no"}`,
+			`{"ocspStapling": true}`,
+			`{"ocspStapling": true, "ocspResponder": "ocsp"}`,
+			`{"ocspResponder": "/Common/ocsp"}`,
+		} {
+			_, err = parseTlsPolicy(map[string]string{f5VsTlsPolicyAnnotation: val})
+			Expect(err).ToNot(BeNil(), val)
+		}
+	})
+
+	It("builds Strict-Transport-Security headers", func() {
+		header, err := hstsHeader(map[string]string{})
+		Expect(err).To(BeNil())
+		Expect(header).To(BeEmpty())
+
+		header, err = hstsHeader(map[string]string{
+			f5VsHstsMaxAgeAnnotation:            "31536000",
+			f5VsHstsIncludeSubdomainsAnnotation: "true",
+			f5VsHstsPreloadAnnotation:           "false",
+		})
+		Expect(err).To(BeNil())
+		Expect(header).To(Equal("max-age=31536000; includeSubDomains"))
+
+		for _, annotations := range []map[string]string{
+			{f5VsHstsMaxAgeAnnotation: "a year"},
+			{f5VsHstsMaxAgeAnnotation: "-1"},
+			{f5VsHstsMaxAgeAnnotation: "0", f5VsHstsPreloadAnnotation: "sure"},
+		} {
+			_, err = hstsHeader(annotations)
+			Expect(err).ToNot(BeNil(), "%v", annotations)
+		}
+	})
+})
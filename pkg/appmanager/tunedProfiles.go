@@ -0,0 +1,418 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	log "github.com/F5Networks/k8s-bigip-ctlr/pkg/vlogger"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// Kinds of profiles that can be attached to a virtual server
+const (
+	tunedProfileHttp            = "http"
+	tunedProfileOneConnect      = "oneconnect"
+	tunedProfileHttpCompression = "http-compression"
+	tunedProfileHttp2           = "http2"
+	tunedProfileWebSocket       = "websocket"
+	tunedProfileTcp             = "tcp"
+	tunedProfileFastL4          = "fastl4"
+)
+
+// Types of settings
+const (
+	settingBool   = "bool"
+	settingInt    = "int"
+	settingString = "string"
+)
+
+type tunedProfileKind struct {
+	// BIG-IP profile type and the parent of the profiles the controller
+	// creates
+	Type   string
+	Parent string
+	// Context the profile is attached in
+	Context string
+	// Whether the profile needs an HTTP virtual server
+	NeedsHttp bool
+	// Default profiles the profile replaces on a virtual server
+	Replaces []string
+	// Settings that can be given, and their types
+	Settings map[string]string
+}
+
+var tunedProfileKinds = map[string]tunedProfileKind{
+	tunedProfileHttp: {
+		Type:      "http",
+		Parent:    "/Common/http",
+		Context:   customProfileAll,
+		NeedsHttp: true,
+		Replaces:  []string{"http"},
+		Settings: map[string]string{
+			"insertXForwardedFor": settingBool,
+			"maxHeaderCount":      settingInt,
+			"maxHeaderSize":       settingInt,
+			"redirectRewrite":     settingString,
+			"serverAgentName":     settingString,
+		},
+	},
+	tunedProfileOneConnect: {
+		Type:      "one-connect",
+		Parent:    "/Common/oneconnect",
+		Context:   customProfileAll,
+		NeedsHttp: true,
+		Settings: map[string]string{
+			"idleTimeoutOverride": settingInt,
+			"maxAge":              settingInt,
+			"maxReuse":            settingInt,
+			"maxSize":             settingInt,
+			"sourceMask":          settingString,
+		},
+	},
+	tunedProfileHttpCompression: {
+		Type:      "http-compression",
+		Parent:    "/Common/httpcompression",
+		Context:   customProfileAll,
+		NeedsHttp: true,
+		Settings: map[string]string{
+			"bufferSize":         settingInt,
+			"gzipLevel":          settingInt,
+			"keepAcceptEncoding": settingBool,
+			"minSize":            settingInt,
+		},
+	},
+	tunedProfileHttp2: {
+		Type:      "http2",
+		Parent:    "/Common/http2",
+		Context:   customProfileClient,
+		NeedsHttp: true,
+		Settings: map[string]string{
+			"concurrentStreamsPerConnection": settingInt,
+			"connectionIdleTimeout":          settingInt,
+			"headerTableSize":                settingInt,
+			"insertHeader":                   settingBool,
+		},
+	},
+	tunedProfileWebSocket: {
+		Type:      "websocket",
+		Parent:    "/Common/websocket",
+		Context:   customProfileAll,
+		NeedsHttp: true,
+		Settings: map[string]string{
+			"masking": settingString,
+		},
+	},
+	tunedProfileTcp: {
+		Type:     "tcp",
+		Parent:   "/Common/tcp",
+		Context:  customProfileAll,
+		Replaces: []string{"tcp"},
+		Settings: map[string]string{
+			"idleTimeout":       settingInt,
+			"keepAliveInterval": settingInt,
+			"nagle":             settingBool,
+		},
+	},
+	tunedProfileFastL4: {
+		Type:     "fastl4",
+		Parent:   "/Common/fastL4",
+		Context:  customProfileAll,
+		Replaces: []string{"tcp", "udp"},
+		Settings: map[string]string{
+			"idleTimeout":         settingInt,
+			"looseInitialization": settingBool,
+			"resetOnTimeout":      settingBool,
+		},
+	},
+}
+
+// Annotations that set each kind of profile
+var tunedProfileAnnotations = map[string]string{
+	tunedProfileHttp:            f5VsHttpProfileAnnotation,
+	tunedProfileOneConnect:      f5VsOneConnectProfileAnnotation,
+	tunedProfileHttpCompression: f5VsHttpCompressionProfileAnnotation,
+	tunedProfileHttp2:           f5VsHttp2ProfileAnnotation,
+	tunedProfileWebSocket:       f5VsWebSocketProfileAnnotation,
+	tunedProfileTcp:             f5VsTcpProfileAnnotation,
+	tunedProfileFastL4:          f5VsFastL4ProfileAnnotation,
+}
+
+func formatTunedProfileName(vsName, kind string) string {
+	return fmt.Sprintf("%s_%s", vsName, kind)
+}
+
+// Return the profile settings of the annotations of an object. An
+// annotation is either the path of a BIG-IP profile or a JSON object of
+// settings.
+func annotationTunedProfiles(
+	annotations map[string]string,
+) map[string]json.RawMessage {
+	profiles := make(map[string]json.RawMessage)
+	for kind, annotation := range tunedProfileAnnotations {
+		val, ok := annotations[annotation]
+		if !ok {
+			continue
+		}
+		if strings.HasPrefix(strings.TrimSpace(val), "{") {
+			profiles[kind] = json.RawMessage(val)
+		} else {
+			profiles[kind], _ = json.Marshal(val)
+		}
+	}
+	return profiles
+}
+
+// Return the profile settings of an F5 resource ConfigMap
+func configMapTunedProfiles(cm *v1.ConfigMap) map[string]json.RawMessage {
+	var cfgMap ConfigMap
+	if err := json.Unmarshal([]byte(cm.Data["data"]), &cfgMap); nil != err {
+		return nil
+	}
+	return cfgMap.VirtualServer.Frontend.TunedProfiles
+}
+
+// Parse the settings of a profile. Returns the reference of a BIG-IP
+// profile, or the profile to create.
+func parseTunedProfile(
+	kind string,
+	raw json.RawMessage,
+	vsName string,
+	partition string,
+) (ProfileRef, *TunedProfile, error) {
+	pk, ok := tunedProfileKinds[kind]
+	if !ok {
+		return ProfileRef{}, nil, fmt.Errorf("unknown profile kind '%s'", kind)
+	}
+	var path string
+	if err := json.Unmarshal(raw, &path); nil == err {
+		if path == "" || len(strings.Split(strings.TrimPrefix(path, "/"), "/")) > 2 {
+			return ProfileRef{}, nil, fmt.Errorf(
+				"%s profile '%s' is not a profile path", kind, path)
+		}
+		return convertStringToProfileRef(path, pk.Context, ""), nil, nil
+	}
+
+	var settings map[string]interface{}
+	if err := json.Unmarshal(raw, &settings); nil != err {
+		return ProfileRef{}, nil, fmt.Errorf(
+			"%s profile must be a profile path or an object of settings: %v",
+			kind, err)
+	}
+	for name, val := range settings {
+		valid := false
+		switch pk.Settings[name] {
+		case settingBool:
+			_, valid = val.(bool)
+		case settingInt:
+			num, ok := val.(float64)
+			valid = ok && num >= 0 && num == float64(int(num))
+			if valid {
+				settings[name] = int(num)
+			}
+		case settingString:
+			_, valid = val.(string)
+		default:
+			return ProfileRef{}, nil, fmt.Errorf(
+				"unknown %s profile setting '%s'", kind, name)
+		}
+		if !valid {
+			return ProfileRef{}, nil, fmt.Errorf(
+				"%s profile setting '%s' must be of type %s, not '%v'",
+				kind, name, pk.Settings[name], val)
+		}
+	}
+	prof := TunedProfile{
+		Name:         formatTunedProfileName(vsName, kind),
+		Partition:    partition,
+		Type:         pk.Type,
+		DefaultsFrom: pk.Parent,
+		Settings:     settings,
+	}
+	ref := ProfileRef{
+		Name:      prof.Name,
+		Partition: partition,
+		Context:   pk.Context,
+	}
+	return ref, &prof, nil
+}
+
+// Remove the profiles attached by earlier settings from a virtual server,
+// and put back the default profiles they replaced
+func resetTunedProfiles(rsCfg *ResourceConfig) {
+	for _, ref := range rsCfg.MetaData.TunedProfs {
+		rsCfg.Virtual.RemoveProfile(ref)
+	}
+	for _, ref := range rsCfg.MetaData.ReplacedProfs {
+		rsCfg.Virtual.AddOrUpdateProfile(ref)
+	}
+	rsCfg.MetaData.TunedProfs = nil
+	rsCfg.MetaData.ReplacedProfs = nil
+	rsCfg.MetaData.TunedOwner = ""
+	rsCfg.TunedProfiles = nil
+}
+
+var tunedProfileSetting = ownedSetting{
+	action:         "attaching",
+	name:           "profiles",
+	conflictReason: "ProfileConflict",
+	owner: func(rsCfg *ResourceConfig) *string {
+		return &rsCfg.MetaData.TunedOwner
+	},
+	reset: resetTunedProfiles,
+}
+
+// Return whether the profiles attached to a virtual server are those of
+// the given settings
+func hasTunedProfiles(
+	rsCfg *ResourceConfig,
+	settings map[string]json.RawMessage,
+) bool {
+	refs, profs, err := tunedProfilesFor(rsCfg, settings)
+	return nil == err &&
+		reflect.DeepEqual(refs, rsCfg.MetaData.TunedProfs) &&
+		reflect.DeepEqual(profs, rsCfg.TunedProfiles)
+}
+
+// Attach the profiles an object asks for to its virtual server, creating
+// those given as settings. Profiles the object no longer asks for are
+// removed. If any settings are invalid, no profiles are attached. A
+// virtual shared by several Ingresses keeps the profiles of the one that
+// attached them until it stops asking for them, and others asking for
+// different profiles get an event.
+func (appMgr *Manager) handleTunedProfiles(
+	rsCfg *ResourceConfig,
+	obj runtime.Object,
+	meta metav1.ObjectMeta,
+	settings map[string]json.RawMessage,
+) {
+	if rsCfg.MetaData.ResourceType == "iapp" ||
+		nil == rsCfg.Virtual.VirtualAddress ||
+		rsCfg.Virtual.VirtualAddress.BindAddr == "" {
+		// Nothing to attach for iApps and pool-only mode
+		return
+	}
+	if !appMgr.mayOwnSetting(tunedProfileSetting, rsCfg, obj, meta,
+		len(settings) == 0 || hasTunedProfiles(rsCfg, settings)) {
+		return
+	}
+	resetTunedProfiles(rsCfg)
+	if len(settings) == 0 {
+		return
+	}
+
+	refs, profs, err := tunedProfilesFor(rsCfg, settings)
+	if nil != err {
+		msg := fmt.Sprintf("Not attaching profiles for %s: %v", meta.Name, err)
+		log.Warning(msg)
+		appMgr.recordEvent(obj, meta.Namespace, v1.EventTypeWarning,
+			"InvalidProfile", msg)
+		return
+	}
+	if len(profs) > 0 && !appMgr.checkDriverFeature(obj, meta,
+		driverFeatureTunedProfiles, "profile settings") {
+		return
+	}
+
+	tunedProfs := make(map[string]ProfileRef)
+	var replaced []ProfileRef
+	for kind, ref := range refs {
+		for _, name := range tunedProfileKinds[kind].Replaces {
+			for _, prof := range rsCfg.Virtual.Profiles {
+				if prof.Partition == "Common" && prof.Name == name {
+					rsCfg.Virtual.RemoveProfile(prof)
+					replaced = append(replaced, prof)
+					break
+				}
+			}
+		}
+		rsCfg.Virtual.AddOrUpdateProfile(ref)
+		tunedProfs[kind] = ref
+	}
+	rsCfg.MetaData.TunedProfs = tunedProfs
+	rsCfg.MetaData.ReplacedProfs = replaced
+	rsCfg.MetaData.TunedOwner = meta.Namespace + "/" + meta.Name
+	rsCfg.TunedProfiles = profs
+}
+
+// Parse the profile settings for a virtual server and check that they fit
+// it and each other
+func tunedProfilesFor(
+	rsCfg *ResourceConfig,
+	settings map[string]json.RawMessage,
+) (map[string]ProfileRef, []TunedProfile, error) {
+	var kinds []string
+	for kind := range settings {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	httpVirtual := isHttpVirtual(rsCfg)
+	udpVirtual := rsCfg.Virtual.IpProtocol == "udp"
+	refs := make(map[string]ProfileRef)
+	var profs []TunedProfile
+	for _, kind := range kinds {
+		ref, prof, err := parseTunedProfile(kind, settings[kind],
+			rsCfg.Virtual.Name, rsCfg.Virtual.Partition)
+		if nil != err {
+			return nil, nil, err
+		}
+		pk := tunedProfileKinds[kind]
+		if pk.NeedsHttp && !httpVirtual {
+			return nil, nil, fmt.Errorf(
+				"%s profile needs a virtual server in http mode", kind)
+		}
+		if kind == tunedProfileTcp && udpVirtual {
+			return nil, nil, fmt.Errorf(
+				"%s profile needs a virtual server in tcp or http mode", kind)
+		}
+		refs[kind] = ref
+		if nil != prof {
+			profs = append(profs, *prof)
+		}
+	}
+	if _, ok := refs[tunedProfileFastL4]; ok {
+		if httpVirtual {
+			return nil, nil, fmt.Errorf(
+				"%s profile cannot be used by a virtual server in http mode",
+				tunedProfileFastL4)
+		}
+		if _, ok := refs[tunedProfileTcp]; ok {
+			return nil, nil, fmt.Errorf("%s and %s profiles cannot be combined",
+				tunedProfileFastL4, tunedProfileTcp)
+		}
+	}
+	return refs, profs, nil
+}
+
+// Add a profile to a list, replacing the one with the same name
+func appendTunedProfile(profs []TunedProfile, p TunedProfile) []TunedProfile {
+	for i, prof := range profs {
+		if prof.Name == p.Name {
+			profs[i] = p
+			return profs
+		}
+	}
+	return append(profs, p)
+}
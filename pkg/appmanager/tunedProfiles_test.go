@@ -0,0 +1,95 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Tuned Profile Tests", func() {
+	It("parses profile settings", func() {
+		ref, prof, err := parseTunedProfile(tunedProfileOneConnect,
+			json.RawMessage(`"/Common/oneconnect"`), "vs", "velcro")
+		Expect(err).To(BeNil())
+		Expect(prof).To(BeNil())
+		Expect(ref).To(Equal(ProfileRef{
+			Name:      "oneconnect",
+			Partition: "Common",
+			Context:   customProfileAll,
+		}))
+
+		ref, prof, err = parseTunedProfile(tunedProfileHttp,
+			json.RawMessage(`{"insertXForwardedFor": true, "maxHeaderSize": 65536}`),
+			"vs", "velcro")
+		Expect(err).To(BeNil())
+		Expect(*prof).To(Equal(TunedProfile{
+			Name:         "vs_http",
+			Partition:    "velcro",
+			Type:         "http",
+			DefaultsFrom: "/Common/http",
+			Settings: map[string]interface{}{
+				"insertXForwardedFor": true,
+				"maxHeaderSize":       65536,
+			},
+		}))
+		Expect(ref).To(Equal(ProfileRef{
+			Name:      "vs_http",
+			Partition: "velcro",
+			Context:   customProfileAll,
+		}))
+
+		for _, bad := range []struct {
+			kind string
+			raw  string
+		}{
+			{"spdy", `"/Common/spdy"`},
+			{tunedProfileHttp, `"/a/b/c"`},
+			{tunedProfileHttp, `["/Common/http"]`},
+			{tunedProfileHttp, `{"insertXForwardedFor": "yes"}`},
+			{tunedProfileTcp, `{"idleTimeout": 1.5}`},
+			{tunedProfileTcp, `{"idleTimeout": -1}`},
+			{tunedProfileTcp, `{"maxHeaderSize": 1024}`},
+		} {
+			_, _, err = parseTunedProfile(bad.kind, json.RawMessage(bad.raw),
+				"vs", "velcro")
+			Expect(err).ToNot(BeNil(), "%s %s", bad.kind, bad.raw)
+		}
+	})
+
+	It("checks that profiles fit the virtual server", func() {
+		var rsCfg ResourceConfig
+		rsCfg.Virtual.Name = "vs"
+		setProfilesForMode("tcp", &rsCfg)
+		for _, settings := range []map[string]json.RawMessage{
+			{tunedProfileHttp: json.RawMessage(`{}`)},
+			{tunedProfileWebSocket: json.RawMessage(`"/Common/websocket"`)},
+			{tunedProfileFastL4: json.RawMessage(`{}`),
+				tunedProfileTcp: json.RawMessage(`{}`)},
+		} {
+			_, _, err := tunedProfilesFor(&rsCfg, settings)
+			Expect(err).ToNot(BeNil(), "%v", settings)
+		}
+
+		setProfilesForMode("http", &rsCfg)
+		_, _, err := tunedProfilesFor(&rsCfg, map[string]json.RawMessage{
+			tunedProfileFastL4: json.RawMessage(`{}`)})
+		Expect(err).ToNot(BeNil())
+	})
+})
@@ -16,6 +16,8 @@
 
 package appmanager
 
+import "encoding/json"
+
 type (
 	// Configs for each BIG-IP partition
 	PartitionMap map[string]*BigIPConfig
@@ -27,9 +29,11 @@ type (
 		Monitors           Monitors            `json:"monitors,omitempty"`
 		Policies           []Policy            `json:"l7Policies,omitempty"`
 		CustomProfiles     []CustomProfile     `json:"customProfiles,omitempty"`
+		TunedProfiles      []TunedProfile      `json:"tunedProfiles,omitempty"`
 		IRules             []IRule             `json:"iRules,omitempty"`
 		InternalDataGroups []InternalDataGroup `json:"internalDataGroups,omitempty"`
 		IApps              []IApp              `json:"iapps,omitempty"`
+		FirewallPolicies   []FirewallPolicy    `json:"firewallPolicies,omitempty"`
 	}
 
 	// Config for a single resource (ConfigMap, Ingress, or Route)
@@ -40,6 +44,10 @@ type (
 		Pools    Pools    `json:"pools,omitempty"`
 		Monitors Monitors `json:"monitors,omitempty"`
 		Policies Policies `json:"policies,omitempty"`
+		// Profiles the controller creates for the virtual
+		TunedProfiles []TunedProfile `json:"tunedProfiles,omitempty"`
+		// Firewall policy the controller creates for the virtual
+		FirewallPolicy *FirewallPolicy `json:"firewallPolicy,omitempty"`
 	}
 	ResourceConfigs []*ResourceConfig
 
@@ -48,6 +56,23 @@ type (
 		ResourceType string
 		// Only used for Routes (for keeping track of annotated profiles)
 		RouteProfs map[routeKey]string
+		// Profiles attached by annotation or ConfigMap, by kind, and the
+		// default profiles they replaced
+		TunedProfs    map[string]ProfileRef
+		ReplacedProfs []ProfileRef
+		// Object ("namespace/name") whose profiles are attached
+		TunedOwner string
+		// Only used for Ingresses: the client profile each Ingress
+		// ("namespace/name") asks to be the Default for SNI
+		SniDefaults map[string]string
+		// Object ("namespace/name") whose security policies are attached
+		SecurityOwner string
+		// Object ("namespace/name") whose access policies are attached
+		AccessOwner string
+		// Object ("namespace/name") whose firewall rules are enforced
+		FirewallOwner string
+		// Object ("namespace/name") whose persistence is set
+		PersistOwner string
 	}
 
 	// Key used to store annotated profiles for a route
@@ -80,8 +105,23 @@ type (
 		Policies              []nameRef             `json:"policies,omitempty"`
 		IRules                []string              `json:"rules,omitempty"`
 		Profiles              ProfileRefs           `json:"profiles,omitempty"`
+		Persist               []persistenceRef      `json:"persist,omitempty"`
 		Description           string                `json:"description,omitempty"`
 		VirtualAddress        *virtualAddress       `json:"-"`
+		// Security policies and profiles, as BIG-IP paths
+		WafPolicy           string   `json:"wafPolicy,omitempty"`
+		DosProfile          string   `json:"dosProfile,omitempty"`
+		BotDefenseProfile   string   `json:"botDefenseProfile,omitempty"`
+		SecurityLogProfiles []string `json:"securityLogProfiles,omitempty"`
+		// Access (APM) profiles and policy, as BIG-IP paths. The BIG-IP
+		// needs the access profile attached before the connectivity profile
+		// and the per-request policy, and detached after them, so they are
+		// kept apart from the other profiles.
+		AccessProfile       string `json:"accessProfile,omitempty"`
+		ConnectivityProfile string `json:"connectivityProfile,omitempty"`
+		PerRequestPolicy    string `json:"perRequestPolicy,omitempty"`
+		// Path of the firewall (AFM) policy enforced on the virtual
+		FirewallPolicy string `json:"firewallEnforcedPolicy,omitempty"`
 	}
 	Virtuals []Virtual
 
@@ -101,20 +141,33 @@ type (
 		Address string `json:"address"`
 		Port    int32  `json:"port"`
 		Session string `json:"session,omitempty"`
+		Ratio   int    `json:"ratio,omitempty"`
 	}
 
 	// Pool config
 	Pool struct {
-		Name         string   `json:"name"`
-		Partition    string   `json:"-"`
-		ServiceName  string   `json:"-"`
-		ServicePort  int32    `json:"-"`
-		Balance      string   `json:"loadBalancingMode"`
-		Members      []Member `json:"members"`
-		MonitorNames []string `json:"monitors,omitempty"`
+		Name         string        `json:"name"`
+		Partition    string        `json:"-"`
+		ServiceName  string        `json:"-"`
+		ServicePort  int32         `json:"-"`
+		Balance      string        `json:"loadBalancingMode"`
+		Members      []Member      `json:"members"`
+		MonitorNames []string      `json:"monitors,omitempty"`
+		Backends     []PoolBackend `json:"-"`
+		// Only takes requests when the pools it backs up are down
+		Fallback bool `json:"-"`
+		// Namespace of the Service of a fallback pool
+		Namespace string `json:"-"`
 	}
 	Pools []Pool
 
+	// One of the pools whose members make up a weighted pool, with the share
+	// of the traffic it gets
+	PoolBackend struct {
+		Pool   string
+		Weight int
+	}
+
 	// Pool health monitor
 	Monitor struct {
 		Name      string `json:"name"`
@@ -158,32 +211,55 @@ type (
 
 	// action config for a Rule
 	action struct {
-		Name      string `json:"name"`
-		Pool      string `json:"pool,omitempty"`
-		HttpReply bool   `json:"httpReply,omitempty"`
-		Forward   bool   `json:"forward,omitempty"`
-		Location  string `json:"location,omitempty"`
-		Redirect  bool   `json:"redirect,omitempty"`
-		Request   bool   `json:"request,omitempty"`
-		Reset     bool   `json:"reset,omitempty"`
+		Name       string `json:"name"`
+		Pool       string `json:"pool,omitempty"`
+		HttpReply  bool   `json:"httpReply,omitempty"`
+		HTTPHeader bool   `json:"httpHeader,omitempty"`
+		HTTPHost   bool   `json:"httpHost,omitempty"`
+		HTTPURI    bool   `json:"httpUri,omitempty"`
+		Forward    bool   `json:"forward,omitempty"`
+		Insert     bool   `json:"insert,omitempty"`
+		Location   string `json:"location,omitempty"`
+		Path       string `json:"path,omitempty"`
+		Redirect   bool   `json:"redirect,omitempty"`
+		Remove     bool   `json:"remove,omitempty"`
+		Replace    bool   `json:"replace,omitempty"`
+		Request    bool   `json:"request,omitempty"`
+		Reset      bool   `json:"reset,omitempty"`
+		Response   bool   `json:"response,omitempty"`
+		TmName     string `json:"tmName,omitempty"`
+		Value      string `json:"value,omitempty"`
 	}
 
 	// condition config for a Rule
 	condition struct {
 		Name            string   `json:"name"`
+		Address         bool     `json:"address,omitempty"`
 		CaseInsensitive bool     `json:"caseInsensitive,omitempty"`
+		Contains        bool     `json:"contains,omitempty"`
 		Equals          bool     `json:"equals,omitempty"`
 		EndsWith        bool     `json:"endsWith,omitempty"`
 		External        bool     `json:"external,omitempty"`
+		HTTPCookie      bool     `json:"httpCookie,omitempty"`
+		HTTPHeader      bool     `json:"httpHeader,omitempty"`
 		HTTPHost        bool     `json:"httpHost,omitempty"`
+		HTTPMethod      bool     `json:"httpMethod,omitempty"`
 		Host            bool     `json:"host,omitempty"`
 		HTTPURI         bool     `json:"httpUri,omitempty"`
 		Index           int      `json:"index,omitempty"`
+		Matches         bool     `json:"matches,omitempty"`
+		Not             bool     `json:"not,omitempty"`
+		Path            bool     `json:"path,omitempty"`
 		PathSegment     bool     `json:"pathSegment,omitempty"`
 		Present         bool     `json:"present,omitempty"`
+		QueryParameter  bool     `json:"queryParameter,omitempty"`
+		QueryString     bool     `json:"queryString,omitempty"`
 		Remote          bool     `json:"remote,omitempty"`
 		Request         bool     `json:"request,omitempty"`
 		Scheme          bool     `json:"scheme,omitempty"`
+		StartsWith      bool     `json:"startsWith,omitempty"`
+		TCP             bool     `json:"tcp,omitempty"`
+		TmName          string   `json:"tmName,omitempty"`
 		Values          []string `json:"values"`
 	}
 
@@ -196,6 +272,43 @@ type (
 		Partition string `json:"partition"`
 	}
 
+	// Reference to the persistence profile of a Virtual
+	persistenceRef struct {
+		Name      string `json:"name"`
+		Partition string `json:"partition"`
+		TmDefault string `json:"tmDefault"`
+	}
+
+	// Session persistence of a virtual server
+	persistence struct {
+		Method string `json:"method"`
+		Header string `json:"header,omitempty"`
+	}
+
+	// Security policies and profiles of a virtual server
+	securityPolicies struct {
+		WafPolicy         string   `json:"wafPolicy,omitempty"`
+		DosProfile        string   `json:"dosProfile,omitempty"`
+		BotDefenseProfile string   `json:"botDefenseProfile,omitempty"`
+		LogProfiles       []string `json:"logProfiles,omitempty"`
+	}
+
+	// Firewall rule of an annotation or ConfigMap
+	firewallRule struct {
+		Action   string   `json:"action"`
+		Protocol string   `json:"protocol,omitempty"`
+		Sources  []string `json:"sources,omitempty"`
+		// Ports are numbers, or strings of ranges such as "8000-8080"
+		Ports []json.RawMessage `json:"ports,omitempty"`
+	}
+
+	// Access (APM) profiles and policy of a virtual server
+	accessPolicies struct {
+		AccessProfile       string `json:"accessProfile,omitempty"`
+		ConnectivityProfile string `json:"connectivityProfile,omitempty"`
+		PerRequestPolicy    string `json:"perRequestPolicy,omitempty"`
+	}
+
 	// frontend bindaddr and port
 	virtualAddress struct {
 		BindAddr string `json:"bindAddr,omitempty"`
@@ -239,6 +352,44 @@ type (
 		SNIDefault   bool   `json:"sniDefault,omitempty"`
 		PeerCertMode string `json:"peerCertMode,omitempty"`
 		CAFile       string `json:"caFile,omitempty"`
+		CrlFile      string `json:"crlFile,omitempty"`
+		// CRL of a CA file profile
+		Crl string `json:"crl,omitempty"`
+		// Set by a TLS policy
+		Ciphers       string   `json:"ciphers,omitempty"`
+		TmOptions     []string `json:"tmOptions,omitempty"`
+		Renegotiation string   `json:"renegotiation,omitempty"`
+		SessionTicket string   `json:"sessionTicket,omitempty"`
+		OcspStapling  string   `json:"ocspStapling,omitempty"`
+		// OCSP cert validator of a client profile that staples
+		Ocsp string `json:"ocsp,omitempty"`
+	}
+
+	// Profile the controller creates from the settings of an annotation or
+	// ConfigMap
+	TunedProfile struct {
+		Name         string                 `json:"name"`
+		Partition    string                 `json:"-"`
+		Type         string                 `json:"type"`
+		DefaultsFrom string                 `json:"defaultsFrom"`
+		Settings     map[string]interface{} `json:"settings"`
+	}
+
+	// Firewall (AFM) policy the controller creates for a virtual server
+	FirewallPolicy struct {
+		Name      string               `json:"name"`
+		Partition string               `json:"-"`
+		Rules     []FirewallPolicyRule `json:"rules"`
+	}
+
+	// Rule of a firewall policy. Rules are matched in order, and traffic
+	// no rule matches is accepted.
+	FirewallPolicyRule struct {
+		Name             string   `json:"name"`
+		Action           string   `json:"action"`
+		IpProtocol       string   `json:"ipProtocol,omitempty"`
+		SourceAddresses  []string `json:"sourceAddresses,omitempty"`
+		DestinationPorts []string `json:"destinationPorts,omitempty"`
 	}
 
 	// Used to unmarshal ConfigMap data
@@ -273,17 +424,22 @@ type (
 		Partition string `json:"partition,omitempty"`
 
 		// VirtualServer parameters
-		Balance               string                `json:"balance,omitempty"`
-		Mode                  string                `json:"mode,omitempty"`
-		VirtualAddress        *virtualAddress       `json:"virtualAddress,omitempty"`
-		Destination           string                `json:"destination,omitempty"`
-		Enabled               bool                  `json:"enabled,omitempty"`
-		IpProtocol            string                `json:"ipProtocol,omitempty"`
-		SourceAddrTranslation SourceAddrTranslation `json:"sourceAddressTranslation,omitempty"`
-		SslProfile            *sslProfile           `json:"sslProfile,omitempty"`
-		Policies              []nameRef             `json:"policies,omitempty"`
-		IRules                []string              `json:"rules,omitempty"`
-		Profiles              ProfileRefs           `json:"profiles,omitempty"`
+		Balance               string                     `json:"balance,omitempty"`
+		Mode                  string                     `json:"mode,omitempty"`
+		VirtualAddress        *virtualAddress            `json:"virtualAddress,omitempty"`
+		Destination           string                     `json:"destination,omitempty"`
+		Enabled               bool                       `json:"enabled,omitempty"`
+		IpProtocol            string                     `json:"ipProtocol,omitempty"`
+		SourceAddrTranslation SourceAddrTranslation      `json:"sourceAddressTranslation,omitempty"`
+		SslProfile            *sslProfile                `json:"sslProfile,omitempty"`
+		Policies              []nameRef                  `json:"policies,omitempty"`
+		IRules                []string                   `json:"rules,omitempty"`
+		Profiles              ProfileRefs                `json:"profiles,omitempty"`
+		Persistence           *persistence               `json:"persistence,omitempty"`
+		TunedProfiles         map[string]json.RawMessage `json:"tunedProfiles,omitempty"`
+		Security              *securityPolicies          `json:"security,omitempty"`
+		Access                *accessPolicies            `json:"access,omitempty"`
+		FirewallRules         json.RawMessage            `json:"firewallRules,omitempty"`
 
 		// iApp parameters
 		IApp                string                    `json:"iapp,omitempty"`
@@ -17,6 +17,8 @@
 package appmanager
 
 import (
+	"fmt"
+
 	routeapi "github.com/openshift/origin/pkg/route/api"
 	"k8s.io/client-go/pkg/api/v1"
 	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
@@ -42,6 +44,13 @@ func (appMgr *Manager) checkValidConfigMap(
 		}
 		return false, nil
 	}
+	if !appMgr.checkPartition(cm, cm.ObjectMeta, cfg.GetPartition()) {
+		err = fmt.Errorf("partition '%s' is not managed", cfg.GetPartition())
+		if handleConfigMapParseFailure(appMgr, cm, cfg, err) {
+			appMgr.outputConfig()
+		}
+		return false, nil
+	}
 	key := &serviceQueueKey{
 		ServiceName: cfg.Pools[0].ServiceName,
 		Namespace:   namespace,
@@ -101,6 +110,18 @@ func (appMgr *Manager) checkValidIngress(
 		// Not watching this namespace
 		return false, nil
 	}
+	if isCanaryIngress(ing) {
+		// A canary is configured on the virtual servers of its primary while
+		// the Ingresses of its namespace are synced, so just queue its Services
+		var keyList []*serviceQueueKey
+		for _, svcName := range ingressServiceNames(ing) {
+			keyList = append(keyList, &serviceQueueKey{
+				ServiceName: svcName,
+				Namespace:   namespace,
+			})
+		}
+		return true, keyList
+	}
 
 	bindAddr := ""
 	if addr, ok := ing.ObjectMeta.Annotations[f5VsBindAddrAnnotation]; ok {
@@ -172,6 +193,8 @@ func (appMgr *Manager) checkValidRoute(
 		return false, nil
 	}
 	svcNames := getRouteServiceNames(route)
+	svcNames = append(svcNames,
+		fallbackServiceNames(route.ObjectMeta.Annotations)...)
 	for _, svcName := range svcNames {
 		key := &serviceQueueKey{
 			ServiceName: svcName,
@@ -179,5 +202,54 @@ func (appMgr *Manager) checkValidRoute(
 		}
 		allKeys = append(allKeys, key)
 	}
+	// Routes competing for the same host may be admitted or rejected by
+	// this change, so their services need to be synced as well.
+	allKeys = appMgr.appendRouteHostKeys(allKeys, route.Spec.Host)
 	return true, allKeys
 }
+
+// Like checkValidRoute, but for a Route that was updated. If its host
+// changed, the Routes for its previous host are synced too, since those
+// that lost the host to it may be admitted now.
+func (appMgr *Manager) checkValidRouteUpdate(
+	old interface{},
+	cur interface{},
+) (bool, []*serviceQueueKey) {
+	ok, keys := appMgr.checkValidRoute(cur)
+	if !ok {
+		return false, nil
+	}
+	oldRoute, isRoute := old.(*routeapi.Route)
+	if isRoute && oldRoute.Spec.Host != cur.(*routeapi.Route).Spec.Host {
+		keys = appMgr.appendRouteHostKeys(keys, oldRoute.Spec.Host)
+	}
+	return true, keys
+}
+
+// Append the keys of the services of all Routes for a host, skipping keys
+// already in the list
+func (appMgr *Manager) appendRouteHostKeys(
+	keys []*serviceQueueKey,
+	host string,
+) []*serviceQueueKey {
+	if host == "" {
+		return keys
+	}
+	seen := make(map[serviceQueueKey]bool)
+	for _, key := range keys {
+		seen[*key] = true
+	}
+	for _, other := range appMgr.getRoutesForHost(host) {
+		for _, svcName := range getRouteServiceNames(other) {
+			key := serviceQueueKey{
+				ServiceName: svcName,
+				Namespace:   other.ObjectMeta.Namespace,
+			}
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, &key)
+			}
+		}
+	}
+	return keys
+}
@@ -0,0 +1,125 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/F5Networks/k8s-bigip-ctlr/pkg/vlogger"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Settings of a virtual server that only one of the objects sharing it can
+// set, such as its security policies. The object ("namespace/name") that set
+// them owns them until it stops asking for them or is deleted.
+type ownedSetting struct {
+	// What is done with the settings and what they are, for events
+	action string
+	name   string
+	// Reason of the event recorded when another object owns them
+	conflictReason string
+	// Return the owner field in the metadata of a virtual
+	owner func(rsCfg *ResourceConfig) *string
+	// Remove the settings from a virtual
+	reset func(rsCfg *ResourceConfig)
+}
+
+// Settings released by the sync of a namespace once their owner is deleted,
+// in the order they are released
+var ownedSettings = []ownedSetting{
+	securityPolicySetting,
+	accessPolicySetting,
+	firewallRuleSetting,
+	persistenceSetting,
+	tunedProfileSetting,
+}
+
+// Remove the settings of a virtual if owner set them
+func (s ownedSetting) detach(rsCfg *ResourceConfig, owner string) {
+	if field := s.owner(rsCfg); *field == owner {
+		s.reset(rsCfg)
+		*field = ""
+	}
+}
+
+// Return true if owner may set the settings of a virtual. If another object
+// owns them, false is returned, and an event is recorded on obj unless it
+// asks for the same settings.
+func (appMgr *Manager) mayOwnSetting(
+	s ownedSetting,
+	rsCfg *ResourceConfig,
+	obj runtime.Object,
+	meta metav1.ObjectMeta,
+	same bool,
+) bool {
+	owner := meta.Namespace + "/" + meta.Name
+	current := *s.owner(rsCfg)
+	if "" == current || current == owner {
+		return true
+	}
+	if !same {
+		msg := fmt.Sprintf("Not %s %s for %s: virtual server %s keeps the %s "+
+			"of %s", s.action, s.name, meta.Name, rsCfg.GetName(), s.name, current)
+		log.Warning(msg)
+		appMgr.recordEvent(obj, meta.Namespace, v1.EventTypeWarning,
+			s.conflictReason, msg)
+	}
+	return false
+}
+
+// Remove the settings of virtuals whose owner is an Ingress or Route of a
+// namespace that no longer exists
+func (appMgr *Manager) syncOwnedSetting(
+	s ownedSetting,
+	appInf *appInformer,
+	namespace string,
+	stats *vsSyncStats,
+) {
+	for _, cfg := range appMgr.resources.GetAllResources() {
+		owner := *s.owner(cfg)
+		if !strings.HasPrefix(owner, namespace+"/") {
+			continue
+		}
+		if ownerDeleted(appInf, cfg, owner) {
+			s.detach(cfg, owner)
+			stats.vsUpdated += 1
+		}
+	}
+}
+
+// Whether the Ingress or Route ("namespace/name") that attached settings to
+// a virtual server no longer exists. ConfigMap virtuals are rebuilt on each
+// sync, so their owners are never reported deleted.
+func ownerDeleted(appInf *appInformer, cfg *ResourceConfig, owner string) bool {
+	var informer cache.SharedIndexInformer
+	switch cfg.MetaData.ResourceType {
+	case "ingress":
+		informer = appInf.ingInformer
+	case "route":
+		informer = appInf.routeInformer
+	}
+	if nil == informer {
+		return false
+	}
+	_, found, _ := informer.GetIndexer().GetByKey(owner)
+	return !found
+}
@@ -0,0 +1,349 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/F5Networks/k8s-bigip-ctlr/pkg/vlogger"
+	routeapi "github.com/openshift/origin/pkg/route/api"
+	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
+)
+
+// A weighted pool holds the members of several Service pools, each with a
+// ratio that gives its Service its share of the traffic
+const weightedPoolBalance = "ratio-member"
+
+// Largest ratio BIG-IP accepts for a pool member
+const maxMemberRatio = 65535
+
+// Ways to split the traffic of an A/B Route between its Services
+const (
+	abModeIRule = "irule"
+	abModeRatio = "ratio"
+)
+
+func formatRouteWeightedPoolName(namespace, route string) string {
+	return fmt.Sprintf("openshift_%s_%s_weighted", namespace, route)
+}
+
+// Name the weighted pool of an Ingress after the Services it spreads the
+// traffic over
+func formatIngressWeightedPoolName(namespace, ing string, svcs []string) string {
+	return fmt.Sprintf("ingress_%s_%s_%s", namespace, ing, strings.Join(svcs, "_"))
+}
+
+// Parse the backend-weights annotation of an Ingress, a JSON object of
+// Service names and weights
+func parseBackendWeights(annotations map[string]string) (map[string]int, error) {
+	val, ok := annotations[f5VsBackendWeightsAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	var weights map[string]int
+	if err := json.Unmarshal([]byte(val), &weights); nil != err {
+		return nil, fmt.Errorf("invalid %s annotation: %v",
+			f5VsBackendWeightsAnnotation, err)
+	}
+	for svc, weight := range weights {
+		if weight < 0 {
+			return nil, fmt.Errorf("invalid %s annotation: weight %d of %s "+
+				"is negative", f5VsBackendWeightsAnnotation, weight, svc)
+		}
+	}
+	return weights, nil
+}
+
+// Return whether the Services of an A/B Route share a weighted pool rather
+// than being selected by the A/B iRule. Passthrough and re-encrypt Routes
+// select their pool in the passthrough iRule, so they always use the iRule.
+func isRouteRatioABDeployment(route *routeapi.Route) bool {
+	if !isRouteABDeployment(route) ||
+		route.ObjectMeta.Annotations[f5RouteABModeAnnotation] != abModeRatio {
+		return false
+	}
+	tls := route.Spec.TLS
+	return nil == tls || len(tls.Termination) == 0 ||
+		tls.Termination == routeapi.TLSTerminationEdge
+}
+
+// Return whether an A/B Route gets a weighted pool. Without pool member
+// ratios in the driver, Routes in ratio mode are split by the A/B iRule.
+func (appMgr *Manager) useRouteWeightedPool(route *routeapi.Route) bool {
+	return isRouteRatioABDeployment(route) &&
+		appMgr.driverFeatures[driverFeaturePoolMemberRatio]
+}
+
+// Return the weighted pool of an A/B Route
+func routeWeightedPool(route *routeapi.Route, partition string) Pool {
+	pool := Pool{
+		Name: formatRouteWeightedPoolName(
+			route.ObjectMeta.Namespace, route.ObjectMeta.Name),
+		Partition: partition,
+		Balance:   weightedPoolBalance,
+	}
+	for _, svc := range getRouteServices(route) {
+		pool.Backends = append(pool.Backends, PoolBackend{
+			Pool:   formatRoutePoolName(route.ObjectMeta.Namespace, svc.name),
+			Weight: svc.weight,
+		})
+	}
+	return pool
+}
+
+// Return the weighted pools for the hosts and paths of an Ingress that are
+// listed with more than one Service, and the name of the pool for each of
+// them, keyed by host and path. Each of those Services needs a weight.
+func ingressWeightedPools(
+	ing *v1beta1.Ingress,
+	pools Pools,
+	weights map[string]int,
+) (Pools, map[string]string, error) {
+	hasPool := make(map[string]bool)
+	for _, pool := range pools {
+		hasPool[pool.ServiceName] = true
+	}
+	var keys []string
+	svcsByKey := make(map[string][]string)
+	for _, rule := range ing.Spec.Rules {
+		if nil == rule.IngressRuleValue.HTTP {
+			continue
+		}
+		for _, path := range rule.IngressRuleValue.HTTP.Paths {
+			svc := path.Backend.ServiceName
+			if !hasPool[svc] {
+				continue
+			}
+			key := rule.Host + path.Path
+			if _, ok := svcsByKey[key]; !ok {
+				keys = append(keys, key)
+			}
+			if !contains(svcsByKey[key], svc) {
+				svcsByKey[key] = append(svcsByKey[key], svc)
+			}
+		}
+	}
+
+	var weighted Pools
+	names := make(map[string]string)
+	for _, key := range keys {
+		svcs := svcsByKey[key]
+		if len(svcs) < 2 {
+			continue
+		}
+		for _, svc := range svcs {
+			if _, ok := weights[svc]; !ok {
+				return nil, nil, fmt.Errorf("invalid %s annotation: no weight "+
+					"for %s, which shares %s", f5VsBackendWeightsAnnotation, svc, key)
+			}
+		}
+		sort.Strings(svcs)
+		pool := Pool{
+			Name: formatIngressWeightedPoolName(
+				ing.ObjectMeta.Namespace, ing.ObjectMeta.Name, svcs),
+			Partition: pools[0].Partition,
+			Balance:   weightedPoolBalance,
+		}
+		for _, svc := range svcs {
+			pool.Backends = append(pool.Backends, PoolBackend{
+				Pool:   formatIngressPoolName(ing.ObjectMeta.Namespace, svc),
+				Weight: weights[svc],
+			})
+		}
+		names[key] = pool.Name
+		found := false
+		for _, pl := range weighted {
+			if pl.Name == pool.Name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			weighted = append(weighted, pool)
+		}
+	}
+	return weighted, names, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func gcd(a, b int64) int64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// Return whether two lists of monitors hold the same monitors
+func sameMonitors(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, monitor := range a {
+		if !contains(b, monitor) {
+			return false
+		}
+	}
+	return true
+}
+
+// Return the members of a weighted pool. Each member gets a ratio so that
+// the members of a backend together get the weight of the backend, however
+// many members each backend has. The monitors of the backends apply to all
+// the members, so the pool only gets them when the backends with members
+// all have the same ones.
+func weightedPoolMembers(backends []PoolBackend, pools Pools) ([]Member, []string) {
+	var monitors []string
+	var monitored, mixed bool
+	membersOf := make([][]Member, len(backends))
+	lcm := int64(1)
+	for i, backend := range backends {
+		for _, pool := range pools {
+			if pool.Name != backend.Pool {
+				continue
+			}
+			if backend.Weight > 0 && len(pool.Members) > 0 {
+				membersOf[i] = pool.Members
+				n := int64(len(pool.Members))
+				lcm = lcm / gcd(lcm, n) * n
+				if !monitored {
+					monitors = append([]string(nil), pool.MonitorNames...)
+					monitored = true
+				} else if !sameMonitors(monitors, pool.MonitorNames) {
+					mixed = true
+				}
+			}
+		}
+	}
+	if mixed {
+		log.Debugf("Not monitoring the members of the weighted pool of %v: "+
+			"they have different health monitors", backends)
+		monitors = nil
+	}
+
+	var members []Member
+	ratios := make(map[Member]int64)
+	var divisor, largest int64
+	for i, backend := range backends {
+		for _, member := range membersOf[i] {
+			member.Ratio = 0
+			ratio := int64(backend.Weight) * lcm / int64(len(membersOf[i]))
+			if _, ok := ratios[member]; !ok {
+				members = append(members, member)
+			}
+			ratios[member] += ratio
+		}
+	}
+	for _, member := range members {
+		divisor = gcd(divisor, ratios[member])
+		if ratios[member] > largest {
+			largest = ratios[member]
+		}
+	}
+	for i, member := range members {
+		ratio := ratios[member] / divisor
+		if largest/divisor > maxMemberRatio {
+			ratio = ratios[member] * maxMemberRatio / largest
+			if ratio < 1 {
+				ratio = 1
+			}
+		}
+		members[i].Ratio = int(ratio)
+	}
+	return members, monitors
+}
+
+// Add a weighted pool to the config, or update the backends of the pool
+// with the same name
+func (rc *ResourceConfig) setWeightedPool(pool Pool) {
+	for i, pl := range rc.Pools {
+		if pl.Name == pool.Name {
+			rc.Pools[i].Balance = pool.Balance
+			rc.Pools[i].Backends = pool.Backends
+			return
+		}
+	}
+	rc.Pools = append(rc.Pools, pool)
+}
+
+// Set the members and monitors of the weighted pools from their backends
+func (rc *ResourceConfig) updateWeightedPools() {
+	for i, pool := range rc.Pools {
+		if len(pool.Backends) == 0 {
+			continue
+		}
+		rc.Pools[i].Members, rc.Pools[i].MonitorNames =
+			weightedPoolMembers(pool.Backends, rc.Pools)
+	}
+}
+
+// Remove the weighted pools that no policy rule forwards to. Returns
+// whether any were removed.
+func (rc *ResourceConfig) removeUnusedWeightedPools() bool {
+	inUse := make(map[string]bool)
+	for _, policy := range rc.Policies {
+		for _, rule := range policy.Rules {
+			for _, act := range rule.Actions {
+				if act.Forward && act.Pool != "" {
+					inUse[act.Pool] = true
+				}
+			}
+		}
+	}
+	var removed bool
+	for i := len(rc.Pools) - 1; i >= 0; i-- {
+		pool := rc.Pools[i]
+		if len(pool.Backends) > 0 &&
+			!inUse[joinBigipPath(pool.Partition, pool.Name)] &&
+			rc.Virtual.PoolName != joinBigipPath(pool.Partition, pool.Name) {
+			removed = rc.RemovePoolAt(i) || removed
+		}
+	}
+	return removed
+}
+
+// Drop a pool from the backends of the weighted pools. Returns the names
+// of the weighted pools left without any backends.
+func (rc *ResourceConfig) removeWeightedPoolBackend(poolName string) []string {
+	var emptied []string
+	for i, pool := range rc.Pools {
+		if len(pool.Backends) == 0 {
+			continue
+		}
+		var backends []PoolBackend
+		for _, backend := range pool.Backends {
+			if backend.Pool != poolName {
+				backends = append(backends, backend)
+			}
+		}
+		if len(backends) == 0 {
+			emptied = append(emptied, pool.Name)
+		}
+		rc.Pools[i].Backends = backends
+	}
+	return emptied
+}
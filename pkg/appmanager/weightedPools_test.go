@@ -0,0 +1,90 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appmanager
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Weighted Pool Tests", func() {
+	It("parses backend weights", func() {
+		weights, err := parseBackendWeights(map[string]string{})
+		Expect(err).To(BeNil())
+		Expect(weights).To(BeNil())
+
+		weights, err = parseBackendWeights(map[string]string{
+			f5VsBackendWeightsAnnotation: `{"app-v1": 90, "app-v2": 10}`,
+		})
+		Expect(err).To(BeNil())
+		Expect(weights).To(Equal(map[string]int{"app-v1": 90, "app-v2": 10}))
+
+		for _, val := range []string{`["app-v1"]`, `{"app-v1": -1}`} {
+			_, err = parseBackendWeights(map[string]string{
+				f5VsBackendWeightsAnnotation: val,
+			})
+			Expect(err).ToNot(BeNil(), val)
+		}
+	})
+
+	It("gives each backend its share with member ratios", func() {
+		pools := Pools{
+			{Name: "a", MonitorNames: []string{"/velcro/a_0_http"},
+				Members: []Member{
+					{Address: "10.0.0.1", Port: 80},
+					{Address: "10.0.0.2", Port: 80},
+					{Address: "10.0.0.3", Port: 80},
+				}},
+			{Name: "b", Members: []Member{{Address: "10.0.1.1", Port: 80}}},
+			{Name: "c", Members: []Member{{Address: "10.0.2.1", Port: 80}}},
+		}
+		members, monitors := weightedPoolMembers([]PoolBackend{
+			{Pool: "a", Weight: 90},
+			{Pool: "b", Weight: 10},
+			{Pool: "c", Weight: 0},
+		}, pools)
+		Expect(members).To(Equal([]Member{
+			{Address: "10.0.0.1", Port: 80, Ratio: 3},
+			{Address: "10.0.0.2", Port: 80, Ratio: 3},
+			{Address: "10.0.0.3", Port: 80, Ratio: 3},
+			{Address: "10.0.1.1", Port: 80, Ratio: 1},
+		}))
+		// Backends with different monitors leave the members unmonitored
+		Expect(monitors).To(BeEmpty())
+		pools[1].MonitorNames = []string{"/velcro/a_0_http"}
+		_, monitors = weightedPoolMembers([]PoolBackend{
+			{Pool: "a", Weight: 90},
+			{Pool: "b", Weight: 10},
+			{Pool: "c", Weight: 0},
+		}, pools)
+		Expect(monitors).To(Equal([]string{"/velcro/a_0_http"}))
+
+		// Ratios are scaled down to what BIG-IP accepts
+		members, _ = weightedPoolMembers([]PoolBackend{
+			{Pool: "b", Weight: 1000000},
+			{Pool: "c", Weight: 1},
+		}, pools)
+		Expect(members[0].Ratio).To(Equal(maxMemberRatio))
+		Expect(members[1].Ratio).To(Equal(1))
+
+		// Without any weight there are no members
+		members, _ = weightedPoolMembers([]PoolBackend{
+			{Pool: "a", Weight: 0},
+		}, pools)
+		Expect(members).To(BeEmpty())
+	})
+})
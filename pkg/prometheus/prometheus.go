@@ -31,6 +31,22 @@ var CurrentErrors = prometheus.NewGaugeVec(
 	[]string{},
 )
 
+var IPAMAllocations = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "bigip_ipam_allocations",
+		Help: "Total count of virtual addresses allocated by the BigIP k8s CTLR",
+	},
+	[]string{"label"},
+)
+
+var CertificateExpiry = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "bigip_certificate_expiry_timestamp_seconds",
+		Help: "Expiry time of the certificates sent to the BigIP by the BigIP k8s CTLR",
+	},
+	[]string{"namespace", "resource", "profile"},
+)
+
 // further metrics? todo think about
 // RegisterMetrics registers all Prometheus metrics defined above
 func RegisterMetrics() {
@@ -38,4 +54,6 @@ func RegisterMetrics() {
 	prometheus.MustRegister(MonitoredNodes)
 	prometheus.MustRegister(MonitoredServices)
 	prometheus.MustRegister(CurrentErrors)
+	prometheus.MustRegister(IPAMAllocations)
+	prometheus.MustRegister(CertificateExpiry)
 }
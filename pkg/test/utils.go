@@ -279,8 +279,26 @@ func CreateFakeHTTPClient() *fake.RESTClient {
 	return fakeClient
 }
 
+// SentObjects keeps the objects sent by a fake RESTClient
+type SentObjects struct {
+	Objects []runtime.Object
+	// Fails the requests that send objects when set
+	Err error
+	sync.Mutex
+}
+
+// CreateRecordingHTTPClient returns a fake RESTClient which keeps the objects
+// sent in its request bodies
+func CreateRecordingHTTPClient(sent *SentObjects) *fake.RESTClient {
+	fakeClient := CreateFakeHTTPClient()
+	fakeClient.NegotiatedSerializer = &fakeNegotiatedSerializer{sent: sent}
+	return fakeClient
+}
+
 // // Below here is all used to mock the client calls
-type fakeNegotiatedSerializer struct{}
+type fakeNegotiatedSerializer struct {
+	sent *SentObjects
+}
 
 func (fns *fakeNegotiatedSerializer) SupportedMediaTypes() []runtime.SerializerInfo {
 	info := runtime.SerializerInfo{
@@ -301,7 +319,7 @@ func (fns *fakeNegotiatedSerializer) EncoderForVersion(
 	serializer runtime.Encoder,
 	gv runtime.GroupVersioner,
 ) runtime.Encoder {
-	return nil
+	return &fakeDecoder{sent: fns.sent}
 }
 
 func (fns *fakeNegotiatedSerializer) DecoderToVersion(
@@ -313,6 +331,7 @@ func (fns *fakeNegotiatedSerializer) DecoderToVersion(
 
 type fakeDecoder struct {
 	IsWatching bool
+	sent       *SentObjects
 }
 
 func (fd *fakeDecoder) Decode(
@@ -337,6 +356,14 @@ func (fd *fakeDecoder) Decode(
 }
 
 func (fd *fakeDecoder) Encode(obj runtime.Object, w io.Writer) error {
+	if nil != fd.sent {
+		fd.sent.Lock()
+		defer fd.sent.Unlock()
+		if nil != fd.sent.Err {
+			return fd.sent.Err
+		}
+		fd.sent.Objects = append(fd.sent.Objects, obj)
+	}
 	return nil
 }
 
@@ -61,11 +61,30 @@ type configSection struct {
 type doneCall func(chan<- struct{})
 type errCall func(chan<- error, error)
 
+// The config holds the private keys of custom profiles, so only the owner
+// may read it
+const (
+	configDirMode  os.FileMode = 0700
+	configFileMode os.FileMode = 0600
+)
+
 func NewConfigWriter() (Writer, error) {
-	dir, err := ioutil.TempDir("", "k8s-bigip-ctlr.config")
+	return NewConfigWriterInDir("")
+}
+
+// Create a ConfigWriter whose config lives in a unique directory under
+// parent, such as a tmpfs mount, or under the default temp directory if
+// parent is empty
+func NewConfigWriterInDir(parent string) (Writer, error) {
+	dir, err := ioutil.TempDir(parent, "k8s-bigip-ctlr.config")
 	if nil != err {
 		return nil, fmt.Errorf("could not create unique config directory: %v", err)
 	}
+	err = os.Chmod(dir, configDirMode)
+	if nil != err {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("could not restrict config directory: %v", err)
+	}
 
 	tmpfn := filepath.Join(dir, "config.json")
 
@@ -177,8 +196,14 @@ func (cw *configWriter) _lockAndWrite(
 }
 
 func (cw *configWriter) lockAndWrite(output []byte) (wroteSome bool, err error) {
-	f, err := os.OpenFile(cw.configFile, os.O_WRONLY|os.O_CREATE, 0644)
+	f, err := os.OpenFile(cw.configFile, os.O_WRONLY|os.O_CREATE, configFileMode)
+	if nil != err {
+		return wroteSome, err
+	}
+	// The file may have been created with a wider mode before
+	err = f.Chmod(configFileMode)
 	if nil != err {
+		f.Close()
 		return wroteSome, err
 	}
 
@@ -200,6 +200,35 @@ var _ = Describe("Config Writer Tests", func() {
 			Expect(err).To(BeNil())
 		})
 
+		It("keeps the config to its owner", func() {
+			dir := filepath.Dir(f)
+			info, err := os.Stat(dir)
+			Expect(err).To(BeNil())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0700)))
+
+			doneCh, errCh, err := cw.SendSection("owner-only", struct{}{})
+			Expect(err).To(BeNil())
+			pollDone(doneCh, errCh)
+			info, err = os.Stat(f)
+			Expect(err).To(BeNil())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+		})
+
+		It("writes the config under a given directory", func() {
+			parent, err := ioutil.TempDir("", "config-writer-parent")
+			Expect(err).To(BeNil())
+			defer os.RemoveAll(parent)
+
+			dirCw, err := NewConfigWriterInDir(parent)
+			Expect(err).To(BeNil())
+			defer dirCw.Stop()
+			Expect(filepath.Dir(filepath.Dir(dirCw.GetOutputFilename()))).To(
+				Equal(parent))
+
+			_, err = NewConfigWriterInDir(filepath.Join(parent, "missing"))
+			Expect(err).ToNot(BeNil())
+		})
+
 		It("doesn't write when stopped", func() {
 			testFile(f, false)
 
@@ -0,0 +1,68 @@
+/*-
+ * Copyright (c) 2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package writer
+
+import (
+	"regexp"
+)
+
+// Replaces key material in logs
+const Redacted = "<redacted>"
+
+var (
+	// PEM private keys, whose newlines may be escaped
+	pemKeyRegexp = regexp.MustCompile(
+		`-----BEGIN [A-Z ]*PRIVATE KEY-----(?s:.*?)-----END [A-Z ]*PRIVATE KEY-----`)
+	// Ends of PEM private keys that span lines
+	pemKeyBeginRegexp = regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----`)
+	pemKeyEndRegexp   = regexp.MustCompile(`-----END [A-Z ]*PRIVATE KEY-----`)
+	// "key" fields of the config as JSON, and as logged by the driver
+	jsonKeyRegexp   = regexp.MustCompile(`("key"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+	pythonKeyRegexp = regexp.MustCompile(`('key'\s*:\s*u?)'(?:[^'\\]|\\.)*'`)
+)
+
+// Hide the private keys in a line of output before it is logged
+func RedactKeys(s string) string {
+	s = pemKeyRegexp.ReplaceAllLiteralString(s, Redacted)
+	s = jsonKeyRegexp.ReplaceAllString(s, `${1}"`+Redacted+`"`)
+	return pythonKeyRegexp.ReplaceAllString(s, `${1}'`+Redacted+`'`)
+}
+
+// Hides the private keys in output read line by line, including PEM keys
+// whose lines are read one at a time
+type KeyRedactor struct {
+	inKey bool
+}
+
+// Hide the private keys in the next line of output before it is logged
+func (kr *KeyRedactor) RedactKeys(s string) string {
+	if kr.inKey {
+		loc := pemKeyEndRegexp.FindStringIndex(s)
+		if nil == loc {
+			return Redacted
+		}
+		kr.inKey = false
+		s = Redacted + s[loc[1]:]
+	}
+	s = RedactKeys(s)
+	// A key that does not end on this line hides the lines up to its end
+	if loc := pemKeyBeginRegexp.FindStringIndex(s); nil != loc {
+		kr.inKey = true
+		s = s[:loc[0]] + Redacted
+	}
+	return s
+}